@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Append only file settings, set with --appendonly, --appendfilename,
+// --appendfsync and --aof-use-rdb-preamble.
+var appendOnly = false
+var appendFilename = "appendonly.aof"
+var appendFsync = "everysec"
+var aofUseRDBPreamble = true
+
+// appendFsyncPolicies are the accepted values of appendfsync: fsync after every
+// write, once per second from a background goroutine, or leave it to the OS.
+var appendFsyncPolicies = map[string]bool{"always": true, "everysec": true, "no": true}
+
+// aofRewriteItemsPerCommand caps the elements a rewrite packs into a single
+// command, so that replaying a huge collection does not need a huge request.
+const aofRewriteItemsPerCommand = 64
+
+// Append only file state, guarded by keyspaceMutex.
+var (
+	aofFile              *os.File     // Open for appending while appendonly is on
+	aofRewriteInProgress = false      // Set while a BGREWRITEAOF goroutine runs
+	aofRewriteBuffer     bytes.Buffer // Writes made since the rewrite's snapshot
+	aofUnsynced          = false      // Set when writes await the everysec fsync
+)
+
+// aofPath returns the path of the append only file.
+func aofPath() string {
+	return filepath.Join(dir, appendFilename)
+}
+
+// feedAppendOnlyFile appends a write command to the AOF, and to the rewrite
+// buffer while a rewrite runs so that the new file does not miss it.
+// It follows the replication stream, SELECT and MULTI/EXEC included.
+func feedAppendOnlyFile(commandStringArray []string) {
+	if aofFile == nil && !aofRewriteInProgress {
+		return
+	}
+	encoded := StringArrayToBulkStringArray(absoluteExpiryCommand(commandStringArray))
+	if aofFile != nil {
+		start := time.Now()
+		if _, err := aofFile.Write(encoded); err != nil {
+			serverLog(logWarning, "Error writing to the AOF: %v", err)
+		}
+		latencyAddSampleIfNeeded("aof-write", time.Since(start))
+		switch appendFsync {
+		case "always":
+			start = time.Now()
+			if err := aofFile.Sync(); err != nil {
+				serverLog(logWarning, "Error syncing the AOF: %v", err)
+			}
+			latencyAddSampleIfNeeded("aof-fsync-always", time.Since(start))
+		case "everysec":
+			aofUnsynced = true
+		}
+	}
+	if aofRewriteInProgress {
+		aofRewriteBuffer.Write(encoded)
+	}
+}
+
+// absoluteExpiryCommand returns the equivalent of a command that sets a relative
+// expiration, with an absolute one instead, so that replaying the AOF later does
+// not extend the TTL. Other commands are returned unchanged.
+func absoluteExpiryCommand(args []string) []string {
+	// at converts a TTL argument in the given unit to a unix time in milliseconds
+	at := func(ttl string, unit time.Duration) (string, bool) {
+		n, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatInt(time.Now().Add(time.Duration(n)*unit).UnixMilli(), 10), true
+	}
+	unit := time.Second
+
+	switch strings.ToLower(args[0]) {
+	case "pexpire", "hpexpire":
+		unit = time.Millisecond
+		fallthrough
+	case "expire", "hexpire":
+		if len(args) < 3 {
+			break
+		}
+		when, ok := at(args[2], unit)
+		if !ok {
+			break
+		}
+		name := "PEXPIREAT"
+		if strings.HasPrefix(strings.ToLower(args[0]), "h") {
+			name = "HPEXPIREAT"
+		}
+		return append([]string{name, args[1], when}, args[3:]...)
+
+	case "psetex":
+		unit = time.Millisecond
+		fallthrough
+	case "setex":
+		if len(args) != 4 {
+			break
+		}
+		if when, ok := at(args[2], unit); ok {
+			return []string{"SET", args[1], args[3], "PXAT", when}
+		}
+
+	case "set":
+		for i := 3; i+1 < len(args); i++ {
+			option := strings.ToLower(args[i])
+			if option != "ex" && option != "px" {
+				continue
+			}
+			if option == "px" {
+				unit = time.Millisecond
+			}
+			if when, ok := at(args[i+1], unit); ok {
+				converted := slices.Clone(args)
+				converted[i], converted[i+1] = "PXAT", when
+				return converted
+			}
+		}
+	}
+	return args
+}
+
+// aofFsyncCron flushes the AOF to disk once per second under the everysec policy.
+// The fsync itself runs without the lock, so that a slow disk does not stall clients.
+func aofFsyncCron() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		keyspaceMutex.Lock()
+		f := aofFile
+		pending := aofUnsynced && appendFsync == "everysec"
+		aofUnsynced = false
+		keyspaceMutex.Unlock()
+
+		if f != nil && pending {
+			// A rewrite may close the file meanwhile, its successor is synced when renamed
+			if err := f.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+				serverLog(logWarning, "Error syncing the AOF: %v", err)
+			}
+		}
+	}
+}
+
+// openAppendOnlyFile opens the AOF for appending, creating it from the
+// current dataset if it does not exist yet.
+func openAppendOnlyFile() error {
+	if _, err := os.Stat(aofPath()); errors.Is(err, os.ErrNotExist) {
+		if err := writeRewrittenAOF(aofPath(), databases, -1); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(aofPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	aofFile = f
+	// The file does not tell which database its last command ran against
+	replicationDB = -1
+	return nil
+}
+
+// loadAppendOnlyFile loads the RDB preamble of the AOF, if it has one, and
+// replays its commands into the databases.
+// A transaction left unterminated by a truncated file is discarded, as is a
+// truncated last command. Returns os.ErrNotExist if there is no AOF.
+func loadAppendOnlyFile() error {
+	data, err := os.ReadFile(aofPath())
+	if err != nil {
+		return err
+	}
+
+	// A rewritten AOF may start with an RDB snapshot, followed by the commands
+	// written since
+	if bytes.HasPrefix(data, []byte("REDIS")) {
+		n, err := decodeRDB(data, databases)
+		if err != nil {
+			return fmt.Errorf("RDB preamble: %w", err)
+		}
+		data = data[n:]
+	}
+
+	// The fake client has no user, so that ACL rules do not apply
+	client := &Client{Authenticated: true}
+	requests := newRequestReader(bufio.NewReader(bytes.NewReader(data)))
+	var transaction []Command
+	inTransaction := false
+
+	for {
+		args, _, err := requests.readRequest()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			serverLog(logWarning, "The AOF ends with a truncated command, ignoring it: %v", err)
+			break
+		}
+
+		commandStringArray := argumentStrings(args)
+		command := Command{StringArray: commandStringArray, Name: strings.ToLower(commandStringArray[0])}
+		switch command.Name {
+		case "multi":
+			inTransaction = true
+			transaction = nil
+		case "exec":
+			for _, queued := range transaction {
+				replayAOFCommand(client, queued)
+			}
+			inTransaction = false
+			transaction = nil
+		default:
+			if inTransaction {
+				transaction = append(transaction, command)
+			} else {
+				replayAOFCommand(client, command)
+			}
+		}
+	}
+	if inTransaction {
+		serverLog(logWarning, "The AOF ends with an unterminated transaction, discarding it")
+	}
+
+	// Replaying is not a change to persist again
+	dirty = 0
+	replicationDB = -1
+	return nil
+}
+
+// replayAOFCommand runs a command read from the AOF.
+func replayAOFCommand(client *Client, command Command) {
+	if reply := ProcessCommand(client, command); len(reply) > 0 && reply[0] == '-' {
+		serverLog(logWarning, "Error replaying %s from the AOF: %s", command.Name, bytes.TrimSpace(reply[1:]))
+	}
+}
+
+// bgrewriteaof implements BGREWRITEAOF. A goroutine writes the commands that
+// recreate a snapshot of the dataset to a temporary file; the writes made
+// meanwhile are buffered, appended to it, and the file then replaces the AOF.
+// Must be called with keyspaceMutex held.
+func bgrewriteaof() []byte {
+	if aofRewriteInProgress {
+		return []byte("-ERR Background append only file rewriting already in progress\r\n")
+	}
+	aofRewriteInProgress = true
+	aofRewriteBuffer.Reset()
+	snapshot := snapshotDatabases()
+	// The buffered writes continue the stream from the database selected at this point
+	snapshotDB := replicationDB
+
+	go func() {
+		temp := filepath.Join(dir, fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeRewrittenAOF(temp, snapshot, snapshotDB)
+
+		keyspaceMutex.Lock()
+		if err == nil {
+			err = finishAOFRewrite(temp)
+		}
+		aofRewriteInProgress = false
+		aofRewriteBuffer.Reset()
+		keyspaceMutex.Unlock()
+
+		if err != nil {
+			os.Remove(temp)
+			serverLog(logWarning, "Background AOF rewrite error: %v", err)
+			return
+		}
+		serverLog(logNotice, "Background AOF rewrite finished successfully")
+	}()
+
+	return []byte("+Background append only file rewriting started\r\n")
+}
+
+// finishAOFRewrite appends the writes buffered during a rewrite to its
+// temporary file, then atomically renames it over the AOF, which further
+// writes go to. Must be called with keyspaceMutex held.
+func finishAOFRewrite(temp string) error {
+	f, err := os.OpenFile(temp, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(aofRewriteBuffer.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(temp, aofPath()); err != nil {
+		f.Close()
+		return err
+	}
+
+	if aofFile == nil {
+		return f.Close()
+	}
+	aofFile.Close()
+	aofFile = f
+	return nil
+}
+
+// writeRewrittenAOF writes to path the contents of dbs, as an RDB preamble
+// with aof-use-rdb-preamble and otherwise as commands recreating them, one per
+// key where possible. It ends with a SELECT of finalDB unless it is negative.
+func writeRewrittenAOF(path string, dbs []map[string]*redisObject, finalDB int) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	emit := func(args ...string) {
+		w.Write(StringArrayToBulkStringArray(args))
+	}
+
+	if aofUseRDBPreamble {
+		w.Write(encodeRDB(dbs))
+		dbs = nil
+	}
+	for index, db := range dbs {
+		if len(db) == 0 {
+			continue
+		}
+		emit("SELECT", strconv.Itoa(index))
+		for key, obj := range db {
+			if isExpired(obj) {
+				continue
+			}
+			rewriteObject(emit, key, obj)
+			if obj.Expiry != nil {
+				emit("PEXPIREAT", key, strconv.FormatInt(obj.Expiry.UnixMilli(), 10))
+			}
+		}
+	}
+	if finalDB >= 0 {
+		emit("SELECT", strconv.Itoa(finalDB))
+	}
+
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rewriteObject emits the commands recreating the value of a key.
+func rewriteObject(emit func(args ...string), key string, obj *redisObject) {
+	// emitBatched emits command key followed by args, aofRewriteItemsPerCommand
+	// items (of width arguments each) at a time
+	emitBatched := func(command string, args []string, width int) {
+		for len(args) > 0 {
+			n := min(len(args), aofRewriteItemsPerCommand*width)
+			emit(append([]string{command, key}, args[:n]...)...)
+			args = args[n:]
+		}
+	}
+
+	switch value := obj.Value.(type) {
+	case string:
+		emit("SET", key, value)
+
+	case []string:
+		emitBatched("RPUSH", value, 1)
+
+	case *redisSet:
+		emitBatched("SADD", value.members(), 1)
+
+	case *sortedSet:
+		var args []string
+		for _, m := range value.members() {
+			args = append(args, strconv.FormatFloat(m.Score, 'g', 17, 64), m.Member)
+		}
+		emitBatched("ZADD", args, 2)
+
+	case *redisHash:
+		emitBatched("HSET", value.entries(), 2)
+		for _, field := range slices.Sorted(maps.Keys(value.expiries)) {
+			emit("HPEXPIREAT", key, strconv.FormatInt(value.expiries[field].UnixMilli(), 10), "FIELDS", "1", field)
+		}
+
+	case *redisStream:
+		rewriteStream(emit, key, value)
+	}
+}
+
+// rewriteStream emits the commands recreating a stream: its entries, its
+// metadata, then its consumer groups with their consumers and pending entries.
+func rewriteStream(emit func(args ...string), key string, s *redisStream) {
+	if len(s.entries) == 0 {
+		// Like Redis, create an empty stream by adding an entry trimmed right away
+		id := s.lastID
+		if id == (streamID{}) {
+			id.seq = 1
+		}
+		emit("XADD", key, "MAXLEN", "0", id.String(), "x", "y")
+	}
+	for _, entry := range s.entries {
+		emit(append([]string{"XADD", key, entry.ID.String()}, entry.Fields...)...)
+	}
+	emit("XSETID", key, s.lastID.String(),
+		"ENTRIESADDED", strconv.FormatUint(s.entriesAdded, 10),
+		"MAXDELETEDID", s.maxDeletedID.String())
+
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		group := s.groups[name]
+		emit("XGROUP", "CREATE", key, name, group.lastID.String(),
+			"ENTRIESREAD", strconv.FormatInt(group.entriesRead, 10))
+		for _, consumer := range slices.Sorted(maps.Keys(group.consumers)) {
+			emit("XGROUP", "CREATECONSUMER", key, name, consumer)
+		}
+		for _, id := range slices.SortedFunc(maps.Keys(group.pending), streamID.compare) {
+			nack := group.pending[id]
+			emit("XCLAIM", key, name, nack.consumer, "0", id.String(),
+				"TIME", strconv.FormatInt(nack.deliveryTime.UnixMilli(), 10),
+				"RETRYCOUNT", strconv.Itoa(nack.deliveryCount), "JUSTID", "FORCE")
+		}
+	}
+}
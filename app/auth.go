@@ -3,36 +3,204 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
+	"maps"
+	"slices"
 	"strings"
 )
 
-// setUserPassword updates the credentials for a user.
-// It adheres to the Redis ACL syntax where a password rule starting with '>'
-// indicates a new password should be added.
-func setUserPassword(username, passwordRule string) string {
-	// Check if the user exists in the global 'users' map
-	user, ok := users[username]
-	if !ok {
-		return "-ERR no such user\r\n"
+func init() {
+	// The default user may run every command against every key
+	applyACLRule(users["default"], "allcommands")
+	applyACLRule(users["default"], "allkeys")
+}
+
+// newACLUser returns a user as ACL SETUSER creates it: disabled, without
+// passwords, and allowed no command nor key.
+func newACLUser() *ACLUser {
+	user := &ACLUser{Flags: map[string]bool{"off": true}, Passwords: []string{}}
+	applyACLRule(user, "nocommands")
+	return user
+}
+
+// clone returns a deep copy of the user, for rules to be applied to.
+func (user *ACLUser) clone() *ACLUser {
+	return &ACLUser{
+		Flags:        maps.Clone(user.Flags),
+		Passwords:    slices.Clone(user.Passwords),
+		Commands:     maps.Clone(user.Commands),
+		CommandRules: slices.Clone(user.CommandRules),
+		KeyPatterns:  slices.Clone(user.KeyPatterns),
 	}
+}
 
-	// Validate the rule syntax.
-	if !strings.HasPrefix(passwordRule, ">") {
-		return "-ERR invalid rule\r\n"
+// setUser implements ACL SETUSER username [rule ...]: the user is created if
+// needed, then the rules are applied in order. They are applied atomically:
+// if one is invalid, the user is left untouched.
+func setUser(username string, rules []string) []byte {
+	user := newACLUser()
+	if existing, ok := users[username]; ok {
+		user = existing.clone()
 	}
 
-	// Extract the plain text password by stripping the leading '>'
-	password := passwordRule[1:]
+	for _, rule := range rules {
+		if err := applyACLRule(user, rule); err != nil {
+			return []byte("-ERR Error in ACL SETUSER modifier '" + sanitizeErrorArgument(rule) + "': " + err.Error() + "\r\n")
+		}
+	}
+	users[username] = user
+	return []byte("+OK\r\n")
+}
+
+// applyACLRule applies one rule of the Redis ACL syntax to a user:
+//   - on and off enable and disable the user;
+//   - >password adds a password and <password removes it; nopass lets the user
+//     authenticate with any password, resetpass removes them all and nopass;
+//   - +command, -command, +command|subcommand and -command|subcommand allow or
+//     deny a command or one of its subcommands;
+//   - +@category and -@category do the same for every command of a category,
+//     with allcommands and nocommands as aliases for +@all and -@all;
+//   - ~pattern allows the keys matching a glob-style pattern, allkeys being
+//     an alias for ~* and resetkeys forgetting the patterns;
+//   - reset restores a user to the state of a new one.
+func applyACLRule(user *ACLUser, rule string) error {
+	switch strings.ToLower(rule) {
+	case "on":
+		delete(user.Flags, "off")
+		user.Flags["on"] = true
+		return nil
+	case "off":
+		delete(user.Flags, "on")
+		user.Flags["off"] = true
+		return nil
+	case "nopass":
+		user.Passwords = []string{}
+		user.Flags["nopass"] = true
+		return nil
+	case "resetpass":
+		user.Passwords = []string{}
+		delete(user.Flags, "nopass")
+		return nil
+	case "reset":
+		*user = *newACLUser()
+		return nil
+	case "allcommands":
+		rule = "+@all"
+	case "nocommands":
+		rule = "-@all"
+	case "allkeys":
+		user.KeyPatterns = []string{"*"}
+		return nil
+	case "resetkeys":
+		user.KeyPatterns = nil
+		return nil
+	}
+
+	switch {
+	case strings.HasPrefix(rule, ">"):
+		// Hash the password for storage using SHA-256.
+		hash := sha256.Sum256([]byte(rule[1:]))
+		hashHex := hex.EncodeToString(hash[:])
+		if !slices.Contains(user.Passwords, hashHex) {
+			user.Passwords = append(user.Passwords, hashHex)
+		}
+		delete(user.Flags, "nopass")
+
+	case strings.HasPrefix(rule, "<"):
+		hash := sha256.Sum256([]byte(rule[1:]))
+		hashHex := hex.EncodeToString(hash[:])
+		if !slices.Contains(user.Passwords, hashHex) {
+			return errors.New("The password you are trying to remove from the user does not exist")
+		}
+		user.Passwords = slices.DeleteFunc(user.Passwords, func(p string) bool { return p == hashHex })
+
+	case strings.HasPrefix(rule, "~"):
+		user.KeyPatterns = append(user.KeyPatterns, rule[1:])
+
+	case strings.HasPrefix(rule, "+@"), strings.HasPrefix(rule, "-@"):
+		category := strings.ToLower(rule[2:])
+		names := commandsInCategory(category)
+		if len(names) == 0 {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		if category == "all" {
+			user.Commands = map[string]bool{}
+			user.CommandRules = nil
+		}
+		for _, name := range names {
+			setCommandAllowed(user, name, rule[0] == '+')
+		}
+		user.CommandRules = append(user.CommandRules, rule[:1]+"@"+category)
+
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		name := strings.ToLower(rule[1:])
+		command, subcommand, _ := strings.Cut(name, "|")
+		if commandTable[command] == nil || strings.Contains(subcommand, "|") {
+			return errors.New("Unknown command or category name in ACL")
+		}
+		setCommandAllowed(user, name, rule[0] == '+')
+		user.CommandRules = append(user.CommandRules, rule[:1]+name)
+
+	default:
+		return errors.New("Syntax error")
+	}
+	return nil
+}
 
-	// Hash the password for storage using SHA-256.
+// setCommandAllowed allows or denies a command, or a "command|subcommand". A
+// rule about a whole command overrides those about its subcommands.
+func setCommandAllowed(user *ACLUser, name string, allowed bool) {
+	if !strings.Contains(name, "|") {
+		for entry := range user.Commands {
+			if strings.HasPrefix(entry, name+"|") {
+				delete(user.Commands, entry)
+			}
+		}
+	}
+	user.Commands[name] = allowed
+}
+
+// aclCheckCommand returns the NOPERM error for a command the user may not run,
+// or that accesses a key the user may not access, or nil if it is allowed.
+func aclCheckCommand(username string, user *ACLUser, info *commandInfo, args []string) []byte {
+	name := strings.ToLower(args[0])
+	allowed := user.Commands[name]
+	if len(args) > 1 {
+		if subcommandAllowed, ok := user.Commands[name+"|"+strings.ToLower(args[1])]; ok {
+			allowed = subcommandAllowed
+			name += "|" + strings.ToLower(args[1])
+		}
+	}
+	if !allowed {
+		return []byte("-NOPERM User " + sanitizeErrorArgument(username) + " has no permissions to run the '" + sanitizeErrorArgument(name) + "' command\r\n")
+	}
+
+	for _, key := range info.commandKeys(args) {
+		if !slices.ContainsFunc(user.KeyPatterns, func(pattern string) bool { return globMatch(pattern, key) }) {
+			return []byte("-NOPERM User " + sanitizeErrorArgument(username) + " has no permissions to access the '" + sanitizeErrorArgument(key) + "' key\r\n")
+		}
+	}
+	return nil
+}
+
+// authenticate logs the client in as username if password is one of the
+// user's, or if the user has nopass. Disabled users cannot log in.
+func authenticate(client *Client, username, password string) bool {
+	user := users[username]
+	if user == nil || !user.Flags["on"] {
+		return false
+	}
+
+	// Verify Password Hash
 	hash := sha256.Sum256([]byte(password))
 	hashHex := hex.EncodeToString(hash[:])
+	if !user.Flags["nopass"] && !slices.Contains(user.Passwords, hashHex) {
+		return false
+	}
 
-	// Update user state:
-	user.Passwords = append(user.Passwords, hashHex)
-	delete(user.Flags, "nopass")
-
-	return "+OK\r\n"
+	client.Authenticated = true
+	client.Username = username
+	return true
 }
 
 // encodeACLGetUser implements the logic for the 'ACL GETUSER <username>' command.
@@ -47,16 +215,26 @@ func encodeACLGetUser(username string) []byte {
 	for flag := range user.Flags {
 		flagsArray = append(flagsArray, flag)
 	}
+	slices.Sort(flagsArray)
 
 	passwordsArray := make([]string, len(user.Passwords))
 	copy(passwordsArray, user.Passwords)
 
 	// Construct the final output.
-	// [ "flags", [flag1, flag2...], "passwords", [hash1, hash2...] ]
-	return []byte(encodeArray([]interface{}{
+	// [ "flags", [flag1, flag2...], "passwords", [hash1, hash2...], "commands", "+@all", "keys", "~*" ]
+	keys := make([]string, len(user.KeyPatterns))
+	for i, pattern := range user.KeyPatterns {
+		keys[i] = "~" + pattern
+	}
+
+	return encodeArray([]interface{}{
 		"flags",
 		flagsArray,
 		"passwords",
 		passwordsArray,
-	}))
+		"commands",
+		strings.Join(user.CommandRules, " "),
+		"keys",
+		strings.Join(keys, " "),
+	})
 }
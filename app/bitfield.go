@@ -0,0 +1,253 @@
+package main
+
+import (
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// bitfieldType describes an integer encoding such as i8 or u16.
+type bitfieldType struct {
+	Signed bool
+	Bits   uint
+}
+
+// bitfieldOp is a single GET / SET / INCRBY operation of a BITFIELD command.
+type bitfieldOp struct {
+	Kind     string // "get", "set" or "incrby"
+	Type     bitfieldType
+	Offset   uint64 // Bit offset, already multiplied out for the #N form
+	Value    int64  // New value for SET, increment for INCRBY
+	Overflow string // Overflow policy in effect: "wrap", "sat" or "fail"
+}
+
+// parseBitfieldType parses types like i5 or u63. Unsigned values are limited
+// to 63 bits so that every result fits in a signed 64 bit reply.
+func parseBitfieldType(s string) (bitfieldType, bool) {
+	if len(s) < 2 || (s[0] != 'i' && s[0] != 'u' && s[0] != 'I' && s[0] != 'U') {
+		return bitfieldType{}, false
+	}
+
+	bits, err := strconv.Atoi(s[1:])
+	signed := s[0] == 'i' || s[0] == 'I'
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		return bitfieldType{}, false
+	}
+
+	return bitfieldType{Signed: signed, Bits: uint(bits)}, true
+}
+
+// parseBitfieldOffset parses a bit offset. The #N form addresses the N-th
+// field of the given width rather than a raw bit position.
+func parseBitfieldOffset(s string, t bitfieldType) (uint64, bool) {
+	multiply := strings.HasPrefix(s, "#")
+	if multiply {
+		s = s[1:]
+	}
+
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if multiply {
+		offset *= uint64(t.Bits)
+	}
+
+	// The field must fit inside the maximum string size
+	if offset+uint64(t.Bits) > maxStringLength*8 {
+		return 0, false
+	}
+	return offset, true
+}
+
+// readBits reads a field of type t starting at the given bit offset.
+// Bit 0 is the most significant bit of the first byte; bits past the end read as zero.
+func readBits(buf []byte, offset uint64, t bitfieldType) int64 {
+	var value uint64
+	for i := uint64(0); i < uint64(t.Bits); i++ {
+		pos := offset + i
+		bit := uint64(0)
+		if pos/8 < uint64(len(buf)) {
+			bit = uint64(buf[pos/8]>>(7-pos%8)) & 1
+		}
+		value = value<<1 | bit
+	}
+
+	// Sign extend negative values
+	if t.Signed && t.Bits < 64 && value&(1<<(t.Bits-1)) != 0 {
+		value |= ^uint64(0) << t.Bits
+	}
+	return int64(value)
+}
+
+// writeBits writes value as a field of type t at the given bit offset,
+// growing buf as needed, and returns the resulting buffer.
+func writeBits(buf []byte, offset uint64, t bitfieldType, value int64) []byte {
+	needed := int((offset + uint64(t.Bits) + 7) / 8)
+	if needed > len(buf) {
+		buf = append(buf, make([]byte, needed-len(buf))...)
+	}
+
+	for i := uint64(0); i < uint64(t.Bits); i++ {
+		pos := offset + i
+		bit := byte(uint64(value)>>(uint64(t.Bits)-1-i)) & 1
+		mask := byte(1) << (7 - pos%8)
+		if bit == 1 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+	return buf
+}
+
+// fitBitfieldValue fits an exact result into type t according to the overflow policy.
+// Returns false when the policy is FAIL and the value does not fit.
+func fitBitfieldValue(exact *big.Int, t bitfieldType, overflow string) (int64, bool) {
+	minimum, maximum := new(big.Int), new(big.Int)
+	if t.Signed {
+		minimum.Lsh(big.NewInt(1), t.Bits-1).Neg(minimum)
+		maximum.Lsh(big.NewInt(1), t.Bits-1).Sub(maximum, big.NewInt(1))
+	} else {
+		maximum.Lsh(big.NewInt(1), t.Bits).Sub(maximum, big.NewInt(1))
+	}
+
+	if exact.Cmp(minimum) >= 0 && exact.Cmp(maximum) <= 0 {
+		return exact.Int64(), true
+	}
+
+	switch overflow {
+	case "fail":
+		return 0, false
+
+	case "sat":
+		if exact.Cmp(minimum) < 0 {
+			return minimum.Int64(), true
+		}
+		return maximum.Int64(), true
+
+	default:
+		// WRAP: keep the low bits, interpreting them as two's complement when signed
+		modulus := new(big.Int).Lsh(big.NewInt(1), t.Bits)
+		wrapped := new(big.Int).Mod(exact, modulus)
+		if t.Signed && wrapped.Cmp(maximum) > 0 {
+			wrapped.Sub(wrapped, modulus)
+		}
+		return wrapped.Int64(), true
+	}
+}
+
+// parseBitfieldOps parses the subcommands of BITFIELD key [GET type offset]
+// [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP|SAT|FAIL] ...
+// On failure the RESP error to reply with is returned.
+func parseBitfieldOps(args []string) ([]bitfieldOp, []byte) {
+	ops := []bitfieldOp{}
+	overflow := "wrap"
+
+	for i := 0; i < len(args); i++ {
+		kind := strings.ToLower(args[i])
+
+		if kind == "overflow" {
+			if i+1 >= len(args) {
+				return nil, []byte("-ERR syntax error\r\n")
+			}
+			i++
+			overflow = strings.ToLower(args[i])
+			if overflow != "wrap" && overflow != "sat" && overflow != "fail" {
+				return nil, []byte("-ERR Invalid OVERFLOW type specified\r\n")
+			}
+			continue
+		}
+
+		argCount := 2
+		switch kind {
+		case "get":
+		case "set", "incrby":
+			argCount = 3
+		default:
+			return nil, []byte("-ERR syntax error\r\n")
+		}
+		if i+argCount >= len(args) {
+			return nil, []byte("-ERR syntax error\r\n")
+		}
+
+		t, ok := parseBitfieldType(args[i+1])
+		if !ok {
+			return nil, []byte("-ERR Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.\r\n")
+		}
+		offset, ok := parseBitfieldOffset(args[i+2], t)
+		if !ok {
+			return nil, []byte("-ERR bit offset is not an integer or out of range\r\n")
+		}
+
+		op := bitfieldOp{Kind: kind, Type: t, Offset: offset, Overflow: overflow}
+		if argCount == 3 {
+			value, err := strconv.ParseInt(args[i+3], 10, 64)
+			if err != nil {
+				return nil, []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			op.Value = value
+		}
+
+		ops = append(ops, op)
+		i += argCount
+	}
+
+	return ops, nil
+}
+
+// bitfield runs every operation against the string stored at key, in order,
+// and replies with one result per GET / SET / INCRBY. Operations skipped by
+// OVERFLOW FAIL reply with a Null Bulk String.
+func bitfield(key string, ops []bitfieldOp) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	var buf []byte
+	if value != nil {
+		buf = []byte(value.Value.(string))
+	}
+
+	modified := false
+	results := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		current := readBits(buf, op.Offset, op.Type)
+
+		switch op.Kind {
+		case "get":
+			results = append(results, int(current))
+
+		case "set":
+			fitted, ok := fitBitfieldValue(big.NewInt(op.Value), op.Type, op.Overflow)
+			if !ok {
+				results = append(results, nil)
+				continue
+			}
+			buf = writeBits(buf, op.Offset, op.Type, fitted)
+			modified = true
+			results = append(results, int(current))
+
+		case "incrby":
+			exact := new(big.Int).Add(big.NewInt(current), big.NewInt(op.Value))
+			fitted, ok := fitBitfieldValue(exact, op.Type, op.Overflow)
+			if !ok {
+				results = append(results, nil)
+				continue
+			}
+			buf = writeBits(buf, op.Offset, op.Type, fitted)
+			modified = true
+			results = append(results, int(fitted))
+		}
+	}
+
+	if modified {
+		if value == nil {
+			value = setKey(key, StringType, "")
+		}
+		value.Value = string(buf)
+	}
+
+	return encodeArray(results)
+}
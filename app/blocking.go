@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// blockedClient is a client waiting on one or more keys of a database until a
+// blocking command (BLPOP, BLMOVE...) can be served.
+type blockedClient struct {
+	client *Client
+	db     int
+	keys   []string
+	try    func() []byte // Attempts the command, returning nil while it cannot be served
+	reply  chan []byte   // Receives the reply once a writer has served the command
+}
+
+// dbKey identifies a key within a numbered database.
+type dbKey struct {
+	db  int
+	key string
+}
+
+// blockedClients maps every key to the clients waiting on it, in arrival order.
+var blockedClients = make(map[dbKey][]*blockedClient)
+
+// readyKeys lists the keys written to since blocked clients were last served.
+// readyKeySet guards against queueing a key twice.
+var readyKeys []dbKey
+var readyKeySet = make(map[dbKey]struct{})
+
+// parseBlockTimeout parses the timeout argument of a blocking command, given in
+// seconds with an optional fractional part. Zero means block forever.
+// On failure the RESP error to reply with is returned.
+func parseBlockTimeout(arg string) (time.Duration, []byte) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) {
+		return 0, []byte("-ERR timeout is not a float or out of range\r\n")
+	}
+	if seconds < 0 {
+		return 0, []byte("-ERR timeout is negative\r\n")
+	}
+	// Infinite or too long timeouts would overflow the duration
+	if seconds > math.MaxInt64/float64(time.Second) {
+		return 0, []byte("-ERR timeout is out of range\r\n")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// signalKeyAsReady marks key in the selected database as written to, so that
+// clients blocked on it get a chance to be served once the current command ends.
+func signalKeyAsReady(key string) {
+	signalKeyAsReadyInDB(selectedDB, key)
+}
+
+// signalKeyAsReadyInDB is signalKeyAsReady for an explicit database.
+func signalKeyAsReadyInDB(db int, key string) {
+	k := dbKey{db, key}
+	if _, waited := blockedClients[k]; !waited {
+		return
+	}
+	if _, queued := readyKeySet[k]; queued {
+		return
+	}
+	readyKeySet[k] = struct{}{}
+	readyKeys = append(readyKeys, k)
+}
+
+// signalDBAsReady marks every waited-on key of db as ready, for commands like
+// SWAPDB that change a whole database at once.
+func signalDBAsReady(db int) {
+	for k := range blockedClients {
+		if k.db == db {
+			signalKeyAsReadyInDB(db, k.key)
+		}
+	}
+}
+
+// serveBlockedClients retries the commands of the clients waiting on ready keys,
+// oldest first, handing each served client its reply.
+// Serving a client may ready further keys (BLMOVE pushes onto its destination),
+// so this runs until no ready keys remain.
+// Must be called with keyspaceMutex held.
+func serveBlockedClients() {
+	for len(readyKeys) > 0 {
+		keys := readyKeys
+		readyKeys = nil
+		clear(readyKeySet)
+
+		for _, k := range keys {
+			for _, waiter := range slices.Clone(blockedClients[k]) {
+				selectDB(k.db)
+				reply := waiter.try()
+				if reply == nil {
+					continue
+				}
+				unblockClient(waiter)
+				waiter.reply <- reply
+			}
+		}
+	}
+}
+
+// unblockClient removes waiter from the wait list of every key it blocks on.
+func unblockClient(waiter *blockedClient) {
+	for _, key := range waiter.keys {
+		k := dbKey{waiter.db, key}
+		waiters := slices.DeleteFunc(blockedClients[k], func(b *blockedClient) bool {
+			return b == waiter
+		})
+		if len(waiters) == 0 {
+			delete(blockedClients, k)
+		} else {
+			blockedClients[k] = waiters
+		}
+	}
+}
+
+// blockUntilServed runs try and, if the command cannot be served yet, blocks the
+// client on keys until a writer serves it, the timeout elapses or the client
+// disconnects. timeoutReply is sent when no reply came. Inside MULTI/EXEC a
+// blocking command never waits, matching Redis.
+// Must be called with keyspaceMutex held; it is released while waiting. On the
+// execution loop of io-threads, the client is left to wait once it returns.
+func blockUntilServed(client *Client, keys []string, timeout time.Duration, timeoutReply []byte, try func() []byte) []byte {
+	if reply := try(); reply != nil {
+		return reply
+	}
+	if client.InExec {
+		return timeoutReply
+	}
+
+	waiter := &blockedClient{
+		client: client,
+		db:     selectedDB,
+		keys:   keys,
+		try:    try,
+		reply:  make(chan []byte, 1),
+	}
+	for _, key := range keys {
+		k := dbKey{selectedDB, key}
+		blockedClients[k] = append(blockedClients[k], waiter)
+	}
+
+	if executionQueue != nil {
+		// The execution loop cannot wait: the client does, see execute
+		client.blocked = &pendingBlock{waiter: waiter, timeout: timeout, timeoutReply: timeoutReply}
+		return nil
+	}
+
+	keyspaceMutex.Unlock()
+	reply := waitForReply(waiter, timeout)
+	keyspaceMutex.Lock()
+	return finishBlocking(waiter, reply, timeoutReply)
+}
+
+// finishBlocking returns the reply of a blocked client once it is done waiting,
+// the one it was served with or timeoutReply.
+// Must be called with keyspaceMutex held.
+func finishBlocking(waiter *blockedClient, reply []byte, timeoutReply []byte) []byte {
+	if reply == nil {
+		// A writer may have served the client while the lock was being reacquired
+		select {
+		case reply = <-waiter.reply:
+		default:
+			unblockClient(waiter)
+			reply = timeoutReply
+		}
+	}
+	return reply
+}
+
+// waitForReply waits for waiter to be served. Returns nil if the timeout
+// (zero meaning none) elapses or the client disconnects first.
+func waitForReply(waiter *blockedClient, timeout time.Duration) []byte {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// The replies to the commands pipelined before this one are not held back
+	waiter.client.flush()
+
+	gone, stopWatching := watchDisconnect(waiter.client)
+	defer stopWatching()
+
+	select {
+	case reply := <-waiter.reply:
+		return reply
+	case <-expired:
+		return nil
+	case <-gone:
+		return nil
+	}
+}
+
+// watchDisconnect returns a channel that is closed if the client's connection
+// is closed while it is blocked. It peeks at the connection without consuming
+// anything, so commands the client pipelines meanwhile are left for the main loop.
+// The returned stop function must be called before the connection is read again.
+func watchDisconnect(client *Client) (<-chan struct{}, func()) {
+	gone := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		if _, err := client.Reader.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(gone)
+		}
+	}()
+
+	stop := func() {
+		// Interrupt the pending peek, then restore the connection for normal reads
+		client.Connection.SetReadDeadline(time.Now())
+		<-done
+		client.Connection.SetReadDeadline(time.Time{})
+	}
+	return gone, stop
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"cmp"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// nextClientID hands out the IDs of the clients, in connection order.
+var nextClientID atomic.Int64
+
+// idleTimeout is the number of seconds after which an idle client is
+// disconnected, set with the timeout parameter. 0 disables the timeout.
+var idleTimeout = 0
+
+// clients maps the IDs of the connected clients to them.
+var clients = make(map[int64]*Client)
+
+// registerClient adds a newly connected client to clients.
+func registerClient(client *Client) {
+	keyspaceMutex.Lock()
+	defer keyspaceMutex.Unlock()
+	clients[client.ID] = client
+}
+
+// setIdleDeadline bounds the wait for the next command of a client with the
+// idle timeout. Pub/sub clients and replication links wait for as long as they
+// need, and so do blocked clients as they do not read in the meantime.
+func setIdleDeadline(client *Client) {
+	if idleTimeout > 0 && !client.SubscribedMode && !client.Primary && !client.Replica {
+		client.Connection.SetReadDeadline(time.Now().Add(time.Duration(idleTimeout) * time.Second))
+	} else {
+		client.Connection.SetReadDeadline(time.Time{})
+	}
+}
+
+// clientCommand implements CLIENT ID | SETNAME | GETNAME | LIST | INFO | TRACKING | HELP.
+// Must be called with keyspaceMutex held.
+func clientCommand(client *Client, args []string) []byte {
+	if len(args) < 1 {
+		return []byte("-ERR wrong number of arguments for 'client' command\r\n")
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "id":
+		if len(args) != 1 {
+			return []byte("-ERR wrong number of arguments for 'client|id' command\r\n")
+		}
+		return []byte(":" + strconv.FormatInt(client.ID, 10) + "\r\n")
+
+	case "setname":
+		if len(args) != 2 {
+			return []byte("-ERR wrong number of arguments for 'client|setname' command\r\n")
+		}
+		if !validClientName(args[1]) {
+			return []byte("-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+		}
+		client.Name = args[1]
+		return []byte("+OK\r\n")
+
+	case "getname":
+		if len(args) != 1 {
+			return []byte("-ERR wrong number of arguments for 'client|getname' command\r\n")
+		}
+		if client.Name == "" {
+			return encodeRESP(nil, client.Protocol)
+		}
+		return StringToBulkString(client.Name)
+
+	case "list":
+		return clientList(args[1:])
+
+	case "info":
+		if len(args) != 1 {
+			return []byte("-ERR wrong number of arguments for 'client|info' command\r\n")
+		}
+		return StringToBulkString(describeClient(client) + "\n")
+
+	case "tracking":
+		return clientTracking(client, args[1:])
+
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"CLIENT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"GETNAME",
+			"    Return the name of the current connection.",
+			"ID",
+			"    Return the ID of the current connection.",
+			"INFO",
+			"    Return information about the current client connection.",
+			"LIST [TYPE (NORMAL|MASTER|REPLICA|PUBSUB)] [ID <id> [<id> ...]]",
+			"    Return information about client connections.",
+			"SETNAME <name>",
+			"    Assign the name <name> to the current connection.",
+			"TRACKING (ON|OFF) [REDIRECT <id>] [BCAST] [PREFIX <prefix> [...]] [NOLOOP]",
+			"    Control server assisted client side caching.",
+			"HELP",
+			"    Print this help.",
+		})
+	}
+	return []byte("-ERR unknown subcommand '" + sanitizeErrorArgument(args[0]) + "'. Try CLIENT HELP.\r\n")
+}
+
+// clientType returns the type of a client, as filtered by CLIENT LIST TYPE.
+func clientType(client *Client) string {
+	switch {
+	case client.Primary:
+		return "master"
+	case client.Replica:
+		return "replica"
+	case client.SubscribedMode:
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// clientList implements CLIENT LIST [TYPE type] [ID id ...]: one line per
+// client, in ID order.
+func clientList(args []string) []byte {
+	typeFilter := ""
+	var ids []int64
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "type" && i+1 < len(args):
+			typeFilter = strings.ToLower(args[i+1])
+			if typeFilter == "slave" {
+				typeFilter = "replica"
+			}
+			if !slices.Contains([]string{"normal", "master", "replica", "pubsub"}, typeFilter) {
+				return []byte("-ERR Unknown client type '" + sanitizeErrorArgument(args[i+1]) + "'\r\n")
+			}
+			i++
+		case option == "id" && i+1 < len(args):
+			for i++; i < len(args); i++ {
+				id, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil || id <= 0 {
+					return []byte("-ERR Invalid client ID\r\n")
+				}
+				ids = append(ids, id)
+			}
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	listed := slices.SortedFunc(maps.Values(clients), func(a, b *Client) int { return cmp.Compare(a.ID, b.ID) })
+	var b strings.Builder
+	for _, c := range listed {
+		if typeFilter != "" && clientType(c) != typeFilter {
+			continue
+		}
+		if ids != nil && !slices.Contains(ids, c.ID) {
+			continue
+		}
+		b.WriteString(describeClient(c) + "\n")
+	}
+	return StringToBulkString(b.String())
+}
+
+// describeClient formats the CLIENT LIST line of a client.
+func describeClient(c *Client) string {
+	flags := ""
+	if c.Primary {
+		flags += "M"
+	}
+	if c.Replica {
+		flags += "S"
+	}
+	if c.SubscribedMode {
+		flags += "P"
+	}
+	if c.Tracking != nil {
+		flags += "t"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+
+	now := time.Now()
+	fields := []string{
+		"id=" + strconv.FormatInt(c.ID, 10),
+		"addr=" + c.Connection.RemoteAddr().String(),
+		"laddr=" + c.Connection.LocalAddr().String(),
+		"name=" + c.Name,
+		"age=" + strconv.Itoa(int(now.Sub(c.CreatedAt).Seconds())),
+		"idle=" + strconv.Itoa(int(now.Sub(c.LastInteraction).Seconds())),
+		"flags=" + flags,
+		"db=" + strconv.Itoa(c.DB),
+		"sub=" + strconv.Itoa(len(c.SubscribedChannels)),
+		"psub=" + strconv.Itoa(len(c.SubscribedPatterns)),
+		"cmd=" + c.LastCommand,
+		"user=" + c.Username,
+		"resp=" + strconv.Itoa(c.Protocol),
+	}
+	return strings.Join(fields, " ")
+}
+
+// helloCommand implements HELLO [protover [AUTH username password] [SETNAME name]]:
+// it switches the connection to the requested RESP version, optionally
+// authenticating and naming it at the same time, and replies with a map
+// describing the server.
+func helloCommand(client *Client, args []string) []byte {
+	protocol := client.Protocol
+	if len(args) > 0 {
+		version, err := strconv.Atoi(args[0])
+		if err != nil {
+			return []byte("-ERR Protocol version is not an integer or out of range\r\n")
+		}
+		if version != 2 && version != 3 {
+			return []byte("-NOPROTO unsupported protocol version\r\n")
+		}
+		protocol = version
+	}
+
+	var auth []string
+	name, setName := "", false
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "auth" && i+2 < len(args):
+			auth = args[i+1 : i+3]
+			i += 2
+		case option == "setname" && i+1 < len(args):
+			name, setName = args[i+1], true
+			if !validClientName(name) {
+				return []byte("-ERR Client names cannot contain spaces, newlines or special characters.\r\n")
+			}
+			i++
+		default:
+			return []byte("-ERR Syntax error in HELLO option '" + sanitizeErrorArgument(args[i]) + "'\r\n")
+		}
+	}
+
+	if auth != nil {
+		if !authenticate(client, auth[0], auth[1]) {
+			return []byte("-WRONGPASS invalid username-password pair or user is disabled\r\n")
+		}
+	} else if !client.Authenticated {
+		return []byte("-NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time\r\n")
+	}
+
+	client.Protocol = protocol
+	if setName {
+		client.Name = name
+	}
+
+	role := "master"
+	if isReplica {
+		role = "replica"
+	}
+	return encodeRESP(respMap{
+		"server", "redis",
+		"version", serverVersion,
+		"proto", protocol,
+		"id", int(client.ID),
+		"mode", "standalone",
+		"role", role,
+		"modules", []interface{}{},
+	}, protocol)
+}
+
+// validClientName reports whether name can name a connection: it may not
+// contain spaces, newlines or other characters outside of '!' to '~'.
+func validClientName(name string) bool {
+	for i := 0; i < len(name); i++ {
+		if name[i] < '!' || name[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
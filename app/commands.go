@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// commandInfo describes a command for the ACL rules and COMMAND: the
+// categories it belongs to, its arity, and which of its arguments are keys.
+type commandInfo struct {
+	categories []string
+	// arity is the number of arguments, the name included, or minus the
+	// minimum number when it takes a variable number of them
+	arity int
+	// Keys are the arguments from firstKey to lastKey, every step arguments;
+	// a negative lastKey counts from the end, a zero firstKey means no keys.
+	firstKey, lastKey, step int
+	// keys extracts them instead when their position depends on other arguments
+	keys func(args []string) []string
+}
+
+// command builds a commandInfo from space-separated categories, an arity and
+// a key range.
+func command(categories string, arity, firstKey, lastKey, step int) *commandInfo {
+	return &commandInfo{categories: strings.Fields(categories), arity: arity, firstKey: firstKey, lastKey: lastKey, step: step}
+}
+
+// commandWithKeys builds a commandInfo whose keys are extracted by keys.
+func commandWithKeys(categories string, arity int, keys func(args []string) []string) *commandInfo {
+	return &commandInfo{categories: strings.Fields(categories), arity: arity, keys: keys}
+}
+
+// commandTable describes every command ProcessCommand implements, and those of
+// transactions and replication handled by the connection loop. The categories
+// are the ones Redis uses, @all being implied.
+var commandTable = map[string]*commandInfo{
+	// Connection
+	"ping":    command("fast connection", -1, 0, 0, 0),
+	"echo":    command("fast connection", 2, 0, 0, 0),
+	"select":  command("fast connection", 2, 0, 0, 0),
+	"auth":    command("fast connection", -2, 0, 0, 0),
+	"hello":   command("fast connection", -1, 0, 0, 0),
+	"client":  command("slow connection", -2, 0, 0, 0),
+	"command": command("slow connection", -1, 0, 0, 0),
+
+	// Transactions
+	"multi":   command("fast transaction", 1, 0, 0, 0),
+	"exec":    command("slow transaction", 1, 0, 0, 0),
+	"discard": command("fast transaction", 1, 0, 0, 0),
+
+	// Server
+	"info":         command("slow dangerous", -1, 0, 0, 0),
+	"config":       command("admin slow dangerous", -2, 0, 0, 0),
+	"save":         command("admin slow dangerous", 1, 0, 0, 0),
+	"bgsave":       command("admin slow dangerous", -1, 0, 0, 0),
+	"bgrewriteaof": command("admin slow dangerous", 1, 0, 0, 0),
+	"lolwut":       command("read fast", -1, 0, 0, 0),
+	"lastsave":     command("fast dangerous", 1, 0, 0, 0),
+	"debug":        command("admin slow dangerous", -2, 0, 0, 0),
+	"acl":          command("admin slow dangerous", -2, 0, 0, 0),
+	"psync":        command("admin slow dangerous", -3, 0, 0, 0),
+	"replconf":     command("admin slow dangerous", -1, 0, 0, 0),
+
+	// Strings
+	"set":         command("write string slow", -3, 1, 1, 1),
+	"setnx":       command("write string fast", 3, 1, 1, 1),
+	"setex":       command("write string slow", 4, 1, 1, 1),
+	"psetex":      command("write string slow", 4, 1, 1, 1),
+	"getset":      command("write string fast", 3, 1, 1, 1),
+	"get":         command("read string fast", 2, 1, 1, 1),
+	"append":      command("write string fast", 3, 1, 1, 1),
+	"strlen":      command("read string fast", 2, 1, 1, 1),
+	"getrange":    command("read string slow", 4, 1, 1, 1),
+	"setrange":    command("write string slow", 4, 1, 1, 1),
+	"mget":        command("read string fast", -2, 1, -1, 1),
+	"mset":        command("write string slow", -3, 1, -1, 2),
+	"msetnx":      command("write string slow", -3, 1, -1, 2),
+	"incr":        command("write string fast", 2, 1, 1, 1),
+	"decr":        command("write string fast", 2, 1, 1, 1),
+	"incrby":      command("write string fast", 3, 1, 1, 1),
+	"decrby":      command("write string fast", 3, 1, 1, 1),
+	"incrbyfloat": command("write string fast", 3, 1, 1, 1),
+	"bitfield":    command("write bitmap slow", -2, 1, 1, 1),
+
+	// Generic
+	"keys":        command("keyspace read slow dangerous", 2, 0, 0, 0),
+	"exists":      command("keyspace read fast", -2, 1, -1, 1),
+	"expire":      command("keyspace write fast", -3, 1, 1, 1),
+	"pexpire":     command("keyspace write fast", -3, 1, 1, 1),
+	"expireat":    command("keyspace write fast", -3, 1, 1, 1),
+	"pexpireat":   command("keyspace write fast", -3, 1, 1, 1),
+	"persist":     command("keyspace write fast", 2, 1, 1, 1),
+	"ttl":         command("keyspace read fast", 2, 1, 1, 1),
+	"pttl":        command("keyspace read fast", 2, 1, 1, 1),
+	"expiretime":  command("keyspace read fast", 2, 1, 1, 1),
+	"pexpiretime": command("keyspace read fast", 2, 1, 1, 1),
+	"del":         command("keyspace write slow", -2, 1, -1, 1),
+	"unlink":      command("keyspace write fast", -2, 1, -1, 1),
+	"touch":       command("keyspace read fast", -2, 1, -1, 1),
+	"rename":      command("keyspace write slow", 3, 1, 2, 1),
+	"renamenx":    command("keyspace write fast", 3, 1, 2, 1),
+	"copy":        command("keyspace write slow", -3, 1, 2, 1),
+	"move":        command("keyspace write fast", 3, 1, 1, 1),
+	"type":        command("keyspace read fast", 2, 1, 1, 1),
+	"object":      command("keyspace read slow", -2, 2, 2, 1),
+	"latency":     command("admin slow dangerous", -2, 0, 0, 0),
+	"memory":      command("read slow", -2, 2, 2, 1),
+	"randomkey":   command("keyspace read slow", 1, 0, 0, 0),
+	"dbsize":      command("keyspace read fast", 1, 0, 0, 0),
+	"scan":        command("keyspace read slow", -2, 0, 0, 0),
+	"flushdb":     command("keyspace write slow dangerous", -1, 0, 0, 0),
+	"flushall":    command("keyspace write slow dangerous", -1, 0, 0, 0),
+	"swapdb":      command("keyspace write fast dangerous", 3, 0, 0, 0),
+
+	// Lists
+	"rpush":  command("write list fast", -3, 1, 1, 1),
+	"lpush":  command("write list fast", -3, 1, 1, 1),
+	"lpop":   command("write list fast", -2, 1, 1, 1),
+	"rpop":   command("write list fast", -2, 1, 1, 1),
+	"llen":   command("read list fast", 2, 1, 1, 1),
+	"lrange": command("read list slow", 4, 1, 1, 1),
+	"lrem":   command("write list slow", 4, 1, 1, 1),
+	"ltrim":  command("write list slow", 4, 1, 1, 1),
+	"lmove":  command("write list slow", 5, 1, 2, 1),
+	"blmove": command("write list slow blocking", 6, 1, 2, 1),
+	"blpop":  command("write list slow blocking", -3, 1, -2, 1),
+	"brpop":  command("write list slow blocking", -3, 1, -2, 1),
+	"lmpop":  commandWithKeys("write list slow", -4, numKeysAt(1)),
+	"blmpop": commandWithKeys("write list slow blocking", -5, numKeysAt(2)),
+
+	// Hashes
+	"hset":         command("write hash fast", -4, 1, 1, 1),
+	"hget":         command("read hash fast", 3, 1, 1, 1),
+	"hmget":        command("read hash fast", -3, 1, 1, 1),
+	"hdel":         command("write hash fast", -3, 1, 1, 1),
+	"hgetall":      command("read hash slow", 2, 1, 1, 1),
+	"hexists":      command("read hash fast", 3, 1, 1, 1),
+	"hincrby":      command("write hash fast", 4, 1, 1, 1),
+	"hlen":         command("read hash fast", 2, 1, 1, 1),
+	"hkeys":        command("read hash slow", 2, 1, 1, 1),
+	"hvals":        command("read hash slow", 2, 1, 1, 1),
+	"hscan":        command("read hash slow", -3, 1, 1, 1),
+	"hexpire":      command("write hash fast", -6, 1, 1, 1),
+	"hpexpire":     command("write hash fast", -6, 1, 1, 1),
+	"hexpireat":    command("write hash fast", -6, 1, 1, 1),
+	"hpexpireat":   command("write hash fast", -6, 1, 1, 1),
+	"hpersist":     command("write hash fast", -5, 1, 1, 1),
+	"httl":         command("read hash fast", -5, 1, 1, 1),
+	"hpttl":        command("read hash fast", -5, 1, 1, 1),
+	"hexpiretime":  command("read hash fast", -5, 1, 1, 1),
+	"hpexpiretime": command("read hash fast", -5, 1, 1, 1),
+
+	// Sets
+	"sadd":        command("write set fast", -3, 1, 1, 1),
+	"srem":        command("write set fast", -3, 1, 1, 1),
+	"smembers":    command("read set slow", 2, 1, 1, 1),
+	"scard":       command("read set fast", 2, 1, 1, 1),
+	"sismember":   command("read set fast", 3, 1, 1, 1),
+	"srandmember": command("read set slow", -2, 1, 1, 1),
+	"spop":        command("write set fast", -2, 1, 1, 1),
+	"smove":       command("write set fast", 4, 1, 2, 1),
+	"sscan":       command("read set slow", -3, 1, 1, 1),
+	"sinter":      command("read set slow", -2, 1, -1, 1),
+	"sunion":      command("read set slow", -2, 1, -1, 1),
+	"sdiff":       command("read set slow", -2, 1, -1, 1),
+	"sinterstore": command("write set slow", -3, 1, -1, 1),
+	"sunionstore": command("write set slow", -3, 1, -1, 1),
+	"sdiffstore":  command("write set slow", -3, 1, -1, 1),
+
+	// Sorted sets
+	"zadd":             command("write sortedset fast", -4, 1, 1, 1),
+	"zrem":             command("write sortedset fast", -3, 1, 1, 1),
+	"zrank":            command("read sortedset fast", -3, 1, 1, 1),
+	"zcard":            command("read sortedset fast", 2, 1, 1, 1),
+	"zscore":           command("read sortedset fast", 3, 1, 1, 1),
+	"zmscore":          command("read sortedset fast", -3, 1, 1, 1),
+	"zcount":           command("read sortedset fast", 4, 1, 1, 1),
+	"zlexcount":        command("read sortedset fast", 4, 1, 1, 1),
+	"zrange":           command("read sortedset slow", -4, 1, 1, 1),
+	"zrevrange":        command("read sortedset slow", -4, 1, 1, 1),
+	"zrangebyscore":    command("read sortedset slow", -4, 1, 1, 1),
+	"zrevrangebyscore": command("read sortedset slow", -4, 1, 1, 1),
+	"zrangebylex":      command("read sortedset slow", -4, 1, 1, 1),
+	"zrevrangebylex":   command("read sortedset slow", -4, 1, 1, 1),
+	"zrandmember":      command("read sortedset slow", -2, 1, 1, 1),
+	"zscan":            command("read sortedset slow", -3, 1, 1, 1),
+	"zrangestore":      command("write sortedset slow", -5, 1, 2, 1),
+	"zpopmin":          command("write sortedset fast", -2, 1, 1, 1),
+	"zpopmax":          command("write sortedset fast", -2, 1, 1, 1),
+	"bzpopmin":         command("write sortedset fast blocking", -3, 1, -2, 1),
+	"bzpopmax":         command("write sortedset fast blocking", -3, 1, -2, 1),
+	"zunion":           commandWithKeys("read sortedset slow", -3, numKeysAt(1)),
+	"zinter":           commandWithKeys("read sortedset slow", -3, numKeysAt(1)),
+	"zdiff":            commandWithKeys("read sortedset slow", -3, numKeysAt(1)),
+	"zunionstore":      commandWithKeys("write sortedset slow", -4, destinationAndNumKeys),
+	"zinterstore":      commandWithKeys("write sortedset slow", -4, destinationAndNumKeys),
+	"zdiffstore":       commandWithKeys("write sortedset slow", -4, destinationAndNumKeys),
+	"zmpop":            commandWithKeys("write sortedset slow", -4, numKeysAt(1)),
+	"bzmpop":           commandWithKeys("write sortedset slow blocking", -5, numKeysAt(2)),
+
+	// Geospatial indexes
+	"geoadd":    command("write geo slow", -5, 1, 1, 1),
+	"geopos":    command("read geo slow", -2, 1, 1, 1),
+	"geodist":   command("read geo slow", -4, 1, 1, 1),
+	"geosearch": command("read geo slow", -7, 1, 1, 1),
+
+	// HyperLogLogs
+	"pfadd":   command("write hyperloglog fast", -2, 1, 1, 1),
+	"pfcount": command("read hyperloglog slow", -2, 1, -1, 1),
+	"pfmerge": command("write hyperloglog slow", -2, 1, -1, 1),
+
+	// Pub/Sub
+	"subscribe":    command("pubsub slow", -2, 0, 0, 0),
+	"unsubscribe":  command("pubsub slow", -1, 0, 0, 0),
+	"psubscribe":   command("pubsub slow", -2, 0, 0, 0),
+	"punsubscribe": command("pubsub slow", -1, 0, 0, 0),
+	"publish":      command("pubsub fast", 3, 0, 0, 0),
+	"pubsub":       command("pubsub slow", -2, 0, 0, 0),
+
+	// Streams
+	"xadd":       command("write stream fast", -5, 1, 1, 1),
+	"xtrim":      command("write stream slow", -4, 1, 1, 1),
+	"xdel":       command("write stream fast", -3, 1, 1, 1),
+	"xsetid":     command("write stream fast", -3, 1, 1, 1),
+	"xlen":       command("read stream fast", 2, 1, 1, 1),
+	"xack":       command("write stream fast", -4, 1, 1, 1),
+	"xclaim":     command("write stream fast", -6, 1, 1, 1),
+	"xautoclaim": command("write stream fast", -6, 1, 1, 1),
+	"xpending":   command("read stream slow", -3, 1, 1, 1),
+	"xgroup":     command("write stream slow", -2, 2, 2, 1),
+	"xinfo":      command("read stream slow", -2, 2, 2, 1),
+	"xread":      commandWithKeys("read stream slow blocking", -4, streamsKeys),
+	"xreadgroup": commandWithKeys("write stream slow blocking", -7, streamsKeys),
+}
+
+// validateCommand checks that name is a known command and that args, its
+// arguments with the name first, match its arity. Returns the error reply if not.
+func validateCommand(name string, args []string) []byte {
+	info := commandTable[name]
+	if info == nil {
+		return unknownCommandError(args)
+	}
+	if (info.arity > 0 && len(args) != info.arity) || len(args) < -info.arity {
+		return []byte("-ERR wrong number of arguments for '" + name + "' command\r\n")
+	}
+	return nil
+}
+
+// unknownCommandError is the reply to a command that does not exist, quoting
+// the beginning of its arguments as Redis does.
+func unknownCommandError(args []string) []byte {
+	var b strings.Builder
+	b.WriteString("-ERR unknown command '" + sanitizeErrorArgument(args[0]) + "', with args beginning with: ")
+	for _, arg := range args[1:] {
+		if b.Len() > 128 {
+			break
+		}
+		b.WriteString("'" + sanitizeErrorArgument(arg) + "' ")
+	}
+	b.WriteString("\r\n")
+	return []byte(b.String())
+}
+
+// sanitizeErrorArgument shortens an argument quoted in an error reply and
+// blanks the line breaks that would end it early.
+func sanitizeErrorArgument(arg string) string {
+	if len(arg) > 128 {
+		arg = arg[:128]
+	}
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(arg)
+}
+
+// sanitizeErrorReply blanks the line breaks inside an error reply, which the
+// client would read as the end of the error followed by another reply. It backs
+// sanitizeErrorArgument for the errors that quote an argument without it.
+func sanitizeErrorReply(reply []byte) []byte {
+	if len(reply) < 3 || reply[0] != '-' || !bytes.ContainsAny(reply[1:len(reply)-2], "\r\n") {
+		return reply
+	}
+	body := bytes.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, reply[1:len(reply)-2])
+	return append(append([]byte{'-'}, body...), "\r\n"...)
+}
+
+// isWriteCommand reports whether the named command may modify the dataset,
+// being in the @write category.
+func isWriteCommand(name string) bool {
+	info := commandTable[name]
+	return info != nil && slices.Contains(info.categories, "write")
+}
+
+// commandKeys returns the keys among the arguments of a command, args[0]
+// being its name.
+func (info *commandInfo) commandKeys(args []string) []string {
+	if info.keys != nil {
+		return info.keys(args)
+	}
+	if info.firstKey == 0 {
+		return nil
+	}
+
+	last := info.lastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := info.firstKey; i <= last && i < len(args); i += info.step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// numKeysAt extracts the keys of commands such as LMPOP: a count of keys at
+// the given index, followed by the keys.
+func numKeysAt(index int) func(args []string) []string {
+	return func(args []string) []string {
+		if index >= len(args) {
+			return nil
+		}
+		count, err := strconv.Atoi(args[index])
+		if err != nil || count < 0 || index+1+count > len(args) {
+			return nil
+		}
+		return args[index+1 : index+1+count]
+	}
+}
+
+// destinationAndNumKeys extracts the keys of commands such as ZUNIONSTORE: the
+// destination, then a count of source keys followed by them.
+func destinationAndNumKeys(args []string) []string {
+	if len(args) < 2 {
+		return nil
+	}
+	return append([]string{args[1]}, numKeysAt(2)(args)...)
+}
+
+// streamsKeys extracts the keys of XREAD and XREADGROUP: the first half of the
+// arguments following STREAMS, the second half being their IDs.
+func streamsKeys(args []string) []string {
+	for i, arg := range args {
+		if strings.ToLower(arg) == "streams" {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// commandsInCategory returns the sorted names of the commands in an ACL
+// category, every command belonging to "all".
+func commandsInCategory(category string) []string {
+	var names []string
+	for name, info := range commandTable {
+		if category == "all" || slices.Contains(info.categories, category) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+// aclCategories returns the sorted names of the ACL categories.
+func aclCategories() []string {
+	categories := []string{}
+	for _, info := range commandTable {
+		for _, category := range info.categories {
+			if !slices.Contains(categories, category) {
+				categories = append(categories, category)
+			}
+		}
+	}
+	slices.Sort(categories)
+	return categories
+}
+
+// commandFlags returns the flags COMMAND reports for a command, derived as in
+// Redis from its categories, whether it may use more memory and how its keys
+// are found.
+func commandFlags(name string, info *commandInfo) []string {
+	flags := []string{}
+	for _, category := range info.categories {
+		switch category {
+		case "write", "admin", "pubsub", "blocking", "fast":
+			flags = append(flags, category)
+		case "read":
+			flags = append(flags, "readonly")
+		}
+	}
+	if denyOOMCommands[name] {
+		flags = append(flags, "denyoom")
+	}
+	if name == "auth" || name == "hello" {
+		flags = append(flags, "no_auth")
+	}
+	if info.keys != nil {
+		flags = append(flags, "movablekeys")
+	}
+	return flags
+}
+
+// commandGroup returns the group COMMAND DOCS reports for a command: the data
+// type it works on, or the connection, transactions or the server.
+func commandGroup(info *commandInfo) string {
+	for _, category := range info.categories {
+		switch category {
+		case "string", "list", "hash", "set", "geo", "hyperloglog", "pubsub", "stream", "connection", "transaction":
+			return category
+		case "sortedset":
+			return "sorted-set"
+		case "keyspace":
+			return "generic"
+		case "bitmap":
+			return "bitmap"
+		}
+	}
+	return "server"
+}
+
+// commandInfoReply describes a command as COMMAND INFO does: its name, arity,
+// flags, first and last key and step, ACL categories, then tips, key specs and
+// subcommands, which are left empty.
+func commandInfoReply(name string, info *commandInfo) []interface{} {
+	categories := make([]string, len(info.categories))
+	for i, category := range info.categories {
+		categories[i] = "@" + category
+	}
+	return []interface{}{
+		name, info.arity, respSet(commandFlags(name, info)),
+		info.firstKey, info.lastKey, info.step, respSet(categories),
+		[]interface{}{}, []interface{}{}, []interface{}{},
+	}
+}
+
+// commandCommand implements COMMAND [COUNT | INFO [name ...] | DOCS [name ...] | HELP].
+func commandCommand(args []string, protocol int) []byte {
+	if len(args) == 1 {
+		return commandCommand([]string{"command", "info"}, protocol)
+	}
+
+	// names returns the commands named by the arguments, all of them if none
+	names := func() []string {
+		if len(args) > 2 {
+			return args[2:]
+		}
+		return slices.Sorted(maps.Keys(commandTable))
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "count":
+		if len(args) == 2 {
+			return []byte(":" + strconv.Itoa(len(commandTable)) + "\r\n")
+		}
+
+	case "info":
+		reply := []interface{}{}
+		for _, name := range names() {
+			name = strings.ToLower(name)
+			if info := commandTable[name]; info != nil {
+				reply = append(reply, commandInfoReply(name, info))
+			} else {
+				reply = append(reply, nil)
+			}
+		}
+		return encodeRESP(reply, protocol)
+
+	case "docs":
+		reply := respMap{}
+		for _, name := range names() {
+			name = strings.ToLower(name)
+			if info := commandTable[name]; info != nil {
+				reply = append(reply, name, respMap{"group", commandGroup(info)})
+			}
+		}
+		return encodeRESP(reply, protocol)
+
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"COMMAND <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"(no subcommand)",
+			"    Return details about all commands.",
+			"COUNT",
+			"    Return the total number of commands in this server.",
+			"INFO [<command-name> ...]",
+			"    Return details about multiple commands.",
+			"    If no command names are given, documentation details for all",
+			"    commands are returned.",
+			"DOCS [<command-name> ...]",
+			"    Return documentation details about multiple commands.",
+			"    If no command names are given, documentation details for all",
+			"    commands are returned.",
+			"HELP",
+			"    Print this help.",
+		})
+	}
+	return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(args[1]) + "'. Try COMMAND HELP.\r\n")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandStats holds the statistics of a command reported by INFO
+// commandstats and latencystats.
+type commandStats struct {
+	calls         int64 // Calls run, failed ones included
+	usec          int64 // Cumulative time spent running them
+	rejectedCalls int64 // Calls refused before running: authentication, ACL, OOM...
+	failedCalls   int64 // Calls that ran and replied with an error
+	latency       latencyHistogram
+}
+
+// commandStatsTable maps the names of the commands called since the start, or
+// the last CONFIG RESETSTAT, to their statistics. Guarded by keyspaceMutex.
+var commandStatsTable = make(map[string]*commandStats)
+
+// latencyTracking enables the latency histograms of latencystats, set with
+// latency-tracking, and latencyTrackingPercentiles lists the percentiles it
+// reports, set with latency-tracking-info-percentiles.
+var latencyTracking = true
+var latencyTrackingPercentiles = []float64{50, 99, 99.9}
+
+// lookupCommandStats returns the statistics of a known command, creating them
+// on its first call, or nil for unknown commands.
+func lookupCommandStats(name string) *commandStats {
+	stats := commandStatsTable[name]
+	if stats == nil && commandTable[name] != nil {
+		stats = &commandStats{}
+		commandStatsTable[name] = stats
+	}
+	return stats
+}
+
+// recordCommandCall accounts for a call of the named command that started at
+// start and replied with reply. A blocking command is timed until it blocks.
+// Must be called with keyspaceMutex held.
+func recordCommandCall(name string, start time.Time, reply []byte) {
+	stats := lookupCommandStats(name)
+	if stats == nil {
+		return
+	}
+	elapsed := time.Since(start)
+	stats.calls++
+	stats.usec += elapsed.Microseconds()
+	if len(reply) > 0 && reply[0] == '-' {
+		stats.failedCalls++
+	}
+	if latencyTracking {
+		stats.latency.record(elapsed)
+	}
+	if slices.Contains(commandTable[name].categories, "fast") {
+		latencyAddSampleIfNeeded("fast-command", elapsed)
+	} else {
+		latencyAddSampleIfNeeded("command", elapsed)
+	}
+}
+
+// recordRejectedCall accounts for a call of the named command refused before
+// running. Must be called with keyspaceMutex held.
+func recordRejectedCall(name string) {
+	if stats := lookupCommandStats(name); stats != nil {
+		stats.rejectedCalls++
+	}
+}
+
+// latencyHistogram counts durations in logarithmic buckets: 16 per power of
+// two of nanoseconds, so that the percentiles it reports are within about 6%
+// of the exact ones, whatever the magnitude.
+type latencyHistogram struct {
+	counts [64 * 16]int64
+	total  int64
+}
+
+// latencyBucket returns the bucket of a duration of ns nanoseconds.
+func latencyBucket(ns uint64) int {
+	if ns < 16 {
+		return int(ns)
+	}
+	shift := bits.Len64(ns) - 5
+	return (shift+1)*16 + int(ns>>shift) - 16
+}
+
+// latencyBucketMax returns the longest duration, in nanoseconds, counted in
+// the given bucket.
+func latencyBucketMax(bucket int) uint64 {
+	if bucket < 16 {
+		return uint64(bucket)
+	}
+	shift := bucket/16 - 1
+	return (uint64(bucket%16+16)+1)<<shift - 1
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	h.counts[latencyBucket(uint64(max(d, 0)))]++
+	h.total++
+}
+
+// percentile returns the duration, in microseconds, below which fall p% of
+// the recorded ones.
+func (h *latencyHistogram) percentile(p float64) float64 {
+	target := int64(float64(h.total) * p / 100)
+	target = max(target, 1)
+	seen := int64(0)
+	for bucket, count := range h.counts {
+		seen += count
+		if seen >= target {
+			return float64(latencyBucketMax(bucket)) / 1000
+		}
+	}
+	return 0
+}
+
+// writeCommandStats appends the fields of INFO commandstats, or of INFO
+// latencystats when latency is set, by command name.
+func writeCommandStats(b *strings.Builder, latency bool) {
+	for _, name := range slices.Sorted(maps.Keys(commandStatsTable)) {
+		stats := commandStatsTable[name]
+		if !latency {
+			perCall := 0.0
+			if stats.calls > 0 {
+				perCall = float64(stats.usec) / float64(stats.calls)
+			}
+			fmt.Fprintf(b, "cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d\r\n",
+				name, stats.calls, stats.usec, perCall, stats.rejectedCalls, stats.failedCalls)
+			continue
+		}
+		if stats.latency.total == 0 {
+			continue
+		}
+		percentiles := make([]string, len(latencyTrackingPercentiles))
+		for i, p := range latencyTrackingPercentiles {
+			percentiles[i] = fmt.Sprintf("p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), stats.latency.percentile(p))
+		}
+		fmt.Fprintf(b, "latency_percentiles_usec_%s:%s\r\n", name, strings.Join(percentiles, ","))
+	}
+}
+
+// parsePercentiles parses the value of latency-tracking-info-percentiles.
+func parsePercentiles(args []string) ([]float64, error) {
+	percentiles := []float64{}
+	for _, arg := range strings.Fields(strings.Join(args, " ")) {
+		p, err := strconv.ParseFloat(arg, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, errors.New("percentiles must be between 0 and 100")
+		}
+		percentiles = append(percentiles, p)
+	}
+	return percentiles, nil
+}
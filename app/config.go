@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Memory limit settings: past maxmemory, keys are evicted following
+// maxmemory-policy before running commands, see performEvictions.
+var maxmemory int64 = 0 // 0 means no limit
+var maxmemoryPolicy = "noeviction"
+
+var maxmemoryPolicies = map[string]bool{
+	"noeviction":      true,
+	"allkeys-lru":     true,
+	"allkeys-lfu":     true,
+	"allkeys-random":  true,
+	"volatile-lru":    true,
+	"volatile-lfu":    true,
+	"volatile-random": true,
+	"volatile-ttl":    true,
+}
+
+// configDirective is one setting, from a line of the configuration file or
+// from a command-line flag, with the line it comes from for error messages.
+type configDirective struct {
+	name string
+	args []string
+	line int // 0 for command-line flags
+}
+
+// loadConfig applies the configuration file given with --config, if any, then
+// the other command-line flags, so that the flags override the file.
+func loadConfig(args []string) error {
+	flags, err := parseCommandLineFlags(args)
+	if err != nil {
+		return err
+	}
+
+	for _, flag := range flags {
+		if flag.name != "config" {
+			continue
+		}
+		if len(flag.args) != 1 {
+			return errors.New("--config takes the path of the configuration file")
+		}
+		directives, err := parseConfigFile(flag.args[0])
+		if err != nil {
+			return err
+		}
+		if err := applyConfigDirectives(directives); err != nil {
+			return fmt.Errorf("%s: %w", flag.args[0], err)
+		}
+	}
+	return applyConfigDirectives(flags)
+}
+
+// parseCommandLineFlags groups the command-line arguments by flag: every
+// "--name" is followed by its values up to the next flag.
+func parseCommandLineFlags(args []string) ([]configDirective, error) {
+	var flags []configDirective
+	for _, arg := range args {
+		if name, ok := strings.CutPrefix(arg, "--"); ok {
+			flags = append(flags, configDirective{name: strings.ToLower(name)})
+			continue
+		}
+		if len(flags) == 0 {
+			return nil, fmt.Errorf("unexpected argument '%s', options are given as --name value", arg)
+		}
+		flags[len(flags)-1].args = append(flags[len(flags)-1].args, arg)
+	}
+	return flags, nil
+}
+
+// parseConfigFile reads a redis.conf-style file: one directive per line, its
+// name followed by its arguments, blank lines and lines starting with '#'
+// being ignored.
+func parseConfigFile(path string) ([]configDirective, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var directives []configDirective
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields, ok := splitArguments(line)
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: unbalanced quotes in configuration line", path, lineNumber)
+		}
+		directives = append(directives, configDirective{strings.ToLower(fields[0]), fields[1:], lineNumber})
+	}
+	return directives, scanner.Err()
+}
+
+// splitArguments splits a configuration line or an inline command into its
+// arguments the way Redis does: separated by spaces, in double quotes with backslash escapes such as
+// "\n" or "\x41", or in single quotes where only "\'" is an escape.
+func splitArguments(line string) ([]string, bool) {
+	var fields []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i == len(line) {
+			return fields, true
+		}
+
+		var field strings.Builder
+		switch line[i] {
+		case '"':
+			i++
+			for {
+				if i == len(line) {
+					return nil, false
+				}
+				if line[i] == '"' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) {
+					if line[i+1] == 'x' && i+3 < len(line) {
+						if b, err := strconv.ParseUint(line[i+2:i+4], 16, 8); err == nil {
+							field.WriteByte(byte(b))
+							i += 4
+							continue
+						}
+					}
+					switch c := line[i+1]; c {
+					case 'n':
+						field.WriteByte('\n')
+					case 'r':
+						field.WriteByte('\r')
+					case 't':
+						field.WriteByte('\t')
+					case 'b':
+						field.WriteByte('\b')
+					case 'a':
+						field.WriteByte('\a')
+					default:
+						field.WriteByte(c)
+					}
+					i += 2
+					continue
+				}
+				field.WriteByte(line[i])
+				i++
+			}
+		case '\'':
+			i++
+			for {
+				if i == len(line) {
+					return nil, false
+				}
+				if line[i] == '\'' {
+					i++
+					break
+				}
+				if line[i] == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					field.WriteByte('\'')
+					i += 2
+					continue
+				}
+				field.WriteByte(line[i])
+				i++
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				field.WriteByte(line[i])
+				i++
+			}
+			fields = append(fields, field.String())
+			continue
+		}
+
+		// A closing quote must end the argument
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' {
+			return nil, false
+		}
+		fields = append(fields, field.String())
+	}
+}
+
+// applyConfigDirectives applies the directives in order. The save directives
+// of one source add up, replacing the save points configured before it.
+func applyConfigDirectives(directives []configDirective) error {
+	saveSeen := false
+	for _, directive := range directives {
+		if directive.name == "save" && !saveSeen {
+			savePoints = []savePoint{}
+			saveSeen = true
+		}
+
+		err := applyConfigDirective(directive.name, directive.args)
+		if errors.Is(err, errUnknownConfigDirective) {
+			serverLog(logWarning, "Ignoring unsupported configuration directive: %s", describeConfigDirective(directive))
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", describeConfigDirective(directive), err)
+		}
+	}
+	return nil
+}
+
+// describeConfigDirective names a directive for messages, with its line when
+// it comes from the configuration file.
+func describeConfigDirective(directive configDirective) string {
+	if directive.line == 0 {
+		return "--" + directive.name
+	}
+	return fmt.Sprintf("line %d '%s'", directive.line, directive.name)
+}
+
+var errUnknownConfigDirective = errors.New("unknown configuration directive")
+
+// configParameter is an entry of the configuration registry: how CONFIG GET
+// reads the parameter, and how the configuration file and the command line
+// set it.
+type configParameter struct {
+	name  string
+	arity int // Number of arguments taken by set, -1 for any
+	get   func() string
+	set   func(args []string) error
+}
+
+// requirepass is the value of the requirepass parameter, kept for CONFIG GET as
+// the default user only stores password hashes.
+var requirepass = ""
+
+// configParameters is the configuration registry, in the order CONFIG GET
+// reports the parameters. The encoding thresholds are added by init.
+var configParameters = []configParameter{
+	{name: "port", arity: 1, get: func() string { return port }, set: func(args []string) error {
+		if n, err := strconv.Atoi(args[0]); err != nil || n < 0 || n > 65535 {
+			return errors.New("invalid port")
+		}
+		port = args[0]
+		return nil
+	}},
+	{name: "replicaof", arity: -1, get: func() string {
+		if !isReplica {
+			return ""
+		}
+		return replicaHost + " " + replicaPort
+	}, set: func(args []string) error {
+		// The command line takes "host port" as a single argument
+		if len(args) == 1 {
+			args = strings.Fields(args[0])
+		}
+		if len(args) != 2 {
+			return errors.New("replicaof takes a host and a port")
+		}
+		isReplica = true
+		replicaHost, replicaPort = args[0], args[1]
+		return nil
+	}},
+	boolConfig("replica-read-only", &replicaReadOnly),
+	stringConfig("dir", &dir),
+	stringConfig("dbfilename", &dbfilename),
+	intConfig("databases", &databaseCount, 1),
+	intConfig("timeout", &idleTimeout, 0),
+	intConfig("tcp-backlog", &tcpBacklog, 1),
+	intConfig("tcp-keepalive", &tcpKeepalive, 0),
+	boolConfig("tcp-nodelay", &tcpNoDelay),
+	memoryConfig("proto-max-bulk-len", &protoMaxBulkLen, 1<<20),
+	intConfig("proto-max-multibulk-len", &protoMaxMultibulkLen, 1),
+	intConfig("io-threads", &ioThreads, 1),
+	{name: "client-output-buffer-limit", arity: -1, get: formatOutputBufferLimits, set: setOutputBufferLimits},
+	{name: "save", arity: -1, get: formatSavePoints, set: func(args []string) error {
+		// Each directive adds its save points, "" clearing them all
+		points, ok := parseSavePoints(strings.Join(args, " "))
+		if !ok {
+			return errors.New("invalid save parameters")
+		}
+		if len(points) == 0 {
+			savePoints = []savePoint{}
+		}
+		savePoints = append(savePoints, points...)
+		return nil
+	}},
+	{name: "requirepass", arity: 1, get: func() string { return requirepass }, set: func(args []string) error {
+		// Shorthand for the password of the default user, "" removing it
+		user := users["default"]
+		requirepass = args[0]
+		if requirepass == "" {
+			user.Passwords = []string{}
+			user.Flags["nopass"] = true
+			return nil
+		}
+		hash := sha256.Sum256([]byte(requirepass))
+		user.Passwords = []string{hex.EncodeToString(hash[:])}
+		delete(user.Flags, "nopass")
+		return nil
+	}},
+	boolConfig("appendonly", &appendOnly),
+	stringConfig("appendfilename", &appendFilename),
+	enumConfig("appendfsync", &appendFsync, appendFsyncPolicies),
+	boolConfig("aof-use-rdb-preamble", &aofUseRDBPreamble),
+	memoryConfig("maxmemory", &maxmemory, 0),
+	enumConfig("maxmemory-policy", &maxmemoryPolicy, maxmemoryPolicies),
+	intConfig("maxmemory-samples", &maxmemorySamples, 1),
+	intConfig("lfu-log-factor", &lfuLogFactor, 0),
+	intConfig("lfu-decay-time", &lfuDecayTime, 0),
+	boolConfig("lazyfree-lazy-eviction", &lazyfreeLazyEviction),
+	boolConfig("lazyfree-lazy-expire", &lazyfreeLazyExpire),
+	boolConfig("lazyfree-lazy-server-del", &lazyfreeLazyServerDel),
+	boolConfig("lazyfree-lazy-user-del", &lazyfreeLazyUserDel),
+	boolConfig("lazyfree-lazy-user-flush", &lazyfreeLazyUserFlush),
+	boolConfig("daemonize", &daemonizeServer),
+	stringConfig("pidfile", &pidfile),
+	{name: "loglevel", arity: 1, get: func() string { return loglevel }, set: func(args []string) error {
+		level := strings.ToLower(args[0])
+		if _, ok := logLevelNames[level]; !ok {
+			return errors.New("argument must be one of debug, verbose, notice, warning")
+		}
+		loglevel = level
+		return nil
+	}},
+	stringConfig("logfile", &logfile),
+	intConfig("metrics-port", &metricsPort, 0),
+	stringConfig("debug-http", &debugHTTPAddr),
+	intConfig("latency-monitor-threshold", &latencyMonitorThreshold, 0),
+	boolConfig("latency-tracking", &latencyTracking),
+	{name: "latency-tracking-info-percentiles", arity: -1, get: func() string {
+		percentiles := make([]string, len(latencyTrackingPercentiles))
+		for i, p := range latencyTrackingPercentiles {
+			percentiles[i] = strconv.FormatFloat(p, 'f', -1, 64)
+		}
+		return strings.Join(percentiles, " ")
+	}, set: func(args []string) error {
+		percentiles, err := parsePercentiles(args)
+		if err != nil {
+			return err
+		}
+		latencyTrackingPercentiles = percentiles
+		return nil
+	}},
+}
+
+// configAliases maps the legacy names still accepted for some parameters.
+var configAliases = map[string]string{
+	"slaveof":         "replicaof",
+	"slave-read-only": "replica-read-only",
+}
+
+func init() {
+	names := make([]string, 0, len(encodingConfig))
+	for name := range encodingConfig {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		configParameters = append(configParameters, intConfig(name, encodingConfig[name], 0))
+	}
+}
+
+// stringConfig registers a parameter taking any string.
+func stringConfig(name string, value *string) configParameter {
+	return configParameter{name: name, arity: 1,
+		get: func() string { return *value },
+		set: func(args []string) error {
+			*value = args[0]
+			return nil
+		},
+	}
+}
+
+// boolConfig registers a yes/no parameter.
+func boolConfig(name string, value *bool) configParameter {
+	return configParameter{name: name, arity: 1,
+		get: func() string {
+			if *value {
+				return "yes"
+			}
+			return "no"
+		},
+		set: func(args []string) error {
+			parsed, err := parseYesNo(args[0])
+			if err != nil {
+				return err
+			}
+			*value = parsed
+			return nil
+		},
+	}
+}
+
+// intConfig registers an integer parameter of at least min.
+func intConfig(name string, value *int, min int) configParameter {
+	return configParameter{name: name, arity: 1,
+		get: func() string { return strconv.Itoa(*value) },
+		set: func(args []string) error {
+			parsed, err := strconv.Atoi(args[0])
+			if err != nil || parsed < min {
+				return errors.New("invalid value")
+			}
+			*value = parsed
+			return nil
+		},
+	}
+}
+
+// memoryConfig registers an amount of memory of at least min bytes, given with
+// an optional unit and reported in bytes.
+func memoryConfig(name string, value *int64, min int64) configParameter {
+	return configParameter{name: name, arity: 1,
+		get: func() string { return strconv.FormatInt(*value, 10) },
+		set: func(args []string) error {
+			parsed, ok := parseMemory(args[0])
+			if !ok || parsed < min {
+				return errors.New("invalid memory amount")
+			}
+			*value = parsed
+			return nil
+		},
+	}
+}
+
+// enumConfig registers a parameter taking one of the given values, in any case.
+func enumConfig(name string, value *string, values map[string]bool) configParameter {
+	return configParameter{name: name, arity: 1,
+		get: func() string { return *value },
+		set: func(args []string) error {
+			parsed := strings.ToLower(args[0])
+			if !values[parsed] {
+				return errors.New("argument must be one of " + strings.Join(slices.Sorted(maps.Keys(values)), ", "))
+			}
+			*value = parsed
+			return nil
+		},
+	}
+}
+
+// lookupConfigParameter returns the registry entry of the parameter name,
+// which may be an alias, or nil if there is none.
+func lookupConfigParameter(name string) *configParameter {
+	if canonical, ok := configAliases[name]; ok {
+		name = canonical
+	}
+	for i := range configParameters {
+		if configParameters[i].name == name {
+			return &configParameters[i]
+		}
+	}
+	return nil
+}
+
+// applyConfigDirective sets the configuration parameter name to the value given
+// by args.
+func applyConfigDirective(name string, args []string) error {
+	switch name {
+	case "config":
+		// Handled by loadConfig
+		return nil
+	case "rename-command":
+		return renameCommand(args)
+	}
+
+	param := lookupConfigParameter(name)
+	if param == nil {
+		return errUnknownConfigDirective
+	}
+	if param.arity >= 0 && len(args) != param.arity {
+		return errors.New("wrong number of arguments")
+	}
+	return param.set(args)
+}
+
+// renamedCommands maps the names given with rename-command to the commands they
+// stand for. disabledCommands holds the names no longer answering, those of
+// the commands renamed or disabled and the names they were renamed to before
+// being renamed again.
+var renamedCommands = map[string]string{}
+var disabledCommands = map[string]bool{}
+
+// renameCommand applies "rename-command name new-name": the command then only
+// answers to new-name, or to nothing at all when new-name is "". As in Redis,
+// name must be a command's current name, and new-name may not be taken by
+// another command.
+func renameCommand(args []string) error {
+	if len(args) != 2 {
+		return errors.New("wrong number of arguments")
+	}
+	name, newName := strings.ToLower(args[0]), strings.ToLower(args[1])
+	command := resolveCommandName(name)
+	if commandTable[command] == nil {
+		return errors.New("no such command in rename-command")
+	}
+
+	// The command leaves its current name first, so that it can be given it back
+	delete(renamedCommands, name)
+	disabledCommands[name] = true
+	if newName == "" {
+		return nil
+	}
+	if commandTable[resolveCommandName(newName)] != nil {
+		return errors.New("target command name already exists")
+	}
+	renamedCommands[newName] = command
+	return nil
+}
+
+// resolveCommandName returns the command a client runs by sending name, after
+// rename-command, or "" if it was disabled.
+func resolveCommandName(name string) string {
+	if command, ok := renamedCommands[name]; ok {
+		return command
+	}
+	if disabledCommands[name] {
+		return ""
+	}
+	return name
+}
+
+// configGet implements CONFIG GET pattern [pattern ...]: the names and values
+// of the parameters matching any of the glob-style patterns.
+func configGet(patterns []string, protocol int) []byte {
+	reply := respMap{}
+	for _, param := range configParameters {
+		for _, pattern := range patterns {
+			if globMatch(strings.ToLower(pattern), param.name) {
+				reply = append(reply, param.name, param.get())
+				break
+			}
+		}
+	}
+	return encodeRESP(reply, protocol)
+}
+
+// parseYesNo parses the value of a boolean parameter.
+func parseYesNo(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+// parseMemory parses an amount of memory in bytes with an optional unit, as in
+// redis.conf: k, m and g are powers of 1000, kb, mb and gb powers of 1024.
+func parseMemory(value string) (int64, bool) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+
+	value = strings.ToLower(value)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if number, ok := strings.CutSuffix(value, unit.suffix); ok {
+			value, multiplier = number, unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/multiplier {
+		return 0, false
+	}
+	return n * multiplier, true
+}
@@ -0,0 +1,737 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamGroup is a consumer group of a stream: a cursor into the stream shared
+// by its consumers, and the entries delivered to them but not yet acknowledged.
+type streamGroup struct {
+	lastID      streamID                   // Last entry delivered to the group
+	entriesRead int64                      // Number of entries up to lastID, -1 if unknown
+	pending     map[streamID]*pendingEntry // Pending entries list (PEL) of the group
+	consumers   map[string]*streamConsumer
+}
+
+// pendingEntry is an entry delivered to a consumer of a group and awaiting XACK.
+type pendingEntry struct {
+	consumer      string
+	deliveryTime  time.Time
+	deliveryCount int
+}
+
+// streamConsumer is a consumer of a group, created the first time it is named.
+type streamConsumer struct {
+	seenTime   time.Time // Last time the consumer attempted an interaction
+	activeTime time.Time // Last time the consumer was delivered entries, zero if never
+}
+
+// newStreamGroup returns a group whose consumers will be delivered the entries
+// after lastID, entriesRead being the logical position of lastID in the stream.
+func newStreamGroup(lastID streamID, entriesRead int64) *streamGroup {
+	return &streamGroup{
+		lastID:      lastID,
+		entriesRead: entriesRead,
+		pending:     make(map[streamID]*pendingEntry),
+		consumers:   make(map[string]*streamConsumer),
+	}
+}
+
+// group returns the consumer group with the given name, or nil if there is none.
+// A nil stream has no groups.
+func (s *redisStream) group(name string) *streamGroup {
+	if s == nil {
+		return nil
+	}
+	return s.groups[name]
+}
+
+// clone returns an independent copy of the group.
+func (g *streamGroup) clone() *streamGroup {
+	duplicate := &streamGroup{
+		lastID:      g.lastID,
+		entriesRead: g.entriesRead,
+		pending:     make(map[streamID]*pendingEntry, len(g.pending)),
+		consumers:   make(map[string]*streamConsumer, len(g.consumers)),
+	}
+	for id, nack := range g.pending {
+		copied := *nack
+		duplicate.pending[id] = &copied
+	}
+	for name, consumer := range g.consumers {
+		copied := *consumer
+		duplicate.consumers[name] = &copied
+	}
+	return duplicate
+}
+
+// consumer returns the consumer with the given name, creating it if needed.
+// created reports whether it did not exist yet.
+func (g *streamGroup) consumer(name string) (consumer *streamConsumer, created bool) {
+	if consumer, ok := g.consumers[name]; ok {
+		return consumer, false
+	}
+	consumer = &streamConsumer{seenTime: time.Now()}
+	g.consumers[name] = consumer
+	return consumer, true
+}
+
+// pendingIDs returns the IDs of the pending entries owned by consumer (or by
+// any consumer if it is empty) that are greater than after, in ascending order,
+// at most count of them if count is non-zero.
+func (g *streamGroup) pendingIDs(consumer string, after streamID, count int) []streamID {
+	ids := []streamID{}
+	for id, nack := range g.pending {
+		if after.less(id) && (consumer == "" || nack.consumer == consumer) {
+			ids = append(ids, id)
+		}
+	}
+	slices.SortFunc(ids, streamID.compare)
+	if count > 0 && len(ids) > count {
+		ids = ids[:count]
+	}
+	return ids
+}
+
+// advance moves the group's last delivered ID to id, keeping entriesRead
+// exact while no entry after the previous position was deleted.
+func (g *streamGroup) advance(stream *redisStream, id streamID) {
+	if g.entriesRead >= 0 && !stream.hasTombstonesAfter(g.lastID) {
+		g.entriesRead++
+	} else {
+		g.entriesRead = stream.entriesReadAt(id)
+	}
+	g.lastID = id
+}
+
+// lag returns the number of entries in the stream still to be delivered to the
+// group. ok is false when deletions make that impossible to tell.
+func (g *streamGroup) lag(stream *redisStream) (lag int64, ok bool) {
+	added := int64(stream.entriesAdded)
+	if added == 0 {
+		return 0, true
+	}
+	if g.entriesRead >= 0 && !stream.hasTombstonesAfter(g.lastID) {
+		return added - g.entriesRead, true
+	}
+	if read := stream.entriesReadAt(g.lastID); read >= 0 {
+		return added - read, true
+	}
+	return 0, false
+}
+
+// noGroupError is the reply for XREADGROUP naming a missing key or group.
+func noGroupError(key, group string) []byte {
+	return []byte("-NOGROUP No such key '" + sanitizeErrorArgument(key) + "' or consumer group '" + sanitizeErrorArgument(group) + "' in XREADGROUP with GROUP option\r\n")
+}
+
+// xreadgroup reads on behalf of a consumer of a group, for every stream in
+// options.Keys. The ID ">" delivers entries never delivered to the group,
+// adding them to its pending entries list unless NOACK is given; any other ID
+// reads the consumer's own pending entries after it, which are always replied
+// with (possibly as an empty list), and an entry deleted meanwhile is replied
+// with a nil field list. Returns nil if there is nothing to reply with.
+func xreadgroup(options xreadOptions) []byte {
+	now := time.Now()
+	var result []interface{}
+	for i, key := range options.Keys {
+		stream, wrongType := lookupStream(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		group := stream.group(options.Group)
+		if group == nil {
+			return noGroupError(key, options.Group)
+		}
+		consumer, _ := group.consumer(options.Consumer)
+		consumer.seenTime = now
+
+		if options.IDs[i] == ">" {
+			entries := stream.entriesAfter(group.lastID, options.Count)
+			if len(entries) == 0 {
+				continue
+			}
+			for _, entry := range entries {
+				group.advance(stream, entry.ID)
+			}
+			consumer.activeTime = now
+			if !options.NoAck {
+				for _, entry := range entries {
+					group.pending[entry.ID] = &pendingEntry{
+						consumer:      options.Consumer,
+						deliveryTime:  now,
+						deliveryCount: 1,
+					}
+				}
+			}
+			result = append(result, []interface{}{key, encodeStreamEntries(entries)})
+			continue
+		}
+
+		after, _ := parseStreamID(options.IDs[i])
+		history := []interface{}{}
+		for _, id := range group.pendingIDs(options.Consumer, after, options.Count) {
+			nack := group.pending[id]
+			nack.deliveryTime = now
+			nack.deliveryCount++
+
+			if entry := stream.entry(id); entry != nil {
+				history = append(history, encodeStreamEntries([]streamEntry{*entry})[0])
+			} else {
+				history = append(history, []interface{}{id.String(), nil})
+			}
+		}
+		result = append(result, []interface{}{key, history})
+	}
+
+	if result == nil {
+		return nil
+	}
+	return encodeArray(result)
+}
+
+// servedXReadGroup is xreadgroup that also sends replicas the equivalent
+// non-blocking command once something was read, so their groups stay in step.
+func servedXReadGroup(options xreadOptions) []byte {
+	reply := xreadgroup(options)
+	if reply != nil && reply[0] == '*' {
+		command := []string{"XREADGROUP", "GROUP", options.Group, options.Consumer}
+		if options.Count > 0 {
+			command = append(command, "COUNT", strconv.Itoa(options.Count))
+		}
+		if options.NoAck {
+			command = append(command, "NOACK")
+		}
+		command = append(command, "STREAMS")
+		command = append(command, options.Keys...)
+		command = append(command, options.IDs...)
+		PropagateWriteCommandToReplicas(command)
+	}
+	return reply
+}
+
+// xgroupCommand implements XGROUP CREATE | DESTROY | CREATECONSUMER | HELP.
+func xgroupCommand(commandStringArray []string) []byte {
+	if len(commandStringArray) < 2 {
+		return []byte("-ERR wrong number of arguments for 'xgroup' command\r\n")
+	}
+	subcommand := strings.ToLower(commandStringArray[1])
+
+	if subcommand == "help" {
+		return StringArrayToBulkStringArray([]string{
+			"XGROUP <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CREATE <key> <groupname> <id|$> [option]",
+			"    Create a new consumer group. Options are:",
+			"    * MKSTREAM",
+			"      Create the empty stream if it does not exist.",
+			"    * ENTRIESREAD entries_read",
+			"      Set the group's entries_read counter (internal use).",
+			"CREATECONSUMER <key> <groupname> <consumer>",
+			"    Create a new consumer in the specified group.",
+			"DESTROY <key> <groupname>",
+			"    Remove the specified group.",
+		})
+	}
+
+	arity := map[string]int{"create": 5, "destroy": 4, "createconsumer": 5}
+	expected, known := arity[subcommand]
+	if !known || len(commandStringArray) < expected ||
+		(subcommand != "create" && len(commandStringArray) != expected) {
+		return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try XGROUP HELP.\r\n")
+	}
+
+	key, groupName := commandStringArray[2], commandStringArray[3]
+	stream, wrongType := lookupStream(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	switch subcommand {
+	case "create":
+		// XGROUP CREATE key group <id | $> [MKSTREAM] [ENTRIESREAD entries-read]
+		mkstream := false
+		entriesRead := int64(-1)
+		for i := 5; i < len(commandStringArray); i++ {
+			switch strings.ToLower(commandStringArray[i]) {
+			case "mkstream":
+				mkstream = true
+			case "entriesread":
+				if i+1 >= len(commandStringArray) {
+					return []byte("-ERR syntax error\r\n")
+				}
+				n, err := strconv.ParseInt(commandStringArray[i+1], 10, 64)
+				if err != nil {
+					return []byte("-ERR value is not an integer or out of range\r\n")
+				}
+				if n < -1 {
+					return []byte("-ERR value for ENTRIESREAD must be positive or -1\r\n")
+				}
+				entriesRead = n
+				i++
+			default:
+				return []byte("-ERR syntax error\r\n")
+			}
+		}
+
+		var lastID streamID
+		if arg := commandStringArray[4]; arg == "$" {
+			if stream != nil {
+				lastID = stream.lastID
+				entriesRead = int64(stream.entriesAdded)
+			} else {
+				entriesRead = 0
+			}
+		} else {
+			id, ok := parseStreamID(arg)
+			if !ok {
+				return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+			}
+			lastID = id
+		}
+
+		if stream == nil {
+			if !mkstream {
+				return []byte("-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n")
+			}
+			stream = &redisStream{}
+			setKey(key, StreamType, stream)
+		}
+		if stream.group(groupName) != nil {
+			return []byte("-BUSYGROUP Consumer Group name already exists\r\n")
+		}
+		if stream.groups == nil {
+			stream.groups = make(map[string]*streamGroup)
+		}
+		stream.groups[groupName] = newStreamGroup(lastID, entriesRead)
+		return []byte("+OK\r\n")
+
+	case "destroy":
+		if stream == nil {
+			return []byte("-ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.\r\n")
+		}
+		if stream.group(groupName) == nil {
+			return []byte(":0\r\n")
+		}
+		delete(stream.groups, groupName)
+		return []byte(":1\r\n")
+
+	default:
+		// XGROUP CREATECONSUMER key group consumer
+		group := stream.group(groupName)
+		if group == nil {
+			return []byte("-NOGROUP No such consumer group '" + sanitizeErrorArgument(groupName) + "' for key name '" + sanitizeErrorArgument(key) + "'\r\n")
+		}
+		if _, created := group.consumer(commandStringArray[4]); created {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
+	}
+}
+
+// cloneGroups returns an independent copy of a stream's consumer groups.
+func cloneGroups(groups map[string]*streamGroup) map[string]*streamGroup {
+	if groups == nil {
+		return nil
+	}
+	duplicate := maps.Clone(groups)
+	for name, group := range groups {
+		duplicate[name] = group.clone()
+	}
+	return duplicate
+}
+
+// parseStreamBound parses the start (end false) or end (end true) of an ID range:
+// "-" and "+" stand for the smallest and greatest IDs, an ID without a sequence
+// number covers the whole millisecond, and a "(" prefix excludes the ID itself.
+func parseStreamBound(arg string, end bool) (streamID, bool) {
+	switch arg {
+	case "-":
+		return streamID{}, true
+	case "+":
+		return streamID{math.MaxUint64, math.MaxUint64}, true
+	}
+
+	exclusive := strings.HasPrefix(arg, "(")
+	arg = strings.TrimPrefix(arg, "(")
+	id, ok := parseStreamID(arg)
+	if !ok {
+		return streamID{}, false
+	}
+	if end && !strings.Contains(arg, "-") {
+		id.seq = math.MaxUint64
+	}
+	if !exclusive {
+		return id, true
+	}
+
+	// Move to the neighbouring ID, failing at either end of the ID space
+	switch {
+	case !end && id.seq < math.MaxUint64:
+		id.seq++
+	case !end && id.ms < math.MaxUint64:
+		id = streamID{id.ms + 1, 0}
+	case end && id.seq > 0:
+		id.seq--
+	case end && id.ms > 0:
+		id = streamID{id.ms - 1, math.MaxUint64}
+	default:
+		return streamID{}, false
+	}
+	return id, true
+}
+
+// lookupGroup returns the stream stored at key and its group with the given name.
+// On failure the RESP error to reply with is returned.
+func lookupGroup(key, groupName string) (*redisStream, *streamGroup, []byte) {
+	stream, wrongType := lookupStream(key)
+	if wrongType {
+		return nil, nil, []byte(wrongTypeError)
+	}
+	group := stream.group(groupName)
+	if group == nil {
+		return nil, nil, []byte("-NOGROUP No such key '" + sanitizeErrorArgument(key) + "' or consumer group '" + sanitizeErrorArgument(groupName) + "'\r\n")
+	}
+	return stream, group, nil
+}
+
+// xack implements XACK key group id [id ...], removing the given IDs from the
+// group's pending entries list. Replies with the number of entries acknowledged.
+func xack(args []string) []byte {
+	if len(args) < 4 {
+		return []byte("-ERR wrong number of arguments for 'xack' command\r\n")
+	}
+	ids := make([]streamID, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		id, ok := parseStreamID(arg)
+		if !ok {
+			return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+		}
+		ids = append(ids, id)
+	}
+
+	stream, wrongType := lookupStream(args[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	group := stream.group(args[2])
+	if group == nil {
+		return []byte(":0\r\n")
+	}
+
+	acknowledged := 0
+	for _, id := range ids {
+		if _, ok := group.pending[id]; ok {
+			delete(group.pending, id)
+			acknowledged++
+		}
+	}
+	return []byte(":" + strconv.Itoa(acknowledged) + "\r\n")
+}
+
+// xpending implements XPENDING key group [[IDLE min-idle-time] start end count [consumer]].
+// Without a range it replies with a summary: the number of pending entries,
+// the smallest and greatest pending IDs and the count per consumer. With one it
+// lists [id, consumer, idle time, delivery count] for every matching entry.
+func xpending(args []string) []byte {
+	if len(args) < 3 {
+		return []byte("-ERR wrong number of arguments for 'xpending' command\r\n")
+	}
+	_, group, errReply := lookupGroup(args[1], args[2])
+
+	if len(args) == 3 {
+		if errReply != nil {
+			return errReply
+		}
+		ids := group.pendingIDs("", streamID{}, 0)
+		if len(ids) == 0 {
+			return []byte("*4\r\n:0\r\n$-1\r\n$-1\r\n*-1\r\n")
+		}
+
+		counts := make(map[string]int)
+		for _, nack := range group.pending {
+			counts[nack.consumer]++
+		}
+		consumers := []interface{}{}
+		for _, name := range slices.Sorted(maps.Keys(counts)) {
+			consumers = append(consumers, []string{name, strconv.Itoa(counts[name])})
+		}
+		return encodeArray([]interface{}{len(ids), ids[0].String(), ids[len(ids)-1].String(), consumers})
+	}
+
+	rest := args[3:]
+	minIdle := time.Duration(0)
+	if strings.ToLower(rest[0]) == "idle" {
+		if len(rest) < 2 {
+			return []byte("-ERR syntax error\r\n")
+		}
+		ms, err := strconv.ParseInt(rest[1], 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		minIdle = time.Duration(ms) * time.Millisecond
+		rest = rest[2:]
+	}
+	if len(rest) != 3 && len(rest) != 4 {
+		return []byte("-ERR syntax error\r\n")
+	}
+	start, ok1 := parseStreamBound(rest[0], false)
+	end, ok2 := parseStreamBound(rest[1], true)
+	if !ok1 || !ok2 {
+		return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+	}
+	count, err := strconv.Atoi(rest[2])
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	consumer := ""
+	if len(rest) == 4 {
+		consumer = rest[3]
+	}
+	if errReply != nil {
+		return errReply
+	}
+
+	now := time.Now()
+	result := []interface{}{}
+	for _, id := range group.pendingIDs(consumer, streamID{}, 0) {
+		if len(result) >= count {
+			break
+		}
+		nack := group.pending[id]
+		idle := now.Sub(nack.deliveryTime)
+		if id.less(start) || end.less(id) || idle < minIdle {
+			continue
+		}
+		result = append(result, []interface{}{id.String(), nack.consumer, int(idle.Milliseconds()), nack.deliveryCount})
+	}
+	return encodeArray(result)
+}
+
+// claimOptions holds the optional arguments of XCLAIM.
+type claimOptions struct {
+	DeliveryTime *time.Time // Set by IDLE or TIME, defaults to now
+	RetryCount   int        // Set by RETRYCOUNT, -1 to increment the count instead
+	Force        bool
+	JustID       bool
+	LastID       *streamID
+}
+
+// claim transfers the pending entry id of group to consumer if it has been idle
+// for at least minIdle, recording a new delivery unless options.JustID is set.
+// An entry no longer in the stream is dropped from the pending list instead.
+// Returns whether the entry was claimed and whether it was found deleted.
+func claim(stream *redisStream, group *streamGroup, consumer string, id streamID, minIdle time.Duration, options claimOptions) (claimed, deleted bool) {
+	now := time.Now()
+	nack, pending := group.pending[id]
+	exists := stream.entry(id) != nil
+	if !pending {
+		if !options.Force || !exists {
+			return false, false
+		}
+		nack = &pendingEntry{deliveryTime: now}
+		group.pending[id] = nack
+	}
+	if !exists {
+		delete(group.pending, id)
+		return false, true
+	}
+	if pending && minIdle > 0 && now.Sub(nack.deliveryTime) < minIdle {
+		return false, false
+	}
+
+	nack.consumer = consumer
+	nack.deliveryTime = now
+	if options.DeliveryTime != nil {
+		nack.deliveryTime = *options.DeliveryTime
+	}
+	switch {
+	case options.RetryCount >= 0:
+		nack.deliveryCount = options.RetryCount
+	case !options.JustID:
+		nack.deliveryCount++
+	}
+	return true, false
+}
+
+// encodeClaimed encodes claimed entries as full entries, or only their IDs with JUSTID.
+func encodeClaimed(stream *redisStream, ids []streamID, justID bool) []interface{} {
+	result := []interface{}{}
+	for _, id := range ids {
+		if justID {
+			result = append(result, id.String())
+		} else {
+			result = append(result, encodeStreamEntries([]streamEntry{*stream.entry(id)})[0])
+		}
+	}
+	return result
+}
+
+// xclaim implements
+//
+//	XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms] [TIME unix-time-milliseconds]
+//	    [RETRYCOUNT count] [FORCE] [JUSTID] [LASTID lastid]
+//
+// transferring the given pending entries to consumer. Replies with the claimed entries.
+func xclaim(args []string) []byte {
+	if len(args) < 6 {
+		return []byte("-ERR wrong number of arguments for 'xclaim' command\r\n")
+	}
+	minIdleMs, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return []byte("-ERR Invalid min-idle-time argument for XCLAIM\r\n")
+	}
+
+	// IDs come first, options follow
+	var ids []streamID
+	i := 5
+	for ; i < len(args); i++ {
+		id, ok := parseStreamID(args[i])
+		if !ok {
+			break
+		}
+		ids = append(ids, id)
+	}
+
+	options := claimOptions{RetryCount: -1}
+	for ; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		switch option {
+		case "force":
+			options.Force = true
+			continue
+		case "justid":
+			options.JustID = true
+			continue
+		case "idle", "time", "retrycount", "lastid":
+		default:
+			return []byte("-ERR Unrecognized XCLAIM option '" + sanitizeErrorArgument(args[i]) + "'\r\n")
+		}
+		if i+1 >= len(args) {
+			return []byte("-ERR syntax error\r\n")
+		}
+		i++
+
+		if option == "lastid" {
+			id, ok := parseStreamID(args[i])
+			if !ok {
+				return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+			}
+			options.LastID = &id
+			continue
+		}
+		value, err := strconv.ParseInt(args[i], 10, 64)
+		if err != nil {
+			return []byte("-ERR Invalid " + strings.ToUpper(option) + " option argument for XCLAIM\r\n")
+		}
+		switch option {
+		case "idle":
+			t := time.Now().Add(-time.Duration(value) * time.Millisecond)
+			options.DeliveryTime = &t
+		case "time":
+			t := time.UnixMilli(value)
+			options.DeliveryTime = &t
+		case "retrycount":
+			options.RetryCount = int(value)
+		}
+	}
+
+	stream, group, errReply := lookupGroup(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+	if options.LastID != nil && group.lastID.less(*options.LastID) {
+		group.lastID = *options.LastID
+	}
+
+	consumer, _ := group.consumer(args[3])
+	consumer.seenTime = time.Now()
+
+	var claimedIDs []streamID
+	for _, id := range ids {
+		if claimed, _ := claim(stream, group, args[3], id, time.Duration(minIdleMs)*time.Millisecond, options); claimed {
+			claimedIDs = append(claimedIDs, id)
+		}
+	}
+	if len(claimedIDs) > 0 {
+		consumer.activeTime = time.Now()
+	}
+	return encodeArray(encodeClaimed(stream, claimedIDs, options.JustID))
+}
+
+// xautoclaim implements XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID],
+// claiming up to count entries idle for long enough, scanning the pending entries
+// list from start. Replies with the cursor to continue from ("0-0" once the scan
+// is complete), the claimed entries and the IDs found deleted from the stream.
+func xautoclaim(args []string) []byte {
+	if len(args) < 6 {
+		return []byte("-ERR wrong number of arguments for 'xautoclaim' command\r\n")
+	}
+	minIdleMs, err := strconv.ParseInt(args[4], 10, 64)
+	if err != nil {
+		return []byte("-ERR Invalid min-idle-time argument for XAUTOCLAIM\r\n")
+	}
+	start, ok := parseStreamBound(args[5], false)
+	if !ok {
+		return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+	}
+
+	count := 100
+	options := claimOptions{RetryCount: -1}
+	for i := 6; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "count":
+			if i+1 >= len(args) {
+				return []byte("-ERR syntax error\r\n")
+			}
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count < 1 {
+				return []byte("-ERR COUNT must be > 0\r\n")
+			}
+			i++
+		case "justid":
+			options.JustID = true
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	stream, group, errReply := lookupGroup(args[1], args[2])
+	if errReply != nil {
+		return errReply
+	}
+	consumer, _ := group.consumer(args[3])
+	consumer.seenTime = time.Now()
+
+	// Like Redis, look at no more than ten times count entries per call
+	candidates := group.pendingIDs("", streamID{}, 0)
+	first, _ := slices.BinarySearchFunc(candidates, start, streamID.compare)
+	candidates = candidates[first:]
+
+	var claimedIDs []streamID
+	deletedIDs := []string{}
+	attempts := count * 10
+	next := streamID{}
+	for i, id := range candidates {
+		if len(claimedIDs) >= count || attempts == 0 {
+			next = candidates[i]
+			break
+		}
+		attempts--
+		claimed, deleted := claim(stream, group, args[3], id, time.Duration(minIdleMs)*time.Millisecond, options)
+		if claimed {
+			claimedIDs = append(claimedIDs, id)
+		} else if deleted {
+			deletedIDs = append(deletedIDs, id.String())
+		}
+	}
+	if len(claimedIDs) > 0 {
+		consumer.activeTime = time.Now()
+	}
+
+	return encodeArray([]interface{}{next.String(), encodeClaimed(stream, claimedIDs, options.JustID), deletedIDs})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"os"
+	"strconv"
+)
+
+// daemonizeServer runs the server in the background, detached from the
+// terminal, set with daemonize.
+var daemonizeServer = false
+
+// pidfile is the file the process ID is written to, set with pidfile. As in
+// Redis, it is only written when set, or when daemonized, to defaultPidFile.
+var pidfile = ""
+
+const defaultPidFile = "/var/run/redis.pid"
+
+// createPidFile writes the process ID to pidfile, for init scripts to find the
+// server. Failing to is not fatal, as in Redis.
+func createPidFile() {
+	if pidfile == "" && daemonizeServer {
+		pidfile = defaultPidFile
+	}
+	if pidfile == "" {
+		return
+	}
+	if err := os.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		serverLog(logWarning, "Failed to write PID file: %v", err)
+	}
+}
+
+// removePidFile removes the file written by createPidFile, on shutdown.
+func removePidFile() {
+	if pidfile != "" {
+		os.Remove(pidfile)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// daemonize is not supported on this platform: the server is left to a
+// service manager.
+func daemonize() error {
+	return errors.New("daemonize is not supported on this platform")
+}
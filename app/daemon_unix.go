@@ -0,0 +1,41 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks the process started by daemonize, which carries on as the
+// daemon.
+const daemonEnv = "GEDIS_DAEMONIZED"
+
+// daemonize detaches the server from the terminal. A Go program cannot fork,
+// so it is started again with the same arguments, in a new session and with
+// its standard streams on /dev/null, and this process exits. Returns in the
+// daemon.
+func daemonize() error {
+	if os.Getenv(daemonEnv) != "" {
+		return nil
+	}
+
+	null, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = null, null, null
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
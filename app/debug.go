@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// debugCommand implements DEBUG RELOAD | SLEEP | CHANGE-REPL-ID | HELP.
+// Must be called with keyspaceMutex held.
+func debugCommand(commandStringArray []string) []byte {
+	if len(commandStringArray) < 2 {
+		return []byte("-ERR wrong number of arguments for 'debug' command\r\n")
+	}
+
+	subcommand := strings.ToLower(commandStringArray[1])
+	switch subcommand {
+	case "reload":
+		return debugReload(commandStringArray[2:])
+
+	case "sleep":
+		// Stalls the whole server, to try out the latency monitor
+		if len(commandStringArray) != 3 {
+			break
+		}
+		seconds, err := strconv.ParseFloat(commandStringArray[2], 64)
+		if err != nil {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+		time.Sleep(time.Duration(seconds * float64(time.Second)))
+		return []byte("+OK\r\n")
+
+	case "change-repl-id":
+		// Replicas asking to continue from the old history get a full resync
+		if len(commandStringArray) != 2 {
+			break
+		}
+		replID = newReplicationID()
+		serverLog(logNotice, "Changed replication ID to %s", replID)
+		return []byte("+OK\r\n")
+
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"DEBUG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"RELOAD [MERGE] [NOFLUSH] [NOSAVE]",
+			"    Save the RDB on disk and reload it back to memory. By default it will",
+			"    save the RDB file and load it back.",
+			"    * MERGE: Merge the content of the RDB file with the current dataset.",
+			"    * NOFLUSH: Do not empty the current dataset before loading the RDB.",
+			"    * NOSAVE: Do not save the RDB file before reloading.",
+			"SLEEP <seconds>",
+			"    Stop the server for <seconds>. Decimals allowed.",
+			"CHANGE-REPL-ID",
+			"    Change the replication IDs of the instance.",
+			"    Dangerous: should be used only for testing the replication subsystem.",
+			"HELP",
+			"    Print this help.",
+		})
+	}
+	return []byte("-ERR unknown subcommand '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try DEBUG HELP.\r\n")
+}
+
+// debugReload implements DEBUG RELOAD: the dataset goes through the RDB
+// encoder and back through the decoder, so that anything either of them gets
+// wrong shows up in the reloaded keys. The keys of the file overwrite the ones
+// already present with MERGE or NOFLUSH.
+func debugReload(options []string) []byte {
+	save, flush := true, true
+	for _, option := range options {
+		switch strings.ToLower(option) {
+		case "merge", "noflush":
+			flush = false
+		case "nosave":
+			save = false
+		default:
+			return []byte("-ERR DEBUG RELOAD only supports the MERGE, NOFLUSH and NOSAVE options.\r\n")
+		}
+	}
+
+	var data []byte
+	if save {
+		data = encodeRDB(databases)
+		if err := writeRDBFile(data); err != nil {
+			return []byte("-ERR Error trying to save the RDB dump: " + err.Error() + "\r\n")
+		}
+		dirty = 0
+		lastSave = time.Now()
+	} else {
+		var err error
+		if data, err = os.ReadFile(rdbPath()); err != nil {
+			return []byte("-ERR Error trying to load the RDB dump: " + err.Error() + "\r\n")
+		}
+	}
+
+	if flush {
+		for _, db := range databases {
+			clear(db)
+		}
+	}
+	if _, err := decodeRDB(data, databases); err != nil {
+		return []byte("-ERR Error trying to load the RDB dump: " + err.Error() + "\r\n")
+	}
+	return []byte("+OK\r\n")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// debugHTTPAddr is the address of the HTTP server exposing the profiles of
+// net/http/pprof, set with debug-http, e.g. "localhost:6060". "" disables it.
+var debugHTTPAddr = ""
+
+// serveDebugHTTP serves the pprof endpoints under /debug/pprof/ on
+// debugHTTPAddr until the process exits, e.g. for
+// "go tool pprof http://localhost:6060/debug/pprof/profile".
+func serveDebugHTTP() {
+	// Sample the contention on the locks, keyspaceMutex first among them
+	runtime.SetMutexProfileFraction(100)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	if err := http.ListenAndServe(debugHTTPAddr, mux); err != nil {
+		serverLog(logWarning, "Failed to serve debug endpoints: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "strconv"
+
+// Thresholds below which collections keep a compact encoding, named and
+// defaulted as in Redis. A set, hash or sorted set converts to its general
+// representation (hashtable, skiplist) once it grows past either limit, and
+// never converts back. Lists have no compact representation: they are a slice
+// whatever their length, and list-max-listpack-size only decides whether
+// OBJECT ENCODING reports them as a listpack or a quicklist.
+var (
+	hashMaxListpackEntries = 128
+	hashMaxListpackValue   = 64
+	setMaxIntsetEntries    = 512
+	setMaxListpackEntries  = 128
+	setMaxListpackValue    = 64
+	zsetMaxListpackEntries = 128
+	zsetMaxListpackValue   = 64
+	listMaxListpackSize    = 128
+)
+
+// encodingConfig maps the configuration name of every threshold to its variable,
+// for the matching command-line flags and CONFIG GET.
+var encodingConfig = map[string]*int{
+	"hash-max-listpack-entries": &hashMaxListpackEntries,
+	"hash-max-listpack-value":   &hashMaxListpackValue,
+	"set-max-intset-entries":    &setMaxIntsetEntries,
+	"set-max-listpack-entries":  &setMaxListpackEntries,
+	"set-max-listpack-value":    &setMaxListpackValue,
+	"zset-max-listpack-entries": &zsetMaxListpackEntries,
+	"zset-max-listpack-value":   &zsetMaxListpackValue,
+	"list-max-listpack-size":    &listMaxListpackSize,
+}
+
+// parseIntsetMember reports whether member can be stored in an intset, i.e. it is
+// the canonical decimal form of a 64-bit integer ("12" but not "012" or "+12").
+func parseIntsetMember(member string) (int64, bool) {
+	value, err := strconv.ParseInt(member, 10, 64)
+	if err != nil || strconv.FormatInt(value, 10) != member {
+		return 0, false
+	}
+	return value, true
+}
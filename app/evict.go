@@ -0,0 +1,231 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// maxmemorySamples is the number of keys each database contributes to the
+// eviction pool per round, set with maxmemory-samples. More samples pick
+// better candidates, at a higher cost.
+var maxmemorySamples = 5
+
+// LFU settings. The counter of a key grows logarithmically with its accesses,
+// more slowly the higher lfu-log-factor, and decays by one every
+// lfu-decay-time minutes, 0 disabling the decay.
+var lfuLogFactor = 10
+var lfuDecayTime = 1
+
+// lfuInitVal is the counter of new keys, so that they are not evicted before
+// getting a chance to be accessed.
+const lfuInitVal = 5
+
+// evictionPoolSize is the number of candidates kept between evictions, as in Redis.
+const evictionPoolSize = 16
+
+// statEvictedKeys counts the keys evicted to honour maxmemory, for INFO.
+var statEvictedKeys int64
+
+// evictionCandidate is a key sampled for eviction. The higher its score, the
+// better a candidate it is: the idle time under the LRU policies, the lack of
+// accesses under the LFU policies, how soon it expires under volatile-ttl.
+type evictionCandidate struct {
+	db    int
+	key   string
+	score int64
+}
+
+// evictionPool holds the best candidates sampled so far, by ascending score.
+// Approximating LRU this way, over successive small samples, keeps eviction
+// cheap while its choices stay close to those of an exact LRU.
+var evictionPool []evictionCandidate
+
+// denyOOMCommands lists the commands that may use more memory, refused while
+// the memory used cannot be brought back under maxmemory.
+var denyOOMCommands = map[string]bool{
+	"set": true, "setnx": true, "setex": true, "psetex": true, "getset": true,
+	"mset": true, "msetnx": true, "append": true, "setrange": true,
+	"incr": true, "incrby": true, "decr": true, "decrby": true, "incrbyfloat": true,
+	"bitfield": true, "pfadd": true, "pfmerge": true, "copy": true,
+	"hset": true, "hincrby": true,
+	"sadd": true, "sinterstore": true, "sunionstore": true, "sdiffstore": true,
+	"rpush": true, "lpush": true, "lmove": true, "blmove": true,
+	"zadd": true, "geoadd": true, "zunionstore": true, "zinterstore": true,
+	"zdiffstore": true, "zrangestore": true,
+	"xadd": true, "xgroup": true,
+}
+
+// oomError is the reply to the commands of denyOOMCommands when eviction
+// could not free enough memory.
+const oomError = "-OOM command not allowed when used memory > 'maxmemory'.\r\n"
+
+// performEvictions evicts keys, following maxmemory-policy, until the memory
+// used is back under maxmemory. It returns false if that is not possible,
+// because the policy is noeviction or no key is left to evict.
+// Replicas leave eviction to their primary, whose DELs they receive.
+// Must be called with keyspaceMutex held.
+func performEvictions() bool {
+	if maxmemory == 0 || isReplica {
+		return true
+	}
+	used := usedMemory()
+	if used <= maxmemory {
+		return true
+	}
+	if maxmemoryPolicy == "noeviction" {
+		return false
+	}
+
+	clientDB := selectedDB
+	defer selectDB(clientDB)
+	start := time.Now()
+	defer func() { latencyAddSampleIfNeeded("eviction-cycle", time.Since(start)) }()
+
+	toFree, freed := used-maxmemory, int64(0)
+	for freed < toFree {
+		db, key, ok := evictionCandidateKey()
+		if !ok {
+			break
+		}
+		selectDB(db)
+		obj := keyspace[key]
+		freed += objectMemoryUsage(key, obj, memoryUsageSamples)
+		delete(keyspace, key)
+		invalidateKey(key, nil)
+		PropagateWriteCommandToReplicas([]string{"DEL", key})
+		statEvictedKeys++
+	}
+	freedSinceGC.Add(freed)
+	return freed >= toFree
+}
+
+// evictionCandidateKey picks the next key to evict under maxmemory-policy.
+func evictionCandidateKey() (db int, key string, ok bool) {
+	volatile := maxmemoryPolicy == "volatile-lru" || maxmemoryPolicy == "volatile-lfu" ||
+		maxmemoryPolicy == "volatile-random" || maxmemoryPolicy == "volatile-ttl"
+
+	if maxmemoryPolicy == "allkeys-random" || maxmemoryPolicy == "volatile-random" {
+		return randomEvictionKey(volatile)
+	}
+
+	for {
+		for i := range databases {
+			sampleEvictionPool(i, volatile)
+		}
+		if len(evictionPool) == 0 {
+			return 0, "", false
+		}
+
+		// Take the best candidate, skipping the ones gone or changed since sampled
+		for len(evictionPool) > 0 {
+			best := evictionPool[len(evictionPool)-1]
+			evictionPool = evictionPool[:len(evictionPool)-1]
+			obj := databases[best.db][best.key]
+			if obj != nil && (!volatile || obj.Expiry != nil) {
+				return best.db, best.key, true
+			}
+		}
+	}
+}
+
+// sampleEvictionPool adds a sample of the keys of a database to evictionPool,
+// keeping the best evictionPoolSize candidates. Under the volatile policies,
+// only keys with an expiry are sampled.
+func sampleEvictionPool(db int, volatile bool) {
+	now := time.Now()
+	sampled, visited := 0, 0
+	for key, obj := range databases[db] {
+		if sampled >= maxmemorySamples || visited >= activeExpireMaxVisits {
+			break
+		}
+		visited++
+		if volatile && obj.Expiry == nil {
+			continue
+		}
+		sampled++
+
+		var score int64
+		if maxmemoryPolicy == "volatile-ttl" {
+			score = math.MaxInt64 - obj.Expiry.UnixMilli()
+		} else if lfuPolicy() {
+			score = 255 - int64(lfuDecrAndReturn(obj))
+		} else {
+			score = now.Sub(obj.LastAccess).Milliseconds()
+		}
+
+		candidate := evictionCandidate{db: db, key: key, score: score}
+		i, _ := slices.BinarySearchFunc(evictionPool, candidate, func(a, b evictionCandidate) int {
+			return int(min(max(a.score-b.score, -1), 1))
+		})
+		if slices.ContainsFunc(evictionPool, func(c evictionCandidate) bool { return c.db == db && c.key == key }) {
+			continue
+		}
+		if len(evictionPool) < evictionPoolSize {
+			evictionPool = slices.Insert(evictionPool, i, candidate)
+		} else if i > 0 {
+			// Replace the worst candidate
+			copy(evictionPool, evictionPool[1:i])
+			evictionPool[i-1] = candidate
+		}
+	}
+}
+
+// randomEvictionKey picks a random key of a random non-empty database, with
+// an expiry under volatile-random.
+func randomEvictionKey(volatile bool) (int, string, bool) {
+	start := rand.IntN(len(databases))
+	for i := range databases {
+		db := (start + i) % len(databases)
+		visited := 0
+		for key, obj := range databases[db] {
+			if visited >= activeExpireMaxVisits {
+				break
+			}
+			visited++
+			if !volatile || obj.Expiry != nil {
+				return db, key, true
+			}
+		}
+	}
+	return 0, "", false
+}
+
+// lfuPolicy reports whether maxmemory-policy is one of the LFU policies, under
+// which the access frequency of keys is tracked.
+func lfuPolicy() bool {
+	return maxmemoryPolicy == "allkeys-lfu" || maxmemoryPolicy == "volatile-lfu"
+}
+
+// lfuTimeInMinutes returns the current time for LFUTime.
+func lfuTimeInMinutes() uint32 {
+	return uint32(time.Now().Unix() / 60)
+}
+
+// lfuDecrAndReturn returns the counter of obj, decayed by the lfu-decay-time
+// periods elapsed since it was last updated.
+func lfuDecrAndReturn(obj *redisObject) uint8 {
+	if lfuDecayTime == 0 {
+		return obj.Frequency
+	}
+	periods := (lfuTimeInMinutes() - obj.LFUTime) / uint32(lfuDecayTime)
+	if periods >= uint32(obj.Frequency) {
+		return 0
+	}
+	return obj.Frequency - uint8(periods)
+}
+
+// updateLFU records an access to obj: its counter is decayed, then
+// incremented with a probability falling as it grows, as in Redis.
+func updateLFU(obj *redisObject) {
+	counter := lfuDecrAndReturn(obj)
+	if counter < 255 {
+		base := max(float64(counter)-lfuInitVal, 0)
+		if rand.Float64() < 1/(base*float64(lfuLogFactor)+1) {
+			counter++
+		}
+	}
+	obj.Frequency = counter
+	obj.LFUTime = lfuTimeInMinutes()
+}
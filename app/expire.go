@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	activeExpireInterval   = 100 * time.Millisecond // How often the background cycle runs
+	activeExpireSampleSize = 20                     // Volatile keys inspected per sample
+	activeExpireMaxVisits  = 400                    // Upper bound on entries walked to find a sample
+	activeExpireTimeLimit  = 25 * time.Millisecond  // Upper bound on time spent per cycle
+)
+
+// getExpiry returns the expiration time of key, or nil if it has none.
+func getExpiry(key string) *time.Time {
+	if obj, ok := keyspace[key]; ok {
+		return obj.Expiry
+	}
+	return nil
+}
+
+// setExpiry sets the expiration time of an existing key. A nil time clears it.
+func setExpiry(key string, t *time.Time) {
+	if obj, ok := keyspace[key]; ok {
+		obj.Expiry = t
+	}
+}
+
+// expiryFromArgument converts a numeric expiry argument into an absolute time.
+// unit is the resolution of amount and absolute means amount is a unix timestamp
+// rather than a delta from now. Returns false if the result would overflow.
+func expiryFromArgument(amount int64, unit time.Duration, absolute bool) (time.Time, bool) {
+	unitMs := int64(unit / time.Millisecond)
+	if amount > math.MaxInt64/unitMs || amount < math.MinInt64/unitMs {
+		return time.Time{}, false
+	}
+
+	whenMs := amount * unitMs
+	if !absolute {
+		nowMs := time.Now().UnixMilli()
+		if whenMs > math.MaxInt64-nowMs {
+			return time.Time{}, false
+		}
+		whenMs += nowMs
+	}
+
+	return time.UnixMilli(whenMs), true
+}
+
+// expireCommand implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT.
+// unit is the resolution of the numeric argument (seconds or milliseconds) and
+// absolute marks the *AT variants, which take a unix timestamp instead of a delta.
+// Returns 1 if the timeout was set and 0 if the key is missing or a condition failed.
+func expireCommand(commandStringArray []string, unit time.Duration, absolute bool) []byte {
+	commandName := strings.ToLower(commandStringArray[0])
+	if len(commandStringArray) < 3 {
+		return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+	}
+
+	key := commandStringArray[1]
+	amount, err := strconv.ParseInt(commandStringArray[2], 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+
+	// Parse NX | XX | GT | LT
+	var nx, xx, gt, lt bool
+	for _, option := range commandStringArray[3:] {
+		switch strings.ToLower(option) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "gt":
+			gt = true
+		case "lt":
+			lt = true
+		default:
+			return []byte("-ERR Unsupported option " + sanitizeErrorArgument(option) + "\r\n")
+		}
+	}
+	if nx && (xx || gt || lt) {
+		return []byte("-ERR NX and XX, GT or LT options at the same time are not compatible\r\n")
+	}
+	if gt && lt {
+		return []byte("-ERR GT and LT options at the same time are not compatible\r\n")
+	}
+
+	when, ok := expiryFromArgument(amount, unit, absolute)
+	if !ok {
+		return []byte("-ERR invalid expire time in '" + commandName + "' command\r\n")
+	}
+
+	if !keyExists(key) {
+		return []byte(":0\r\n")
+	}
+
+	// A key without a TTL is treated as having an infinite one for GT / LT.
+	current := getExpiry(key)
+	switch {
+	case nx && current != nil:
+		return []byte(":0\r\n")
+	case xx && current == nil:
+		return []byte(":0\r\n")
+	case gt && (current == nil || !when.After(*current)):
+		return []byte(":0\r\n")
+	case lt && current != nil && !when.Before(*current):
+		return []byte(":0\r\n")
+	}
+
+	// A timeout in the past deletes the key straight away.
+	if !when.After(time.Now()) {
+		deleteKey(key)
+		return []byte(":1\r\n")
+	}
+
+	setExpiry(key, &when)
+	return []byte(":1\r\n")
+}
+
+// ttlCommand implements TTL, PTTL, EXPIRETIME and PEXPIRETIME.
+// It reports the remaining time to live (or the absolute unix expiry time when
+// absolute is set) in the given unit, -1 if the key has no expiry and -2 if the key is missing.
+func ttlCommand(commandStringArray []string, unit time.Duration, absolute bool) []byte {
+	if len(commandStringArray) != 2 {
+		return []byte("-ERR wrong number of arguments for '" + strings.ToLower(commandStringArray[0]) + "' command\r\n")
+	}
+
+	key := commandStringArray[1]
+	if !keyExists(key) {
+		return []byte(":-2\r\n")
+	}
+
+	expiry := getExpiry(key)
+	if expiry == nil {
+		return []byte(":-1\r\n")
+	}
+
+	unitMs := int64(unit / time.Millisecond)
+	if absolute {
+		return []byte(":" + strconv.FormatInt(expiry.UnixMilli()/unitMs, 10) + "\r\n")
+	}
+
+	// Round to the nearest unit, like Redis does for TTL.
+	remainingMs := time.Until(*expiry).Milliseconds()
+	return []byte(":" + strconv.FormatInt((remainingMs+unitMs/2)/unitMs, 10) + "\r\n")
+}
+
+// persist removes the expiry from key.
+// Returns 1 if a timeout was removed, 0 if the key is missing or had none.
+func persist(key string) []byte {
+	if !keyExists(key) || getExpiry(key) == nil {
+		return []byte(":0\r\n")
+	}
+
+	setExpiry(key, nil)
+	return []byte(":1\r\n")
+}
+
+// activeExpireCycle periodically samples keys that carry a TTL and deletes the
+// ones that have expired, so that keys nobody reads again are still reclaimed.
+// Like Redis, it keeps sampling while more than a quarter of the keys in a sample
+// were expired, within a fixed time budget.
+func activeExpireCycle() {
+	ticker := time.NewTicker(activeExpireInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		keyspaceMutex.Lock()
+		start := time.Now()
+		deadline := start.Add(activeExpireTimeLimit)
+		for _, db := range databases {
+			for {
+				sampled, expired := expireSample(db)
+				if expired*4 <= sampled || time.Now().After(deadline) {
+					break
+				}
+			}
+		}
+		latencyAddSampleIfNeeded("expire-cycle", time.Since(start))
+		keyspaceMutex.Unlock()
+	}
+}
+
+// expireSample inspects a random sample of volatile keys in db and deletes the expired ones.
+// Hashes walked past along the way also lose their expired fields.
+// Returns the number of keys inspected and the number deleted.
+func expireSample(db map[string]*redisObject) (int, int) {
+	now := time.Now()
+	var expiredKeys []string
+
+	// Walk the database (whose iteration order is randomised)
+	// until enough keys carrying a TTL have been seen.
+	visited, sampled := 0, 0
+	for key, obj := range db {
+		if sampled >= activeExpireSampleSize || visited >= activeExpireMaxVisits {
+			break
+		}
+		visited++
+		if expireHashFields(obj) {
+			expiredKeys = append(expiredKeys, key)
+			continue
+		}
+		if obj.Expiry == nil {
+			continue
+		}
+		sampled++
+		if !now.Before(*obj.Expiry) {
+			expiredKeys = append(expiredKeys, key)
+		}
+	}
+
+	for _, key := range expiredKeys {
+		delete(db, key)
+	}
+
+	return sampled, len(expiredKeys)
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"cmp"
+	"fmt"
 	"math"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -86,21 +91,20 @@ func GeoDistance(c1, c2 Coordinates) float64 {
 	return EARTH_RADIUS * c
 }
 
-// RadiusToMeters normalizes distance units (km, miles, ft) into meters
-// for consistent internal calculation.
-func RadiusToMeters(radius float64, unit string) float64 {
-	switch unit {
+// UnitToMeters returns the number of meters in a distance unit (m, km, mi,
+// ft), or false for any other unit.
+func UnitToMeters(unit string) (float64, bool) {
+	switch strings.ToLower(unit) {
 	case "m":
-		return radius
+		return 1, true
 	case "km":
-		return radius * 1000
+		return 1000, true
 	case "mi":
-		return radius * 1609.344
+		return 1609.344, true
 	case "ft":
-		return radius * 0.3048
-	default:
-		return radius // Default to meters
+		return 0.3048, true
 	}
+	return 0, false
 }
 
 // spreadInt32ToInt64 takes a 32-bit integer and "spreads" its bits apart.
@@ -140,3 +144,222 @@ func GeospatialEncode(latitude, longitude float64) uint64 {
 
 	return interleave(latInt, lonInt)
 }
+
+// geoSearchResult is a member found by GEOSEARCH, with its distance in meters
+// from the center of the search.
+type geoSearchResult struct {
+	member   string
+	score    float64
+	coords   Coordinates
+	distance float64
+}
+
+// geosearch implements GEOSEARCH key <FROMMEMBER member | FROMLONLAT longitude
+// latitude> <BYRADIUS radius unit | BYBOX width height unit> [ASC | DESC]
+// [COUNT count [ANY]] [WITHCOORD] [WITHDIST] [WITHHASH].
+// Must be called with keyspaceMutex held.
+func geosearch(args []string, protocol int) []byte {
+	const syntaxError = "-ERR syntax error\r\n"
+	const floatError = "-ERR value is not a valid float\r\n"
+
+	var fromMember string
+	var center Coordinates
+	fromSet, fromMemberSet, byRadius, byBox := false, false, false, false
+	var radius, width, height, unitFactor float64
+	sort, count, countAny := 0, 0, false // sort is 1 for ASC, -1 for DESC
+	withCoord, withDist, withHash := false, false, false
+
+	// parseUnit reads the unit following a BYRADIUS or BYBOX
+	parseUnit := func(unit string) bool {
+		factor, ok := UnitToMeters(unit)
+		unitFactor = factor
+		return ok
+	}
+	for i := 2; i < len(args); i++ {
+		left := len(args) - i - 1
+		switch strings.ToLower(args[i]) {
+		case "frommember":
+			if left < 1 {
+				return []byte(syntaxError)
+			}
+			if fromSet {
+				return []byte("-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n")
+			}
+			fromMember, fromSet, fromMemberSet = args[i+1], true, true
+			i++
+		case "fromlonlat":
+			if left < 2 {
+				return []byte(syntaxError)
+			}
+			if fromSet {
+				return []byte("-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n")
+			}
+			longitude, err1 := strconv.ParseFloat(args[i+1], 64)
+			latitude, err2 := strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil {
+				return []byte(floatError)
+			}
+			if longitude < MIN_LONGITUDE || longitude > MAX_LONGITUDE || latitude < MIN_LATITUDE || latitude > MAX_LATITUDE {
+				return []byte(fmt.Sprintf("-ERR invalid longitude,latitude pair %.6f,%.6f\r\n", longitude, latitude))
+			}
+			center, fromSet = Coordinates{Latitude: latitude, Longitude: longitude}, true
+			i += 2
+		case "byradius":
+			if left < 2 {
+				return []byte(syntaxError)
+			}
+			if byRadius || byBox {
+				return []byte("-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n")
+			}
+			var err error
+			if radius, err = strconv.ParseFloat(args[i+1], 64); err != nil {
+				return []byte(floatError)
+			}
+			if radius < 0 {
+				return []byte("-ERR radius cannot be negative\r\n")
+			}
+			if !parseUnit(args[i+2]) {
+				return []byte("-ERR unsupported unit provided. please use M, KM, FT, MI\r\n")
+			}
+			byRadius = true
+			i += 2
+		case "bybox":
+			if left < 3 {
+				return []byte(syntaxError)
+			}
+			if byRadius || byBox {
+				return []byte("-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n")
+			}
+			var err1, err2 error
+			width, err1 = strconv.ParseFloat(args[i+1], 64)
+			height, err2 = strconv.ParseFloat(args[i+2], 64)
+			if err1 != nil || err2 != nil {
+				return []byte(floatError)
+			}
+			if width < 0 || height < 0 {
+				return []byte("-ERR height or width cannot be negative\r\n")
+			}
+			if !parseUnit(args[i+3]) {
+				return []byte("-ERR unsupported unit provided. please use M, KM, FT, MI\r\n")
+			}
+			byBox = true
+			i += 3
+		case "asc":
+			sort = 1
+		case "desc":
+			sort = -1
+		case "count":
+			if left < 1 {
+				return []byte(syntaxError)
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if n <= 0 {
+				return []byte("-ERR COUNT must be > 0\r\n")
+			}
+			count = n
+			i++
+			if left >= 2 && strings.ToLower(args[i+1]) == "any" {
+				countAny = true
+				i++
+			}
+		case "withcoord":
+			withCoord = true
+		case "withdist":
+			withDist = true
+		case "withhash":
+			withHash = true
+		default:
+			return []byte(syntaxError)
+		}
+	}
+	if !fromSet {
+		return []byte("-ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH\r\n")
+	}
+	if !byRadius && !byBox {
+		return []byte("-ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH\r\n")
+	}
+	if countAny && count == 0 {
+		return []byte("-ERR the ANY argument requires COUNT argument\r\n")
+	}
+	// The closest members are the ones to return, unless any will do
+	if count > 0 && sort == 0 && !countAny {
+		sort = 1
+	}
+
+	zset, wrongType := lookupZSet(args[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if zset == nil {
+		return []byte("*0\r\n")
+	}
+	if fromMemberSet {
+		score, ok := zset.score(fromMember)
+		if !ok {
+			return []byte("-ERR could not decode requested zset member\r\n")
+		}
+		center = GeospatialDecode(uint64(score))
+	}
+
+	var results []geoSearchResult
+	for _, member := range zset.members() {
+		coords := GeospatialDecode(uint64(member.Score))
+		distance := GeoDistance(center, coords)
+		if byRadius && distance > radius*unitFactor {
+			continue
+		}
+		if byBox {
+			// The latitude distance is the cheaper one, so it is checked first
+			latDistance := EARTH_RADIUS * math.Abs(degToRad(coords.Latitude)-degToRad(center.Latitude))
+			if latDistance > height*unitFactor/2 {
+				continue
+			}
+			lonDistance := GeoDistance(Coordinates{Latitude: coords.Latitude, Longitude: center.Longitude}, coords)
+			if lonDistance > width*unitFactor/2 {
+				continue
+			}
+		}
+		results = append(results, geoSearchResult{member.Member, member.Score, coords, distance})
+		if countAny && len(results) == count {
+			break
+		}
+	}
+
+	if sort != 0 {
+		slices.SortStableFunc(results, func(a, b geoSearchResult) int {
+			return sort * cmp.Compare(a.distance, b.distance)
+		})
+	}
+	if count > 0 && len(results) > count {
+		results = results[:count]
+	}
+
+	if !withCoord && !withDist && !withHash {
+		members := make([]string, len(results))
+		for i, result := range results {
+			members[i] = result.member
+		}
+		return StringArrayToBulkStringArray(members)
+	}
+	reply := make([]interface{}, len(results))
+	for i, result := range results {
+		item := []interface{}{result.member}
+		if withDist {
+			item = append(item, strconv.FormatFloat(result.distance/unitFactor, 'f', 4, 64))
+		}
+		if withHash {
+			item = append(item, int64(result.score))
+		}
+		if withCoord {
+			item = append(item, []string{
+				strconv.FormatFloat(result.coords.Longitude, 'f', -1, 64),
+				strconv.FormatFloat(result.coords.Latitude, 'f', -1, 64),
+			})
+		}
+		reply[i] = item
+	}
+	return encodeRESP(reply, protocol)
+}
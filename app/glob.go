@@ -0,0 +1,96 @@
+package main
+
+// globMatch reports whether s matches the Redis style glob pattern.
+// Supported syntax: '*' (any run), '?' (any single byte), '[abc]', '[^abc]',
+// '[a-z]' (byte classes) and '\' to escape the following character.
+func globMatch(pattern, s string) bool {
+	p := 0
+	for p < len(pattern) {
+		switch pattern[p] {
+		case '*':
+			// Collapse consecutive stars
+			for p+1 < len(pattern) && pattern[p+1] == '*' {
+				p++
+			}
+			if p+1 == len(pattern) {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern[p+1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			s = s[1:]
+
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			p++
+			negate := p < len(pattern) && pattern[p] == '^'
+			if negate {
+				p++
+			}
+
+			matched := false
+			for p < len(pattern) && pattern[p] != ']' {
+				switch {
+				case pattern[p] == '\\' && p+1 < len(pattern):
+					p++
+					if pattern[p] == s[0] {
+						matched = true
+					}
+				case p+2 < len(pattern) && pattern[p+1] == '-':
+					start, end := pattern[p], pattern[p+2]
+					if start > end {
+						start, end = end, start
+					}
+					if s[0] >= start && s[0] <= end {
+						matched = true
+					}
+					p += 2
+				case pattern[p] == s[0]:
+					matched = true
+				}
+				p++
+			}
+
+			if negate {
+				matched = !matched
+			}
+			if !matched {
+				return false
+			}
+			s = s[1:]
+
+			// An unterminated class runs to the end of the pattern
+			if p == len(pattern) {
+				return len(s) == 0
+			}
+
+		case '\\':
+			if p+1 < len(pattern) {
+				p++
+			}
+			if len(s) == 0 || pattern[p] != s[0] {
+				return false
+			}
+			s = s[1:]
+
+		default:
+			if len(s) == 0 || pattern[p] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		p++
+	}
+
+	return len(s) == 0
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisHash is the value of a hash key. Small hashes are kept as a listpack,
+// a flat [field1, value1, field2, value2, ...] slice in insertion order, and
+// converted to a hashtable once they grow past the listpack limits.
+type redisHash struct {
+	listpack []string
+	dict     map[string]string    // Non-nil once converted to a hashtable
+	expiries map[string]time.Time // Expiration time of the fields that have one
+}
+
+// newHash returns an empty hash in the listpack encoding.
+func newHash() *redisHash {
+	return &redisHash{listpack: []string{}}
+}
+
+// encoding returns the name of the hash's encoding, as reported by OBJECT ENCODING.
+func (h *redisHash) encoding() string {
+	switch {
+	case h.dict != nil:
+		return "hashtable"
+	case h.expiries != nil:
+		return "listpackex"
+	}
+	return "listpack"
+}
+
+// listpackIndex returns the position of field in the listpack, or -1.
+func (h *redisHash) listpackIndex(field string) int {
+	for i := 0; i < len(h.listpack); i += 2 {
+		if h.listpack[i] == field {
+			return i
+		}
+	}
+	return -1
+}
+
+// length returns the number of fields; a nil hash is empty.
+func (h *redisHash) length() int {
+	switch {
+	case h == nil:
+		return 0
+	case h.dict != nil:
+		return len(h.dict)
+	}
+	return len(h.listpack) / 2
+}
+
+// get returns the value of field, and whether it exists.
+func (h *redisHash) get(field string) (string, bool) {
+	switch {
+	case h == nil:
+		return "", false
+	case h.dict != nil:
+		value, ok := h.dict[field]
+		return value, ok
+	}
+	if i := h.listpackIndex(field); i >= 0 {
+		return h.listpack[i+1], true
+	}
+	return "", false
+}
+
+// set stores value in field, converting the hash to a hashtable once it no
+// longer fits the listpack limits. The field keeps its expiry, if any.
+// Returns true if the field is new.
+func (h *redisHash) set(field, value string) bool {
+	if h.dict == nil {
+		if i := h.listpackIndex(field); i >= 0 && len(value) <= hashMaxListpackValue {
+			h.listpack[i+1] = value
+			return false
+		} else if i < 0 && h.length() < hashMaxListpackEntries &&
+			len(field) <= hashMaxListpackValue && len(value) <= hashMaxListpackValue {
+			h.listpack = append(h.listpack, intern(field), value)
+			return true
+		}
+		h.convertToHashtable()
+	}
+
+	_, exists := h.dict[field]
+	if !exists {
+		field = intern(field)
+	}
+	h.dict[field] = value
+	return !exists
+}
+
+// delete removes field and its expiry. Returns false if it was not present.
+func (h *redisHash) delete(field string) bool {
+	delete(h.expiries, field)
+	if h.dict != nil {
+		if _, ok := h.dict[field]; !ok {
+			return false
+		}
+		delete(h.dict, field)
+		return true
+	}
+	i := h.listpackIndex(field)
+	if i < 0 {
+		return false
+	}
+	h.listpack = slices.Delete(h.listpack, i, i+2)
+	return true
+}
+
+// entries returns every field and value, flattened as [field1, value1, ...].
+func (h *redisHash) entries() []string {
+	switch {
+	case h == nil:
+		return []string{}
+	case h.dict != nil:
+		result := make([]string, 0, len(h.dict)*2)
+		for field, value := range h.dict {
+			result = append(result, field, value)
+		}
+		return result
+	}
+	return slices.Clone(h.listpack)
+}
+
+// convertToHashtable switches the hash to the hashtable encoding.
+func (h *redisHash) convertToHashtable() {
+	h.dict = make(map[string]string, len(h.listpack)/2)
+	for i := 0; i < len(h.listpack); i += 2 {
+		h.dict[h.listpack[i]] = h.listpack[i+1]
+	}
+	h.listpack = nil
+}
+
+// clone returns an independent copy of the hash and its field expiries,
+// in the same encoding.
+func (h *redisHash) clone() *redisHash {
+	return &redisHash{
+		listpack: slices.Clone(h.listpack),
+		dict:     maps.Clone(h.dict),
+		expiries: maps.Clone(h.expiries),
+	}
+}
+
+// fieldExpiry returns the expiration time of field, or nil if it has none.
+func (h *redisHash) fieldExpiry(field string) *time.Time {
+	if when, ok := h.expiries[field]; ok {
+		return &when
+	}
+	return nil
+}
+
+// setFieldExpiry sets the expiration time of an existing field. A nil time clears it.
+func (h *redisHash) setFieldExpiry(field string, t *time.Time) {
+	if t == nil {
+		delete(h.expiries, field)
+		return
+	}
+	if h.expiries == nil {
+		h.expiries = make(map[string]time.Time)
+	}
+	h.expiries[field] = *t
+}
+
+// expireHashFields deletes the expired fields of obj, if it is a hash whose
+// fields carry TTLs. Returns true if that left the hash empty, in which case
+// the caller must delete the key.
+func expireHashFields(obj *redisObject) bool {
+	hash, ok := obj.Value.(*redisHash)
+	if !ok || len(hash.expiries) == 0 {
+		return false
+	}
+
+	now := time.Now()
+	for field, when := range hash.expiries {
+		if !now.Before(when) {
+			hash.delete(field)
+		}
+	}
+	return hash.length() == 0
+}
+
+// lookupHash returns the hash stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupHash(key string) (hash *redisHash, wrongType bool) {
+	obj, wrongType := lookupKeyOfType(key, HashType)
+	if obj == nil {
+		return nil, wrongType
+	}
+	return obj.Value.(*redisHash), false
+}
+
+// hset sets the given field/value pairs in the hash stored at key,
+// creating the hash if needed. Replies with the number of fields that were added.
+func hset(key string, fieldValues []string) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if hash == nil {
+		hash = newHash()
+		setKey(key, HashType, hash)
+	}
+
+	added := 0
+	for i := 0; i+1 < len(fieldValues); i += 2 {
+		if hash.set(fieldValues[i], fieldValues[i+1]) {
+			added++
+		}
+		// Overwriting a field clears its TTL
+		hash.setFieldExpiry(fieldValues[i], nil)
+	}
+
+	return []byte(":" + strconv.Itoa(added) + "\r\n")
+}
+
+// hget returns the value of field in the hash stored at key as a Bulk String.
+func hget(key, field string) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	value, ok := hash.get(field)
+	if !ok {
+		return []byte("$-1\r\n")
+	}
+	return StringToBulkString(value)
+}
+
+// hdel removes the given fields from the hash stored at key.
+// The key is deleted once its last field is removed.
+// Replies with the number of fields that were removed.
+func hdel(key string, fields []string) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if hash == nil {
+		return []byte(":0\r\n")
+	}
+
+	removed := 0
+	for _, field := range fields {
+		if hash.delete(field) {
+			removed++
+		}
+	}
+
+	if hash.length() == 0 {
+		deleteKey(key)
+	}
+
+	return []byte(":" + strconv.Itoa(removed) + "\r\n")
+}
+
+// hgetall replies with every field and value of the hash stored at key,
+// flattened as [field1, value1, field2, value2, ...].
+func hgetall(key string, protocol int) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	entries := respMap{}
+	for _, entry := range hash.entries() {
+		entries = append(entries, entry)
+	}
+	return encodeRESP(entries, protocol)
+}
+
+// hkeys returns every field name of the hash stored at key.
+func hkeys(hash *redisHash) []string {
+	entries := hash.entries()
+	result := make([]string, 0, len(entries)/2)
+	for i := 0; i < len(entries); i += 2 {
+		result = append(result, entries[i])
+	}
+	return result
+}
+
+// hvals returns every value of the hash stored at key.
+func hvals(hash *redisHash) []string {
+	entries := hash.entries()
+	result := make([]string, 0, len(entries)/2)
+	for i := 1; i < len(entries); i += 2 {
+		result = append(result, entries[i])
+	}
+	return result
+}
+
+// hmget returns the values of the given fields as a RESP array,
+// with a Null Bulk String in place of every missing field.
+func hmget(key string, fields []string) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	values := make([]interface{}, len(fields))
+	for i, field := range fields {
+		if value, ok := hash.get(field); ok {
+			values[i] = value
+		}
+	}
+	return encodeArray(values)
+}
+
+// hincrby increments the integer stored in field of the hash at key by increment.
+// A missing field is treated as 0. The field keeps its TTL, if any.
+func hincrby(key, field string, increment int64) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	current := int64(0)
+	if value, ok := hash.get(field); ok {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return []byte("-ERR hash value is not an integer\r\n")
+		}
+		current = parsed
+	}
+
+	if (increment > 0 && current > math.MaxInt64-increment) ||
+		(increment < 0 && current < math.MinInt64-increment) {
+		return []byte("-ERR increment or decrement would overflow\r\n")
+	}
+
+	current += increment
+	if hash == nil {
+		hash = newHash()
+		setKey(key, HashType, hash)
+	}
+	hash.set(field, strconv.FormatInt(current, 10))
+
+	return []byte(":" + strconv.FormatInt(current, 10) + "\r\n")
+}
+
+// parseHashFields parses the FIELDS numfields field [field ...] block that ends
+// the hash field expiration commands. On failure the RESP error to reply with is returned.
+func parseHashFields(args []string) ([]string, []byte) {
+	if len(args) < 2 || strings.ToLower(args[0]) != "fields" {
+		return nil, []byte("-ERR Mandatory argument FIELDS is missing or not at the right position\r\n")
+	}
+	numFields, err := strconv.Atoi(args[1])
+	if err != nil || numFields <= 0 {
+		return nil, []byte("-ERR Parameter `numFields` should be greater than 0\r\n")
+	}
+	if numFields != len(args)-2 {
+		return nil, []byte("-ERR The `numfields` parameter must match the number of arguments\r\n")
+	}
+	return args[2:], nil
+}
+
+// hexpireCommand implements HEXPIRE, HPEXPIRE, HEXPIREAT and HPEXPIREAT:
+//
+//	HEXPIRE key seconds [NX | XX | GT | LT] FIELDS numfields field [field ...]
+//
+// unit and absolute are as for expireCommand. Replies with one integer per field:
+// -2 if the field does not exist, 0 if the condition failed, 1 if the TTL was set
+// and 2 if the field was deleted because the time is already in the past.
+func hexpireCommand(commandStringArray []string, unit time.Duration, absolute bool) []byte {
+	commandName := strings.ToLower(commandStringArray[0])
+	if len(commandStringArray) < 6 {
+		return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+	}
+
+	key := commandStringArray[1]
+	amount, err := strconv.ParseInt(commandStringArray[2], 10, 64)
+	if err != nil {
+		return []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if amount < 0 {
+		return []byte("-ERR invalid expire time, must be >= 0 and < 2^48\r\n")
+	}
+
+	rest := commandStringArray[3:]
+	condition := ""
+	switch option := strings.ToLower(rest[0]); option {
+	case "nx", "xx", "gt", "lt":
+		condition = option
+		rest = rest[1:]
+	}
+	fields, errReply := parseHashFields(rest)
+	if errReply != nil {
+		return errReply
+	}
+
+	when, ok := expiryFromArgument(amount, unit, absolute)
+	if !ok {
+		return []byte("-ERR invalid expire time in '" + commandName + "' command\r\n")
+	}
+
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	results := make([]int, len(fields))
+	for i, field := range fields {
+		if _, ok := hash.get(field); !ok {
+			results[i] = -2
+			continue
+		}
+
+		// A field without a TTL is treated as having an infinite one for GT / LT.
+		current := hash.fieldExpiry(field)
+		switch {
+		case condition == "nx" && current != nil,
+			condition == "xx" && current == nil,
+			condition == "gt" && (current == nil || !when.After(*current)),
+			condition == "lt" && current != nil && !when.Before(*current):
+			results[i] = 0
+		case !when.After(time.Now()):
+			hash.delete(field)
+			results[i] = 2
+		default:
+			hash.setFieldExpiry(field, &when)
+			results[i] = 1
+		}
+	}
+
+	if hash != nil && hash.length() == 0 {
+		deleteKey(key)
+	}
+	return encodeIntegerArray(results)
+}
+
+// httlCommand implements HTTL, HPTTL, HEXPIRETIME and HPEXPIRETIME:
+//
+//	HTTL key FIELDS numfields field [field ...]
+//
+// Replies with the remaining time to live of every field (or its absolute unix
+// expiry time when absolute is set) in the given unit, -1 for a field with no
+// TTL and -2 for a missing field.
+func httlCommand(commandStringArray []string, unit time.Duration, absolute bool) []byte {
+	if len(commandStringArray) < 5 {
+		return []byte("-ERR wrong number of arguments for '" + strings.ToLower(commandStringArray[0]) + "' command\r\n")
+	}
+
+	fields, errReply := parseHashFields(commandStringArray[2:])
+	if errReply != nil {
+		return errReply
+	}
+	hash, wrongType := lookupHash(commandStringArray[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	unitMs := int64(unit / time.Millisecond)
+	results := make([]int, len(fields))
+	for i, field := range fields {
+		if _, ok := hash.get(field); !ok {
+			results[i] = -2
+			continue
+		}
+		expiry := hash.fieldExpiry(field)
+		switch {
+		case expiry == nil:
+			results[i] = -1
+		case absolute:
+			results[i] = int(expiry.UnixMilli() / unitMs)
+		default:
+			remainingMs := time.Until(*expiry).Milliseconds()
+			results[i] = int((remainingMs + unitMs/2) / unitMs)
+		}
+	}
+	return encodeIntegerArray(results)
+}
+
+// hpersist implements HPERSIST key FIELDS numfields field [field ...].
+// Replies with one integer per field: 1 if its TTL was removed, -1 if it had
+// none and -2 if the field does not exist.
+func hpersist(commandStringArray []string) []byte {
+	if len(commandStringArray) < 5 {
+		return []byte("-ERR wrong number of arguments for 'hpersist' command\r\n")
+	}
+
+	fields, errReply := parseHashFields(commandStringArray[2:])
+	if errReply != nil {
+		return errReply
+	}
+	hash, wrongType := lookupHash(commandStringArray[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	results := make([]int, len(fields))
+	for i, field := range fields {
+		switch _, ok := hash.get(field); {
+		case !ok:
+			results[i] = -2
+		case hash.fieldExpiry(field) == nil:
+			results[i] = -1
+		default:
+			hash.setFieldExpiry(field, nil)
+			results[i] = 1
+		}
+	}
+	return encodeIntegerArray(results)
+}
+
+// encodeIntegerArray encodes values as a RESP array of integers.
+func encodeIntegerArray(values []int) []byte {
+	elements := make([]interface{}, len(values))
+	for i, value := range values {
+		elements[i] = value
+	}
+	return encodeArray(elements)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"strconv"
+)
+
+// HyperLogLogs are stored as plain string values using the same dense layout as Redis:
+// a 16 byte header ("HYLL", encoding, 3 unused bytes, 8 byte cached cardinality)
+// followed by 16384 registers of 6 bits each, packed LSB first.
+const (
+	HLL_P         = 14                                          // Bits of the hash used to select a register
+	HLL_Q         = 64 - HLL_P                                  // Bits of the hash used to count leading zeros
+	HLL_REGISTERS = 1 << HLL_P                                  // Number of registers
+	HLL_BITS      = 6                                           // Bits per register
+	HLL_REG_MAX   = (1 << HLL_BITS) - 1                         // Largest value a register can hold
+	HLL_HDR_SIZE  = 16                                          // Header length in bytes
+	HLL_SIZE      = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8 // Total length of a dense HLL
+	HLL_DENSE     = 0                                           // Encoding byte of the dense representation
+	HLL_ALPHA_INF = 0.721347520444481703680                     // Bias correction constant for m -> infinity
+	HLL_HASH_SEED = 0xadc83b19
+)
+
+// murmurHash64A is the 64 bit MurmurHash2 variant used by Redis to hash HLL elements.
+func murmurHash64A(key []byte, seed uint64) uint64 {
+	const m = 0xc6a4a7935bd1e995
+	const r = 47
+
+	h := seed ^ (uint64(len(key)) * m)
+
+	for len(key) >= 8 {
+		k := binary.LittleEndian.Uint64(key)
+		k *= m
+		k ^= k >> r
+		k *= m
+
+		h ^= k
+		h *= m
+		key = key[8:]
+	}
+
+	switch len(key) {
+	case 7:
+		h ^= uint64(key[6]) << 48
+		fallthrough
+	case 6:
+		h ^= uint64(key[5]) << 40
+		fallthrough
+	case 5:
+		h ^= uint64(key[4]) << 32
+		fallthrough
+	case 4:
+		h ^= uint64(key[3]) << 24
+		fallthrough
+	case 3:
+		h ^= uint64(key[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint64(key[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint64(key[0])
+		h *= m
+	}
+
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+// hllPatternLength hashes element and returns the register it maps to along with
+// the length of the 000..1 run in the remaining hash bits.
+func hllPatternLength(element string) (int, uint8) {
+	hash := murmurHash64A([]byte(element), HLL_HASH_SEED)
+	index := int(hash & (HLL_REGISTERS - 1))
+
+	// Force a terminating 1 bit so the loop always ends within Q+1 iterations
+	hash >>= HLL_P
+	hash |= 1 << HLL_Q
+
+	count := uint8(1)
+	for bit := uint64(1); hash&bit == 0; bit <<= 1 {
+		count++
+	}
+	return index, count
+}
+
+// hllGetRegister reads register i from the packed register area.
+func hllGetRegister(registers []byte, i int) uint8 {
+	byteIndex := i * HLL_BITS / 8
+	firstBit := uint(i * HLL_BITS & 7)
+
+	value := uint(registers[byteIndex]) >> firstBit
+	if byteIndex+1 < len(registers) {
+		value |= uint(registers[byteIndex+1]) << (8 - firstBit)
+	}
+	return uint8(value & HLL_REG_MAX)
+}
+
+// hllSetRegister writes value into register i of the packed register area.
+func hllSetRegister(registers []byte, i int, value uint8) {
+	byteIndex := i * HLL_BITS / 8
+	firstBit := uint(i * HLL_BITS & 7)
+
+	registers[byteIndex] &^= byte(HLL_REG_MAX << firstBit)
+	registers[byteIndex] |= byte(uint(value) << firstBit)
+	if byteIndex+1 < len(registers) {
+		registers[byteIndex+1] &^= byte(HLL_REG_MAX >> (8 - firstBit))
+		registers[byteIndex+1] |= byte(uint(value) >> (8 - firstBit))
+	}
+}
+
+// newHLL returns an empty dense HyperLogLog with a valid (zero) cached cardinality.
+func newHLL() []byte {
+	hll := make([]byte, HLL_SIZE)
+	copy(hll, "HYLL")
+	hll[4] = HLL_DENSE
+	return hll
+}
+
+// isValidHLL reports whether s is a dense HyperLogLog this server can operate on.
+func isValidHLL(s string) bool {
+	return len(s) == HLL_SIZE && s[:4] == "HYLL" && s[4] == HLL_DENSE
+}
+
+// hllInvalidateCache marks the cached cardinality as stale.
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 1 << 7
+}
+
+// hllSigma and hllTau are the helper series of the improved cardinality
+// estimator by Otmar Ertl, which Redis also uses.
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime := z
+		z += x * y
+		y += y
+		if zPrime == z {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime := z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			return z / 3
+		}
+	}
+}
+
+// hllCount estimates the cardinality from a register area.
+func hllCount(registers []byte) uint64 {
+	var histogram [HLL_Q + 2]int
+	for i := 0; i < HLL_REGISTERS; i++ {
+		histogram[hllGetRegister(registers, i)]++
+	}
+
+	m := float64(HLL_REGISTERS)
+	z := m * hllTau((m-float64(histogram[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(histogram[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(histogram[0])/m)
+
+	return uint64(math.Round(HLL_ALPHA_INF * m * m / z))
+}
+
+// lookupHLL returns a mutable copy of the HyperLogLog stored at key, or nil if the key is missing.
+// On failure the RESP error to reply with is returned.
+func lookupHLL(key string) ([]byte, []byte) {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return nil, []byte(wrongTypeError)
+	}
+	if value == nil {
+		return nil, nil
+	}
+	str := value.Value.(string)
+	if !isValidHLL(str) {
+		return nil, []byte("-WRONGTYPE Key is not a valid HyperLogLog string value.\r\n")
+	}
+	return []byte(str), nil
+}
+
+// storeHLL writes hll back to key, preserving the key's TTL if it already exists.
+func storeHLL(key string, hll []byte) {
+	if value, ok := keyspace[key]; ok {
+		value.Value = string(hll)
+		return
+	}
+	setKey(key, StringType, string(hll))
+}
+
+// pfadd adds elements to the HyperLogLog at key, creating it if needed.
+// Replies 1 if any register was altered (or the key was created), 0 otherwise.
+func pfadd(key string, elements []string) []byte {
+	hll, errReply := lookupHLL(key)
+	if errReply != nil {
+		return errReply
+	}
+
+	updated := false
+	if hll == nil {
+		hll = newHLL()
+		updated = true
+	}
+
+	registers := hll[HLL_HDR_SIZE:]
+	for _, element := range elements {
+		index, count := hllPatternLength(element)
+		if count > hllGetRegister(registers, index) {
+			hllSetRegister(registers, index, count)
+			updated = true
+		}
+	}
+
+	if updated {
+		hllInvalidateCache(hll)
+		storeHLL(key, hll)
+		return []byte(":1\r\n")
+	}
+	return []byte(":0\r\n")
+}
+
+// pfcount estimates the number of unique elements added to the given HyperLogLogs.
+// With several keys the estimate is that of their union. A single key's result
+// is cached in its header until the next modification.
+func pfcount(keys []string) []byte {
+	if len(keys) == 1 {
+		hll, errReply := lookupHLL(keys[0])
+		if errReply != nil {
+			return errReply
+		}
+		if hll == nil {
+			return []byte(":0\r\n")
+		}
+
+		if hll[15]&(1<<7) == 0 {
+			return []byte(":" + strconv.FormatUint(binary.LittleEndian.Uint64(hll[8:16]), 10) + "\r\n")
+		}
+
+		count := hllCount(hll[HLL_HDR_SIZE:])
+		binary.LittleEndian.PutUint64(hll[8:16], count)
+		storeHLL(keys[0], hll)
+		return []byte(":" + strconv.FormatUint(count, 10) + "\r\n")
+	}
+
+	merged, errReply := hllMerge(keys)
+	if errReply != nil {
+		return errReply
+	}
+	return []byte(":" + strconv.FormatUint(hllCount(merged[HLL_HDR_SIZE:]), 10) + "\r\n")
+}
+
+// hllMerge returns a HyperLogLog whose registers are the maximum of those at keys.
+// Missing keys are treated as empty.
+func hllMerge(keys []string) ([]byte, []byte) {
+	merged := newHLL()
+	for _, key := range keys {
+		hll, errReply := lookupHLL(key)
+		if errReply != nil {
+			return nil, errReply
+		}
+		if hll == nil {
+			continue
+		}
+
+		for i := 0; i < HLL_REGISTERS; i++ {
+			if value := hllGetRegister(hll[HLL_HDR_SIZE:], i); value > hllGetRegister(merged[HLL_HDR_SIZE:], i) {
+				hllSetRegister(merged[HLL_HDR_SIZE:], i, value)
+			}
+		}
+	}
+
+	hllInvalidateCache(merged)
+	return merged, nil
+}
+
+// pfmerge stores the union of the destination and source HyperLogLogs at destination.
+func pfmerge(destination string, sources []string) []byte {
+	merged, errReply := hllMerge(append([]string{destination}, sources...))
+	if errReply != nil {
+		return errReply
+	}
+
+	storeHLL(destination, merged)
+	return []byte("+OK\r\n")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// serverVersion is the version of Redis whose behaviour the server follows,
+// reported by INFO and HELLO.
+const serverVersion = "7.4.0"
+
+// serverStartTime is when the server started, for the uptime.
+var serverStartTime = time.Now()
+
+// Server statistics reported by INFO and cleared by CONFIG RESETSTAT. Except
+// for the atomic counters, updated outside of commands, they are guarded by
+// keyspaceMutex.
+var statNumCommands int64           // Commands processed
+var statNumConnections atomic.Int64 // Connections accepted
+var statKeyspaceHits int64          // Reads of an existing key
+var statKeyspaceMisses int64        // Reads of a missing key
+var runningReadCommand = false      // Whether the running command counts towards the hits and misses
+
+// infoSections lists the sections of INFO in the order they are reported, and
+// allInfoSections adds those only reported when asked for, by name or with
+// "all" or "everything".
+var infoSections = []string{"server", "memory", "persistence", "stats", "replication", "keyspace"}
+var allInfoSections = append(slices.Clone(infoSections), "commandstats", "latencystats")
+
+// recordKeyspaceLookup counts a key read by a read-only command as a hit or a
+// miss. Writes do not count, even when they read the key they modify.
+func recordKeyspaceLookup(found bool) {
+	if !runningReadCommand {
+		return
+	}
+	if found {
+		statKeyspaceHits++
+	} else {
+		statKeyspaceMisses++
+	}
+}
+
+// resetStats implements CONFIG RESETSTAT.
+// Must be called with keyspaceMutex held.
+func resetStats() {
+	statNumCommands = 0
+	statNumConnections.Store(0)
+	statOutputBufferLimitDisconnections.Store(0)
+	statKeyspaceHits = 0
+	statKeyspaceMisses = 0
+	statEvictedKeys = 0
+	clear(commandStatsTable)
+}
+
+// infoCommand implements INFO [section ...]. Without a section, or with
+// "default", the sections of infoSections are reported, and with "all" or
+// "everything" those of allInfoSections.
+// Must be called with keyspaceMutex held.
+func infoCommand(args []string) []byte {
+	sections := infoSections
+	if len(args) > 0 {
+		sections = nil
+		for _, arg := range args {
+			section := strings.ToLower(arg)
+			if section == "all" || section == "everything" {
+				sections = allInfoSections
+				break
+			}
+			if section == "default" {
+				sections = append(sections, infoSections...)
+				continue
+			}
+			sections = append(sections, section)
+		}
+	}
+
+	var b strings.Builder
+	for _, section := range allInfoSections {
+		if !slices.Contains(sections, section) {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		writeInfoSection(&b, section)
+	}
+	return StringToBulkString(b.String())
+}
+
+// writeInfoSection appends the header and the fields of a section of INFO.
+func writeInfoSection(b *strings.Builder, section string) {
+	field := func(name string, value any) {
+		fmt.Fprintf(b, "%s:%v\r\n", name, value)
+	}
+	boolField := func(name string, value bool) {
+		if value {
+			field(name, 1)
+		} else {
+			field(name, 0)
+		}
+	}
+
+	b.WriteString("# " + strings.ToUpper(section[:1]) + section[1:] + "\r\n")
+	switch section {
+	case "server":
+		uptime := time.Since(serverStartTime)
+		field("redis_version", serverVersion)
+		field("redis_mode", "standalone")
+		field("process_id", os.Getpid())
+		field("tcp_port", port)
+		field("uptime_in_seconds", int64(uptime.Seconds()))
+		field("uptime_in_days", int64(uptime.Hours()/24))
+
+	case "memory":
+		field("used_memory", usedMemory())
+		field("used_memory_peak", peakMemory.Load())
+		field("used_memory_startup", startupMemory)
+		field("maxmemory", maxmemory)
+		field("maxmemory_policy", maxmemoryPolicy)
+
+	case "persistence":
+		lastBgsaveStatus := "ok"
+		if lastBgsaveFailed {
+			lastBgsaveStatus = "err"
+		}
+		field("rdb_changes_since_last_save", dirty)
+		boolField("rdb_bgsave_in_progress", bgsaveInProgress)
+		field("rdb_last_save_time", lastSave.Unix())
+		field("rdb_last_bgsave_status", lastBgsaveStatus)
+		boolField("aof_enabled", appendOnly)
+		boolField("aof_rewrite_in_progress", aofRewriteInProgress)
+
+	case "stats":
+		field("total_connections_received", statNumConnections.Load())
+		field("total_commands_processed", statNumCommands)
+		field("keyspace_hits", statKeyspaceHits)
+		field("keyspace_misses", statKeyspaceMisses)
+		field("evicted_keys", statEvictedKeys)
+		field("client_output_buffer_limit_disconnections", statOutputBufferLimitDisconnections.Load())
+
+	case "replication":
+		if isReplica {
+			field("role", "slave")
+			field("master_host", replicaHost)
+			field("master_port", replicaPort)
+			field("master_repl_offset", offset)
+		} else {
+			field("role", "master")
+			field("connected_slaves", len(replicaClients))
+			field("master_replid", replID)
+			field("master_repl_offset", replOffset)
+		}
+
+	case "keyspace":
+		for i, db := range databases {
+			if len(db) == 0 {
+				continue
+			}
+			expires := 0
+			for _, obj := range db {
+				if obj.Expiry != nil {
+					expires++
+				}
+			}
+			fmt.Fprintf(b, "db%d:keys=%d,expires=%d\r\n", i, len(db), expires)
+		}
+
+	case "commandstats":
+		writeCommandStats(b, false)
+
+	case "latencystats":
+		writeCommandStats(b, true)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// ioThreads is the io-threads setting. With the default of 1, every connection
+// runs its commands itself, taking keyspaceMutex in turn. With more, commands
+// run on a single execution loop and at most ioThreads connections parse
+// requests at once, as with the I/O threads of Redis. Replies are written by
+// the writer goroutine of each client.
+var ioThreads = 1
+
+// ioSlots bounds the connections parsing at once, nil unless io-threads is
+// above 1.
+var ioSlots chan struct{}
+
+// executionQueue feeds the execution loop, nil unless io-threads is above 1.
+var executionQueue chan *execution
+
+// execution is a command handed to the execution loop.
+type execution struct {
+	run   func() []byte
+	reply chan []byte
+}
+
+// pendingBlock is a blocking command that could not be served right away,
+// left for its client to wait on when the execution loop ran it.
+type pendingBlock struct {
+	waiter       *blockedClient
+	timeout      time.Duration
+	timeoutReply []byte
+}
+
+// startIOThreads starts the execution loop when io-threads is above 1.
+func startIOThreads() {
+	if ioThreads <= 1 {
+		return
+	}
+	ioSlots = make(chan struct{}, ioThreads)
+	executionQueue = make(chan *execution, 1024)
+	go executionLoop()
+}
+
+// executionLoop runs the commands of every client, one at a time. It takes
+// keyspaceMutex once for all the commands queued meanwhile rather than once
+// per command, which spares the clients from contending on it. Background jobs
+// get the lock between batches.
+func executionLoop() {
+	for job := range executionQueue {
+		keyspaceMutex.Lock()
+		for batch := len(executionQueue); ; batch-- {
+			job.reply <- job.run()
+			serveBlockedClients()
+			if batch == 0 {
+				break
+			}
+			job = <-executionQueue
+		}
+		keyspaceMutex.Unlock()
+	}
+}
+
+// execute runs a command of client with keyspaceMutex held, on the execution
+// loop with io-threads, and returns its reply. A blocking command that cannot
+// be served right away makes the client wait here rather than on the loop.
+func execute(client *Client, run func() []byte) []byte {
+	if executionQueue == nil {
+		keyspaceMutex.Lock()
+		defer keyspaceMutex.Unlock()
+		reply := run()
+		serveBlockedClients()
+		return reply
+	}
+
+	job := &execution{run: run, reply: make(chan []byte, 1)}
+	executionQueue <- job
+	reply := <-job.reply
+
+	if pending := client.blocked; pending != nil {
+		client.blocked = nil
+		reply = waitForReply(pending.waiter, pending.timeout)
+		return execute(client, func() []byte {
+			return finishBlocking(pending.waiter, reply, pending.timeoutReply)
+		})
+	}
+	return reply
+}
+
+// ioSource is the connection a client's requests are read from. While the
+// client parses them holding an I/O slot, the slot is given back for as long
+// as a read waits on the network, so that slow clients do not hold it.
+type ioSource struct {
+	conn net.Conn
+	held bool
+}
+
+func (s *ioSource) Read(p []byte) (int, error) {
+	if !s.held {
+		return s.conn.Read(p)
+	}
+	<-ioSlots
+	n, err := s.conn.Read(p)
+	ioSlots <- struct{}{}
+	return n, err
+}
+
+// readClientRequest reads the next request of a client, holding an I/O slot
+// while parsing it with io-threads.
+func readClientRequest(requests *requestReader, source *ioSource) ([][]byte, int, error) {
+	if ioSlots == nil {
+		return requests.readRequest()
+	}
+	ioSlots <- struct{}{}
+	source.held = true
+	defer func() {
+		source.held = false
+		<-ioSlots
+	}()
+	return requests.readRequest()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// objectType identifies the data type held by a redisObject.
+type objectType int
+
+const (
+	StringType objectType = iota
+	ListType
+	SetType
+	ZSetType
+	HashType
+	StreamType
+)
+
+// typeNames maps every objectType to the name reported by TYPE.
+var typeNames = map[objectType]string{
+	StringType: "string",
+	ListType:   "list",
+	SetType:    "set",
+	ZSetType:   "zset",
+	HashType:   "hash",
+	StreamType: "stream",
+}
+
+// redisObject is a value stored in the keyspace together with its metadata.
+// Depending on Type, Value holds a string, a []string (list), a *redisSet (set),
+// a *sortedSet (zset), a *redisHash (hash) or a *redisStream (stream).
+// Keys, values and members are Go strings used as immutable byte sequences:
+// they are length-delimited everywhere, so binary data is stored as is.
+type redisObject struct {
+	Type       objectType
+	Value      interface{}
+	Expiry     *time.Time // Absolute expiration time, nil if the key never expires
+	LastAccess time.Time  // Last time a command read or wrote the value
+	Frequency  uint8      // Logarithmic access counter, kept under the LFU policies
+	LFUTime    uint32     // Minute the counter was last updated at, for its decay
+}
+
+// databaseCount is the number of logical databases, set with --databases.
+var databaseCount = 16
+
+// databases holds the numbered logical databases. Each maps every key to the
+// single value stored under it, whatever its type.
+var databases = makeDatabases(databaseCount)
+
+// keyspace is the database selected by the client whose command is running.
+// It is switched by selectDB before every command.
+var keyspace = databases[0]
+
+// selectedDB is the index of the database keyspace points at.
+var selectedDB = 0
+
+// wrongTypeError is the reply for an operation against a key holding another data type.
+const wrongTypeError = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+// keyspaceMutex serialises access to the keyspace. Client commands run while
+// holding it, and so does the background expiration cycle. Nothing is written
+// to a socket while it is held: replies and what is pushed to other clients,
+// pub/sub messages, invalidations and the replication stream, are queued for
+// the writer goroutine of each client, see send.
+var keyspaceMutex sync.Mutex
+
+// makeDatabases allocates count empty databases.
+func makeDatabases(count int) []map[string]*redisObject {
+	dbs := make([]map[string]*redisObject, count)
+	for i := range dbs {
+		dbs[i] = make(map[string]*redisObject)
+	}
+	return dbs
+}
+
+// selectDB points keyspace at the database with the given index.
+func selectDB(index int) {
+	selectedDB = index
+	keyspace = databases[index]
+}
+
+// parseDBIndex parses a database index argument.
+// On failure the RESP error to reply with is returned.
+func parseDBIndex(arg string) (int, []byte) {
+	index, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if index < 0 || index >= len(databases) {
+		return 0, []byte("-ERR DB index is out of range\r\n")
+	}
+	return index, nil
+}
+
+// isExpired reports whether obj has an expiry that has already passed.
+func isExpired(obj *redisObject) bool {
+	return obj.Expiry != nil && !time.Now().Before(*obj.Expiry)
+}
+
+// lookupKey returns the live value stored at key, or nil if there is none,
+// and records the access. An expired value is deleted on the spot.
+func lookupKey(key string) *redisObject {
+	obj := peekKey(key)
+	recordKeyspaceLookup(obj != nil)
+	if obj != nil {
+		obj.LastAccess = time.Now()
+		if lfuPolicy() {
+			updateLFU(obj)
+		}
+	}
+	return obj
+}
+
+// peekKey is lookupKey without recording the access, for commands that
+// only inspect the keyspace (EXISTS, TYPE, OBJECT...).
+func peekKey(key string) *redisObject {
+	obj, ok := keyspace[key]
+	if !ok {
+		return nil
+	}
+	if isExpired(obj) || expireHashFields(obj) {
+		delete(keyspace, key)
+		return nil
+	}
+	return obj
+}
+
+// lookupKeyOfType returns the live value stored at key if it has type t.
+// wrongType is set when key holds a value of another type.
+func lookupKeyOfType(key string, t objectType) (obj *redisObject, wrongType bool) {
+	obj = lookupKey(key)
+	if obj == nil {
+		return nil, false
+	}
+	if obj.Type != t {
+		return nil, true
+	}
+	return obj, false
+}
+
+// setKey stores value of type t at key, replacing any previous value and its TTL.
+// String values spelling small integers are stored as shared integers.
+// Returns the newly stored object.
+func setKey(key string, t objectType, value interface{}) *redisObject {
+	if s, ok := value.(string); ok {
+		value = stringValue(s)
+	}
+	obj := &redisObject{Type: t, Value: value, LastAccess: time.Now(), Frequency: lfuInitVal, LFUTime: lfuTimeInMinutes()}
+	keyspace[key] = obj
+	return obj
+}
+
+// keyExists reports whether key holds a live value.
+func keyExists(key string) bool {
+	return peekKey(key) != nil
+}
+
+// deleteKey removes key and its expiry from the keyspace.
+// Returns true if a live value was removed.
+func deleteKey(key string) bool {
+	existed := keyExists(key)
+	delete(keyspace, key)
+	return existed
+}
+
+// renameKey moves the value stored at source, along with its TTL, to destination,
+// overwriting any value already stored there. The caller must ensure source exists.
+func renameKey(source, destination string) {
+	if source == destination {
+		return
+	}
+
+	keyspace[destination] = keyspace[source]
+	delete(keyspace, source)
+	signalKeyAsReady(destination)
+}
+
+// duplicateObject returns a deep copy of obj, including its TTL.
+func duplicateObject(obj *redisObject) *redisObject {
+	duplicate := &redisObject{Type: obj.Type, LastAccess: time.Now(), Frequency: lfuInitVal, LFUTime: lfuTimeInMinutes()}
+	if obj.Expiry != nil {
+		t := *obj.Expiry
+		duplicate.Expiry = &t
+	}
+
+	switch value := obj.Value.(type) {
+	case []string:
+		duplicate.Value = slices.Clone(value)
+	case *redisSet:
+		duplicate.Value = value.clone()
+	case *sortedSet:
+		duplicate.Value = value.clone()
+	case *redisHash:
+		duplicate.Value = value.clone()
+	case *redisStream:
+		duplicate.Value = value.clone()
+	default:
+		// Strings are immutable
+		duplicate.Value = value
+	}
+
+	return duplicate
+}
+
+// copyKey stores a deep copy of the value at source, along with its TTL, under
+// destination in the target database, overwriting any value already stored there.
+// The caller must ensure source exists.
+func copyKey(source, destination string, target map[string]*redisObject) {
+	target[destination] = duplicateObject(keyspace[source])
+}
+
+// allKeys returns the name of every live key.
+func allKeys() []string {
+	keys := make([]string, 0, len(keyspace))
+	for key := range keyspace {
+		if peekKey(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// keyType returns the type name of the value stored at key, as reported by TYPE,
+// or "none" if the key does not exist.
+func keyType(key string) string {
+	obj := peekKey(key)
+	if obj == nil {
+		return "none"
+	}
+	return typeNames[obj.Type]
+}
+
+// flushDatabase removes every key of the database with the given index.
+// With async set, the old contents are swapped out for an empty map in
+// constant time and left to the garbage collector, rather than cleared key by
+// key, so that flushing a huge dataset does not stall the server.
+func flushDatabase(index int, async bool) {
+	if !async {
+		clear(databases[index])
+		return
+	}
+
+	databases[index] = make(map[string]*redisObject)
+	if index == selectedDB {
+		keyspace = databases[index]
+	}
+}
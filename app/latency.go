@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// latencyMonitorThreshold is the duration, in milliseconds, from which the
+// latency monitor records an event, set with latency-monitor-threshold.
+// 0 disables the monitor.
+var latencyMonitorThreshold = 0
+
+// latencyHistoryLen is the number of samples kept per event, as in Redis.
+const latencyHistoryLen = 160
+
+// latencySample is the worst latency of an event during one second.
+type latencySample struct {
+	time    int64 // Unix time, in seconds
+	latency int64 // In milliseconds
+}
+
+// latencyEvent is the history of the samples of an event, oldest first, and
+// the worst latency it ever had.
+type latencyEvent struct {
+	history []latencySample
+	max     int64
+}
+
+// latencyEvents maps the names of the events that went past the threshold to
+// their history. Guarded by keyspaceMutex.
+var latencyEvents = make(map[string]*latencyEvent)
+
+// latencyAddSampleIfNeeded records that event took d, if that reaches
+// latency-monitor-threshold. Samples of the same second are merged, keeping
+// the worst.
+//
+// The events are:
+//   - command and fast-command: commands, the fast ones being O(1) or O(log N)
+//   - expire-cycle: a round of the active expiration of keys
+//   - eviction-cycle: evicting keys to get back under maxmemory
+//   - fork: copying the dataset for a background save, which stalls clients
+//     where Redis forks
+//   - aof-write and aof-fsync-always: appending to the AOF, and syncing it
+//     under appendfsync always
+//
+// Must be called with keyspaceMutex held.
+func latencyAddSampleIfNeeded(event string, d time.Duration) {
+	if latencyMonitorThreshold == 0 || d < time.Duration(latencyMonitorThreshold)*time.Millisecond {
+		return
+	}
+
+	e := latencyEvents[event]
+	if e == nil {
+		e = &latencyEvent{}
+		latencyEvents[event] = e
+	}
+	ms, now := d.Milliseconds(), time.Now().Unix()
+	e.max = max(e.max, ms)
+	if last := len(e.history) - 1; last >= 0 && e.history[last].time == now {
+		e.history[last].latency = max(e.history[last].latency, ms)
+		return
+	}
+	if len(e.history) == latencyHistoryLen {
+		e.history = slices.Delete(e.history, 0, 1)
+	}
+	e.history = append(e.history, latencySample{time: now, latency: ms})
+}
+
+// latencyCommand implements LATENCY LATEST | HISTORY event | RESET [event ...]
+// | DOCTOR | HELP.
+// Must be called with keyspaceMutex held.
+func latencyCommand(args []string) []byte {
+	switch strings.ToLower(args[1]) {
+	case "latest":
+		if len(args) != 2 {
+			break
+		}
+		reply := []interface{}{}
+		for _, name := range slices.Sorted(maps.Keys(latencyEvents)) {
+			e := latencyEvents[name]
+			last := e.history[len(e.history)-1]
+			reply = append(reply, []interface{}{name, last.time, last.latency, e.max})
+		}
+		return encodeArray(reply)
+
+	case "history":
+		if len(args) != 3 {
+			break
+		}
+		reply := []interface{}{}
+		if e := latencyEvents[strings.ToLower(args[2])]; e != nil {
+			for _, sample := range e.history {
+				reply = append(reply, []interface{}{sample.time, sample.latency})
+			}
+		}
+		return encodeArray(reply)
+
+	case "reset":
+		reset := 0
+		if len(args) == 2 {
+			reset = len(latencyEvents)
+			clear(latencyEvents)
+		}
+		for _, name := range args[2:] {
+			name = strings.ToLower(name)
+			if latencyEvents[name] != nil {
+				delete(latencyEvents, name)
+				reset++
+			}
+		}
+		return []byte(":" + strconv.Itoa(reset) + "\r\n")
+
+	case "doctor":
+		if len(args) == 2 {
+			return StringToBulkString(latencyDoctor())
+		}
+
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"LATENCY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"DOCTOR",
+			"    Return a human readable latency analysis report.",
+			"HISTORY <event>",
+			"    Return time-latency samples for the <event> class.",
+			"LATEST",
+			"    Return the latest latency samples for all events.",
+			"RESET [<event> ...]",
+			"    Reset latency data of one or more <event> classes.",
+			"    (default: reset all data for all event classes)",
+			"HELP",
+			"    Print this help.",
+		})
+	}
+	return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(args[1]) + "'. Try LATENCY HELP.\r\n")
+}
+
+// latencyAdvice is the advice LATENCY DOCTOR gives for each event.
+var latencyAdvice = map[string]string{
+	"command":          "Check INFO commandstats and latencystats to find the commands that are too slow to execute, and avoid O(N) commands such as KEYS or SMEMBERS on large values.",
+	"fast-command":     "Even O(1) or O(log N) commands were slow: the host may be overloaded, or the garbage collector competing with the server for CPU. Check the system load and the memory used.",
+	"expire-cycle":     "Deleting, expiring or evicting large objects is costly. If you have very large objects that are often deleted, expired, or evicted, try to fragment those objects into multiple smaller objects.",
+	"eviction-cycle":   "Deleting, expiring or evicting large objects is costly. If you have very large objects that are often deleted, expired, or evicted, try to fragment those objects into multiple smaller objects.",
+	"fork":             "Background saves copy the whole dataset while clients wait. Consider fewer save points, or relying on the AOF instead.",
+	"aof-write":        "Writes to the AOF are slow: the disk is probably busy or slow. Consider a faster disk, or moving the AOF to a disk that is not shared with other processes.",
+	"aof-fsync-always": "Syncing the AOF after every write is slow on this disk. Consider appendfsync everysec, which syncs once per second in the background.",
+}
+
+// latencyDoctor builds the report of LATENCY DOCTOR, in the words of Redis.
+func latencyDoctor() string {
+	if latencyMonitorThreshold == 0 {
+		return "I'm sorry, Dave, I can't do that. Latency monitoring is disabled in this Redis instance. You may use \"latency-monitor-threshold <milliseconds>\" in the configuration file or on the command line in order to enable it.\n"
+	}
+	if len(latencyEvents) == 0 {
+		return "Dave, no latency spike was observed during the lifetime of this Redis instance, not in the slightest bit. I honestly think you ought to sleep tonight.\n"
+	}
+
+	var b strings.Builder
+	b.WriteString("Dave, I have observed latency spikes in this Redis instance. You don't mind talking about it, do you Dave?\n\n")
+	names := slices.Sorted(maps.Keys(latencyEvents))
+	for i, name := range names {
+		e := latencyEvents[name]
+		var sum int64
+		for _, sample := range e.history {
+			sum += sample.latency
+		}
+		avg := float64(sum) / float64(len(e.history))
+		var deviation float64
+		for _, sample := range e.history {
+			deviation += math.Abs(float64(sample.latency) - avg)
+		}
+		deviation /= float64(len(e.history))
+		period := 0.0
+		if len(e.history) > 1 {
+			period = float64(e.history[len(e.history)-1].time-e.history[0].time) / float64(len(e.history)-1)
+		}
+		fmt.Fprintf(&b, "%d. %s: %d latency spikes (average %.0fms, mean deviation %.0fms, period %.2f sec). Worst all time event %dms.\n",
+			i+1, name, len(e.history), avg, deviation, period, e.max)
+	}
+
+	b.WriteString("\nI have a few advices for you:\n\n")
+	seen := map[string]bool{}
+	for _, name := range names {
+		if advice, ok := latencyAdvice[name]; ok && !seen[advice] {
+			seen[advice] = true
+			b.WriteString("- " + advice + "\n")
+		}
+	}
+	return b.String()
+}
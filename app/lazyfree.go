@@ -0,0 +1,16 @@
+package main
+
+// Lazy freeing settings, set with the lazyfree-lazy-* parameters. In Redis they
+// make evictions, expiry, commands storing over existing keys, DEL and the
+// flushes free the values they remove in a background thread, as UNLINK and
+// the ASYNC flushes always do. Here removing a key only drops a reference, and
+// the garbage collector reclaims the value concurrently whatever its size, so
+// DEL already is what UNLINK is and these settings are accepted for
+// compatibility without effect, except for lazyfree-lazy-user-flush: flushes
+// are ASYNC by default under it, swapping the database for an empty one rather
+// than clearing it key by key.
+var lazyfreeLazyEviction = false
+var lazyfreeLazyExpire = false
+var lazyfreeLazyServerDel = false
+var lazyfreeLazyUserDel = false
+var lazyfreeLazyUserFlush = false
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// lookupList returns the list stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupList(key string) (list *redisObject, wrongType bool) {
+	return lookupKeyOfType(key, ListType)
+}
+
+// listItems returns the elements of the list held by obj (nil for a missing list).
+func listItems(obj *redisObject) []string {
+	if obj == nil {
+		return nil
+	}
+	return obj.Value.([]string)
+}
+
+// storeList replaces the elements of the list at key. An empty list removes the key,
+// matching Redis where a list ceases to exist once its last element is gone.
+func storeList(key string, items []string) {
+	if len(items) == 0 {
+		deleteKey(key)
+		return
+	}
+
+	signalKeyAsReady(key)
+	if obj, _ := lookupList(key); obj != nil {
+		obj.Value = items
+		return
+	}
+	setKey(key, ListType, items)
+}
+
+// normalizeListRange converts the inclusive, possibly negative, start and stop
+// indexes of LRANGE/LTRIM into bounds within a list of the given length.
+// ok is false when the range selects no elements.
+func normalizeListRange(start, stop, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		return 0, 0, false
+	}
+	return start, stop, true
+}
+
+// lrem removes occurrences of element from the list at key: the first count
+// from the head when count is positive, the last -count from the tail when
+// negative, or all of them when zero. Returns the number removed.
+func lrem(key string, count int, element string) []byte {
+	obj, wrongType := lookupList(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	list := listItems(obj)
+
+	limit := count
+	if limit < 0 {
+		limit = -limit
+	}
+
+	// Walk from the tail for a negative count so the last matches go first
+	keep := make([]bool, len(list))
+	removed := 0
+	for i := range list {
+		index := i
+		if count < 0 {
+			index = len(list) - 1 - i
+		}
+		if list[index] == element && (limit == 0 || removed < limit) {
+			removed++
+			continue
+		}
+		keep[index] = true
+	}
+
+	if removed == 0 {
+		return []byte(":0\r\n")
+	}
+
+	remaining := make([]string, 0, len(list)-removed)
+	for i, item := range list {
+		if keep[i] {
+			remaining = append(remaining, item)
+		}
+	}
+	storeList(key, remaining)
+	return []byte(":" + strconv.Itoa(removed) + "\r\n")
+}
+
+// ltrim keeps only the elements of the list at key within the inclusive range.
+// A range selecting nothing removes the key.
+func ltrim(key string, start, stop int) []byte {
+	obj, wrongType := lookupList(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	list := listItems(obj)
+	if list == nil {
+		return []byte("+OK\r\n")
+	}
+
+	start, stop, ok := normalizeListRange(start, stop, len(list))
+	if !ok {
+		storeList(key, nil)
+		return []byte("+OK\r\n")
+	}
+	storeList(key, slices.Clone(list[start:stop+1]))
+	return []byte("+OK\r\n")
+}
+
+// parseMultiPop parses the "numkeys key [key ...] where [COUNT count]" arguments
+// shared by LMPOP and ZMPOP. where must be one of the two given directions;
+// first reports whether it was the first of them.
+// On failure the RESP error to reply with is returned.
+func parseMultiPop(args []string, directions [2]string) (keys []string, first bool, count int, errReply []byte) {
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil || numKeys <= 0 {
+		return nil, false, 0, []byte("-ERR numkeys should be greater than 0\r\n")
+	}
+	if numKeys > len(args)-2 {
+		return nil, false, 0, []byte("-ERR Number of keys can't be greater than number of args\r\n")
+	}
+	keys = args[1 : numKeys+1]
+	rest := args[numKeys+1:]
+
+	switch strings.ToLower(rest[0]) {
+	case directions[0]:
+		first = true
+	case directions[1]:
+	default:
+		return nil, false, 0, []byte("-ERR syntax error\r\n")
+	}
+
+	count = 1
+	switch {
+	case len(rest) == 1:
+	case len(rest) == 3 && strings.ToLower(rest[1]) == "count":
+		count, err = strconv.Atoi(rest[2])
+		if err != nil || count <= 0 {
+			return nil, false, 0, []byte("-ERR count should be greater than 0\r\n")
+		}
+	default:
+		return nil, false, 0, []byte("-ERR syntax error\r\n")
+	}
+
+	return keys, first, count, nil
+}
+
+// lmpop pops up to count elements from the head (left) or tail of the first
+// non-empty list among keys, returning that key and the popped elements.
+// popped is nil when every list is empty.
+func lmpop(keys []string, left bool, count int) (key string, popped []string, errReply []byte) {
+	for _, key := range keys {
+		obj, wrongType := lookupList(key)
+		if wrongType {
+			return "", nil, []byte(wrongTypeError)
+		}
+		list := listItems(obj)
+		if len(list) == 0 {
+			continue
+		}
+
+		count = min(count, len(list))
+		if left {
+			popped = slices.Clone(list[:count])
+			storeList(key, list[count:])
+		} else {
+			popped = slices.Clone(list[len(list)-count:])
+			slices.Reverse(popped)
+			storeList(key, list[:len(list)-count])
+		}
+		return key, popped, nil
+	}
+	return "", nil, nil
+}
+
+// listPop implements LPOP and RPOP key [count]: an element of the head (left)
+// or tail of the list, or with a count an array of up to count of them, which
+// is empty for a count of 0 and null when the list does not exist.
+func listPop(args []string, left bool, protocol int) []byte {
+	if len(args) > 3 {
+		return []byte("-ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command\r\n")
+	}
+	count := 1
+	if len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return []byte("-ERR value is out of range, must be positive\r\n")
+		}
+		count = n
+	}
+
+	if len(args) == 3 && count == 0 {
+		if _, wrongType := lookupList(args[1]); wrongType {
+			return []byte(wrongTypeError)
+		}
+		return []byte("*0\r\n")
+	}
+	_, popped, errReply := lmpop(args[1:2], left, count)
+	if errReply != nil {
+		return errReply
+	}
+	if len(args) == 2 {
+		if popped == nil {
+			return encodeRESP(nil, protocol)
+		}
+		return StringToBulkString(popped[0])
+	}
+	if popped == nil {
+		return encodeRESP(respNullArray{}, protocol)
+	}
+	return StringArrayToBulkStringArray(popped)
+}
+
+// servedListPop is lmpop for the blocking pops. Replicas are sent
+// the equivalent non-blocking pop against the key that was served.
+func servedListPop(keys []string, left bool, count int) (key string, popped []string, errReply []byte) {
+	key, popped, errReply = lmpop(keys, left, count)
+	if popped != nil {
+		end := "RIGHT"
+		if left {
+			end = "LEFT"
+		}
+		PropagateWriteCommandToReplicas([]string{"LMPOP", "1", key, end, "COUNT", strconv.Itoa(len(popped))})
+	}
+	return key, popped, errReply
+}
+
+// parseListEnd parses a LEFT or RIGHT argument, reporting whether it was LEFT.
+func parseListEnd(arg string) (left bool, ok bool) {
+	switch strings.ToLower(arg) {
+	case "left":
+		return true, true
+	case "right":
+		return false, true
+	}
+	return false, false
+}
+
+// lmove atomically pops an element from one end of the source list and pushes it
+// onto one end of the destination list. Replies with the moved element,
+// or returns nil when the source list is empty.
+func lmove(source, destination string, fromLeft, toLeft bool) []byte {
+	sourceObj, wrongType := lookupList(source)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	sourceList := listItems(sourceObj)
+	if len(sourceList) == 0 {
+		return nil
+	}
+	destinationObj, wrongType := lookupList(destination)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	var element string
+	if fromLeft {
+		element = sourceList[0]
+		sourceList = sourceList[1:]
+	} else {
+		element = sourceList[len(sourceList)-1]
+		sourceList = sourceList[:len(sourceList)-1]
+	}
+	storeList(source, sourceList)
+
+	// Rotating a list onto itself pushes onto what is left after the pop
+	destinationList := listItems(destinationObj)
+	if source == destination {
+		destinationList = sourceList
+	}
+	if toLeft {
+		destinationList = append([]string{element}, destinationList...)
+	} else {
+		destinationList = append(slices.Clone(destinationList), element)
+	}
+	storeList(destination, destinationList)
+
+	return StringToBulkString(element)
+}
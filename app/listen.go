@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// TCP settings of the listening socket and of the accepted connections.
+var tcpBacklog = 511   // Length of the queue of connections waiting to be accepted
+var tcpKeepalive = 300 // Seconds between keepalive probes on idle connections, 0 disabling them
+var tcpNoDelay = true  // Whether small replies are sent right away rather than coalesced
+
+// configureConnection applies the TCP settings to an accepted connection.
+func configureConnection(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	// Keepalive probes detect peers gone without closing their connection,
+	// e.g. behind a NAT that dropped it
+	if tcpKeepalive > 0 {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(time.Duration(tcpKeepalive) * time.Second)
+	} else {
+		tcpConn.SetKeepAlive(false)
+	}
+	tcpConn.SetNoDelay(tcpNoDelay)
+}
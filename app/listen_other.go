@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// listenTCP listens on the TCP address. The backlog cannot be set on this
+// platform, the system's default applies.
+func listenTCP(address string, backlog int) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
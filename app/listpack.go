@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+// listpackWriter serializes a listpack, the compact layout Redis uses for small
+// collections and for the nodes of a stream: a 6-byte header (total size and
+// element count), the elements, and a 0xFF terminator. Each element is its
+// encoding and data followed by their length, so it can be walked backwards.
+type listpackWriter struct {
+	elements []byte
+	count    int
+}
+
+// appendString adds s, stored as an integer when it is the canonical decimal
+// form of one, as Redis does.
+func (lp *listpackWriter) appendString(s string) {
+	if value, ok := parseIntsetMember(s); ok {
+		lp.appendInt(value)
+		return
+	}
+
+	start := len(lp.elements)
+	switch n := len(s); {
+	case n < 64:
+		lp.elements = append(lp.elements, 0x80|byte(n))
+	case n < 4096:
+		lp.elements = append(lp.elements, 0xE0|byte(n>>8), byte(n))
+	default:
+		lp.elements = append(lp.elements, 0xF0)
+		lp.elements = binary.LittleEndian.AppendUint32(lp.elements, uint32(n))
+	}
+	lp.elements = append(lp.elements, s...)
+	lp.appendBacklen(len(lp.elements) - start)
+}
+
+// appendInt adds value in the smallest integer encoding able to hold it.
+func (lp *listpackWriter) appendInt(value int64) {
+	start := len(lp.elements)
+	switch {
+	case value >= 0 && value <= 127:
+		lp.elements = append(lp.elements, byte(value))
+	case value >= -4096 && value <= 4095:
+		v := uint16(value) & 0x1FFF
+		lp.elements = append(lp.elements, 0xC0|byte(v>>8), byte(v))
+	case value >= -32768 && value <= 32767:
+		lp.elements = append(lp.elements, 0xF1)
+		lp.elements = binary.LittleEndian.AppendUint16(lp.elements, uint16(value))
+	case value >= -8388608 && value <= 8388607:
+		v := uint32(value)
+		lp.elements = append(lp.elements, 0xF2, byte(v), byte(v>>8), byte(v>>16))
+	case value >= -2147483648 && value <= 2147483647:
+		lp.elements = append(lp.elements, 0xF3)
+		lp.elements = binary.LittleEndian.AppendUint32(lp.elements, uint32(value))
+	default:
+		lp.elements = append(lp.elements, 0xF4)
+		lp.elements = binary.LittleEndian.AppendUint64(lp.elements, uint64(value))
+	}
+	lp.appendBacklen(len(lp.elements) - start)
+}
+
+// appendBacklen terminates an element of the given size with that size, split
+// in 7-bit groups, most significant first, all but the first flagged with 0x80.
+func (lp *listpackWriter) appendBacklen(size int) {
+	n := listpackBacklenSize(size)
+	for i := n - 1; i >= 0; i-- {
+		group := byte(size>>(7*i)) & 0x7F
+		if i < n-1 {
+			group |= 0x80
+		}
+		lp.elements = append(lp.elements, group)
+	}
+	lp.count++
+}
+
+// listpackBacklenSize returns how many bytes the backlen of an element of the
+// given size takes, with the same thresholds as Redis.
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// bytes returns the serialized listpack.
+func (lp *listpackWriter) bytes() []byte {
+	total := 6 + len(lp.elements) + 1
+	buf := make([]byte, 0, total)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(total))
+	// The count saturates, readers then have to walk the elements
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(min(lp.count, 65535)))
+	buf = append(buf, lp.elements...)
+	return append(buf, 0xFF)
+}
+
+// errCorruptEncoding reports a listpack, ziplist or intset that cannot be parsed.
+var errCorruptEncoding = errors.New("corrupt listpack, ziplist or intset")
+
+// parseListpack returns the elements of a serialized listpack, integers being
+// converted to their decimal form.
+func parseListpack(data []byte) ([]string, error) {
+	if len(data) < 7 {
+		return nil, errCorruptEncoding
+	}
+
+	var elements []string
+	pos := 6
+	for pos < len(data) && data[pos] != 0xFF {
+		b := data[pos]
+		var size int   // Encoding and data, the backlen excluded
+		var str []byte // Set for string elements
+		var value int64
+
+		need := func(n int) bool { return pos+n <= len(data) }
+		switch {
+		case b&0x80 == 0:
+			size, value = 1, int64(b)
+		case b&0xC0 == 0x80:
+			n := int(b & 0x3F)
+			if !need(1 + n) {
+				return nil, errCorruptEncoding
+			}
+			size, str = 1+n, data[pos+1:pos+1+n]
+		case b&0xE0 == 0xC0:
+			if !need(2) {
+				return nil, errCorruptEncoding
+			}
+			v := int64(b&0x1F)<<8 | int64(data[pos+1])
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+			size, value = 2, v
+		case b&0xF0 == 0xE0:
+			if !need(2) {
+				return nil, errCorruptEncoding
+			}
+			n := int(b&0x0F)<<8 | int(data[pos+1])
+			if !need(2 + n) {
+				return nil, errCorruptEncoding
+			}
+			size, str = 2+n, data[pos+2:pos+2+n]
+		case b == 0xF0:
+			if !need(5) {
+				return nil, errCorruptEncoding
+			}
+			n := int(binary.LittleEndian.Uint32(data[pos+1:]))
+			if n < 0 || !need(5+n) {
+				return nil, errCorruptEncoding
+			}
+			size, str = 5+n, data[pos+5:pos+5+n]
+		case b == 0xF1 && need(3):
+			size, value = 3, int64(int16(binary.LittleEndian.Uint16(data[pos+1:])))
+		case b == 0xF2 && need(4):
+			v := uint32(data[pos+1]) | uint32(data[pos+2])<<8 | uint32(data[pos+3])<<16
+			size, value = 4, int64(int32(v<<8)>>8)
+		case b == 0xF3 && need(5):
+			size, value = 5, int64(int32(binary.LittleEndian.Uint32(data[pos+1:])))
+		case b == 0xF4 && need(9):
+			size, value = 9, int64(binary.LittleEndian.Uint64(data[pos+1:]))
+		default:
+			return nil, errCorruptEncoding
+		}
+
+		if str != nil {
+			elements = append(elements, string(str))
+		} else {
+			elements = append(elements, strconv.FormatInt(value, 10))
+		}
+		pos += size + listpackBacklenSize(size)
+	}
+	if pos >= len(data) {
+		return nil, errCorruptEncoding
+	}
+	return elements, nil
+}
+
+// parseZiplist returns the elements of a serialized ziplist, the compact
+// encoding listpacks replaced in Redis 7, found in RDB files of older versions.
+func parseZiplist(data []byte) ([]string, error) {
+	if len(data) < 11 {
+		return nil, errCorruptEncoding
+	}
+
+	var elements []string
+	pos := 10
+	for pos < len(data) && data[pos] != 0xFF {
+		// Skip the length of the previous entry
+		if data[pos] < 254 {
+			pos++
+		} else {
+			pos += 5
+		}
+		if pos >= len(data) {
+			return nil, errCorruptEncoding
+		}
+
+		b := data[pos]
+		need := func(n int) bool { return pos+n <= len(data) }
+		var header, n int
+		switch b >> 6 {
+		case 0:
+			header, n = 1, int(b&0x3F)
+		case 1:
+			if !need(2) {
+				return nil, errCorruptEncoding
+			}
+			header, n = 2, int(b&0x3F)<<8|int(data[pos+1])
+		case 2:
+			if !need(5) {
+				return nil, errCorruptEncoding
+			}
+			header, n = 5, int(binary.BigEndian.Uint32(data[pos+1:]))
+		}
+		if header > 0 {
+			if n < 0 || !need(header+n) {
+				return nil, errCorruptEncoding
+			}
+			elements = append(elements, string(data[pos+header:pos+header+n]))
+			pos += header + n
+			continue
+		}
+
+		var value int64
+		switch {
+		case b == 0xC0 && need(3):
+			value, pos = int64(int16(binary.LittleEndian.Uint16(data[pos+1:]))), pos+3
+		case b == 0xD0 && need(5):
+			value, pos = int64(int32(binary.LittleEndian.Uint32(data[pos+1:]))), pos+5
+		case b == 0xE0 && need(9):
+			value, pos = int64(binary.LittleEndian.Uint64(data[pos+1:])), pos+9
+		case b == 0xF0 && need(4):
+			v := uint32(data[pos+1]) | uint32(data[pos+2])<<8 | uint32(data[pos+3])<<16
+			value, pos = int64(int32(v<<8)>>8), pos+4
+		case b == 0xFE && need(2):
+			value, pos = int64(int8(data[pos+1])), pos+2
+		case b >= 0xF1 && b <= 0xFD:
+			value, pos = int64(b&0x0F)-1, pos+1
+		default:
+			return nil, errCorruptEncoding
+		}
+		elements = append(elements, strconv.FormatInt(value, 10))
+	}
+	if pos >= len(data) {
+		return nil, errCorruptEncoding
+	}
+	return elements, nil
+}
+
+// parseIntset returns the members of a serialized intset: the integer width
+// in bytes, the member count, then the sorted members, all little-endian.
+func parseIntset(data []byte) ([]string, error) {
+	if len(data) < 8 {
+		return nil, errCorruptEncoding
+	}
+	width := int(binary.LittleEndian.Uint32(data))
+	count := int(binary.LittleEndian.Uint32(data[4:]))
+	if (width != 2 && width != 4 && width != 8) || count < 0 || len(data) != 8+width*count {
+		return nil, errCorruptEncoding
+	}
+
+	members := make([]string, count)
+	for i := range members {
+		at := data[8+i*width:]
+		var value int64
+		switch width {
+		case 2:
+			value = int64(int16(binary.LittleEndian.Uint16(at)))
+		case 4:
+			value = int64(int32(binary.LittleEndian.Uint32(at)))
+		default:
+			value = int64(binary.LittleEndian.Uint64(at))
+		}
+		members[i] = strconv.FormatInt(value, 10)
+	}
+	return members, nil
+}
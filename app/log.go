@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log levels, from the most to the least verbose, as in Redis.
+const (
+	logDebug = iota
+	logVerbose
+	logNotice
+	logWarning
+)
+
+// logLevelNames maps the values of loglevel to the levels, and logLevelMarks
+// gives the character Redis marks the lines of each level with.
+var logLevelNames = map[string]int{"debug": logDebug, "verbose": logVerbose, "notice": logNotice, "warning": logWarning}
+var logLevelMarks = []byte{'.', '-', '*', '#'}
+
+// loglevel is the least level logged, set with loglevel, and logfile the file
+// the log is appended to, set with logfile. "" logs to the standard output.
+var loglevel = "notice"
+var logfile = ""
+
+// logOutput is where the log goes, guarded by logMutex as every goroutine logs.
+var logOutput io.Writer = os.Stdout
+var logMutex sync.Mutex
+
+// openLogFile opens logfile, if set, for the log to be appended to.
+func openLogFile() error {
+	if logfile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(logfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logOutput = f
+	return nil
+}
+
+// serverLog logs a message of the given level, formatted as by fmt.Sprintf,
+// if loglevel lets it through. Lines are laid out as in Redis: the process ID,
+// the role (M for a primary, S for a replica), the time and the level mark.
+func serverLog(level int, format string, args ...any) {
+	if level < logLevelNames[loglevel] {
+		return
+	}
+	role := 'M'
+	if isReplica {
+		role = 'S'
+	}
+	line := fmt.Sprintf("%d:%c %s %c %s\n", os.Getpid(), role,
+		time.Now().Format("02 Jan 2006 15:04:05.000"), logLevelMarks[level], fmt.Sprintf(format, args...))
+
+	logMutex.Lock()
+	defer logMutex.Unlock()
+	io.WriteString(logOutput, line)
+}
+
+// clientLog logs a message about a client, prefixed with its ID and address so
+// that the lines of a connection can be told apart.
+func clientLog(level int, client *Client, format string, args ...any) {
+	if level < logLevelNames[loglevel] {
+		return
+	}
+	serverLog(level, "id=%d addr=%s %s", client.ID, client.Connection.RemoteAddr(), fmt.Sprintf(format, args...))
+}
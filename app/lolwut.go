@@ -0,0 +1,171 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+)
+
+// lolwutCommand implements LOLWUT [VERSION version] [arg ...]. As in Redis,
+// version 5 draws Georg Nees' Schotter, taking the number of columns of the
+// terminal and of squares per row and column as arguments; the other
+// versions, the default one included, only tell the version of the server.
+func lolwutCommand(args []string) []byte {
+	version := 0
+	if len(args) >= 3 && strings.ToLower(args[1]) == "version" {
+		v, err := strconv.Atoi(args[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		version, args = v, args[3:]
+	} else {
+		args = args[1:]
+	}
+
+	if version != 5 {
+		return StringToBulkString("Redis ver. " + serverVersion + "\n")
+	}
+
+	// Columns, squares per row and squares per column, as Redis bounds them
+	params := []int{66, 8, 12}
+	limits := []int{1000, 200, 200}
+	for i := range params {
+		if i < len(args) {
+			n, err := strconv.Atoi(args[i])
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			params[i] = n
+		}
+		params[i] = min(max(params[i], 1), limits[i])
+	}
+
+	canvas := drawSchotter(params[0], params[1], params[2])
+	return StringToBulkString(canvas.render() +
+		"\nGeorg Nees - schotter, plotter on paper, 1968. Redis ver. " + serverVersion + "\n")
+}
+
+// lolwutCanvas is a monochrome picture, rendered with Braille characters of
+// 2x4 pixels each.
+type lolwutCanvas struct {
+	width, height int
+	pixels        []bool
+}
+
+func newLolwutCanvas(width, height int) *lolwutCanvas {
+	return &lolwutCanvas{width: width, height: height, pixels: make([]bool, width*height)}
+}
+
+// set turns on the pixel at x, y, ignoring those out of the canvas.
+func (c *lolwutCanvas) set(x, y int) {
+	if x >= 0 && x < c.width && y >= 0 && y < c.height {
+		c.pixels[y*c.width+x] = true
+	}
+}
+
+// get reports whether the pixel at x, y is on, those out of the canvas being off.
+func (c *lolwutCanvas) get(x, y int) bool {
+	return x >= 0 && x < c.width && y >= 0 && y < c.height && c.pixels[y*c.width+x]
+}
+
+// line draws a line with Bresenham's algorithm.
+func (c *lolwutCanvas) line(x1, y1, x2, y2 int) {
+	dx, dy := max(x2-x1, x1-x2), max(y2-y1, y1-y2)
+	sx, sy := 1, 1
+	if x1 >= x2 {
+		sx = -1
+	}
+	if y1 >= y2 {
+		sy = -1
+	}
+	err := dx - dy
+	for {
+		c.set(x1, y1)
+		if x1 == x2 && y1 == y2 {
+			return
+		}
+		e2 := err * 2
+		if e2 > -dy {
+			err -= dy
+			x1 += sx
+		}
+		if e2 < dx {
+			err += dx
+			y1 += sy
+		}
+	}
+}
+
+// square draws a square centered on x, y, rotated by angle radians.
+func (c *lolwutCanvas) square(x, y int, size, angle float64) {
+	var px, py [4]int
+	size = math.Round(size / math.Sqrt2)
+	k := math.Pi/4 + angle
+	for j := range 4 {
+		px[j] = int(math.Round(math.Sin(k)*size + float64(x)))
+		py[j] = int(math.Round(math.Cos(k)*size + float64(y)))
+		k += math.Pi / 2
+	}
+	for j := range 4 {
+		c.line(px[j], py[j], px[(j+1)%4], py[(j+1)%4])
+	}
+}
+
+// render returns the canvas as lines of Braille characters.
+func (c *lolwutCanvas) render() string {
+	var b strings.Builder
+	for y := 0; y < c.height; y += 4 {
+		for x := 0; x < c.width; x += 2 {
+			// The dots of a Braille character, in the order of its bits
+			dots := [8][2]int{{0, 0}, {0, 1}, {0, 2}, {1, 0}, {1, 1}, {1, 2}, {0, 3}, {1, 3}}
+			bits := 0
+			for i, dot := range dots {
+				if c.get(x+dot[0], y+dot[1]) {
+					bits |= 1 << i
+				}
+			}
+			b.WriteRune(rune(0x2800 + bits))
+		}
+		if y != c.height-1 {
+			b.WriteByte('\n')
+		}
+	}
+	return b.String()
+}
+
+// drawSchotter draws a grid of squares, ever more disordered from one row to
+// the next, as in Schotter.
+func drawSchotter(consoleCols, squaresPerRow, squaresPerCol int) *lolwutCanvas {
+	width := consoleCols * 2
+	padding := 0
+	if width > 4 {
+		padding = 2
+	}
+	side := float64(width-padding*2) / float64(squaresPerRow)
+	height := int(side*float64(squaresPerCol)) + padding*2
+	canvas := newLolwutCanvas(width, height)
+
+	// random returns a random offset, up to y/squaresPerCol either way
+	random := func(y int) float64 {
+		r := rand.Float64() / float64(squaresPerCol) * float64(y)
+		if rand.IntN(2) == 1 {
+			r = -r
+		}
+		return r
+	}
+	for y := range squaresPerCol {
+		for x := range squaresPerRow {
+			sx := int(float64(x)*side + side/2 + float64(padding))
+			sy := int(float64(y)*side + side/2 + float64(padding))
+			angle := 0.0
+			if y > 1 {
+				angle = random(y)
+				sx += int(random(y) * side / 3)
+				sy += int(random(y) * side / 3)
+			}
+			canvas.square(sx, sy, side, angle)
+		}
+	}
+	return canvas
+}
@@ -3,56 +3,49 @@ package main
 import (
 	"bufio"
 	"encoding/base64"
-	"fmt"
+	"errors"
 	"io"
 	"net"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// valueType represents a stored value with an optional expiration time in the 'data' map.
-type valueType struct {
-	valueString string
-	expiry      *time.Time
-}
-
 // Client holds the state for a connected TCP client.
 type Client struct {
+	ID                 int64            // Unique, increasing identifier
+	Name               string           // Set with CLIENT SETNAME or HELLO SETNAME
+	Protocol           int              // RESP version of the replies, 2 or 3
+	Tracking           *trackingOptions // Set while CLIENT TRACKING is on
+	Primary            bool             // Set on a replica's connection to its primary
+	Replica            bool             // Set once the client has become a replica with PSYNC
+	CreatedAt          time.Time
+	LastInteraction    time.Time // When the client last ran a command
+	LastCommand        string
 	SubscribedMode     bool
 	Authenticated      bool
 	Username           string
+	DB                 int  // Index of the selected logical database
+	InExec             bool // Set while the client's MULTI/EXEC transaction runs
 	SubscribedChannels map[string]struct{}
+	SubscribedPatterns map[string]struct{}
 	Connection         net.Conn
 	Reader             *bufio.Reader
-}
-
-type streamEntry map[string]string
-
-type ArrayElementType int
-
-const (
-	BulkString ArrayElementType = iota
-	Integer
-)
-
-type ArrayElement struct {
-	Type  ArrayElementType
-	Value string
+	output             *outputQueue  // Queues the replies and pushes, see write, flush and send
+	blocked            *pendingBlock // Left by a blocking command run on the execution loop
 }
 
 // ACLUser defines user permissions and credentials
 type ACLUser struct {
-	Flags     map[string]bool
-	Passwords []string // List of valid SHA-256 password hashes
+	Flags        map[string]bool
+	Passwords    []string        // List of valid SHA-256 password hashes
+	Commands     map[string]bool // Whether the user may run a command, or a "command|subcommand"
+	CommandRules []string        // The command rules applied since the last +@all or -@all
+	KeyPatterns  []string        // Glob-style patterns of the keys the user may access
 }
 
-// Data stores for different Redis data types
-var streams = make(map[string][]streamEntry)
-var data = make(map[string]*valueType)
-var listData = make(map[string][]string)
-
 // Replication state
 var offset = 0 // Tracks the replication offset (bytes processed)
 var emptyRDBBase64 = "UkVESVMwMDEx+glyZWRpcy12ZXIFNy4yLjD6CnJlZGlzLWJpdHPAQPoFY3RpbWXCbQi8ZfoIdXNlZC1tZW3CsMQQAPoIYW9mLWJhc2XAAP/wbjv+wP9aog=="
@@ -60,15 +53,18 @@ var emptyRDB []byte
 
 // Configuration defaults
 var dir = ""
-var dbfilename = ""
+var dbfilename = "dump.rdb"
 var port = "6379"
 
-// maps channel names to a list of client connections
-var channelSubscribers = make(map[string][]net.Conn)
+// maps channel names to the clients subscribed to them
+var channelSubscribers = make(map[string][]*Client)
+
+// maps glob patterns to the clients subscribed to them with PSUBSCRIBE
+var patternSubscribers = make(map[string][]*Client)
 
 // ACL Users initialization (default user has no password)
 var users = map[string]*ACLUser{
-	"default": {Flags: map[string]bool{"nopass": true}, Passwords: []string{}},
+	"default": {Flags: map[string]bool{"on": true, "nopass": true}, Passwords: []string{}},
 }
 
 // Commands allowed while a client is in Pub/Sub mode
@@ -81,26 +77,38 @@ var allowedInSubscribeMode = map[string]bool{
 	"quit":         true,
 }
 
-// Commands that modify data (used to determine if propagation is needed)
-var writeCommand = map[string]bool{
-	"set": true,
-	"del": true,
+// Write commands that send replicas an explicit equivalent once they have
+// run, rather than being propagated as sent: the blocking and random ones, and
+// XADD whose ID may be generated. They still count as changes for the save points.
+var explicitlyPropagatedWriteCommand = map[string]bool{
+	"blpop":      true,
+	"brpop":      true,
+	"blmpop":     true,
+	"blmove":     true,
+	"spop":       true,
+	"bzpopmin":   true,
+	"bzpopmax":   true,
+	"bzmpop":     true,
+	"xadd":       true,
+	"xreadgroup": true,
 }
 
 // handleConnection manages the lifecycle of a client connection.
 // If connectionToPrimary is true, it performs the replication handshake first.
 func handleConnection(conn net.Conn, connectionToPrimary bool) {
 	inTransaction := false
+	transactionFailed := false // Set when a command could not be queued, making EXEC abort
 	var queuedCommands []Command
 
-	reader := bufio.NewReader(conn)
+	source := &ioSource{conn: conn}
+	reader := bufio.NewReader(source)
 
 	// Replication Handshake Logic (if acting as a replica)
 	if connectionToPrimary {
 		// Step 1: Send PING to verify connection
 		_, err := conn.Write([]byte("*1\r\n$4\r\nPING\r\n"))
 		if err != nil {
-			fmt.Println("Failed to send PING to primary:", err)
+			serverLog(logWarning, "Failed to send PING to primary: %v", err)
 			return
 		}
 		reader.ReadString('\n') // Consume PONG
@@ -108,7 +116,7 @@ func handleConnection(conn net.Conn, connectionToPrimary bool) {
 		// Step 2: Inform primary of the listening port
 		_, err = conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$14\r\nlistening-port\r\n$" + strconv.Itoa(len(port)) + "\r\n" + port + "\r\n"))
 		if err != nil {
-			fmt.Println("Failed to send REPLCONF listening-port:", err)
+			serverLog(logWarning, "Failed to send REPLCONF listening-port: %v", err)
 			return
 		}
 		reader.ReadString('\n') // Consume OK
@@ -116,7 +124,7 @@ func handleConnection(conn net.Conn, connectionToPrimary bool) {
 		// Step 3: Inform primary of capabilities (psync2 support)
 		_, err = conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"))
 		if err != nil {
-			fmt.Println("Failed to send REPLCONF capa psync2:", err)
+			serverLog(logWarning, "Failed to send REPLCONF capa psync2: %v", err)
 			return
 		}
 		reader.ReadString('\n') // Consume OK
@@ -124,74 +132,126 @@ func handleConnection(conn net.Conn, connectionToPrimary bool) {
 		// Step 4: Initiate synchronization
 		_, err = conn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"))
 		if err != nil {
-			fmt.Println("Failed to send PSYNC:", err)
+			serverLog(logWarning, "Failed to send PSYNC: %v", err)
 			return
 		}
 
 		// Read PSYNC response
 		line, err := reader.ReadString('\n')
 		if err != nil {
-			fmt.Println("Failed to read PSYNC response:", err)
+			serverLog(logWarning, "Failed to read PSYNC response: %v", err)
 			return
 		}
 		line = strings.TrimSpace(line)
-		fmt.Println("PSYNC response:", line)
+		serverLog(logNotice, "PSYNC response: %s", line)
 
 		// Step 5: Handle Full Resynchronization (RDB transfer)
 		if strings.HasPrefix(line, "+FULLRESYNC") {
 			// Read RDB header (starts with $)
 			rdbHeader, err := reader.ReadString('\n')
 			if err != nil {
-				fmt.Println("Failed to read RDB header:", err)
+				serverLog(logWarning, "Failed to read RDB header: %v", err)
 				return
 			}
 
 			if len(rdbHeader) == 0 || rdbHeader[0] != '$' {
-				fmt.Println("Expected RDB bulk string, got:", rdbHeader)
+				serverLog(logWarning, "Expected RDB bulk string, got: %q", rdbHeader)
 				return
 			}
 
 			// Parse RDB size
 			rdbLen, err := strconv.Atoi(strings.TrimSpace(rdbHeader[1:]))
 			if err != nil {
-				fmt.Println("Invalid RDB length:", err)
+				serverLog(logWarning, "Invalid RDB length: %v", err)
 				return
 			}
 
 			// Read the actual RDB binary data
 			rdb := make([]byte, rdbLen)
 			if _, err := io.ReadFull(reader, rdb); err != nil {
-				fmt.Println("Failed to read RDB:", err)
+				serverLog(logWarning, "Failed to read RDB: %v", err)
 				return
 			}
 
-			fmt.Println("RDB fully received, size:", rdbLen)
+			serverLog(logNotice, "RDB fully received, size: %d", rdbLen)
 		}
 	}
 
 	// Initialize client state
 	client := &Client{
+		ID:                 nextClientID.Add(1),
+		Protocol:           2,
+		Primary:            connectionToPrimary,
+		CreatedAt:          time.Now(),
+		LastInteraction:    time.Now(),
 		Connection:         conn,
 		SubscribedChannels: make(map[string]struct{}),
-		Authenticated:      users["default"].Flags["nopass"],
+		SubscribedPatterns: make(map[string]struct{}),
+		Authenticated:      users["default"].Flags["on"] && users["default"].Flags["nopass"],
 		Username:           "default",
 		Reader:             reader,
 	}
+	client.startOutput()
+	// The primary's stream runs without a user, so that ACL rules do not apply
+	if connectionToPrimary {
+		client.Username = ""
+	}
+	registerClient(client)
+	defer disconnectClient(client)
+	clientLog(logVerbose, client, "Accepted connection")
+
+	requests := newRequestReader(reader)
 
 	// Main Loop
 	for {
+		// Replies are sent once the client's pipeline is drained, so that
+		// pipelined commands cost one write instead of one per reply, or
+		// once too many are pending, to hold back a client that pipelines
+		// more than it reads
+		if reader.Buffered() == 0 || client.pendingOutput() > backpressureThreshold {
+			client.flush()
+		}
+
 		// Parse the next command from the client
-		commandStringArray, commandOffset, err := readRESPArray(reader)
+		setIdleDeadline(client)
+		args, commandOffset, err := readClientRequest(requests, source)
 		if err != nil {
 			if err == io.EOF {
+				clientLog(logVerbose, client, "Client closed connection")
+				return
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				clientLog(logVerbose, client, "Closing idle client")
 				return
 			}
-			fmt.Println("read error:", err)
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				client.write([]byte("-ERR " + protoErr.Error() + "\r\n"))
+			}
+			clientLog(logVerbose, client, "Closing client after read error: %v", err)
 			return
 		}
 
+		commandStringArray := argumentStrings(args)
 		commandName := strings.ToLower(commandStringArray[0])
 
+		// The offset acknowledged to the primary counts every byte of its stream
+		if connectionToPrimary {
+			offset += commandOffset
+		}
+
+		// Commands renamed with rename-command run under their own name, the
+		// one replicas and the AOF know them by. The primary's commands are
+		// never renamed.
+		if !connectionToPrimary {
+			commandName = resolveCommandName(commandName)
+			if commandName == "" {
+				client.write(unknownCommandError(commandStringArray))
+				continue
+			}
+			commandStringArray[0] = commandName
+		}
+
 		command := Command{
 			StringArray: commandStringArray,
 			Name:        commandName,
@@ -205,71 +265,99 @@ func handleConnection(conn net.Conn, connectionToPrimary bool) {
 			if len(commandStringArray) >= 2 {
 				// Replica responding to GETACK from primary to confirm offset
 				if connectionToPrimary && strings.ToLower(commandStringArray[1]) == "getack" {
-					// Respond with REPLCONF ACK <offset>
-					conn.Write([]byte(StringArrayToBulkStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(offset - 37)})))
+					// Respond with REPLCONF ACK <offset>, the GETACK itself excluded
+					client.write(StringArrayToBulkStringArray([]string{"REPLCONF", "ACK", strconv.Itoa(offset - commandOffset)}))
 					continue
 				}
 			}
 
 			// Default response for other REPLCONF commands
-			conn.Write([]byte("+OK\r\n"))
+			client.write([]byte("+OK\r\n"))
 
 		case "multi":
 			// Start a transaction
 			inTransaction = true
+			transactionFailed = false
 			queuedCommands = nil
-			conn.Write([]byte("+OK\r\n"))
+			if !connectionToPrimary {
+				client.write([]byte("+OK\r\n"))
+			}
 
 		case "exec":
 			// Process all queued commands in the transaction
 			if !inTransaction {
-				conn.Write([]byte("-ERR EXEC without MULTI\r\n"))
+				client.write([]byte("-ERR EXEC without MULTI\r\n"))
 				continue
 			}
 
 			inTransaction = false
+			if transactionFailed {
+				queuedCommands = nil
+				client.write([]byte("-EXECABORT Transaction discarded because of previous errors.\r\n"))
+				continue
+			}
 
 			results := make([][]byte, 0, len(queuedCommands))
 
-			// Process every queued command
-			for _, cmd := range queuedCommands {
-				reply := ProcessCommand(client, cmd)
-				results = append(results, reply)
-			}
+			// Process every queued command, holding the lock throughout so the
+			// transaction is not interleaved with other clients
+			execute(client, func() []byte {
+				client.InExec = true
+				beginPropagatedTransaction()
+				for _, cmd := range queuedCommands {
+					reply := ProcessCommand(client, cmd)
+					results = append(results, reply)
+				}
+				endPropagatedTransaction()
+				client.InExec = false
+				return nil
+			})
 
 			queuedCommands = nil
 
-			// Build array response for EXEC
-			response := "*" + strconv.Itoa(len(results)) + "\r\n"
-			for _, r := range results {
-				response += string(r)
+			// Reply with the array of the replies
+			if !connectionToPrimary {
+				client.write([]byte("*" + strconv.Itoa(len(results)) + "\r\n"))
+				for _, r := range results {
+					client.write(r)
+				}
 			}
 
-			conn.Write([]byte(response))
-
 		case "discard":
 			// Discard the transaction
 			if !inTransaction {
-				conn.Write([]byte("-ERR DISCARD without MULTI\r\n"))
+				client.write([]byte("-ERR DISCARD without MULTI\r\n"))
 				continue
 			}
 
 			inTransaction = false
 			queuedCommands = nil
-			conn.Write([]byte("+OK\r\n"))
+			client.write([]byte("+OK\r\n"))
 
 		default:
 			if inTransaction {
-				// Queue command if inside a transaction
+				// Queue command if inside a transaction. Unknown commands and
+				// wrong numbers of arguments make the whole transaction fail.
+				if errReply := validateCommand(commandName, commandStringArray); errReply != nil {
+					transactionFailed = true
+					if !connectionToPrimary {
+						client.write(errReply)
+					}
+					continue
+				}
 				queuedCommands = append(queuedCommands, command)
-				conn.Write([]byte("+QUEUED\r\n"))
+				if !connectionToPrimary {
+					client.write([]byte("+QUEUED\r\n"))
+				}
 			} else {
 				// Process immediately
-				response := ProcessCommand(client, command)
+				response := execute(client, func() []byte {
+					return ProcessCommand(client, command)
+				})
 
 				// Replicas should not reply to commands sent by primary
 				if !connectionToPrimary {
-					conn.Write(response)
+					client.write(response)
 				}
 			}
 		}
@@ -277,73 +365,148 @@ func handleConnection(conn net.Conn, connectionToPrimary bool) {
 	}
 }
 
+// disconnectClient releases everything registered on behalf of a client whose
+// connection is gone: its pub/sub subscriptions, its client-side caching and,
+// for a replica, its place in the replication stream. Without this, PUBLISH and propagation would keep
+// queueing output for the dead connection.
+func disconnectClient(client *Client) {
+	keyspaceMutex.Lock()
+	defer keyspaceMutex.Unlock()
+
+	for channel := range client.SubscribedChannels {
+		removeSubscriber(channelSubscribers, channel, client)
+	}
+	for pattern := range client.SubscribedPatterns {
+		removeSubscriber(patternSubscribers, pattern, client)
+	}
+	replicaClients = slices.DeleteFunc(replicaClients, func(replica *Client) bool {
+		return replica == client
+	})
+	disableTracking(client)
+	delete(clients, client.ID)
+
+	// The writer sends the replies still queued, such as the one to QUIT,
+	// before closing the connection
+	client.closeOutput()
+}
+
 func main() {
 	var err error
 	// Decode the hardcoded empty RDB file for initializing replicas
 	emptyRDB, err = base64.StdEncoding.DecodeString(emptyRDBBase64)
 	if err != nil {
-		fmt.Println("Failed to decode Base64 RDB:", err.Error())
+		serverLog(logWarning, "Failed to decode Base64 RDB: %v", err)
 	}
 
-	// Argument Parsing
-	args := os.Args
-	for i := 1; i < len(args); i++ {
-		switch args[i] {
-
-		case "--port":
-			if i+1 < len(args) {
-				port = args[i+1]
-				i++
-			}
+	// Configuration: the file given with --config, overridden by the other flags
+	if err := loadConfig(os.Args[1:]); err != nil {
+		serverLog(logWarning, "Invalid configuration: %v", err)
+		os.Exit(1)
+	}
+	if daemonizeServer {
+		if err := daemonize(); err != nil {
+			serverLog(logWarning, "Failed to daemonize: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := openLogFile(); err != nil {
+		serverLog(logWarning, "Can't open the log file: %v", err)
+		os.Exit(1)
+	}
 
-		case "--replicaof":
-			if i+1 < len(args) {
-				isReplica = true
-				replicaHost = strings.Split(args[i+1], " ")[0]
-				replicaPort = strings.Split(args[i+1], " ")[1]
-				i++
-			}
+	createPidFile()
 
-		case "--dir":
-			if i+1 < len(args) {
-				dir = args[i+1]
-				i++
-			}
+	databases = makeDatabases(databaseCount)
+	selectDB(0)
+	applyMemoryLimit()
+	startupMemory = usedMemory()
 
-		case "--dbfilename":
-			if i+1 < len(args) {
-				dbfilename = args[i+1]
-				i++
-			}
+	// Restore the dataset saved by a previous run, if any, from the AOF when
+	// it is enabled and exists, otherwise from the RDB file. Replicas get
+	// theirs from the primary instead.
+	if !isReplica {
+		err := os.ErrNotExist
+		if appendOnly {
+			err = loadAppendOnlyFile()
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			err = loadRDBFile()
+		}
+		if err != nil {
+			serverLog(logWarning, "Failed loading the dataset: %v", err)
+			os.Exit(1)
+		}
+	}
+	if appendOnly {
+		if err := openAppendOnlyFile(); err != nil {
+			serverLog(logWarning, "Failed opening the AOF: %v", err)
+			os.Exit(1)
 		}
 	}
 
+	// Run the commands on a single execution loop with io-threads
+	startIOThreads()
+
 	// Start TCP Listener
-	l, err := net.Listen("tcp", "0.0.0.0:"+port)
+	l, err := listenTCP("0.0.0.0:"+port, tcpBacklog)
 	if err != nil {
-		fmt.Println("Failed to bind to port ", port)
+		serverLog(logWarning, "Failed to bind to port %s: %v", port, err)
 		os.Exit(1)
 	}
 
+	// Reclaim expired keys in the background
+	go activeExpireCycle()
+
+	// Dump the dataset whenever a save point is reached
+	go saveCron()
+
+	// Flush the AOF to disk every second under the everysec policy
+	go aofFsyncCron()
+
+	// Keep track of the peak memory usage
+	go memoryCron()
+
+	// Expose the metrics to Prometheus on their own port
+	if metricsPort > 0 {
+		go serveMetrics()
+	}
+
+	// Expose the profiles of the running server for performance investigations
+	if debugHTTPAddr != "" {
+		go serveDebugHTTP()
+	}
+
+	// Persist the dataset before exiting on SIGTERM or SIGINT
+	go handleShutdownSignals(l)
+
 	// If configured as a replica, connect to the primary instance immediately
 	if isReplica {
 		conn, err := net.Dial("tcp", replicaHost+":"+replicaPort)
 		if err != nil {
-			fmt.Println("Failed to connect to primary:", err)
+			serverLog(logWarning, "Failed to connect to primary: %v", err)
 			return
 		}
 
+		configureConnection(conn)
 		go handleConnection(conn, true)
 	}
 
+	serverLog(logNotice, "Ready to accept connections on port %s", port)
+
 	// Accept incoming connections
 	for {
 		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			// Shutting down: the signal handler exits once the dataset is persisted
+			select {}
+		}
 		if err != nil {
-			fmt.Println("Error accepting connection: ", err.Error())
+			serverLog(logWarning, "Error accepting connection: %v", err)
 			os.Exit(1)
 		}
 
+		statNumConnections.Add(1)
+		configureConnection(conn)
 		go handleConnection(conn, false)
 	}
 }
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Estimated overheads, in bytes, of the structures holding the dataset.
+const (
+	objectOverhead  = 64  // A redisObject and its entry in the database map
+	elementOverhead = 16  // A string header in a slice
+	entryOverhead   = 48  // An entry of a Go map
+	clientOverhead  = 512 // A Client and its connection, besides its buffers
+)
+
+// Garbage collector bookkeeping for usedMemory: the bytes released by evictions
+// since the last collection, which the heap keeps showing until it runs.
+// Atomic, so that the memory used can be sampled without keyspaceMutex.
+var lastGCCycles atomic.Uint64
+var freedSinceGC atomic.Int64
+
+// peakMemory is the most memory used seen so far, and startupMemory the memory
+// used once the server started, before loading the dataset.
+var peakMemory atomic.Int64
+var startupMemory int64
+
+// usedMemory returns the memory used by the server, checked against maxmemory:
+// the heap objects, live or not yet collected, less what evictions released
+// since the last collection. It only reads runtime metrics and atomics, so it
+// needs no lock.
+func usedMemory() int64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/heap/objects:bytes"},
+		{Name: "/gc/cycles/total:gc-cycles"},
+	}
+	metrics.Read(samples)
+	if cycles := samples[1].Value.Uint64(); lastGCCycles.Swap(cycles) != cycles {
+		freedSinceGC.Store(0)
+	}
+	used := int64(samples[0].Value.Uint64()) - freedSinceGC.Load()
+	for peak := peakMemory.Load(); used > peak && !peakMemory.CompareAndSwap(peak, used); {
+		peak = peakMemory.Load()
+	}
+	return used
+}
+
+// memoryCronInterval is how often memoryCron samples the memory used.
+const memoryCronInterval = 100 * time.Millisecond
+
+// memoryCron samples the memory used in the background, so that peakMemory
+// catches the peaks reached between the commands that check it. It does not
+// take keyspaceMutex, which every command needs.
+func memoryCron() {
+	ticker := time.NewTicker(memoryCronInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		usedMemory()
+	}
+}
+
+// applyMemoryLimit makes the garbage collector run more often as the heap
+// nears maxmemory, so that garbage does not count as used memory for long.
+func applyMemoryLimit() {
+	if maxmemory > 0 {
+		debug.SetMemoryLimit(maxmemory)
+	}
+}
+
+// memoryUsageSamples is the number of elements of an aggregate value whose
+// size is measured by default, the others being assumed of the same average size.
+const memoryUsageSamples = 5
+
+// objectMemoryUsage estimates the bytes taken by key and its value. The size of
+// a list, set, hash, sorted set or stream is extrapolated from the first
+// samples elements, or computed from all of them when samples is 0.
+func objectMemoryUsage(key string, obj *redisObject, samples int) int64 {
+	size := int64(objectOverhead + len(key))
+	if obj.Expiry != nil {
+		size += 24
+	}
+
+	// sampled extrapolates to count elements the sizes of the first samples
+	// ones, which each yields until told to stop
+	sampled := func(count int, each func(yield func(int64) bool)) int64 {
+		total, n := int64(0), 0
+		each(func(elementSize int64) bool {
+			total += elementSize
+			n++
+			return samples == 0 || n < samples
+		})
+		if n == 0 {
+			return 0
+		}
+		return total * int64(count) / int64(n)
+	}
+	stringsSize := func(strs []string) int64 {
+		return sampled(len(strs), func(yield func(int64) bool) {
+			for _, s := range strs {
+				if !yield(int64(elementOverhead + len(s))) {
+					return
+				}
+			}
+		})
+	}
+
+	switch value := obj.Value.(type) {
+	case string:
+		size += int64(len(value))
+	case []string:
+		size += stringsSize(value)
+	case *redisSet:
+		size += int64(len(value.intset) * 8)
+		size += stringsSize(value.listpack)
+		size += sampled(len(value.dict), func(yield func(int64) bool) {
+			for member := range value.dict {
+				if !yield(int64(entryOverhead + len(member))) {
+					return
+				}
+			}
+		})
+	case *redisHash:
+		size += stringsSize(value.listpack)
+		size += sampled(len(value.dict), func(yield func(int64) bool) {
+			for field, v := range value.dict {
+				if !yield(int64(entryOverhead + len(field) + len(v))) {
+					return
+				}
+			}
+		})
+		size += int64(len(value.expiries) * entryOverhead)
+	case *sortedSet:
+		size += sampled(len(value.listpack), func(yield func(int64) bool) {
+			for _, member := range value.listpack {
+				if !yield(int64(elementOverhead + 8 + len(member.Member))) {
+					return
+				}
+			}
+		})
+		// The dict and the skiplist both index every member
+		size += sampled(len(value.dict), func(yield func(int64) bool) {
+			for member := range value.dict {
+				if !yield(int64(entryOverhead + 8 + 32 + len(member))) {
+					return
+				}
+			}
+		})
+	case *redisStream:
+		size += sampled(len(value.entries), func(yield func(int64) bool) {
+			for _, entry := range value.entries {
+				entrySize := int64(16)
+				for _, field := range entry.Fields {
+					entrySize += int64(elementOverhead + len(field))
+				}
+				if !yield(entrySize) {
+					return
+				}
+			}
+		})
+		for name, group := range value.groups {
+			size += int64(entryOverhead + len(name))
+			size += int64(len(group.pending) * (entryOverhead + 64))
+			size += int64(len(group.consumers) * (entryOverhead + 64))
+		}
+	}
+	return size
+}
+
+// clientMemoryUsage estimates the bytes taken by a client: its request buffer,
+// the output queued for it and its subscriptions.
+func clientMemoryUsage(c *Client) int64 {
+	size := int64(clientOverhead + len(c.Name))
+	if c.Reader != nil {
+		size += int64(c.Reader.Size())
+	}
+	size += c.pendingOutput()
+	for channel := range c.SubscribedChannels {
+		size += int64(entryOverhead + len(channel))
+	}
+	for pattern := range c.SubscribedPatterns {
+		size += int64(entryOverhead + len(pattern))
+	}
+	return size
+}
+
+// memoryStats builds the reply of MEMORY STATS. The memory used is split into
+// the server's own overhead, estimated, and the dataset, which is the rest.
+// The breakdown per type estimates the size of every key, so it walks the
+// whole keyspace.
+func memoryStats(protocol int) []byte {
+	used := usedMemory()
+
+	var normalClients, replicaClientsSize int64
+	for _, c := range clients {
+		if c.Replica {
+			replicaClientsSize += clientMemoryUsage(c)
+		} else {
+			normalClients += clientMemoryUsage(c)
+		}
+	}
+	aofBuffer := int64(aofRewriteBuffer.Cap())
+
+	stats := respMap{
+		"peak.allocated", peakMemory.Load(),
+		"total.allocated", used,
+		"startup.allocated", startupMemory,
+		"clients.slaves", replicaClientsSize,
+		"clients.normal", normalClients,
+		"aof.buffer", aofBuffer,
+	}
+	overhead := startupMemory + normalClients + replicaClientsSize + aofBuffer
+
+	keys := 0
+	typeKeys := make(map[objectType]int)
+	typeBytes := make(map[objectType]int64)
+	for i, db := range databases {
+		if len(db) == 0 {
+			continue
+		}
+		expires := 0
+		for key, obj := range db {
+			if obj.Expiry != nil {
+				expires++
+			}
+			typeKeys[obj.Type]++
+			typeBytes[obj.Type] += objectMemoryUsage(key, obj, memoryUsageSamples)
+		}
+		mainOverhead := int64(len(db) * entryOverhead)
+		expiresOverhead := int64(expires * 24)
+		stats = append(stats, "db."+strconv.Itoa(i), respMap{
+			"overhead.hashtable.main", mainOverhead,
+			"overhead.hashtable.expires", expiresOverhead,
+		})
+		overhead += mainOverhead + expiresOverhead
+		keys += len(db)
+	}
+
+	dataset := max(used-overhead, 0)
+	net := used - startupMemory
+	bytesPerKey, datasetPercentage := int64(0), 0.0
+	if keys > 0 {
+		bytesPerKey = net / int64(keys)
+	}
+	if net > 0 {
+		datasetPercentage = float64(dataset) * 100 / float64(net)
+	}
+	stats = append(stats,
+		"overhead.total", overhead,
+		"keys.count", keys,
+		"keys.bytes-per-key", bytesPerKey,
+		"dataset.bytes", dataset,
+		"dataset.percentage", datasetPercentage,
+		"peak.percentage", float64(used)*100/float64(max(peakMemory.Load(), 1)),
+	)
+
+	for t := StringType; t <= StreamType; t++ {
+		stats = append(stats, "type."+typeNames[t], respMap{
+			"keys", typeKeys[t],
+			"bytes", typeBytes[t],
+		})
+	}
+	return encodeRESP(stats, protocol)
+}
+
+// memoryDoctor reports the memory issues spotted by a few heuristics, in the
+// words of Redis's MEMORY DOCTOR.
+func memoryDoctor() string {
+	used := usedMemory()
+	if used < 5<<20 {
+		return "Hi Sam, this instance is empty or is using very little memory, my issues detector can't be used in these conditions. Please, leave for your mission on Earth and fill it with some data. The new Sam and I will be back to our programming as soon as I finished rebooting."
+	}
+
+	var issues []string
+	if peak := peakMemory.Load(); peak > used*3/2 {
+		issues = append(issues, fmt.Sprintf(" * Peak memory: In the past this instance used more than 150%% the memory that is currently using (peak %d bytes, now %d). The Go runtime gives the memory it no longer needs back to the operating system over time, so the RSS of the process may stay above the memory used for a while after a peak.", peak, used))
+	}
+	if maxmemory > 0 && maxmemoryPolicy == "noeviction" && used > maxmemory/10*9 {
+		issues = append(issues, " * Memory limit: More than 90% of maxmemory is used and maxmemory-policy is noeviction, so commands using more memory will soon be refused with OOM errors. Consider raising maxmemory or choosing an eviction policy.")
+	}
+
+	// The heap objects not live after the last collection are garbage
+	samples := []metrics.Sample{{Name: "/gc/heap/live:bytes"}}
+	metrics.Read(samples)
+	if live := int64(samples[0].Value.Uint64()); live > 0 && used > live*2 {
+		issues = append(issues, " * High garbage ratio: More than half of the memory used is garbage not collected yet, typically left by large deletions or big replies. It counts as used memory until the next garbage collection.")
+	}
+
+	if len(issues) == 0 {
+		return "Hi Sam, I can't find any memory issue in your instance. I can only account for what occurs on this base."
+	}
+	return "Sam, I detected a few issues in this Redis instance memory implants:\n\n" +
+		strings.Join(issues, "\n\n") +
+		"\n\nI'm here to keep you safe, Sam. I want to help you.\n"
+}
+
+// memoryCommand implements MEMORY USAGE | STATS | DOCTOR | HELP.
+// Must be called with keyspaceMutex held.
+func memoryCommand(args []string, protocol int) []byte {
+	if len(args) < 2 {
+		return []byte("-ERR wrong number of arguments for 'memory' command\r\n")
+	}
+
+	switch strings.ToLower(args[1]) {
+	case "usage":
+		if len(args) != 3 && len(args) != 5 {
+			break
+		}
+		samples := memoryUsageSamples
+		if len(args) == 5 {
+			if strings.ToLower(args[3]) != "samples" {
+				return []byte("-ERR syntax error\r\n")
+			}
+			n, err := strconv.Atoi(args[4])
+			if err != nil || n < 0 {
+				return []byte("-ERR value is out of range, must be positive\r\n")
+			}
+			samples = n
+		}
+		obj := peekKey(args[2])
+		if obj == nil {
+			return encodeRESP(nil, 2)
+		}
+		return []byte(":" + strconv.FormatInt(objectMemoryUsage(args[2], obj, samples), 10) + "\r\n")
+
+	case "stats":
+		if len(args) == 2 {
+			return memoryStats(protocol)
+		}
+
+	case "doctor":
+		if len(args) == 2 {
+			return StringToBulkString(memoryDoctor())
+		}
+
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"MEMORY <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"USAGE <key> [SAMPLES <count>]",
+			"    Return memory in bytes used by <key> and its value. Nested values are",
+			"    sampled up to <count> times (default: 5, 0 means sample all).",
+			"STATS",
+			"    Return information about the memory usage of the server.",
+			"DOCTOR",
+			"    Return memory problems reports.",
+			"HELP",
+			"    Print this help.",
+		})
+	}
+	return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(args[1]) + "'. Try MEMORY HELP.\r\n")
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metricsPort is the port of the HTTP server exposing /metrics to Prometheus,
+// set with metrics-port. 0 disables it.
+var metricsPort = 0
+
+// serveMetrics serves /metrics on metricsPort until the process exits.
+func serveMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	addr := net.JoinHostPort("0.0.0.0", strconv.Itoa(metricsPort))
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		serverLog(logWarning, "Failed to serve metrics: %v", err)
+	}
+}
+
+// metricsHandler replies with the metrics in the Prometheus text format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	keyspaceMutex.Lock()
+	body := metricsText()
+	keyspaceMutex.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(body))
+}
+
+// metricsWriter formats metric families in the Prometheus text format.
+type metricsWriter struct {
+	b strings.Builder
+}
+
+// family starts the metric family name, of the given kind: counter or gauge.
+func (w *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(&w.b, "# HELP gedis_%s %s\n# TYPE gedis_%s %s\n", name, help, name, kind)
+}
+
+// sample adds a sample of the family name, with labels given as alternating
+// names and values.
+func (w *metricsWriter) sample(name string, value any, labels ...string) {
+	w.b.WriteString("gedis_" + name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+		}
+		w.b.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	fmt.Fprintf(&w.b, " %v\n", value)
+}
+
+// metricsText builds the metrics: the figures of INFO, the calls of every
+// command as counters, which Prometheus turns into rates, and the time since
+// a replica last heard from its primary as its replication lag.
+// Must be called with keyspaceMutex held.
+func metricsText() string {
+	var w metricsWriter
+
+	w.family("uptime_seconds", "gauge", "Seconds since the server started.")
+	w.sample("uptime_seconds", int64(time.Since(serverStartTime).Seconds()))
+
+	// Clients, replicas excluded as in INFO
+	connected, subscribed := 0, 0
+	for _, c := range clients {
+		if c.Replica {
+			continue
+		}
+		connected++
+		if c.SubscribedMode {
+			subscribed++
+		}
+	}
+	w.family("connected_clients", "gauge", "Connected clients, replicas excluded.")
+	w.sample("connected_clients", connected)
+	w.family("connections_received_total", "counter", "Connections accepted.")
+	w.sample("connections_received_total", statNumConnections.Load())
+
+	w.family("commands_processed_total", "counter", "Commands processed.")
+	w.sample("commands_processed_total", statNumCommands)
+	w.family("commands_total", "counter", "Calls of each command.")
+	names := slices.Sorted(maps.Keys(commandStatsTable))
+	for _, name := range names {
+		w.sample("commands_total", commandStatsTable[name].calls, "cmd", name)
+	}
+	w.family("commands_duration_seconds_total", "counter", "Time spent running each command.")
+	for _, name := range names {
+		w.sample("commands_duration_seconds_total", float64(commandStatsTable[name].usec)/1e6, "cmd", name)
+	}
+	w.family("commands_rejected_calls_total", "counter", "Calls of each command refused before running.")
+	for _, name := range names {
+		w.sample("commands_rejected_calls_total", commandStatsTable[name].rejectedCalls, "cmd", name)
+	}
+	w.family("commands_failed_calls_total", "counter", "Calls of each command that replied with an error.")
+	for _, name := range names {
+		w.sample("commands_failed_calls_total", commandStatsTable[name].failedCalls, "cmd", name)
+	}
+	w.family("keyspace_hits_total", "counter", "Reads of an existing key.")
+	w.sample("keyspace_hits_total", statKeyspaceHits)
+	w.family("keyspace_misses_total", "counter", "Reads of a missing key.")
+	w.sample("keyspace_misses_total", statKeyspaceMisses)
+	w.family("evicted_keys_total", "counter", "Keys evicted to stay under maxmemory.")
+	w.sample("evicted_keys_total", statEvictedKeys)
+
+	w.family("db_keys", "gauge", "Keys of each non-empty database.")
+	expires := make([]int, len(databases))
+	for i, db := range databases {
+		if len(db) == 0 {
+			continue
+		}
+		for _, obj := range db {
+			if obj.Expiry != nil {
+				expires[i]++
+			}
+		}
+		w.sample("db_keys", len(db), "db", fmt.Sprintf("db%d", i))
+	}
+	w.family("db_keys_expiring", "gauge", "Keys with an expiry of each non-empty database.")
+	for i, db := range databases {
+		if len(db) > 0 {
+			w.sample("db_keys_expiring", expires[i], "db", fmt.Sprintf("db%d", i))
+		}
+	}
+
+	w.family("memory_used_bytes", "gauge", "Memory used, checked against maxmemory.")
+	w.sample("memory_used_bytes", usedMemory())
+	w.family("memory_used_peak_bytes", "gauge", "Most memory used since the start.")
+	w.sample("memory_used_peak_bytes", peakMemory.Load())
+	w.family("memory_max_bytes", "gauge", "The maxmemory limit, 0 for none.")
+	w.sample("memory_max_bytes", maxmemory)
+
+	w.family("connected_slaves", "gauge", "Replicas connected to this primary.")
+	w.sample("connected_slaves", len(replicaClients))
+	w.family("repl_offset_bytes", "gauge", "Replication offset: sent to the replicas by a primary, received from the primary by a replica.")
+	if isReplica {
+		w.sample("repl_offset_bytes", offset)
+	} else {
+		w.sample("repl_offset_bytes", replOffset)
+	}
+	if isReplica {
+		// The primary's link is the only client flagged Primary
+		linkUp, lastIO := 0, 0.0
+		for _, c := range clients {
+			if c.Primary {
+				linkUp, lastIO = 1, time.Since(c.LastInteraction).Seconds()
+			}
+		}
+		w.family("master_link_up", "gauge", "Whether the replica is connected to its primary.")
+		w.sample("master_link_up", linkUp)
+		w.family("master_last_io_seconds", "gauge", "Seconds since the replica last received a command from its primary.")
+		w.sample("master_last_io_seconds", lastIO)
+	}
+
+	w.family("pubsub_channels", "gauge", "Channels with subscribers.")
+	w.sample("pubsub_channels", len(channelSubscribers))
+	w.family("pubsub_patterns", "gauge", "Patterns with subscribers.")
+	w.sample("pubsub_patterns", len(patternSubscribers))
+	w.family("pubsub_clients", "gauge", "Clients in subscribed mode.")
+	w.sample("pubsub_clients", subscribed)
+
+	return w.b.String()
+}
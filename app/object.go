@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// objectEncoding returns the name of the internal representation of obj,
+// as reported by OBJECT ENCODING.
+func objectEncoding(obj *redisObject) string {
+	switch obj.Type {
+	case StringType:
+		str := obj.Value.(string)
+		if len(str) <= 20 {
+			if _, err := strconv.ParseInt(str, 10, 64); err == nil {
+				return "int"
+			}
+		}
+		if len(str) <= 44 {
+			return "embstr"
+		}
+		return "raw"
+	case ListType:
+		// Lists are always a single slice: only the name Redis would report
+		// is emulated, by their length against list-max-listpack-size
+		if len(obj.Value.([]string)) <= listMaxListpackSize {
+			return "listpack"
+		}
+		return "quicklist"
+	case SetType:
+		return obj.Value.(*redisSet).encoding()
+	case HashType:
+		return obj.Value.(*redisHash).encoding()
+	case ZSetType:
+		return obj.Value.(*sortedSet).encoding()
+	case StreamType:
+		return "stream"
+	}
+	return "unknown"
+}
+
+// objectCommand implements OBJECT ENCODING | IDLETIME | FREQ | REFCOUNT | HELP.
+// Inspecting a key does not count as an access to it.
+func objectCommand(commandStringArray []string) []byte {
+	if len(commandStringArray) < 2 {
+		return []byte("-ERR wrong number of arguments for 'object' command\r\n")
+	}
+	subcommand := strings.ToLower(commandStringArray[1])
+
+	if subcommand == "help" {
+		return StringArrayToBulkStringArray([]string{
+			"OBJECT <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"ENCODING <key>",
+			"    Return the kind of internal representation used in order to store the value",
+			"    associated with a <key>.",
+			"FREQ <key>",
+			"    Return the access logarithmic frequency counter of a <key>.",
+			"IDLETIME <key>",
+			"    Return the idle time of a <key>, that is the approximated number of",
+			"    seconds elapsed since the last access to the key.",
+			"REFCOUNT <key>",
+			"    Return the number of references of the value associated with the specified",
+			"    <key>.",
+		})
+	}
+
+	if len(commandStringArray) != 3 {
+		return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try OBJECT HELP.\r\n")
+	}
+
+	obj := peekKey(commandStringArray[2])
+
+	switch subcommand {
+	case "encoding":
+		if obj == nil {
+			return []byte("$-1\r\n")
+		}
+		return StringToBulkString(objectEncoding(obj))
+
+	case "idletime":
+		if obj == nil {
+			return []byte("$-1\r\n")
+		}
+		idle := int64(time.Since(obj.LastAccess) / time.Second)
+		return []byte(":" + strconv.FormatInt(idle, 10) + "\r\n")
+
+	case "freq":
+		if obj == nil {
+			return []byte("$-1\r\n")
+		}
+		if !lfuPolicy() {
+			return []byte("-ERR An LFU maxmemory policy is not selected, access frequency not tracked. Please note that when switching between policies at runtime LRU and LFU data will take some time to adjust.\r\n")
+		}
+		return []byte(":" + strconv.Itoa(int(lfuDecrAndReturn(obj))) + "\r\n")
+
+	case "refcount":
+		if obj == nil {
+			return []byte("$-1\r\n")
+		}
+		// Shared integers report the refcount Redis gives its shared objects
+		if s, ok := obj.Value.(string); ok {
+			if _, shared := sharedInteger(s); shared {
+				return []byte(":2147483647\r\n")
+			}
+		}
+		return []byte(":1\r\n")
+	}
+
+	return []byte("-ERR unknown subcommand '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try OBJECT HELP.\r\n")
+}
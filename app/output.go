@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// outputQueue holds what is to be sent to a client until its writer goroutine
+// sends it, so that no connection ever writes to another's socket, nor to its
+// own with keyspaceMutex held: a client that stops reading only fills its own
+// queue, up to its output buffer limit.
+type outputQueue struct {
+	mutex            sync.Mutex
+	drained          sync.Cond     // Broadcast whenever the writer has sent a batch
+	chunks           [][]byte      // Queued, not yet taken by the writer
+	pending          int64         // Bytes queued or being written
+	wake             chan struct{} // Wakes the writer, holds at most one wakeup
+	closed           bool          // Set once nothing more is to be queued
+	softLimitReached time.Time     // When pending went over the soft limit, zero if it is not
+	done             chan struct{} // Closed when the writer returns
+}
+
+// outputBufferLimit bounds the pending output of a class of clients. A client
+// is disconnected once it reaches the hard limit, or stays over the soft limit
+// for more than softSeconds. 0 disables a limit.
+type outputBufferLimit struct {
+	hard        int64
+	soft        int64
+	softSeconds int
+}
+
+// outputBufferLimits holds the limits of each class of clients, set with
+// client-output-buffer-limit. The defaults are those of Redis.
+var outputBufferLimits = map[string]*outputBufferLimit{
+	"normal":  {},
+	"replica": {hard: 256 << 20, soft: 64 << 20, softSeconds: 60},
+	"pubsub":  {hard: 32 << 20, soft: 8 << 20, softSeconds: 60},
+}
+
+// outputBufferLimitClasses lists the classes in the order CONFIG GET reports them.
+var outputBufferLimitClasses = []string{"normal", "replica", "pubsub"}
+
+// statOutputBufferLimitDisconnections counts the clients disconnected for
+// reaching their output buffer limit, as reported by INFO. It is updated by
+// whichever goroutine queues the output that goes over the limit.
+var statOutputBufferLimitDisconnections atomic.Int64
+
+// backpressureThreshold is the pending output over which a client's connection
+// loop flushes and waits for its writer before reading the next command, so that
+// a client pipelining commands faster than it reads the replies is held back
+// instead of growing its queue.
+const backpressureThreshold = 1 << 20
+
+// closeTimeout bounds the time the output still queued for a disconnected
+// client takes to be sent.
+const closeTimeout = 10 * time.Second
+
+// startOutput sets up the output queue of a client and starts its writer.
+func (c *Client) startOutput() {
+	c.output = &outputQueue{wake: make(chan struct{}, 1), done: make(chan struct{})}
+	c.output.drained.L = &c.output.mutex
+	go c.writeOutput()
+}
+
+// write queues b for the client. The replies to the client's own commands are
+// queued this way, and sent once its connection loop calls flush.
+func (c *Client) write(b []byte) {
+	c.queue(b, false)
+}
+
+// flush has the writer send whatever is queued for the client. If much is
+// still pending, it waits for the writer to catch up, so this is only called
+// by the client's own connection loop, without keyspaceMutex held.
+func (c *Client) flush() {
+	q := c.output
+	if q == nil {
+		return
+	}
+	q.wakeWriter()
+	q.mutex.Lock()
+	for q.pending > backpressureThreshold && !q.closed {
+		q.drained.Wait()
+	}
+	q.mutex.Unlock()
+}
+
+// send queues b for the client and has it sent without waiting for the
+// client's connection loop, for what other connections push to it: pub/sub
+// messages, invalidations and the replication stream. It goes through the same
+// queue as the replies so that both keep their order, and returns at once.
+func (c *Client) send(b []byte) {
+	c.queue(b, true)
+}
+
+// queue appends b to the client's output, waking the writer if wake is set.
+// The client is disconnected if this takes it over its output buffer limit.
+func (c *Client) queue(b []byte, wake bool) {
+	q := c.output
+	if q == nil || len(b) == 0 {
+		return
+	}
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return
+	}
+	q.chunks = append(q.chunks, b)
+	q.pending += int64(len(b))
+	if c.outputBufferLimitReached() {
+		q.closed = true
+		q.chunks = nil
+		q.drained.Broadcast()
+		q.mutex.Unlock()
+		q.wakeWriter()
+		statOutputBufferLimitDisconnections.Add(1)
+		clientLog(logWarning, c, "Client scheduled to be closed ASAP for overcoming of output buffer limits.")
+		// Closing the connection does not wait for the peer. The connection
+		// loop then fails to read and disconnects the client.
+		c.Connection.Close()
+		return
+	}
+	q.mutex.Unlock()
+	if wake {
+		q.wakeWriter()
+	}
+}
+
+// wakeWriter has the writer look at the queue, unless a wakeup is already due.
+func (q *outputQueue) wakeWriter() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// closeOutput stops queueing output for the client. The writer sends what is
+// already queued, then closes the connection, giving up after closeTimeout if
+// the client does not read it.
+func (c *Client) closeOutput() {
+	q := c.output
+	if q == nil {
+		c.Connection.Close()
+		return
+	}
+	c.Connection.SetWriteDeadline(time.Now().Add(closeTimeout))
+	q.mutex.Lock()
+	q.closed = true
+	q.drained.Broadcast()
+	q.mutex.Unlock()
+	q.wakeWriter()
+}
+
+// pendingOutput returns the bytes queued for the client and not yet sent.
+func (c *Client) pendingOutput() int64 {
+	if c.output == nil {
+		return 0
+	}
+	c.output.mutex.Lock()
+	defer c.output.mutex.Unlock()
+	return c.output.pending
+}
+
+// writeOutput is the writer goroutine of a client: it sends the queued output
+// whenever woken, until the output is closed, and then closes the connection.
+func (c *Client) writeOutput() {
+	q := c.output
+	defer close(q.done)
+	defer c.Connection.Close()
+	w := bufio.NewWriter(c.Connection)
+
+	for range q.wake {
+		q.mutex.Lock()
+		chunks, closed := q.chunks, q.closed
+		q.chunks = nil
+		q.mutex.Unlock()
+
+		var sent int64
+		err := writeChunks(w, chunks)
+		for _, chunk := range chunks {
+			sent += int64(len(chunk))
+		}
+
+		q.mutex.Lock()
+		q.pending -= sent
+		if q.pending == 0 {
+			q.softLimitReached = time.Time{}
+		}
+		if err != nil {
+			q.closed = true
+			q.chunks = nil
+		}
+		q.drained.Broadcast()
+		q.mutex.Unlock()
+
+		if err != nil {
+			// A connection closed for its output buffer limit is no news
+			if !errors.Is(err, net.ErrClosed) {
+				clientLog(logVerbose, c, "Error writing to client: %v", err)
+			}
+			return
+		}
+		// Nothing is queued once the output is closed, so all of it is sent
+		if closed {
+			return
+		}
+	}
+}
+
+// writeChunks writes chunks to the connection behind w and flushes it. It
+// takes no I/O slot with io-threads, as a client that does not read would hold
+// it for as long as it stalls.
+func writeChunks(w *bufio.Writer, chunks [][]byte) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+	for _, chunk := range chunks {
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// outputClass returns the class of the client for the output buffer limits.
+// The primary's link, which is only sent acknowledgements, is never limited.
+func (c *Client) outputClass() string {
+	switch {
+	case c.Primary:
+		return ""
+	case c.Replica:
+		return "replica"
+	case c.SubscribedMode || len(c.SubscribedChannels) > 0 || len(c.SubscribedPatterns) > 0:
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// outputBufferLimitReached reports whether the pending output of the client
+// has gone over its limits: the hard one, or the soft one for longer than
+// allowed, as in Redis.
+// Must be called with the output queue's mutex held.
+func (c *Client) outputBufferLimitReached() bool {
+	limit := outputBufferLimits[c.outputClass()]
+	if limit == nil {
+		return false
+	}
+	q := c.output
+	if limit.hard > 0 && q.pending >= limit.hard {
+		return true
+	}
+	if limit.soft == 0 || q.pending < limit.soft {
+		q.softLimitReached = time.Time{}
+		return false
+	}
+	if q.softLimitReached.IsZero() {
+		q.softLimitReached = time.Now()
+		return false
+	}
+	return time.Since(q.softLimitReached) > time.Duration(limit.softSeconds)*time.Second
+}
+
+// formatOutputBufferLimits reports client-output-buffer-limit as Redis does,
+// the replica class under its legacy name.
+func formatOutputBufferLimits() string {
+	fields := make([]string, 0, 4*len(outputBufferLimitClasses))
+	for _, class := range outputBufferLimitClasses {
+		limit := outputBufferLimits[class]
+		name := class
+		if class == "replica" {
+			name = "slave"
+		}
+		fields = append(fields, name, strconv.FormatInt(limit.hard, 10),
+			strconv.FormatInt(limit.soft, 10), strconv.Itoa(limit.softSeconds))
+	}
+	return strings.Join(fields, " ")
+}
+
+// setOutputBufferLimits parses client-output-buffer-limit: one or more groups
+// of a class, a hard limit, a soft limit and the soft seconds. The command line
+// takes them as a single argument.
+func setOutputBufferLimits(args []string) error {
+	fields := strings.Fields(strings.Join(args, " "))
+	if len(fields) == 0 || len(fields)%4 != 0 {
+		return errors.New("wrong number of arguments")
+	}
+	parsed := make(map[string]*outputBufferLimit)
+	for i := 0; i < len(fields); i += 4 {
+		class := strings.ToLower(fields[i])
+		if class == "slave" {
+			class = "replica"
+		}
+		if outputBufferLimits[class] == nil {
+			return errors.New("invalid client class specified in buffer limit configuration")
+		}
+		hard, hardOK := parseMemory(fields[i+1])
+		soft, softOK := parseMemory(fields[i+2])
+		softSeconds, err := strconv.Atoi(fields[i+3])
+		if !hardOK || !softOK || err != nil || hard < 0 || soft < 0 || softSeconds < 0 {
+			return errors.New("error in hard, soft or soft_seconds setting in buffer limit configuration")
+		}
+		parsed[class] = &outputBufferLimit{hard: hard, soft: soft, softSeconds: softSeconds}
+	}
+	for class, limit := range parsed {
+		outputBufferLimits[class] = limit
+	}
+	return nil
+}
@@ -2,181 +2,324 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
+	"slices"
 	"strconv"
-	"strings"
 )
 
-// readRESPArray parses a RESP array from the reader.
-// It returns the array elements as a slice of strings, the number of bytes read, or an error.
-func readRESPArray(r *bufio.Reader) ([]string, int, error) {
-	// 1. Read the array header: *<number_of_elements>\r\n
-	line, err := r.ReadString('\n')
-	if err != nil {
-		return nil, 0, err
-	}
+// protocolError reports a request that does not follow the protocol. The
+// client is told about it before being disconnected.
+type protocolError string
 
-	// Update replication offset if this instance is a replica
-	if isReplica {
-		offset += len(line)
-	}
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
 
-	readOffset := len(line)
+// Request size limits, so that a single oversized header cannot make the
+// server allocate unbounded memory.
+var protoMaxBulkLen int64 = 512 << 20  // Longest argument, in bytes
+var protoMaxMultibulkLen = 1024 * 1024 // Most arguments in a request
+
+// inlineMaxSize is the longest inline command accepted, as in Redis.
+const inlineMaxSize = 64 << 10
+
+// requestScratchLimit is the largest capacity the scratch buffers of a
+// requestReader keep between requests. Past it, they are dropped after use so
+// that a single large request does not pin its memory for the connection's life.
+const requestScratchLimit = 64 << 10
+
+// requestReader parses the requests of a connection. Its scratch buffers are
+// reused from one request to the next, so that parsing allocates nothing once
+// they have grown to the size of the connection's requests.
+type requestReader struct {
+	r    *bufio.Reader
+	line []byte   // The current line, when longer than the bufio.Reader buffer
+	data []byte   // The contents of the arguments, back to back
+	ends []int    // Where each argument ends in data
+	args [][]byte // The arguments, slices of data
+}
 
-	line = strings.TrimSpace(line)
-	// Validate RESP array format
-	if len(line) == 0 || line[0] != '*' {
-		return nil, 0, fmt.Errorf("invalid RESP array")
-	}
+func newRequestReader(r *bufio.Reader) *requestReader {
+	return &requestReader{r: r}
+}
 
-	// Parse the number of elements in the array
-	n, err := strconv.Atoi(line[1:])
-	if err != nil {
-		return nil, 0, err
+// readRequest reads the next request: a RESP array of bulk strings, or an
+// inline command, a line of space-separated arguments as typed in telnet.
+// It returns the arguments, only valid until the next call, and the number of
+// bytes the request spans, including any empty request skipped before it.
+func (rr *requestReader) readRequest() ([][]byte, int, error) {
+	if cap(rr.data) > requestScratchLimit {
+		rr.data = nil
+	}
+	if cap(rr.line) > requestScratchLimit {
+		rr.line = nil
 	}
 
-	result := make([]string, 0, n)
-
-	for i := 0; i < n; i++ {
-		// Read bulk string header: $<length>\r\n
-		line, err := r.ReadString('\n')
+	size := 0
+	for {
+		// 1. Read the array header: *<number_of_elements>\r\n
+		line, n, err := rr.readLine("too big inline request")
 		if err != nil {
 			return nil, 0, err
 		}
+		size += n
 
-		if isReplica {
-			offset += len(line)
+		if len(line) == 0 {
+			// Empty inline commands are ignored
+			continue
 		}
-
-		readOffset += len(line)
-
-		line = strings.TrimSpace(line)
-		if line[0] != '$' {
-			return nil, 0, fmt.Errorf("expected bulk string")
+		if line[0] != '*' {
+			args, ok := splitArguments(string(line))
+			if !ok {
+				return nil, 0, protocolError("unbalanced quotes in request")
+			}
+			rr.args = rr.args[:0]
+			for _, arg := range args {
+				rr.args = append(rr.args, []byte(arg))
+			}
+			return rr.args, size, nil
 		}
 
-		// Parse the length of the string
-		l, err := strconv.Atoi(line[1:])
-		if err != nil {
-			return nil, 0, err
+		// Parse the number of elements in the array
+		count, ok := parseLength(line[1:])
+		if !ok || count > int64(protoMaxMultibulkLen) {
+			return nil, 0, protocolError("invalid multibulk length")
 		}
-
-		// Read the exact number of bytes for the string content + \r\n
-		buf := make([]byte, l+2)
-		nRead, err := io.ReadFull(r, buf)
-		if err != nil {
-			return nil, 0, err
+		if count <= 0 {
+			// Empty and null arrays are ignored
+			continue
 		}
 
-		if isReplica {
-			offset += nRead
+		rr.data, rr.ends = rr.data[:0], rr.ends[:0]
+		for i := int64(0); i < count; i++ {
+			// Read bulk string header: $<length>\r\n
+			line, n, err := rr.readLine("too big bulk count string")
+			if err != nil {
+				return nil, 0, err
+			}
+			size += n
+
+			if len(line) == 0 || line[0] != '$' {
+				return nil, 0, protocolError(fmt.Sprintf("expected '$', got '%.1s'", line))
+			}
+			length, ok := parseLength(line[1:])
+			if !ok || length < 0 || length > protoMaxBulkLen {
+				return nil, 0, protocolError("invalid bulk length")
+			}
+
+			// Read the contents and the \r\n that follows, which is then dropped
+			start := len(rr.data)
+			end := start + int(length)
+			rr.data = slices.Grow(rr.data, int(length)+2)[:end+2]
+			if _, err := io.ReadFull(rr.r, rr.data[start:]); err != nil {
+				return nil, 0, err
+			}
+			size += int(length) + 2
+			rr.data = rr.data[:end]
+			rr.ends = append(rr.ends, end)
 		}
 
-		readOffset += nRead
-
-		// Append string content (excluding \r\n) to result
-		result = append(result, string(buf[:l]))
+		// The arguments are sliced once data has stopped moving as it grew
+		rr.args = rr.args[:0]
+		start := 0
+		for _, end := range rr.ends {
+			rr.args = append(rr.args, rr.data[start:end:end])
+			start = end
+		}
+		return rr.args, size, nil
 	}
-
-	return result, 0, nil
 }
 
-// BulkStringArrayToStringArray converts a raw RESP array of bulk strings into a Go slice of strings.
-func BulkStringArrayToStringArray(RESPArray []byte) []string {
-	// Split by CRLF
-	splitArray := strings.Split(string(RESPArray), "\r\n")
-
-	// Parse the number of elements from the first line
-	numberOfElements, _ := strconv.Atoi(splitArray[0][1:])
-
-	stringArray := make([]string, 0, numberOfElements)
-
-	// Iterate over the split array
-	for i := 2; i < len(splitArray); i += 2 {
-		if splitArray[i] == "" {
-			break
+// readLine reads a line, without the spaces and line terminator around it,
+// and returns it with the number of bytes it spans. The line is only valid
+// until the next read. Lines longer than inlineMaxSize are refused with
+// tooLong as the protocol error.
+func (rr *requestReader) readLine(tooLong string) ([]byte, int, error) {
+	line, err := rr.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		// The line continues past the reader's buffer: gather it in rr.line
+		rr.line = append(rr.line[:0], line...)
+		for err == bufio.ErrBufferFull {
+			if len(rr.line) > inlineMaxSize {
+				return nil, 0, protocolError(tooLong)
+			}
+			line, err = rr.r.ReadSlice('\n')
+			rr.line = append(rr.line, line...)
 		}
+		line = rr.line
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(line) > inlineMaxSize {
+		return nil, 0, protocolError(tooLong)
+	}
+	return bytes.TrimSpace(line), len(line), nil
+}
 
-		stringArray = append(stringArray, splitArray[i])
+// parseLength parses the decimal length of a RESP header without allocating.
+func parseLength(b []byte) (int64, bool) {
+	negative := len(b) > 0 && b[0] == '-'
+	if negative {
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
 	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
 
-	return stringArray
+// argumentStrings copies the arguments of a request into strings, which stay
+// valid once the request's buffers are reused.
+func argumentStrings(args [][]byte) []string {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		strs[i] = string(arg)
+	}
+	return strs
 }
 
 // StringArrayToBulkStringArray encodes a Go string slice into a RESP Array.
 func StringArrayToBulkStringArray(StringArray []string) []byte {
-	// Start with array header
-	BulkStringArray := "*" + strconv.Itoa(len(StringArray)) + "\r\n"
-
-	// Append each element as a Bulk String
-	for _, v := range StringArray {
-		BulkStringArray += "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
-	}
-
-	return []byte(BulkStringArray)
+	return encodeRESP(StringArray, 2)
 }
 
 // StringToBulkString encodes a single string as a RESP Bulk String.
 func StringToBulkString(String string) []byte {
-	return []byte("$" + strconv.Itoa(len(String)) + "\r\n" + String + "\r\n")
+	return encodeRESP(String, 2)
 }
 
-// EncodeArray converts a slice of typed ArrayElements into RESP.
-func EncodeArray(elements []ArrayElement) []byte {
-	resp := "*" + strconv.Itoa(len(elements)) + "\r\n"
-
-	for _, el := range elements {
-		switch el.Type {
-		case BulkString:
-			resp += "$" + strconv.Itoa(len(el.Value)) + "\r\n" + el.Value + "\r\n"
-		case Integer:
-			resp += ":" + el.Value + "\r\n"
-		}
-	}
-
-	return []byte(resp)
+// encodeArray encodes a RESP2 array, see encodeRESP for the element types.
+func encodeArray(arr []interface{}) []byte {
+	return encodeRESP(arr, 2)
 }
 
-// encodeBulkString for the recursive encoder
-func encodeBulkString(s string) string {
-	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+// RESP3 types understood by encodeRESP, sent as arrays to RESP2 connections.
+type respMap []interface{} // Alternating keys and values
+type respSet []string
+type respPush []interface{} // Out-of-band data such as pub/sub messages
+
+// respNullArray is the null array, such as the position of a missing GEOPOS
+// member. RESP3 has a single null for it and for the null bulk string.
+type respNullArray struct{}
+
+// encodeRESP encodes a reply for a connection speaking the given RESP version.
+// v may hold a string, sent as a bulk string, an int or an int64, a []string
+// or a []interface{} of any of these types, a float64, sent as a double or as a
+// bulk string, a bool, sent as a boolean or as 1 or 0, and the RESP3 aggregate
+// types; nil is the RESP3 null or the RESP2 null bulk string.
+func encodeRESP(v interface{}, protocol int) []byte {
+	var b bytes.Buffer
+	writeRESP(&b, v, protocol)
+	return b.Bytes()
 }
 
-// encodeInteger for the recursive encoder
-func encodeInteger(i int) string {
-	return fmt.Sprintf(":%d\r\n", i)
-}
-
-// stringsToInterfaceArray converts []string to []interface{} so it can be passed
-// to the recursive encodeArray function.
-func stringsToInterfaceArray(arr []string) []interface{} {
-	result := make([]interface{}, len(arr))
-	for i, s := range arr {
-		result[i] = s
+// writeRESP appends the encoding of v to b, see encodeRESP. Every reply is
+// built by appending to a single buffer, so that large arrays cost linear time.
+func writeRESP(b *bytes.Buffer, v interface{}, protocol int) {
+	resp3 := protocol == 3
+	// header writes a type prefix followed by a length or an integer
+	header := func(prefix byte, n int64) {
+		b.WriteByte(prefix)
+		b.Write(strconv.AppendInt(b.AvailableBuffer(), n, 10))
+		b.WriteString("\r\n")
+	}
+	bulkString := func(s string) {
+		header('$', int64(len(s)))
+		b.WriteString(s)
+		b.WriteString("\r\n")
+	}
+	// aggregate writes the header of an aggregate type with count elements,
+	// counted as pairs by RESP3 maps
+	aggregate := func(prefix byte, count int) {
+		switch {
+		case !resp3:
+			prefix = '*'
+		case prefix == '%':
+			count /= 2
+		}
+		header(prefix, int64(count))
 	}
-	return result
-}
 
-// Recursive encoder
-func encodeArray(arr []interface{}) string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("*%d\r\n", len(arr)))
-
-	for _, elem := range arr {
-		switch v := elem.(type) {
-		case string:
-			sb.WriteString(encodeBulkString(v))
-		case int:
-			sb.WriteString(encodeInteger(v))
-		case []interface{}:
-			sb.WriteString(encodeArray(v))
-		case []string:
-			sb.WriteString(encodeArray(stringsToInterfaceArray(v)))
+	switch v := v.(type) {
+	case nil:
+		if resp3 {
+			b.WriteString("_\r\n")
+		} else {
+			b.WriteString("$-1\r\n")
+		}
+	case respNullArray:
+		if resp3 {
+			b.WriteString("_\r\n")
+		} else {
+			b.WriteString("*-1\r\n")
+		}
+	case string:
+		bulkString(v)
+	case int:
+		header(':', int64(v))
+	case int64:
+		header(':', v)
+	case float64:
+		if !resp3 {
+			bulkString(formatScore(v))
+		} else if math.IsInf(v, 1) {
+			b.WriteString(",inf\r\n")
+		} else if math.IsInf(v, -1) {
+			b.WriteString(",-inf\r\n")
+		} else {
+			b.WriteString("," + formatScore(v) + "\r\n")
+		}
+	case bool:
+		switch {
+		case resp3 && v:
+			b.WriteString("#t\r\n")
+		case resp3:
+			b.WriteString("#f\r\n")
+		case v:
+			b.WriteString(":1\r\n")
 		default:
-			// If type is unknown, we skip it
+			b.WriteString(":0\r\n")
+		}
+	case respMap:
+		aggregate('%', len(v))
+		for _, elem := range v {
+			writeRESP(b, elem, protocol)
+		}
+	case respSet:
+		aggregate('~', len(v))
+		for _, member := range v {
+			bulkString(member)
+		}
+	case respPush:
+		aggregate('>', len(v))
+		for _, elem := range v {
+			writeRESP(b, elem, protocol)
 		}
+	case []string:
+		aggregate('*', len(v))
+		for _, s := range v {
+			bulkString(s)
+		}
+	case []interface{}:
+		aggregate('*', len(v))
+		for _, elem := range v {
+			writeRESP(b, elem, protocol)
+		}
+	default:
+		// If type is unknown, we skip it
 	}
-
-	return sb.String()
 }
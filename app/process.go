@@ -1,10 +1,9 @@
 package main
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"os"
+	"math"
+	"math/rand"
 	"slices"
 	"strconv"
 	"strings"
@@ -15,38 +14,94 @@ import (
 type Command struct {
 	StringArray []string // The full command arguments
 	Name        string   // The command name (normalized to lowercase)
-	Offset      int      // Byte offset in the stream (used for replication tracking)
+	Offset      int      // Size of the request in bytes (used for replication tracking)
 }
 
 // ProcessCommand is the central logic for the application.
 // It routes the command to the correct logic, handles authentication middleware,
 // and manages replication propagation for write operations.
-func ProcessCommand(client *Client, command Command) []byte {
+func ProcessCommand(client *Client, command Command) (reply []byte) {
 	commandName := command.Name
 	commandStringArray := command.StringArray
 
+	// However it was built, an error reply must stay on a single line
+	defer func() { reply = sanitizeErrorReply(reply) }()
+
+	// Commands are checked against the command table before anything else
+	if errReply := validateCommand(commandName, commandStringArray); errReply != nil {
+		recordRejectedCall(commandName)
+		return errReply
+	}
+	info := commandTable[commandName]
+
 	// If the user hasn't authenticated (and isn't sending an AUTH command)
-	if !client.Authenticated && commandName != "auth" {
+	if !client.Authenticated && commandName != "auth" && commandName != "hello" {
+		recordRejectedCall(commandName)
 		return []byte("-NOAUTH Authentication required\r\n")
 	}
 
+	// The user may be restricted to some commands and keys. Clients without a
+	// user, replaying the AOF or the primary's stream, are not.
+	if user := users[client.Username]; user != nil && commandName != "auth" && commandName != "hello" {
+		if errReply := aclCheckCommand(client.Username, user, info, commandStringArray); errReply != nil {
+			recordRejectedCall(commandName)
+			return errReply
+		}
+	}
+
+	// Replicas take their writes from the primary, whose stream runs without a user
+	if isReplica && replicaReadOnly && client.Username != "" && isWriteCommand(commandName) {
+		recordRejectedCall(commandName)
+		return []byte("-READONLY You can't write against a read only replica.\r\n")
+	}
+
+	// Every command operates on the database the client has selected
+	selectDB(client.DB)
+
 	// If a client is in "Subscribe Mode", they are restricted to a subset of commands.
-	if client.SubscribedMode && !allowedInSubscribeMode[commandName] {
+	// RESP3 connections receive messages as push frames, so they are not.
+	if client.SubscribedMode && client.Protocol != 3 && !allowedInSubscribeMode[commandName] {
+		recordRejectedCall(commandName)
 		return []byte("-ERR Can't execute '" + commandName +
 			"': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context\r\n")
 	}
 
+	// Keep the memory used under maxmemory. The AOF and the primary's stream,
+	// replayed without a user, are applied as they come.
+	if client.Username != "" && !performEvictions() && denyOOMCommands[commandName] {
+		recordRejectedCall(commandName)
+		return []byte(oomError)
+	}
+
+	client.LastCommand = commandName
+	client.LastInteraction = time.Now()
+
+	// Writes count towards the save points, reads towards the keyspace hits and misses
+	statNumCommands++
+	runningReadCommand = !isWriteCommand(commandName)
+	if !runningReadCommand {
+		dirty++
+	}
+
 	// If this is a Primary node and the command is a "Write" (modifies data),
 	// we must forward it to all connected Replicas to keep them in sync.
-	if !isReplica && writeCommand[commandName] {
-		replOffset += command.Offset
+	// Primaries and replicas alike append it to the AOF.
+	if !runningReadCommand && !explicitlyPropagatedWriteCommand[commandName] {
 		PropagateWriteCommandToReplicas(commandStringArray)
 	}
 
+	// Client-side caching: remember the keys tracking clients read, and
+	// invalidate the ones about to be written
+	trackCommandKeys(client, commandName, commandStringArray)
+
+	// Time the command for INFO commandstats and latencystats
+	start := time.Now()
+	defer func() { recordCommandCall(commandName, start, reply) }()
+
 	switch commandName {
 
 	case "ping":
-		if client.SubscribedMode {
+		if client.SubscribedMode && client.Protocol != 3 {
 			return []byte("*2\r\n$4\r\npong\r\n$0\r\n\r\n")
 		}
 		return []byte("+PONG\r\n")
@@ -54,283 +109,1025 @@ func ProcessCommand(client *Client, command Command) []byte {
 	case "echo":
 		return StringToBulkString(commandStringArray[1])
 
-	case "config":
-		// Handles 'CONFIG GET dir' or 'CONFIG GET dbfilename'
-		if len(commandStringArray) >= 3 && strings.ToLower(commandStringArray[1]) == "get" {
-			param := commandStringArray[2]
-			var value string
+	case "info":
+		return infoCommand(commandStringArray[1:])
 
-			switch param {
-			case "dir":
-				value = dir
-			case "dbfilename":
-				value = dbfilename
+	case "command":
+		return commandCommand(commandStringArray, client.Protocol)
+
+	case "config":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'config' command\r\n")
+		}
+		switch strings.ToLower(commandStringArray[1]) {
+		case "get":
+			if len(commandStringArray) < 3 {
+				return []byte("-ERR wrong number of arguments for 'config|get' command\r\n")
 			}
-			return StringArrayToBulkStringArray([]string{param, value})
+			return configGet(commandStringArray[2:], client.Protocol)
+		case "resetstat":
+			if len(commandStringArray) != 2 {
+				return []byte("-ERR wrong number of arguments for 'config|resetstat' command\r\n")
+			}
+			resetStats()
+			return []byte("+OK\r\n")
+		case "help":
+			return StringArrayToBulkStringArray([]string{
+				"CONFIG <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+				"GET <pattern> [<pattern> ...]",
+				"    Return parameters matching the glob-like <pattern> and their values.",
+				"RESETSTAT",
+				"    Reset statistics reported by the INFO command.",
+				"HELP",
+				"    Print this help.",
+			})
 		}
+		return []byte("-ERR unknown subcommand '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try CONFIG HELP.\r\n")
 
 	case "set":
-		fmt.Println("setting")
-		key := commandStringArray[1]
+		// SET key value [NX | XX] [GET] [EX s | PX ms | EXAT ts | PXAT ts-ms | KEEPTTL]
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'set' command\r\n")
+		}
+
+		options, errReply := parseSetOptions(commandStringArray[3:])
+		if errReply != nil {
+			return errReply
+		}
+		return setGeneric(commandStringArray[1], commandStringArray[2], options)
+
+	// Legacy SET variants, all expressed in terms of setGeneric
+	case "setnx":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'setnx' command\r\n")
+		}
+		if keyExists(commandStringArray[1]) {
+			return []byte(":0\r\n")
+		}
+		setGeneric(commandStringArray[1], commandStringArray[2], setOptions{})
+		return []byte(":1\r\n")
+
+	case "setex", "psetex":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		amount, err := strconv.ParseInt(commandStringArray[2], 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+
+		unit := time.Second
+		if commandName == "psetex" {
+			unit = time.Millisecond
+		}
+		expiry, ok := expiryFromArgument(amount, unit, false)
+		if amount <= 0 || !ok {
+			return []byte("-ERR invalid expire time in '" + commandName + "' command\r\n")
+		}
+		return setGeneric(commandStringArray[1], commandStringArray[3], setOptions{Expiry: &expiry})
+
+	case "getset":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'getset' command\r\n")
+		}
+		return setGeneric(commandStringArray[1], commandStringArray[2], setOptions{Get: true})
+
+	case "get":
+		value, wrongType := lookupString(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if value != nil {
+			return StringToBulkString(value.Value.(string))
+		}
+
+		return []byte("$-1\r\n")
+
+	case "append":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'append' command\r\n")
+		}
+		return appendString(commandStringArray[1], commandStringArray[2])
+
+	case "strlen":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'strlen' command\r\n")
+		}
+		return strlen(commandStringArray[1])
+
+	case "getrange":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'getrange' command\r\n")
+		}
+		start, err1 := strconv.Atoi(commandStringArray[2])
+		end, err2 := strconv.Atoi(commandStringArray[3])
+		if err1 != nil || err2 != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		return getrange(commandStringArray[1], start, end)
+
+	case "setrange":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'setrange' command\r\n")
+		}
+		offset, err := strconv.Atoi(commandStringArray[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		return setrange(commandStringArray[1], offset, commandStringArray[3])
 
-		data[key] = &valueType{valueString: commandStringArray[2]}
+	case "bitfield":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'bitfield' command\r\n")
+		}
+		ops, errReply := parseBitfieldOps(commandStringArray[2:])
+		if errReply != nil {
+			return errReply
+		}
+		return bitfield(commandStringArray[1], ops)
 
-		// Handle Expiry: SET key val px <milliseconds>
-		if len(commandStringArray) > 3 {
-			if strings.ToLower(commandStringArray[3]) == "px" {
-				ms, err := strconv.Atoi(commandStringArray[4])
+	case "mget":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'mget' command\r\n")
+		}
+		return mget(commandStringArray[1:])
+
+	case "mset":
+		if len(commandStringArray) < 3 || len(commandStringArray)%2 == 0 {
+			return []byte("-ERR wrong number of arguments for 'mset' command\r\n")
+		}
+		mset(commandStringArray[1:])
+		return []byte("+OK\r\n")
+
+	case "msetnx":
+		if len(commandStringArray) < 3 || len(commandStringArray)%2 == 0 {
+			return []byte("-ERR wrong number of arguments for 'msetnx' command\r\n")
+		}
+		if msetnx(commandStringArray[1:]) {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
 
-				if err != nil {
-					fmt.Println("Error reading command: ", err.Error())
-					os.Exit(1)
+	case "incr", "decr":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		if commandName == "decr" {
+			return incrBy(commandStringArray[1], -1)
+		}
+		return incrBy(commandStringArray[1], 1)
+
+	case "incrby", "decrby":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		delta, err := strconv.ParseInt(commandStringArray[2], 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		if commandName == "decrby" {
+			if delta == math.MinInt64 {
+				return []byte("-ERR decrement would overflow\r\n")
+			}
+			delta = -delta
+		}
+		return incrBy(commandStringArray[1], delta)
+
+	case "incrbyfloat":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'incrbyfloat' command\r\n")
+		}
+		delta, err := strconv.ParseFloat(commandStringArray[2], 64)
+		if err != nil || math.IsNaN(delta) || math.IsInf(delta, 0) {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+		return incrByFloat(commandStringArray[1], delta)
+
+	case "keys":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'keys' command\r\n")
+		}
+		pattern := commandStringArray[1]
+
+		matching := []string{}
+		for _, key := range allKeys() {
+			if globMatch(pattern, key) {
+				matching = append(matching, key)
+			}
+		}
+		return StringArrayToBulkStringArray(matching)
+
+	case "exists":
+		// Counts how many of the given keys exist, across every data type.
+		// A key repeated in the arguments is counted once per occurrence.
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'exists' command\r\n")
+		}
+
+		count := 0
+		for _, key := range commandStringArray[1:] {
+			if keyExists(key) {
+				count++
+			}
+		}
+		return []byte(":" + strconv.Itoa(count) + "\r\n")
+
+	// Key Expiration
+	case "expire":
+		return expireCommand(commandStringArray, time.Second, false)
+
+	case "pexpire":
+		return expireCommand(commandStringArray, time.Millisecond, false)
+
+	case "expireat":
+		return expireCommand(commandStringArray, time.Second, true)
+
+	case "pexpireat":
+		return expireCommand(commandStringArray, time.Millisecond, true)
+
+	case "ttl":
+		return ttlCommand(commandStringArray, time.Second, false)
+
+	case "pttl":
+		return ttlCommand(commandStringArray, time.Millisecond, false)
+
+	case "expiretime":
+		return ttlCommand(commandStringArray, time.Second, true)
+
+	case "pexpiretime":
+		return ttlCommand(commandStringArray, time.Millisecond, true)
+
+	case "persist":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'persist' command\r\n")
+		}
+		return persist(commandStringArray[1])
+
+	case "del", "unlink":
+		// UNLINK only differs from DEL in Redis by freeing memory in the background.
+		// Here the garbage collector already reclaims values asynchronously.
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+
+		deleted := 0
+		for _, key := range commandStringArray[1:] {
+			if deleteKey(key) {
+				deleted++
+			}
+		}
+		return []byte(":" + strconv.Itoa(deleted) + "\r\n")
+
+	case "touch":
+		// Records an access to each of the given keys and counts those that exist
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'touch' command\r\n")
+		}
+
+		touched := 0
+		for _, key := range commandStringArray[1:] {
+			if lookupKey(key) != nil {
+				touched++
+			}
+		}
+		return []byte(":" + strconv.Itoa(touched) + "\r\n")
+
+	case "rename", "renamenx":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		source := commandStringArray[1]
+		destination := commandStringArray[2]
+
+		if !keyExists(source) {
+			return []byte("-ERR no such key\r\n")
+		}
+
+		if commandName == "renamenx" {
+			if keyExists(destination) {
+				return []byte(":0\r\n")
+			}
+			renameKey(source, destination)
+			return []byte(":1\r\n")
+		}
+
+		renameKey(source, destination)
+		return []byte("+OK\r\n")
+
+	case "copy":
+		// COPY source destination [DB destination-db] [REPLACE]
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'copy' command\r\n")
+		}
+		source := commandStringArray[1]
+		destination := commandStringArray[2]
+
+		replace := false
+		targetDB := selectedDB
+		for i := 3; i < len(commandStringArray); i++ {
+			switch strings.ToLower(commandStringArray[i]) {
+			case "replace":
+				replace = true
+			case "db":
+				if i+1 >= len(commandStringArray) {
+					return []byte("-ERR syntax error\r\n")
 				}
+				i++
+				index, errReply := parseDBIndex(commandStringArray[i])
+				if errReply != nil {
+					return errReply
+				}
+				targetDB = index
+			default:
+				return []byte("-ERR syntax error\r\n")
+			}
+		}
+
+		if source == destination && targetDB == selectedDB {
+			return []byte("-ERR source and destination objects are the same\r\n")
+		}
+		if !keyExists(source) {
+			return []byte(":0\r\n")
+		}
+		target := databases[targetDB]
+		if existing, ok := target[destination]; ok && !isExpired(existing) && !replace {
+			return []byte(":0\r\n")
+		}
+
+		copyKey(source, destination, target)
+		signalKeyAsReadyInDB(targetDB, destination)
+		return []byte(":1\r\n")
 
-				t := time.Now().Add(time.Duration(ms) * time.Millisecond)
-				data[key].expiry = &t
+	case "randomkey":
+		keys := allKeys()
+		if len(keys) == 0 {
+			return []byte("$-1\r\n")
+		}
+		return StringToBulkString(keys[rand.Intn(len(keys))])
+
+	case "object":
+		return objectCommand(commandStringArray)
+
+	case "lolwut":
+		return lolwutCommand(commandStringArray)
+
+	case "latency":
+		return latencyCommand(commandStringArray)
+
+	case "memory":
+		return memoryCommand(commandStringArray, client.Protocol)
+
+	case "dbsize":
+		// Like Redis, keys that have expired but not yet been reclaimed are counted
+		return []byte(":" + strconv.Itoa(len(keyspace)) + "\r\n")
+
+	case "flushdb", "flushall":
+		// FLUSHDB | FLUSHALL [ASYNC | SYNC], ASYNC by default under lazyfree-lazy-user-flush
+		async := lazyfreeLazyUserFlush
+		if len(commandStringArray) > 2 {
+			return []byte("-ERR syntax error\r\n")
+		}
+		if len(commandStringArray) == 2 {
+			switch strings.ToLower(commandStringArray[1]) {
+			case "async":
+				async = true
+			case "sync":
+				async = false
+			default:
+				return []byte("-ERR syntax error\r\n")
 			}
 		}
+
+		invalidateAll(client)
+		if commandName == "flushall" {
+			for i := range databases {
+				flushDatabase(i, async)
+			}
+		} else {
+			flushDatabase(selectedDB, async)
+		}
 		return []byte("+OK\r\n")
 
-	case "get":
-		value, ok := data[commandStringArray[1]]
+	// Logical databases
+	case "select":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'select' command\r\n")
+		}
+		index, errReply := parseDBIndex(commandStringArray[1])
+		if errReply != nil {
+			return errReply
+		}
+		client.DB = index
+		selectDB(index)
+		return []byte("+OK\r\n")
+
+	case "swapdb":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'swapdb' command\r\n")
+		}
+		first, errReply := parseDBIndex(commandStringArray[1])
+		if errReply != nil {
+			return errReply
+		}
+		second, errReply := parseDBIndex(commandStringArray[2])
+		if errReply != nil {
+			return errReply
+		}
+
+		// Clients keep their selected index, so they now see the other dataset
+		databases[first], databases[second] = databases[second], databases[first]
+		selectDB(client.DB)
+		signalDBAsReady(first)
+		signalDBAsReady(second)
+		return []byte("+OK\r\n")
+
+	case "save":
+		if len(commandStringArray) != 1 {
+			return []byte("-ERR wrong number of arguments for 'save' command\r\n")
+		}
+		return save()
+
+	case "bgsave":
+		if len(commandStringArray) != 1 {
+			return []byte("-ERR wrong number of arguments for 'bgsave' command\r\n")
+		}
+		return bgsave()
+
+	case "debug":
+		return debugCommand(commandStringArray)
+
+	case "lastsave":
+		return []byte(":" + strconv.FormatInt(lastSave.Unix(), 10) + "\r\n")
+
+	case "bgrewriteaof":
+		if len(commandStringArray) != 1 {
+			return []byte("-ERR wrong number of arguments for 'bgrewriteaof' command\r\n")
+		}
+		return bgrewriteaof()
+
+	case "move":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'move' command\r\n")
+		}
+		key := commandStringArray[1]
+		index, errReply := parseDBIndex(commandStringArray[2])
+		if errReply != nil {
+			return errReply
+		}
+		if index == selectedDB {
+			return []byte("-ERR source and destination objects are the same\r\n")
+		}
+
+		obj := lookupKey(key)
+		if obj == nil {
+			return []byte(":0\r\n")
+		}
+		if existing, ok := databases[index][key]; ok && !isExpired(existing) {
+			return []byte(":0\r\n")
+		}
+
+		databases[index][key] = obj
+		delete(keyspace, key)
+		signalKeyAsReadyInDB(index, key)
+		return []byte(":1\r\n")
+
+	case "type":
+		// Returns the data type of the key
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'type' command\r\n")
+		}
+		return []byte("+" + keyType(commandStringArray[1]) + "\r\n")
+
+	// Cursor based iteration
+	case "scan":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'scan' command\r\n")
+		}
+		options, errReply := parseScanOptions(commandStringArray[1:], true)
+		if errReply != nil {
+			return errReply
+		}
+		return scanKeys(options)
+
+	case "hscan", "sscan", "zscan":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		key := commandStringArray[1]
+		options, errReply := parseScanOptions(commandStringArray[2:], false)
+		if errReply != nil {
+			return errReply
+		}
+
+		switch commandName {
+		case "hscan":
+			return hscan(key, options)
+		case "sscan":
+			return sscan(key, options)
+		default:
+			return zscan(key, options)
+		}
+
+	// List Operations
+	case "rpush":
+		key := commandStringArray[1]
+		values := commandStringArray[2:]
+		obj, wrongType := lookupList(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		list := append(listItems(obj), values...)
+		storeList(key, list)
+		return []byte(":" + strconv.Itoa(len(list)) + "\r\n")
+
+	case "lpush":
+		key := commandStringArray[1]
+		values := commandStringArray[2:]
+		obj, wrongType := lookupList(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		slices.Reverse(values)
+		list := append(values, listItems(obj)...)
+		storeList(key, list)
+		return []byte(":" + strconv.Itoa(len(list)) + "\r\n")
+
+	case "llen":
+		key := commandStringArray[1]
+		obj, wrongType := lookupList(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		return []byte(":" + strconv.Itoa(len(listItems(obj))) + "\r\n")
+
+	case "lpop", "rpop":
+		return listPop(commandStringArray, commandName == "lpop", client.Protocol)
+
+	case "lrange":
+		key := commandStringArray[1]
+		start, err := strconv.Atoi(commandStringArray[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		stop, err := strconv.Atoi(commandStringArray[3])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+
+		obj, wrongType := lookupList(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		list := listItems(obj)
+		if list == nil {
+			return []byte("*0\r\n")
+		}
+
+		start, stop, ok := normalizeListRange(start, stop, len(list))
+		if !ok {
+			return []byte("*0\r\n")
+		}
+
+		resultList := list[start : stop+1]
+		return StringArrayToBulkStringArray(resultList)
+
+	case "lmpop":
+		if len(commandStringArray) < 4 {
+			return []byte("-ERR wrong number of arguments for 'lmpop' command\r\n")
+		}
+		keys, left, count, errReply := parseMultiPop(commandStringArray[1:], [2]string{"left", "right"})
+		if errReply != nil {
+			return errReply
+		}
+		key, popped, errReply := lmpop(keys, left, count)
+		if errReply != nil {
+			return errReply
+		}
+		if popped == nil {
+			return []byte("*-1\r\n")
+		}
+		return encodeArray([]interface{}{key, popped})
+
+	case "blmpop":
+		if len(commandStringArray) < 5 {
+			return []byte("-ERR wrong number of arguments for 'blmpop' command\r\n")
+		}
+		timeout, errReply := parseBlockTimeout(commandStringArray[1])
+		if errReply != nil {
+			return errReply
+		}
+		keys, left, count, errReply := parseMultiPop(commandStringArray[2:], [2]string{"left", "right"})
+		if errReply != nil {
+			return errReply
+		}
+
+		return blockUntilServed(client, keys, timeout, []byte("*-1\r\n"), func() []byte {
+			key, popped, errReply := servedListPop(keys, left, count)
+			if errReply != nil || popped == nil {
+				return errReply
+			}
+			return encodeArray([]interface{}{key, popped})
+		})
+
+	case "blpop", "brpop":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		keys := commandStringArray[1 : len(commandStringArray)-1]
+		timeout, errReply := parseBlockTimeout(commandStringArray[len(commandStringArray)-1])
+		if errReply != nil {
+			return errReply
+		}
+
+		return blockUntilServed(client, keys, timeout, []byte("*-1\r\n"), func() []byte {
+			key, popped, errReply := servedListPop(keys, commandName == "blpop", 1)
+			if errReply != nil || popped == nil {
+				return errReply
+			}
+			return StringArrayToBulkStringArray([]string{key, popped[0]})
+		})
+
+	case "lmove", "blmove":
+		arity := 5
+		if commandName == "blmove" {
+			arity = 6
+		}
+		if len(commandStringArray) != arity {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		source, destination := commandStringArray[1], commandStringArray[2]
+		fromLeft, ok := parseListEnd(commandStringArray[3])
+		if !ok {
+			return []byte("-ERR syntax error\r\n")
+		}
+		toLeft, ok := parseListEnd(commandStringArray[4])
+		if !ok {
+			return []byte("-ERR syntax error\r\n")
+		}
+
+		if commandName == "lmove" {
+			if reply := lmove(source, destination, fromLeft, toLeft); reply != nil {
+				return reply
+			}
+			return []byte("$-1\r\n")
+		}
+
+		timeout, errReply := parseBlockTimeout(commandStringArray[5])
+		if errReply != nil {
+			return errReply
+		}
+		return blockUntilServed(client, []string{source}, timeout, []byte("$-1\r\n"), func() []byte {
+			reply := lmove(source, destination, fromLeft, toLeft)
+			if reply != nil && reply[0] == '$' {
+				// Replicas are sent the non-blocking move
+				PropagateWriteCommandToReplicas(append([]string{"LMOVE"}, commandStringArray[1:5]...))
+			}
+			return reply
+		})
+
+	case "lrem":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'lrem' command\r\n")
+		}
+		count, err := strconv.Atoi(commandStringArray[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		return lrem(commandStringArray[1], count, commandStringArray[3])
+
+	case "ltrim":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'ltrim' command\r\n")
+		}
+		start, err := strconv.Atoi(commandStringArray[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		stop, err := strconv.Atoi(commandStringArray[3])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		return ltrim(commandStringArray[1], start, stop)
+
+	// Hash Operations
+	case "hset":
+		if len(commandStringArray) < 4 || len(commandStringArray)%2 != 0 {
+			return []byte("-ERR wrong number of arguments for 'hset' command\r\n")
+		}
+		return hset(commandStringArray[1], commandStringArray[2:])
 
-		if ok {
-			// Check if key has expired before returning
-			if value.expiry == nil || time.Now().Before(*value.expiry) {
-				return StringToBulkString(value.valueString)
-			}
+	case "hget":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'hget' command\r\n")
 		}
+		return hget(commandStringArray[1], commandStringArray[2])
 
-		return []byte("$-1\r\n")
+	case "hdel":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'hdel' command\r\n")
+		}
+		return hdel(commandStringArray[1], commandStringArray[2:])
 
-	case "incr":
-		key := commandStringArray[1]
+	case "hgetall":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'hgetall' command\r\n")
+		}
+		return hgetall(commandStringArray[1], client.Protocol)
 
-		value, ok := data[key]
-		if !ok {
-			data[key] = &valueType{valueString: "1"}
+	case "hexists":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'hexists' command\r\n")
+		}
+		hash, wrongType := lookupHash(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if _, ok := hash.get(commandStringArray[2]); ok {
 			return []byte(":1\r\n")
 		}
+		return []byte(":0\r\n")
 
-		currentValue, err := strconv.Atoi(value.valueString)
+	case "hincrby":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'hincrby' command\r\n")
+		}
+		increment, err := strconv.ParseInt(commandStringArray[3], 10, 64)
 		if err != nil {
 			return []byte("-ERR value is not an integer or out of range\r\n")
 		}
+		return hincrby(commandStringArray[1], commandStringArray[2], increment)
+
+	case "hlen", "hkeys", "hvals":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		hash, wrongType := lookupHash(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
 
-		currentValue++
-		value.valueString = strconv.Itoa(currentValue)
+		switch commandName {
+		case "hlen":
+			return []byte(":" + strconv.Itoa(hash.length()) + "\r\n")
+		case "hkeys":
+			return StringArrayToBulkStringArray(hkeys(hash))
+		default:
+			return StringArrayToBulkStringArray(hvals(hash))
+		}
 
-		return []byte(":" + strconv.Itoa(currentValue) + "\r\n")
+	case "hexpire":
+		return hexpireCommand(commandStringArray, time.Second, false)
 
-	case "keys":
-		pattern := commandStringArray[1]
+	case "hpexpire":
+		return hexpireCommand(commandStringArray, time.Millisecond, false)
 
-		// Currently only supports "*" to list everything
-		if pattern != "*" {
-			return []byte("*0\r\n")
+	case "hexpireat":
+		return hexpireCommand(commandStringArray, time.Second, true)
+
+	case "hpexpireat":
+		return hexpireCommand(commandStringArray, time.Millisecond, true)
+
+	case "httl":
+		return httlCommand(commandStringArray, time.Second, false)
+
+	case "hpttl":
+		return httlCommand(commandStringArray, time.Millisecond, false)
+
+	case "hexpiretime":
+		return httlCommand(commandStringArray, time.Second, true)
+
+	case "hpexpiretime":
+		return httlCommand(commandStringArray, time.Millisecond, true)
+
+	case "hpersist":
+		return hpersist(commandStringArray)
+
+	case "hmget":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'hmget' command\r\n")
 		}
+		return hmget(commandStringArray[1], commandStringArray[2:])
 
-		allKeys := make([]string, 0, len(data)+len(listData))
-		for k := range data {
-			allKeys = append(allKeys, k)
+	// Set Operations
+	case "sadd", "srem":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
 		}
-		for k := range listData {
-			allKeys = append(allKeys, k)
+		key := commandStringArray[1]
+		if _, wrongType := lookupSet(key); wrongType {
+			return []byte(wrongTypeError)
 		}
 
-		return StringArrayToBulkStringArray(allKeys)
+		if commandName == "sadd" {
+			return []byte(":" + strconv.Itoa(sadd(key, commandStringArray[2:])) + "\r\n")
+		}
+		return []byte(":" + strconv.Itoa(srem(key, commandStringArray[2:])) + "\r\n")
 
-	case "type":
-		// Returns the data type of the key
-		// Currently handle string and stream data types
+	case "smembers":
 		if len(commandStringArray) != 2 {
-			return []byte("-ERR wrong number of arguments for 'type' command\r\n")
+			return []byte("-ERR wrong number of arguments for 'smembers' command\r\n")
+		}
+		set, wrongType := lookupSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
 		}
+		return encodeRESP(respSet(smembers(set)), client.Protocol)
 
-		key := commandStringArray[1]
+	case "scard":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'scard' command\r\n")
+		}
+		return scard(commandStringArray[1])
 
-		if _, ok := data[key]; ok {
-			return []byte("+string\r\n")
+	case "sismember":
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'sismember' command\r\n")
 		}
-		if _, ok := streams[key]; ok {
-			return []byte("+stream\r\n")
+		set, wrongType := lookupSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if set.contains(commandStringArray[2]) {
+			return []byte(":1\r\n")
 		}
+		return []byte(":0\r\n")
 
-		return []byte("+none\r\n")
+	case "sinter", "sunion", "sdiff":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		sets, wrongType := lookupSets(commandStringArray[1:])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
 
-	// List Operations
-	case "rpush":
-		key := commandStringArray[1]
-		values := commandStringArray[2:]
-		listData[key] = append(listData[key], values...)
-		return []byte(":" + strconv.Itoa(len(listData[key])) + "\r\n")
+		var members []string
+		switch commandName {
+		case "sinter":
+			members = sinter(sets)
+		case "sunion":
+			members = sunion(sets)
+		case "sdiff":
+			members = sdiff(sets)
+		}
+		return encodeRESP(respSet(members), client.Protocol)
 
-	case "lpush":
-		key := commandStringArray[1]
-		values := commandStringArray[2:]
-		slices.Reverse(values)
-		listData[key] = append(values, listData[key]...)
-		return []byte(":" + strconv.Itoa(len(listData[key])) + "\r\n")
+	case "sinterstore", "sunionstore", "sdiffstore":
+		// Same as above, but the result is written to the destination key
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		sets, wrongType := lookupSets(commandStringArray[2:])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
 
-	case "llen":
-		key := commandStringArray[1]
-		list, ok := listData[key]
-		var length int
-		if ok {
-			length = len(list)
-		} else {
-			length = 0
+		var members []string
+		switch commandName {
+		case "sinterstore":
+			members = sinter(sets)
+		case "sunionstore":
+			members = sunion(sets)
+		case "sdiffstore":
+			members = sdiff(sets)
 		}
-		return []byte(":" + strconv.Itoa(length) + "\r\n")
+		stored := storeSet(commandStringArray[1], members)
+		return []byte(":" + strconv.Itoa(stored) + "\r\n")
 
-	case "lpop":
-		key := commandStringArray[1]
-		list, ok := listData[key]
+	case "smove":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'smove' command\r\n")
+		}
+		if _, wrongType := lookupSets(commandStringArray[1:3]); wrongType {
+			return []byte(wrongTypeError)
+		}
+		if smove(commandStringArray[1], commandStringArray[2], commandStringArray[3]) {
+			return []byte(":1\r\n")
+		}
+		return []byte(":0\r\n")
 
-		if !ok || len(list) == 0 {
-			return []byte("$-1\r\n")
+	case "spop":
+		// Without a count a single member is returned as a Bulk String
+		if len(commandStringArray) < 2 || len(commandStringArray) > 3 {
+			return []byte("-ERR wrong number of arguments for 'spop' command\r\n")
 		}
+		key := commandStringArray[1]
 
-		numberOfElementsToRemove := 1
-		if len(commandStringArray) >= 3 {
-			numberOfElementsToRemove, err := strconv.Atoi(commandStringArray[2])
-			if err != nil || numberOfElementsToRemove < 0 {
-				fmt.Println("Error reading command: ", err.Error())
-				os.Exit(1)
+		count := 1
+		if len(commandStringArray) == 3 {
+			var err error
+			count, err = strconv.Atoi(commandStringArray[2])
+			if err != nil || count < 0 {
+				return []byte("-ERR value is out of range, must be positive\r\n")
 			}
 		}
 
-		if numberOfElementsToRemove > len(list) {
-			numberOfElementsToRemove = len(list)
+		set, wrongType := lookupSet(key)
+		if wrongType {
+			return []byte(wrongTypeError)
 		}
+		popped := spop(key, set, count)
 
-		if numberOfElementsToRemove > 1 {
-			poppedElements := list[:numberOfElementsToRemove]
-			listData[key] = list[numberOfElementsToRemove:]
-			return StringArrayToBulkStringArray(poppedElements)
-		} else {
-			poppedElement := list[0]
-			listData[key] = list[1:]
-			return StringToBulkString(poppedElement)
+		// The popped members are random, so replicas are sent the explicit SREM
+		if len(popped) > 0 {
+			PropagateWriteCommandToReplicas(append([]string{"SREM", key}, popped...))
 		}
 
-	case "lrange":
-		key := commandStringArray[1]
-		start, err := strconv.Atoi(commandStringArray[2])
-		if err != nil {
-			fmt.Println("Error reading command: ", err.Error())
-			os.Exit(1)
-		}
-		stop, err := strconv.Atoi(commandStringArray[3])
-		if err != nil {
-			fmt.Println("Error reading command: ", err.Error())
-			os.Exit(1)
+		if len(commandStringArray) == 3 {
+			return StringArrayToBulkStringArray(popped)
 		}
-
-		list, ok := listData[key]
-		if !ok {
-			return []byte("*0\r\n")
+		if len(popped) == 0 {
+			return []byte("$-1\r\n")
 		}
+		return StringToBulkString(popped[0])
 
-		length := len(list)
-		if start < 0 {
-			start += length
+	case "srandmember":
+		if len(commandStringArray) < 2 || len(commandStringArray) > 3 {
+			return []byte("-ERR wrong number of arguments for 'srandmember' command\r\n")
 		}
-		if stop < 0 {
-			stop += length
+		set, wrongType := lookupSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
 		}
-		if start < 0 {
-			start = 0
+
+		if len(commandStringArray) == 2 {
+			members := srandmember(set, 1)
+			if len(members) == 0 {
+				return []byte("$-1\r\n")
+			}
+			return StringToBulkString(members[0])
 		}
-		if stop < 0 {
-			stop = 0
+
+		count, err := strconv.Atoi(commandStringArray[2])
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
 		}
-		if stop >= length {
-			stop = length - 1
+		return StringArrayToBulkStringArray(srandmember(set, count))
+
+	// HyperLogLog
+	case "pfadd":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'pfadd' command\r\n")
 		}
+		return pfadd(commandStringArray[1], commandStringArray[2:])
 
-		if start > stop || start >= length {
-			return []byte("*0\r\n")
+	case "pfcount":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'pfcount' command\r\n")
 		}
+		return pfcount(commandStringArray[1:])
 
-		resultList := list[start : stop+1]
-		return StringArrayToBulkStringArray(resultList)
+	case "pfmerge":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'pfmerge' command\r\n")
+		}
+		return pfmerge(commandStringArray[1], commandStringArray[2:])
 
 	// Publisher / Subscriber operations
 	case "subscribe":
-		channel := commandStringArray[1]
-
-		// Track subscription
-		client.SubscribedChannels[channel] = struct{}{}
-		client.SubscribedMode = true
-		count := len(client.SubscribedChannels)
-
-		// Add connection to global subscriber map
-		subscribers := channelSubscribers[channel]
-		alreadySubscribed := false
-		for _, c := range subscribers {
-			if c == client.Connection {
-				alreadySubscribed = true
-				break
-			}
-		}
-		if !alreadySubscribed {
-			channelSubscribers[channel] = append(channelSubscribers[channel], client.Connection)
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'subscribe' command\r\n")
 		}
-
-		return EncodeArray([]ArrayElement{
-			{Type: BulkString, Value: "subscribe"},
-			{Type: BulkString, Value: channel},
-			{Type: Integer, Value: strconv.Itoa(count)},
-		})
+		return subscribe(client, commandStringArray[1:])
 
 	case "publish":
-		channel := commandStringArray[1]
-		message := commandStringArray[2]
-		subscribers := channelSubscribers[channel]
-
-		// Broadcast message to all listening connections
-		for _, c := range subscribers {
-			c.Write(EncodeArray([]ArrayElement{
-				{Type: BulkString, Value: "message"},
-				{Type: BulkString, Value: channel},
-				{Type: BulkString, Value: message},
-			}))
+		if len(commandStringArray) != 3 {
+			return []byte("-ERR wrong number of arguments for 'publish' command\r\n")
 		}
-		return []byte(":" + strconv.Itoa(len(subscribers)) + "\r\n")
+		receivers := publish(commandStringArray[1], commandStringArray[2])
+		return []byte(":" + strconv.Itoa(receivers) + "\r\n")
 
 	case "unsubscribe":
-		channel := commandStringArray[1]
+		return unsubscribe(client, commandStringArray[1:])
 
-		subscribers := channelSubscribers[channel]
-		for i, c := range subscribers {
-			if c == client.Connection {
-				channelSubscribers[channel] = append(subscribers[:i], subscribers[i+1:]...)
-				continue
-			}
+	case "psubscribe":
+		if len(commandStringArray) < 2 {
+			return []byte("-ERR wrong number of arguments for 'psubscribe' command\r\n")
 		}
+		return psubscribe(client, commandStringArray[1:])
 
-		delete(client.SubscribedChannels, channel)
+	case "punsubscribe":
+		return punsubscribe(client, commandStringArray[1:])
 
-		return EncodeArray([]ArrayElement{
-			{Type: BulkString, Value: "unsubscribe"},
-			{Type: BulkString, Value: channel},
-			{Type: Integer, Value: strconv.Itoa(len(client.SubscribedChannels))},
-		})
+	case "pubsub":
+		return pubsubCommand(commandStringArray)
 
 	// Sorted Sets
 	case "zadd":
-		key := commandStringArray[1]
-		score, err := strconv.ParseFloat(commandStringArray[2], 64)
-		if err != nil {
-			return []byte("-ERR score must be a float\r\n")
+		if len(commandStringArray) < 4 {
+			return []byte("-ERR wrong number of arguments for 'zadd' command\r\n")
 		}
-		member := commandStringArray[3]
-		added := zadd(key, score, member)
-		return []byte(":" + strconv.Itoa(added) + "\r\n")
+		options, pairs, errReply := parseZAddOptions(commandStringArray[2:])
+		if errReply != nil {
+			return errReply
+		}
+		return zaddGeneric(commandStringArray[1], options, pairs)
 
 	case "zrank":
 		key := commandStringArray[1]
+		if _, wrongType := lookupZSet(key); wrongType {
+			return []byte(wrongTypeError)
+		}
 		member := commandStringArray[2]
 		rank := zrank(key, member)
 		if rank == nil {
@@ -338,34 +1135,258 @@ func ProcessCommand(client *Client, command Command) []byte {
 		}
 		return []byte(":" + strconv.Itoa(*rank) + "\r\n")
 
-	case "zrange":
-		key := commandStringArray[1]
-		start, err := strconv.Atoi(commandStringArray[2])
-		if err != nil {
-			return []byte("-ERR invalid start index\r\n")
+	case "zrange", "zrevrange", "zrangebyscore", "zrevrangebyscore", "zrangebylex", "zrevrangebylex":
+		if len(commandStringArray) < 4 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
 		}
-		stop, err := strconv.Atoi(commandStringArray[3])
+
+		// The legacy range commands are ZRANGE with their mode spelled out
+		args := slices.Clone(commandStringArray[2:4])
+		switch commandName {
+		case "zrevrange":
+			args = append(args, "REV")
+		case "zrangebyscore":
+			args = append(args, "BYSCORE")
+		case "zrevrangebyscore":
+			args = append(args, "BYSCORE", "REV")
+		case "zrangebylex":
+			args = append(args, "BYLEX")
+		case "zrevrangebylex":
+			args = append(args, "BYLEX", "REV")
+		}
+		args = append(args, commandStringArray[4:]...)
+
+		spec, errReply := parseZRangeSpec(args, true)
+		if errReply != nil {
+			return errReply
+		}
+		set, wrongType := lookupZSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		return encodeZSetMembers(zrangeGeneric(set, spec), spec.WithScores)
+
+	case "zrangestore":
+		if len(commandStringArray) < 5 {
+			return []byte("-ERR wrong number of arguments for 'zrangestore' command\r\n")
+		}
+		spec, errReply := parseZRangeSpec(commandStringArray[3:], false)
+		if errReply != nil {
+			return errReply
+		}
+		set, wrongType := lookupZSet(commandStringArray[2])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+
+		result := newSortedSet()
+		for _, m := range zrangeGeneric(set, spec) {
+			result.add(m.Member, m.Score)
+		}
+		count := storeZSet(commandStringArray[1], result)
+		return []byte(":" + strconv.Itoa(count) + "\r\n")
+
+	case "zlexcount":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'zlexcount' command\r\n")
+		}
+		r, errReply := parseLexRange(commandStringArray[2], commandStringArray[3])
+		if errReply != nil {
+			return errReply
+		}
+		set, wrongType := lookupZSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		return []byte(":" + strconv.Itoa(zlexcount(set, r)) + "\r\n")
+
+	case "zcount":
+		if len(commandStringArray) != 4 {
+			return []byte("-ERR wrong number of arguments for 'zcount' command\r\n")
+		}
+		r, errReply := parseScoreRange(commandStringArray[2], commandStringArray[3])
+		if errReply != nil {
+			return errReply
+		}
+		set, wrongType := lookupZSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		return []byte(":" + strconv.Itoa(zcount(set, r)) + "\r\n")
+
+	case "zrandmember":
+		if len(commandStringArray) < 2 || len(commandStringArray) > 4 {
+			return []byte("-ERR wrong number of arguments for 'zrandmember' command\r\n")
+		}
+		set, wrongType := lookupZSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+
+		if len(commandStringArray) == 2 {
+			members := zrandmember(set, 1)
+			if len(members) == 0 {
+				return []byte("$-1\r\n")
+			}
+			return StringToBulkString(members[0].Member)
+		}
+
+		count, err := strconv.Atoi(commandStringArray[2])
 		if err != nil {
-			return []byte("-ERR invalid stop index\r\n")
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		withScores := false
+		if len(commandStringArray) == 4 {
+			if strings.ToLower(commandStringArray[3]) != "withscores" {
+				return []byte("-ERR syntax error\r\n")
+			}
+			withScores = true
 		}
-		members := zrange(key, start, stop)
-		return StringArrayToBulkStringArray(members)
+		return encodeZSetMembers(zrandmember(set, count), withScores)
 
 	case "zcard":
 		key := commandStringArray[1]
+		if _, wrongType := lookupZSet(key); wrongType {
+			return []byte(wrongTypeError)
+		}
 		count := zcard(key)
 		return []byte(":" + strconv.Itoa(count) + "\r\n")
 
 	case "zscore":
 		key := commandStringArray[1]
 		member := commandStringArray[2]
-		return zscore(key, member)
+		return zscore(key, member, client.Protocol)
+
+	case "zmscore":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'zmscore' command\r\n")
+		}
+		set, wrongType := lookupZSet(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+
+		scores := make([]interface{}, 0, len(commandStringArray)-2)
+		for _, member := range commandStringArray[2:] {
+			if score, ok := set.score(member); ok {
+				scores = append(scores, score)
+			} else {
+				scores = append(scores, nil)
+			}
+		}
+		return encodeRESP(scores, client.Protocol)
 
 	case "zrem":
 		key := commandStringArray[1]
 		member := commandStringArray[2]
 		return zrem(key, member)
 
+	case "zmpop":
+		if len(commandStringArray) < 4 {
+			return []byte("-ERR wrong number of arguments for 'zmpop' command\r\n")
+		}
+		keys, lowest, count, errReply := parseMultiPop(commandStringArray[1:], [2]string{"min", "max"})
+		if errReply != nil {
+			return errReply
+		}
+		key, popped, errReply := zmpop(keys, lowest, count)
+		if errReply != nil {
+			return errReply
+		}
+		if popped == nil {
+			return []byte("*-1\r\n")
+		}
+		return encodeArray([]interface{}{key, zsetPairs(popped)})
+
+	case "zunion", "zinter", "zdiff", "zunionstore", "zinterstore", "zdiffstore":
+		store := strings.HasSuffix(commandName, "store")
+		op := strings.TrimSuffix(strings.TrimPrefix(commandName, "z"), "store")
+
+		first := 1
+		if store {
+			first = 2
+		}
+		if len(commandStringArray) < first+2 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		keys, options, errReply := parseZSetOp(commandName, commandStringArray[first:], op != "diff", !store)
+		if errReply != nil {
+			return errReply
+		}
+
+		inputs, errReply := lookupZSetInputs(keys)
+		if errReply != nil {
+			return errReply
+		}
+		result := zsetOperation(op, inputs, options)
+
+		if store {
+			count := storeZSet(commandStringArray[1], result)
+			return []byte(":" + strconv.Itoa(count) + "\r\n")
+		}
+		return encodeZSetMembers(result.members(), options.WithScores)
+
+	case "zpopmin", "zpopmax":
+		if len(commandStringArray) < 2 || len(commandStringArray) > 3 {
+			return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+		}
+		count := 1
+		if len(commandStringArray) == 3 {
+			var err error
+			count, err = strconv.Atoi(commandStringArray[2])
+			if err != nil || count < 0 {
+				return []byte("-ERR value is out of range, must be positive\r\n")
+			}
+		}
+
+		key := commandStringArray[1]
+		set, wrongType := lookupZSet(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if set.length() == 0 {
+			return []byte("*0\r\n")
+		}
+		return encodeZSetMembers(zpop(key, set, commandName == "zpopmin", count), true)
+
+	case "bzpopmin", "bzpopmax", "bzmpop":
+		var keys []string
+		var timeout time.Duration
+		var errReply []byte
+		lowest := commandName == "bzpopmin"
+		count := 1
+
+		if commandName == "bzmpop" {
+			if len(commandStringArray) < 5 {
+				return []byte("-ERR wrong number of arguments for 'bzmpop' command\r\n")
+			}
+			timeout, errReply = parseBlockTimeout(commandStringArray[1])
+			if errReply != nil {
+				return errReply
+			}
+			keys, lowest, count, errReply = parseMultiPop(commandStringArray[2:], [2]string{"min", "max"})
+		} else {
+			if len(commandStringArray) < 3 {
+				return []byte("-ERR wrong number of arguments for '" + commandName + "' command\r\n")
+			}
+			keys = commandStringArray[1 : len(commandStringArray)-1]
+			timeout, errReply = parseBlockTimeout(commandStringArray[len(commandStringArray)-1])
+		}
+		if errReply != nil {
+			return errReply
+		}
+
+		return blockUntilServed(client, keys, timeout, []byte("*-1\r\n"), func() []byte {
+			key, popped, errReply := servedZSetPop(keys, lowest, count)
+			if errReply != nil || popped == nil {
+				return errReply
+			}
+			if commandName == "bzmpop" {
+				return encodeArray([]interface{}{key, zsetPairs(popped)})
+			}
+			return StringArrayToBulkStringArray([]string{key, popped[0].Member, formatScore(popped[0].Score)})
+		})
+
 	// Geospatial Commands
 	case "geoadd":
 		// Encodes Lat/Lon into a 52-bit integer and stores it as the ZSET Score.
@@ -392,42 +1413,35 @@ func ProcessCommand(client *Client, command Command) []byte {
 
 		score := GeospatialEncode(latitude, longitude)
 
-		if sortedSets[key] == nil {
-			sortedSets[key] = make(map[string]sortedSetMember)
-		}
-		sortedSets[key][member] = sortedSetMember{
-			Member: member,
-			Score:  float64(score),
+		if _, wrongType := lookupZSet(key); wrongType {
+			return []byte(wrongTypeError)
 		}
+		zadd(key, float64(score), member)
 		return []byte(":1\r\n")
 
 	case "geopos":
 		// Decodes the 52-bit score back into Lat/Lon coordinates
 		key := commandStringArray[1]
 		members := commandStringArray[2:]
-		response := "*" + strconv.Itoa(len(members)) + "\r\n"
-		zset, keyExists := sortedSets[key]
+		zset, wrongType := lookupZSet(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
 
+		positions := make([]interface{}, 0, len(members))
 		for _, memberName := range members {
-			if !keyExists {
-				response += "*-1\r\n"
-				continue
-			}
-			member, exists := zset[memberName]
+			score, exists := zset.score(memberName)
 			if !exists {
-				response += "*-1\r\n"
+				positions = append(positions, respNullArray{})
 				continue
 			}
 
-			coordinates := GeospatialDecode(uint64(member.Score))
+			coordinates := GeospatialDecode(uint64(score))
 			longitude := strconv.FormatFloat(coordinates.Longitude, 'f', -1, 64)
 			latitude := strconv.FormatFloat(coordinates.Latitude, 'f', -1, 64)
-
-			response += "*2\r\n"
-			response += "$" + strconv.Itoa(len(longitude)) + "\r\n" + longitude + "\r\n"
-			response += "$" + strconv.Itoa(len(latitude)) + "\r\n" + latitude + "\r\n"
+			positions = append(positions, []string{longitude, latitude})
 		}
-		return []byte(response)
+		return encodeRESP(positions, client.Protocol)
 
 	case "geodist":
 		// Calculates Haversine distance between two members
@@ -435,52 +1449,30 @@ func ProcessCommand(client *Client, command Command) []byte {
 		m1 := commandStringArray[2]
 		m2 := commandStringArray[3]
 
-		zset, ok := sortedSets[key]
-		if !ok {
+		zset, wrongType := lookupZSet(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if zset == nil {
 			return []byte("$-1\r\n")
 		}
 
-		sm1, ok1 := zset[m1]
-		sm2, ok2 := zset[m2]
+		score1, ok1 := zset.score(m1)
+		score2, ok2 := zset.score(m2)
 		if !ok1 || !ok2 {
 			return []byte("$-1\r\n")
 		}
 
-		c1 := GeospatialDecode(uint64(sm1.Score))
-		c2 := GeospatialDecode(uint64(sm2.Score))
+		c1 := GeospatialDecode(uint64(score1))
+		c2 := GeospatialDecode(uint64(score2))
 		distance := GeoDistance(c1, c2)
 
 		distanceString := strconv.FormatFloat(distance, 'f', -1, 64)
 		return StringToBulkString(distanceString)
 
 	case "geosearch":
-		// Finds members within a radius of a target point
-		key := commandStringArray[1]
-		zset, ok := sortedSets[key]
-		if !ok {
-			return []byte("*0\r\n")
-		}
-
-		longitude, _ := strconv.ParseFloat(commandStringArray[3], 64)
-		latitude, _ := strconv.ParseFloat(commandStringArray[4], 64)
-		radius, _ := strconv.ParseFloat(commandStringArray[6], 64)
-		unit := strings.ToLower(commandStringArray[7])
-
-		radiusMeters := RadiusToMeters(radius, unit)
-		center := Coordinates{
-			Latitude:  latitude,
-			Longitude: longitude,
-		}
-
-		results := []string{}
-		for _, member := range zset {
-			coords := GeospatialDecode(uint64(member.Score))
-			dist := GeoDistance(center, coords)
-			if dist <= radiusMeters {
-				results = append(results, member.Member)
-			}
-		}
-		return StringArrayToBulkStringArray(results)
+		// Finds members within a radius or a box around a member or a point
+		return geosearch(commandStringArray, client.Protocol)
 
 	// ACL (Access Control List)
 	case "acl":
@@ -491,13 +1483,10 @@ func ProcessCommand(client *Client, command Command) []byte {
 
 		switch aclSubCmd {
 		case "SETUSER":
-			if len(commandStringArray) < 4 {
+			if len(commandStringArray) < 3 {
 				return []byte("-ERR wrong number of arguments for ACL SETUSER\r\n")
 			}
-			username := commandStringArray[2]
-			passwordRule := commandStringArray[3]
-			client.Authenticated = true
-			return []byte(setUserPassword(username, passwordRule))
+			return setUser(commandStringArray[2], commandStringArray[3:])
 
 		case "GETUSER":
 			if len(commandStringArray) < 3 {
@@ -507,12 +1496,32 @@ func ProcessCommand(client *Client, command Command) []byte {
 			return encodeACLGetUser(username)
 
 		case "WHOAMI":
-			return []byte(StringToBulkString("default"))
+			return StringToBulkString(client.Username)
+
+		case "CAT":
+			// ACL CAT lists the categories, ACL CAT category its commands
+			if len(commandStringArray) > 3 {
+				return []byte("-ERR wrong number of arguments for ACL CAT\r\n")
+			}
+			if len(commandStringArray) == 2 {
+				return StringArrayToBulkStringArray(aclCategories())
+			}
+			category := strings.ToLower(commandStringArray[2])
+			if !slices.Contains(aclCategories(), category) {
+				return []byte("-ERR Unknown category '" + sanitizeErrorArgument(commandStringArray[2]) + "'\r\n")
+			}
+			return StringArrayToBulkStringArray(commandsInCategory(category))
 
 		default:
 			return []byte("-ERR unknown ACL subcommand\r\n")
 		}
 
+	case "client":
+		return clientCommand(client, commandStringArray[1:])
+
+	case "hello":
+		return helloCommand(client, commandStringArray[1:])
+
 	case "auth":
 		if len(commandStringArray) != 3 {
 			return []byte("-ERR wrong number of arguments for 'auth' command\r\n")
@@ -520,23 +1529,10 @@ func ProcessCommand(client *Client, command Command) []byte {
 		username := commandStringArray[1]
 		password := commandStringArray[2]
 
-		user := users[username]
-		if user == nil {
+		if !authenticate(client, username, password) {
 			return []byte("-WRONGPASS invalid username-password pair or user is disabled\r\n")
 		}
-
-		// Verify Password Hash
-		hash := sha256.Sum256([]byte(password))
-		hashHex := hex.EncodeToString(hash[:])
-
-		for _, pwHash := range user.Passwords {
-			if pwHash == hashHex {
-				client.Authenticated = true
-				client.Username = username
-				return []byte("+OK\r\n")
-			}
-		}
-		return []byte("-WRONGPASS invalid username-password pair or user is disabled\r\n")
+		return []byte("+OK\r\n")
 
 	// Replication Handshake
 	case "psync":
@@ -545,122 +1541,185 @@ func ProcessCommand(client *Client, command Command) []byte {
 		}
 
 		if commandStringArray[1] == "?" && commandStringArray[2] == "-1" {
-			client.Connection.Write([]byte("+FULLRESYNC " + replID + " 0\r\n"))
+			// Queued, like the stream that follows, and sent by the replica's
+			// writer once the lock is released
+			client.write([]byte("+FULLRESYNC " + replID + " 0\r\n"))
 
 			rdbLength := len(emptyRDB)
-			client.Connection.Write([]byte("$" + strconv.Itoa(rdbLength) + "\r\n"))
-			client.Connection.Write(emptyRDB)
+			client.write([]byte("$" + strconv.Itoa(rdbLength) + "\r\n"))
+			client.write(emptyRDB)
 
-			replicaClients = append(replicaClients, *client)
+			client.Replica = true
+			replicaClients = append(replicaClients, client)
+			// The new replica starts without a selected database
+			replicationDB = -1
 			return nil
 		}
 
-	// Streams (XADD)
+	// Streams
 	case "xadd":
-		if len(commandStringArray) < 4 || len(commandStringArray)%2 == 0 {
+		// XADD key [NOMKSTREAM] [MAXLEN | MINID [= | ~] threshold [LIMIT count]] <* | id> field value [field value ...]
+		if len(commandStringArray) < 5 {
 			return []byte("-ERR wrong number of arguments for 'xadd' command\r\n")
 		}
-
 		key := commandStringArray[1]
-		entryID := commandStringArray[2]
-
-		var ms int64
-		var seq int64
-		var err error
-
-		// ID Generation
-		if entryID == "*" {
-			// Full Auto-Generate (*)
-			ms = time.Now().UnixNano() / int64(time.Millisecond)
-			seq = 0
-
-			for i := len(streams[key]) - 1; i >= 0; i-- {
-				lastID := streams[key][i]["id"]
-				lastParts := strings.Split(lastID, "-")
-				lastMS, _ := strconv.ParseInt(lastParts[0], 10, 64)
-				if lastMS == ms {
-					lastSeq, _ := strconv.ParseInt(lastParts[1], 10, 64)
-					seq = lastSeq + 1
-					break
-				} else if lastMS < ms {
-					break
+
+		i := 2
+		noMkStream := false
+		var trim *streamTrimOptions
+	loop:
+		for ; i < len(commandStringArray); i++ {
+			switch strings.ToLower(commandStringArray[i]) {
+			case "nomkstream":
+				noMkStream = true
+			case "maxlen", "minid":
+				options, consumed, errReply := parseStreamTrim(commandStringArray[i:])
+				if errReply != nil {
+					return errReply
 				}
+				trim = &options
+				i += consumed - 1
+			default:
+				break loop
 			}
-			entryID = fmt.Sprintf("%d-%d", ms, seq)
+		}
+		if i >= len(commandStringArray) {
+			return []byte("-ERR syntax error\r\n")
+		}
+		fieldValues := commandStringArray[i+1:]
+		if len(fieldValues) == 0 || len(fieldValues)%2 != 0 {
+			return []byte("-ERR wrong number of arguments for 'xadd' command\r\n")
+		}
 
-		} else if strings.HasSuffix(entryID, "-*") {
-			// Partial Auto-Generate
-			parts := strings.Split(entryID, "-")
-			if len(parts) != 2 {
-				return []byte("-ERR invalid stream ID format\r\n")
-			}
+		stream, wrongType := lookupStream(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		if stream == nil && noMkStream {
+			return []byte("$-1\r\n")
+		}
 
-			ms, err = strconv.ParseInt(parts[0], 10, 64)
-			if err != nil || ms < 0 {
-				return []byte("-ERR invalid milliseconds part in ID\r\n")
-			}
+		var last streamID
+		if stream != nil {
+			last = stream.lastID
+		}
+		id, errReply := nextStreamID(commandStringArray[i], last)
+		if errReply != nil {
+			return errReply
+		}
+
+		stream = xadd(key, id, fieldValues)
+		if trim != nil {
+			stream.trim(*trim)
+		}
+
+		// Replicas and the AOF get the ID that was actually used
+		propagated := slices.Clone(commandStringArray)
+		propagated[i] = id.String()
+		PropagateWriteCommandToReplicas(propagated)
+		return StringToBulkString(id.String())
+
+	case "xtrim":
+		return xtrim(commandStringArray)
+
+	case "xlen":
+		if len(commandStringArray) != 2 {
+			return []byte("-ERR wrong number of arguments for 'xlen' command\r\n")
+		}
+		stream, wrongType := lookupStream(commandStringArray[1])
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+		return []byte(":" + strconv.Itoa(stream.length()) + "\r\n")
+
+	case "xdel":
+		if len(commandStringArray) < 3 {
+			return []byte("-ERR wrong number of arguments for 'xdel' command\r\n")
+		}
+		return xdel(commandStringArray[1], commandStringArray[2:])
 
-			seq = 0
-			for i := len(streams[key]) - 1; i >= 0; i-- {
-				lastID := streams[key][i]["id"]
-				lastParts := strings.Split(lastID, "-")
-				lastMS, _ := strconv.ParseInt(lastParts[0], 10, 64)
-				if lastMS == ms {
-					lastSeq, _ := strconv.ParseInt(lastParts[1], 10, 64)
-					seq = lastSeq + 1
-					break
+	case "xsetid":
+		return xsetid(commandStringArray)
+
+	case "xread":
+		// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+		options, errReply := parseXRead(commandName, commandStringArray[1:])
+		if errReply != nil {
+			return errReply
+		}
+
+		// "$" stands for the last ID of the stream at the time of the call
+		after := make([]streamID, len(options.Keys))
+		for i, arg := range options.IDs {
+			if arg == "$" {
+				stream, wrongType := lookupStream(options.Keys[i])
+				if wrongType {
+					return []byte(wrongTypeError)
+				}
+				if stream != nil {
+					after[i] = stream.lastID
 				}
+				continue
 			}
+			after[i], _ = parseStreamID(arg)
+		}
 
-			// 0-0 is invalid, so 0-* starts at 0-1
-			if ms == 0 && seq == 0 {
-				seq = 1
+		if !options.Block {
+			if reply := xread(options.Keys, after, options.Count); reply != nil {
+				return reply
 			}
-			entryID = fmt.Sprintf("%d-%d", ms, seq)
+			return []byte("*-1\r\n")
+		}
+		return blockUntilServed(client, options.Keys, options.Timeout, []byte("*-1\r\n"), func() []byte {
+			return xread(options.Keys, after, options.Count)
+		})
 
-		} else {
-			parts := strings.Split(entryID, "-")
-			if len(parts) != 2 {
-				return []byte("-ERR invalid stream ID format\r\n")
+	case "xreadgroup":
+		// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+		options, errReply := parseXRead(commandName, commandStringArray[1:])
+		if errReply != nil {
+			return errReply
+		}
+
+		// Fail right away rather than block on a missing group
+		for _, key := range options.Keys {
+			stream, wrongType := lookupStream(key)
+			if wrongType {
+				return []byte(wrongTypeError)
 			}
-			ms, err1 := strconv.ParseInt(parts[0], 10, 64)
-			seq, err2 := strconv.ParseInt(parts[1], 10, 64)
-			if err1 != nil || err2 != nil || ms < 0 || seq < 0 {
-				return []byte("-ERR invalid stream ID values\r\n")
+			if stream.group(options.Group) == nil {
+				return noGroupError(key, options.Group)
 			}
+		}
 
-			if ms == 0 && seq == 0 {
-				return []byte("-ERR The ID specified in XADD must be greater than 0-0\r\n")
+		if !options.Block {
+			if reply := servedXReadGroup(options); reply != nil {
+				return reply
 			}
+			return []byte("*-1\r\n")
+		}
+		return blockUntilServed(client, options.Keys, options.Timeout, []byte("*-1\r\n"), func() []byte {
+			return servedXReadGroup(options)
+		})
 
-			var lastID string
-			if len(streams[key]) > 0 {
-				lastEntry := streams[key][len(streams[key])-1]
-				lastID = lastEntry["id"]
-			}
+	case "xgroup":
+		return xgroupCommand(commandStringArray)
 
-			if lastID != "" {
-				lastParts := strings.Split(lastID, "-")
-				lastMS, _ := strconv.ParseInt(lastParts[0], 10, 64)
-				lastSeq, _ := strconv.ParseInt(lastParts[1], 10, 64)
+	case "xack":
+		return xack(commandStringArray)
 
-				if ms < lastMS || (ms == lastMS && seq <= lastSeq) {
-					return []byte("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n")
-				}
-			}
-		}
+	case "xpending":
+		return xpending(commandStringArray)
 
-		entry := make(map[string]string)
-		entry["id"] = entryID
-		for i := 3; i < len(commandStringArray); i += 2 {
-			field := commandStringArray[i]
-			value := commandStringArray[i+1]
-			entry[field] = value
-		}
+	case "xclaim":
+		return xclaim(commandStringArray)
+
+	case "xautoclaim":
+		return xautoclaim(commandStringArray)
 
-		streams[key] = append(streams[key], entry)
-		return []byte("$" + strconv.Itoa(len(entryID)) + "\r\n" + entryID + "\r\n")
+	case "xinfo":
+		return xinfo(commandStringArray)
 	}
 
-	return []byte("-ERR unknown command\r\n")
+	return unknownCommandError(commandStringArray)
 }
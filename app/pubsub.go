@@ -0,0 +1,168 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// subscriptionCount returns the number of channels and patterns client is subscribed to,
+// as reported in subscription confirmations.
+func subscriptionCount(client *Client) int {
+	return len(client.SubscribedChannels) + len(client.SubscribedPatterns)
+}
+
+// removeSubscriber removes client from the subscribers of name in registry,
+// dropping the entry once nobody is left.
+func removeSubscriber(registry map[string][]*Client, name string, client *Client) {
+	subscribers := slices.DeleteFunc(registry[name], func(c *Client) bool {
+		return c == client
+	})
+	if len(subscribers) == 0 {
+		delete(registry, name)
+	} else {
+		registry[name] = subscribers
+	}
+}
+
+// publish delivers message to the subscribers of channel and to those of every
+// pattern matching it, as push frames to RESP3 connections. Returns the number
+// of deliveries made. The messages are queued, so a subscriber that does not
+// read holds up neither the publisher nor the lock.
+func publish(channel, message string) int {
+	receivers := 0
+	for _, c := range channelSubscribers[channel] {
+		c.send(encodeRESP(respPush{"message", channel, message}, c.Protocol))
+		receivers++
+	}
+
+	for pattern, subscribers := range patternSubscribers {
+		if !globMatch(pattern, channel) {
+			continue
+		}
+		for _, c := range subscribers {
+			c.send(encodeRESP(respPush{"pmessage", pattern, channel, message}, c.Protocol))
+			receivers++
+		}
+	}
+	return receivers
+}
+
+// subscribeTo subscribes client to every name (channel or pattern, according
+// to kind), tracked in its own set and in registry. Replies with one
+// confirmation per name.
+func subscribeTo(client *Client, kind string, names []string, subscribed map[string]struct{}, registry map[string][]*Client) []byte {
+	var reply []byte
+	for _, name := range names {
+		if _, ok := subscribed[name]; !ok {
+			subscribed[name] = struct{}{}
+			registry[name] = append(registry[name], client)
+		}
+		client.SubscribedMode = true
+
+		reply = append(reply, encodeRESP(respPush{kind, name, subscriptionCount(client)}, client.Protocol)...)
+	}
+	return reply
+}
+
+// unsubscribeFrom is the reverse of subscribeTo. With no names it drops every
+// subscription in subscribed. The client leaves subscribe mode once it has no
+// subscriptions left.
+func unsubscribeFrom(client *Client, kind string, names []string, subscribed map[string]struct{}, registry map[string][]*Client) []byte {
+	if len(names) == 0 {
+		for name := range subscribed {
+			names = append(names, name)
+		}
+		if len(names) == 0 {
+			return encodeRESP(respPush{kind, nil, subscriptionCount(client)}, client.Protocol)
+		}
+	}
+
+	var reply []byte
+	for _, name := range names {
+		if _, ok := subscribed[name]; ok {
+			delete(subscribed, name)
+			removeSubscriber(registry, name, client)
+		}
+		count := subscriptionCount(client)
+		if count == 0 {
+			client.SubscribedMode = false
+		}
+
+		reply = append(reply, encodeRESP(respPush{kind, name, count}, client.Protocol)...)
+	}
+	return reply
+}
+
+// subscribe implements SUBSCRIBE channel [channel ...].
+func subscribe(client *Client, channels []string) []byte {
+	return subscribeTo(client, "subscribe", channels, client.SubscribedChannels, channelSubscribers)
+}
+
+// unsubscribe implements UNSUBSCRIBE [channel ...].
+func unsubscribe(client *Client, channels []string) []byte {
+	return unsubscribeFrom(client, "unsubscribe", channels, client.SubscribedChannels, channelSubscribers)
+}
+
+// psubscribe implements PSUBSCRIBE pattern [pattern ...].
+func psubscribe(client *Client, patterns []string) []byte {
+	return subscribeTo(client, "psubscribe", patterns, client.SubscribedPatterns, patternSubscribers)
+}
+
+// punsubscribe implements PUNSUBSCRIBE [pattern ...].
+func punsubscribe(client *Client, patterns []string) []byte {
+	return unsubscribeFrom(client, "punsubscribe", patterns, client.SubscribedPatterns, patternSubscribers)
+}
+
+// pubsubCommand implements PUBSUB CHANNELS [pattern] | NUMSUB [channel ...] | NUMPAT | HELP.
+func pubsubCommand(commandStringArray []string) []byte {
+	if len(commandStringArray) < 2 {
+		return []byte("-ERR wrong number of arguments for 'pubsub' command\r\n")
+	}
+
+	switch strings.ToLower(commandStringArray[1]) {
+	case "help":
+		return StringArrayToBulkStringArray([]string{
+			"PUBSUB <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CHANNELS [<pattern>]",
+			"    Return the currently active channels matching a <pattern> (default: '*').",
+			"NUMPAT",
+			"    Return number of subscriptions to patterns.",
+			"NUMSUB [<channel> ...]",
+			"    Return the number of subscribers for the specified channels, excluding",
+			"    pattern subscriptions(default: no channels).",
+		})
+
+	case "channels":
+		if len(commandStringArray) > 3 {
+			break
+		}
+		pattern := "*"
+		if len(commandStringArray) == 3 {
+			pattern = commandStringArray[2]
+		}
+		channels := []string{}
+		for channel := range channelSubscribers {
+			if globMatch(pattern, channel) {
+				channels = append(channels, channel)
+			}
+		}
+		slices.Sort(channels)
+		return StringArrayToBulkStringArray(channels)
+
+	case "numsub":
+		result := []interface{}{}
+		for _, channel := range commandStringArray[2:] {
+			result = append(result, channel, len(channelSubscribers[channel]))
+		}
+		return encodeArray(result)
+
+	case "numpat":
+		if len(commandStringArray) != 2 {
+			break
+		}
+		return []byte(":" + strconv.Itoa(len(patternSubscribers)) + "\r\n")
+	}
+
+	return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(commandStringArray[1]) + "'. Try PUBSUB HELP.\r\n")
+}
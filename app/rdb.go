@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RDB format version written by SAVE, the one of Redis 7.4 which introduced
+// hash field expiration.
+const rdbVersion = 12
+
+// RDB opcodes, marking the records that are not keys.
+const (
+	rdbOpcodeAux          = 0xFA
+	rdbOpcodeResizeDB     = 0xFB
+	rdbOpcodeExpireTimeMs = 0xFC
+	rdbOpcodeSelectDB     = 0xFE
+	rdbOpcodeEOF          = 0xFF
+)
+
+// RDB value types, numbered as in Redis.
+const (
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeHash             = 4
+	rdbTypeZSet2            = 5
+	rdbTypeStreamListpacks3 = 21
+	rdbTypeHashMetadata     = 24
+)
+
+// Marker bytes of the length and string encodings.
+const (
+	rdbLength32      = 0x80
+	rdbLength64      = 0x81
+	rdbEncodingInt8  = 0xC0
+	rdbEncodingInt16 = 0xC1
+	rdbEncodingInt32 = 0xC2
+)
+
+// crc64Table is the table of the CRC-64/Jones checksum closing every RDB file.
+var crc64Table = crc64.MakeTable(0x95ac9329ac4bc9b5)
+
+// bgsaveInProgress is set while a BGSAVE goroutine writes a snapshot.
+// Guarded by keyspaceMutex.
+var bgsaveInProgress = false
+
+// rdbEncoder accumulates the serialization of a dataset in the RDB format.
+type rdbEncoder struct {
+	buf bytes.Buffer
+}
+
+// writeLength writes n in the variable length encoding of RDB: 6 bits, 14 bits,
+// or a marker byte followed by 32 or 64 big-endian bits.
+func (e *rdbEncoder) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		e.buf.WriteByte(byte(n))
+	case n < 1<<14:
+		e.buf.WriteByte(0x40 | byte(n>>8))
+		e.buf.WriteByte(byte(n))
+	case n <= math.MaxUint32:
+		e.buf.WriteByte(rdbLength32)
+		e.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	default:
+		e.buf.WriteByte(rdbLength64)
+		e.buf.Write(binary.BigEndian.AppendUint64(nil, n))
+	}
+}
+
+// writeString writes a length-prefixed string, using the integer encodings
+// for the short canonical decimal strings that fit in 32 bits.
+func (e *rdbEncoder) writeString(s string) {
+	if value, ok := parseIntsetMember(s); ok && len(s) <= 11 {
+		switch {
+		case value >= math.MinInt8 && value <= math.MaxInt8:
+			e.buf.Write([]byte{rdbEncodingInt8, byte(value)})
+			return
+		case value >= math.MinInt16 && value <= math.MaxInt16:
+			e.buf.WriteByte(rdbEncodingInt16)
+			e.buf.Write(binary.LittleEndian.AppendUint16(nil, uint16(value)))
+			return
+		case value >= math.MinInt32 && value <= math.MaxInt32:
+			e.buf.WriteByte(rdbEncodingInt32)
+			e.buf.Write(binary.LittleEndian.AppendUint32(nil, uint32(value)))
+			return
+		}
+	}
+	e.writeLength(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+// writeMillisecondTime writes a unix time in milliseconds as 8 little-endian bytes.
+func (e *rdbEncoder) writeMillisecondTime(ms int64) {
+	e.buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(ms)))
+}
+
+// writeStreamID writes id as 16 big-endian bytes, the key of stream nodes and PELs.
+func (e *rdbEncoder) writeStreamID(id streamID) {
+	e.buf.Write(streamIDBytes(id))
+}
+
+// streamIDBytes returns id as 16 big-endian bytes.
+func streamIDBytes(id streamID) []byte {
+	return binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, id.ms), id.seq)
+}
+
+// encodeRDB serializes every database, skipping the keys already expired.
+func encodeRDB(dbs []map[string]*redisObject) []byte {
+	e := &rdbEncoder{}
+	e.buf.WriteString(fmt.Sprintf("REDIS%04d", rdbVersion))
+
+	aux := [][2]string{
+		{"redis-ver", "7.4.0"},
+		{"redis-bits", "64"},
+		{"ctime", strconv.FormatInt(time.Now().Unix(), 10)},
+		{"aof-base", "0"},
+	}
+	for _, field := range aux {
+		e.buf.WriteByte(rdbOpcodeAux)
+		e.writeString(field[0])
+		e.writeString(field[1])
+	}
+
+	for index, db := range dbs {
+		live := make(map[string]*redisObject, len(db))
+		expires := 0
+		for key, obj := range db {
+			if isExpired(obj) {
+				continue
+			}
+			live[key] = obj
+			if obj.Expiry != nil {
+				expires++
+			}
+		}
+		if len(live) == 0 {
+			continue
+		}
+
+		e.buf.WriteByte(rdbOpcodeSelectDB)
+		e.writeLength(uint64(index))
+		e.buf.WriteByte(rdbOpcodeResizeDB)
+		e.writeLength(uint64(len(live)))
+		e.writeLength(uint64(expires))
+
+		for key, obj := range live {
+			if obj.Expiry != nil {
+				e.buf.WriteByte(rdbOpcodeExpireTimeMs)
+				e.writeMillisecondTime(obj.Expiry.UnixMilli())
+			}
+			e.writeObject(key, obj)
+		}
+	}
+
+	e.buf.WriteByte(rdbOpcodeEOF)
+	checksum := ^crc64.Update(^uint64(0), crc64Table, e.buf.Bytes())
+	e.buf.Write(binary.LittleEndian.AppendUint64(nil, checksum))
+	return e.buf.Bytes()
+}
+
+// writeObject writes the type, key and value of a key.
+func (e *rdbEncoder) writeObject(key string, obj *redisObject) {
+	switch value := obj.Value.(type) {
+	case string:
+		e.buf.WriteByte(rdbTypeString)
+		e.writeString(key)
+		e.writeString(value)
+
+	case []string:
+		e.buf.WriteByte(rdbTypeList)
+		e.writeString(key)
+		e.writeLength(uint64(len(value)))
+		for _, element := range value {
+			e.writeString(element)
+		}
+
+	case *redisSet:
+		e.buf.WriteByte(rdbTypeSet)
+		e.writeString(key)
+		members := value.members()
+		e.writeLength(uint64(len(members)))
+		for _, member := range members {
+			e.writeString(member)
+		}
+
+	case *sortedSet:
+		e.buf.WriteByte(rdbTypeZSet2)
+		e.writeString(key)
+		members := value.members()
+		e.writeLength(uint64(len(members)))
+		// Members are written highest score first, so that loading them appends
+		// to the skiplist instead of inserting in the middle
+		for _, m := range slices.Backward(members) {
+			e.writeString(m.Member)
+			e.buf.Write(binary.LittleEndian.AppendUint64(nil, math.Float64bits(m.Score)))
+		}
+
+	case *redisHash:
+		e.writeHash(key, value)
+
+	case *redisStream:
+		e.buf.WriteByte(rdbTypeStreamListpacks3)
+		e.writeString(key)
+		e.writeStream(value)
+	}
+}
+
+// writeHash writes a hash. Hashes with field expiries use the metadata type,
+// which stores every field's expiration time relative to the earliest one.
+func (e *rdbEncoder) writeHash(key string, hash *redisHash) {
+	entries := hash.entries()
+	if len(hash.expiries) == 0 {
+		e.buf.WriteByte(rdbTypeHash)
+		e.writeString(key)
+		e.writeLength(uint64(len(entries) / 2))
+		for _, s := range entries {
+			e.writeString(s)
+		}
+		return
+	}
+
+	minExpire := int64(math.MaxInt64)
+	for _, when := range hash.expiries {
+		minExpire = min(minExpire, when.UnixMilli())
+	}
+
+	e.buf.WriteByte(rdbTypeHashMetadata)
+	e.writeString(key)
+	e.writeMillisecondTime(minExpire)
+	e.writeLength(uint64(len(entries) / 2))
+	for i := 0; i < len(entries); i += 2 {
+		ttl := uint64(0) // No expiry
+		if when := hash.fieldExpiry(entries[i]); when != nil {
+			ttl = uint64(when.UnixMilli()-minExpire) + 1
+		}
+		e.writeLength(ttl)
+		e.writeString(entries[i])
+		e.writeString(entries[i+1])
+	}
+}
+
+// writeStream writes a stream: its entries packed into listpack nodes of up to
+// streamNodeMaxEntries entries, its metadata, then its consumer groups.
+func (e *rdbEncoder) writeStream(s *redisStream) {
+	nodes := slices.Collect(slices.Chunk(s.entries, streamNodeMaxEntries))
+	e.writeLength(uint64(len(nodes)))
+	for _, node := range nodes {
+		e.writeString(string(streamIDBytes(node[0].ID)))
+		e.writeString(string(encodeStreamNode(node)))
+	}
+
+	var firstID streamID
+	if len(s.entries) > 0 {
+		firstID = s.entries[0].ID
+	}
+	e.writeLength(uint64(len(s.entries)))
+	e.writeLength(s.lastID.ms)
+	e.writeLength(s.lastID.seq)
+	e.writeLength(firstID.ms)
+	e.writeLength(firstID.seq)
+	e.writeLength(s.maxDeletedID.ms)
+	e.writeLength(s.maxDeletedID.seq)
+	e.writeLength(s.entriesAdded)
+
+	e.writeLength(uint64(len(s.groups)))
+	for _, name := range slices.Sorted(maps.Keys(s.groups)) {
+		group := s.groups[name]
+		e.writeString(name)
+		e.writeLength(group.lastID.ms)
+		e.writeLength(group.lastID.seq)
+		e.writeLength(uint64(group.entriesRead))
+
+		pending := slices.SortedFunc(maps.Keys(group.pending), streamID.compare)
+		e.writeLength(uint64(len(pending)))
+		for _, id := range pending {
+			e.writeStreamID(id)
+			e.writeMillisecondTime(group.pending[id].deliveryTime.UnixMilli())
+			e.writeLength(uint64(group.pending[id].deliveryCount))
+		}
+
+		e.writeLength(uint64(len(group.consumers)))
+		for _, consumerName := range slices.Sorted(maps.Keys(group.consumers)) {
+			consumer := group.consumers[consumerName]
+			e.writeString(consumerName)
+			e.writeMillisecondTime(consumer.seenTime.UnixMilli())
+			if consumer.activeTime.IsZero() {
+				e.writeMillisecondTime(-1)
+			} else {
+				e.writeMillisecondTime(consumer.activeTime.UnixMilli())
+			}
+
+			owned := slices.DeleteFunc(slices.Clone(pending), func(id streamID) bool {
+				return group.pending[id].consumer != consumerName
+			})
+			e.writeLength(uint64(len(owned)))
+			for _, id := range owned {
+				e.writeStreamID(id)
+			}
+		}
+	}
+}
+
+// Flags of the entries of a stream node.
+const (
+	streamItemFlagNone       = 0
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+)
+
+// encodeStreamNode packs entries into a listpack the way Redis lays out a
+// stream node: a master entry holding the entry count and the fields of the
+// first entry, then every entry as its ID relative to the node's first ID and
+// its fields, leaving out the field names when they match the master's.
+func encodeStreamNode(entries []streamEntry) []byte {
+	lp := &listpackWriter{}
+	master := entries[0]
+	masterFields := make([]string, 0, len(master.Fields)/2)
+	for i := 0; i < len(master.Fields); i += 2 {
+		masterFields = append(masterFields, master.Fields[i])
+	}
+
+	lp.appendInt(int64(len(entries)))
+	lp.appendInt(0) // Deleted entries
+	lp.appendInt(int64(len(masterFields)))
+	for _, field := range masterFields {
+		lp.appendString(field)
+	}
+	lp.appendInt(0)
+
+	for _, entry := range entries {
+		sameFields := len(entry.Fields) == 2*len(masterFields)
+		for i := 0; sameFields && i < len(masterFields); i++ {
+			sameFields = entry.Fields[2*i] == masterFields[i]
+		}
+
+		if sameFields {
+			lp.appendInt(streamItemFlagSameFields)
+		} else {
+			lp.appendInt(streamItemFlagNone)
+		}
+		lp.appendInt(int64(entry.ID.ms - master.ID.ms))
+		lp.appendInt(int64(entry.ID.seq - master.ID.seq))
+
+		if sameFields {
+			for i := 1; i < len(entry.Fields); i += 2 {
+				lp.appendString(entry.Fields[i])
+			}
+			lp.appendInt(int64(3 + len(masterFields)))
+		} else {
+			lp.appendInt(int64(len(entry.Fields) / 2))
+			for _, s := range entry.Fields {
+				lp.appendString(s)
+			}
+			lp.appendInt(int64(4 + len(entry.Fields)))
+		}
+	}
+	return lp.bytes()
+}
+
+// rdbPath returns the path of the RDB file, from the dir and dbfilename parameters.
+func rdbPath() string {
+	return filepath.Join(dir, dbfilename)
+}
+
+// writeRDBFile writes data to the RDB file atomically: it goes to a temporary
+// file first, renamed over the RDB file once safely on disk. Every call gets
+// its own temporary file, as a save may run while a background one is writing.
+func writeRDBFile(data []byte) error {
+	f, err := os.CreateTemp(filepath.Join(dir, "."), fmt.Sprintf("temp-%d-*.rdb", os.Getpid()))
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(temp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, rdbPath())
+}
+
+// savePoint triggers a BGSAVE once at least changes writes happened and
+// seconds elapsed since the last successful save.
+type savePoint struct {
+	seconds int
+	changes int
+}
+
+// savePoints are the automatic save rules, set with --save. Redis' defaults.
+var savePoints = []savePoint{{3600, 1}, {300, 100}, {60, 10000}}
+
+// How often the save points are checked, and how long to wait before trying
+// again after a failed background save.
+const (
+	saveCronInterval = 100 * time.Millisecond
+	bgsaveRetryDelay = 5 * time.Second
+)
+
+// Persistence state, guarded by keyspaceMutex.
+var (
+	dirty            = 0          // Writes since the last successful save
+	lastSave         = time.Now() // Time of the last successful save
+	lastBgsaveTry    time.Time    // Time the last background save started
+	lastBgsaveFailed = false
+)
+
+// parseSavePoints parses the value of the save parameter: pairs of seconds and
+// changes, "3600 1 300 100". An empty value disables automatic saves.
+func parseSavePoints(value string) ([]savePoint, bool) {
+	fields := strings.Fields(value)
+	if len(fields)%2 != 0 {
+		return nil, false
+	}
+	points := []savePoint{}
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 1 || changes < 0 {
+			return nil, false
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, true
+}
+
+// formatSavePoints formats the save points as CONFIG GET save reports them.
+func formatSavePoints() string {
+	fields := make([]string, 0, 2*len(savePoints))
+	for _, point := range savePoints {
+		fields = append(fields, strconv.Itoa(point.seconds), strconv.Itoa(point.changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+// saveCron starts a background save whenever one of the save points is reached.
+// After a failure, it waits bgsaveRetryDelay before trying again.
+func saveCron() {
+	ticker := time.NewTicker(saveCronInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		keyspaceMutex.Lock()
+		now := time.Now()
+		if !bgsaveInProgress && (!lastBgsaveFailed || now.Sub(lastBgsaveTry) > bgsaveRetryDelay) {
+			for _, point := range savePoints {
+				if dirty >= point.changes && now.Sub(lastSave) >= time.Duration(point.seconds)*time.Second {
+					serverLog(logNotice, "%d changes in %d seconds. Saving...", point.changes, point.seconds)
+					bgsave()
+					break
+				}
+			}
+		}
+		keyspaceMutex.Unlock()
+	}
+}
+
+// save implements SAVE, writing the dataset to disk before replying.
+// Must be called with keyspaceMutex held.
+func save() []byte {
+	if bgsaveInProgress {
+		return []byte("-ERR Background save already in progress\r\n")
+	}
+	if err := writeRDBFile(encodeRDB(databases)); err != nil {
+		serverLog(logWarning, "Failed saving the DB: %v", err)
+		return []byte("-ERR " + err.Error() + "\r\n")
+	}
+	dirty = 0
+	lastSave = time.Now()
+	serverLog(logNotice, "DB saved on disk")
+	return []byte("+OK\r\n")
+}
+
+// snapshotDatabases returns a deep copy of the live keys of every database,
+// for background saves to serialize while clients keep writing.
+func snapshotDatabases() []map[string]*redisObject {
+	start := time.Now()
+	defer func() { latencyAddSampleIfNeeded("fork", time.Since(start)) }()
+
+	snapshot := makeDatabases(len(databases))
+	for index, db := range databases {
+		for key, obj := range db {
+			if !isExpired(obj) {
+				snapshot[index][key] = duplicateObject(obj)
+			}
+		}
+	}
+	return snapshot
+}
+
+// bgsave implements BGSAVE. The dataset is copied while the lock is held, then
+// serialized and written by a goroutine so that clients are not stalled.
+// Writes made meanwhile stay counted as dirty.
+// Must be called with keyspaceMutex held.
+func bgsave() []byte {
+	if bgsaveInProgress {
+		return []byte("-ERR Background save already in progress\r\n")
+	}
+	bgsaveInProgress = true
+	lastBgsaveTry = time.Now()
+	dirtyAtSnapshot := dirty
+
+	snapshot := snapshotDatabases()
+
+	go func() {
+		err := writeRDBFile(encodeRDB(snapshot))
+
+		keyspaceMutex.Lock()
+		bgsaveInProgress = false
+		lastBgsaveFailed = err != nil
+		if err == nil {
+			dirty -= dirtyAtSnapshot
+			lastSave = lastBgsaveTry
+		}
+		keyspaceMutex.Unlock()
+
+		if err != nil {
+			serverLog(logWarning, "Background saving error: %v", err)
+			return
+		}
+		serverLog(logNotice, "Background saving terminated with success")
+	}()
+
+	return []byte("+Background saving started\r\n")
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Opcodes and value types found in RDB files written by Redis, besides the
+// ones SAVE writes.
+const (
+	rdbOpcodeSlotInfo   = 0xF4
+	rdbOpcodeIdle       = 0xF8
+	rdbOpcodeFreq       = 0xF9
+	rdbOpcodeExpireTime = 0xFD
+
+	rdbTypeZSet             = 3
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZSetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZSetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeHashListpackEx   = 25
+
+	rdbEncodingLZF = 0xC3
+)
+
+// errRDBTruncated reports an RDB file that ends in the middle of a record.
+var errRDBTruncated = errors.New("unexpected end of file")
+
+// rdbDecoder reads an RDB file held in memory. The first error is kept and
+// every later read returns zero values, so callers only check err once done.
+type rdbDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// fail records err, unless an earlier error was already recorded.
+func (d *rdbDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+// readBytes returns the next n bytes.
+func (d *rdbDecoder) readBytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.data)-d.pos {
+		d.fail(errRDBTruncated)
+		return nil
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+// readByte returns the next byte.
+func (d *rdbDecoder) readByte() byte {
+	b := d.readBytes(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// readLengthOrEncoding reads a length, or the marker of a special string
+// encoding, in which case encoded is set and the marker byte returned.
+func (d *rdbDecoder) readLengthOrEncoding() (n uint64, encoded bool) {
+	b := d.readByte()
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false
+	case 1:
+		return uint64(b&0x3F)<<8 | uint64(d.readByte()), false
+	case 3:
+		return uint64(b), true
+	}
+	switch b {
+	case rdbLength32:
+		if raw := d.readBytes(4); raw != nil {
+			return uint64(binary.BigEndian.Uint32(raw)), false
+		}
+	case rdbLength64:
+		if raw := d.readBytes(8); raw != nil {
+			return binary.BigEndian.Uint64(raw), false
+		}
+	default:
+		d.fail(fmt.Errorf("unknown length encoding 0x%02x", b))
+	}
+	return 0, false
+}
+
+// readLength reads a length.
+func (d *rdbDecoder) readLength() uint64 {
+	n, encoded := d.readLengthOrEncoding()
+	if encoded {
+		d.fail(errors.New("unexpected string encoding in place of a length"))
+		return 0
+	}
+	return n
+}
+
+// readCount reads a length used as an element count, rejecting counts larger
+// than the rest of the file could possibly hold.
+func (d *rdbDecoder) readCount() int {
+	n := d.readLength()
+	if n > uint64(len(d.data)-d.pos) {
+		d.fail(errRDBTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+// readString reads a string in any of its encodings: raw, integer or LZF compressed.
+func (d *rdbDecoder) readString() string {
+	n, encoded := d.readLengthOrEncoding()
+	if !encoded {
+		if n > uint64(len(d.data)-d.pos) {
+			d.fail(errRDBTruncated)
+			return ""
+		}
+		return string(d.readBytes(int(n)))
+	}
+
+	switch n {
+	case rdbEncodingInt8:
+		return strconv.Itoa(int(int8(d.readByte())))
+	case rdbEncodingInt16:
+		if raw := d.readBytes(2); raw != nil {
+			return strconv.Itoa(int(int16(binary.LittleEndian.Uint16(raw))))
+		}
+	case rdbEncodingInt32:
+		if raw := d.readBytes(4); raw != nil {
+			return strconv.Itoa(int(int32(binary.LittleEndian.Uint32(raw))))
+		}
+	case rdbEncodingLZF:
+		compressedLength := d.readCount()
+		length := d.readLength()
+		compressed := d.readBytes(compressedLength)
+		if d.err != nil {
+			return ""
+		}
+		s, err := lzfDecompress(compressed, length)
+		if err != nil {
+			d.fail(err)
+		}
+		return s
+	default:
+		d.fail(fmt.Errorf("unknown string encoding 0x%02x", n))
+	}
+	return ""
+}
+
+// readMillisecondTime reads a unix time in milliseconds, 8 little-endian bytes.
+func (d *rdbDecoder) readMillisecondTime() int64 {
+	raw := d.readBytes(8)
+	if raw == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(raw))
+}
+
+// readDouble reads a zset score in the binary format: a little-endian float64.
+func (d *rdbDecoder) readDouble() float64 {
+	raw := d.readBytes(8)
+	if raw == nil {
+		return 0
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(raw))
+}
+
+// readStringDouble reads a zset score in the legacy format: its length, then
+// its decimal form, with 253 to 255 standing for NaN and the infinities.
+func (d *rdbDecoder) readStringDouble() float64 {
+	switch n := d.readByte(); n {
+	case 253:
+		return math.NaN()
+	case 254:
+		return math.Inf(1)
+	case 255:
+		return math.Inf(-1)
+	default:
+		score, err := strconv.ParseFloat(string(d.readBytes(int(n))), 64)
+		if err != nil {
+			d.fail(err)
+		}
+		return score
+	}
+}
+
+// readStreamID reads a stream ID stored as 16 big-endian bytes.
+func (d *rdbDecoder) readStreamID() streamID {
+	raw := d.readBytes(16)
+	if raw == nil {
+		return streamID{}
+	}
+	return streamID{binary.BigEndian.Uint64(raw), binary.BigEndian.Uint64(raw[8:])}
+}
+
+// readPacked reads a string holding a listpack, ziplist or intset, and
+// returns its elements.
+func (d *rdbDecoder) readPacked(parse func([]byte) ([]string, error)) []string {
+	blob := d.readString()
+	if d.err != nil {
+		return nil
+	}
+	elements, err := parse([]byte(blob))
+	if err != nil {
+		d.fail(err)
+	}
+	return elements
+}
+
+// lzfDecompress expands data compressed with LZF, which Redis applies to long
+// strings, into a string of the given length.
+func lzfDecompress(in []byte, length uint64) (string, error) {
+	errCorrupt := errors.New("corrupt LZF compressed string")
+	if length > uint64(len(in))*256 {
+		return "", errCorrupt
+	}
+
+	out := make([]byte, 0, length)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// A run of ctrl+1 literal bytes
+			if i+ctrl+1 > len(in) {
+				return "", errCorrupt
+			}
+			out = append(out, in[i:i+ctrl+1]...)
+			i += ctrl + 1
+			continue
+		}
+
+		// A back reference: copy n bytes from earlier in the output
+		n := ctrl >> 5
+		if n == 7 {
+			if i >= len(in) {
+				return "", errCorrupt
+			}
+			n += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return "", errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1F)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return "", errCorrupt
+		}
+		for j := 0; j < n+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+
+	if uint64(len(out)) != length {
+		return "", errCorrupt
+	}
+	return string(out), nil
+}
+
+// loadRDBFile populates the databases from the RDB file, if there is one.
+// A missing file is not an error: the server starts empty.
+func loadRDBFile() error {
+	data, err := os.ReadFile(rdbPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = decodeRDB(data, databases)
+	return err
+}
+
+// decodeRDB loads the keys of an RDB file into dbs. Keys already expired are skipped.
+// Returns the size of the RDB payload, which may be followed by more data
+// when it is the preamble of an AOF.
+func decodeRDB(data []byte, dbs []map[string]*redisObject) (int, error) {
+	d := &rdbDecoder{data: data}
+
+	magic := string(d.readBytes(9))
+	if len(magic) != 9 || magic[:5] != "REDIS" {
+		return 0, errors.New("wrong signature, not an RDB file")
+	}
+	version, err := strconv.Atoi(magic[5:])
+	if err != nil || version < 1 || version > rdbVersion {
+		return 0, fmt.Errorf("can't handle RDB format version %s", magic[5:])
+	}
+
+	db := dbs[0]
+	var expiry *time.Time
+	var frequency byte // LFU counter saved for the next key, if hasFrequency
+	hasFrequency := false
+	for d.err == nil {
+		opcode := d.readByte()
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version >= 5 && len(d.data)-d.pos >= 8 {
+				checksum := binary.LittleEndian.Uint64(d.data[d.pos:])
+				computed := ^crc64.Update(^uint64(0), crc64Table, d.data[:d.pos])
+				if checksum != 0 && checksum != computed {
+					return 0, errors.New("wrong RDB checksum")
+				}
+				d.pos += 8
+			}
+			return d.pos, nil
+
+		case rdbOpcodeSelectDB:
+			index := d.readLength()
+			if index >= uint64(len(dbs)) {
+				return 0, fmt.Errorf("DB index %d is out of range", index)
+			}
+			db = dbs[index]
+
+		case rdbOpcodeResizeDB:
+			d.readLength()
+			d.readLength()
+
+		case rdbOpcodeAux:
+			d.readString()
+			d.readString()
+
+		case rdbOpcodeSlotInfo:
+			d.readLength()
+			d.readLength()
+			d.readLength()
+
+		case rdbOpcodeIdle:
+			d.readLength()
+
+		case rdbOpcodeFreq:
+			frequency = d.readByte()
+			hasFrequency = true
+
+		case rdbOpcodeExpireTimeMs:
+			t := time.UnixMilli(d.readMillisecondTime())
+			expiry = &t
+
+		case rdbOpcodeExpireTime:
+			raw := d.readBytes(4)
+			if raw != nil {
+				t := time.Unix(int64(binary.LittleEndian.Uint32(raw)), 0)
+				expiry = &t
+			}
+
+		default:
+			key := d.readString()
+			obj := d.readObject(opcode)
+			if d.err != nil {
+				break
+			}
+			obj.Expiry = expiry
+			expiry = nil
+			if hasFrequency {
+				obj.Frequency = frequency
+				hasFrequency = false
+			}
+			if !isExpired(obj) && !expireHashFields(obj) {
+				db[key] = obj
+			}
+		}
+	}
+	return 0, d.err
+}
+
+// readObject reads a value of the given RDB type, converting it to the
+// encoding this server would have given it.
+func (d *rdbDecoder) readObject(rdbType byte) *redisObject {
+	obj := &redisObject{LastAccess: time.Now(), Frequency: lfuInitVal, LFUTime: lfuTimeInMinutes()}
+
+	switch rdbType {
+	case rdbTypeString:
+		obj.Type, obj.Value = StringType, stringValue(d.readString())
+
+	case rdbTypeList:
+		n := d.readCount()
+		list := make([]string, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			list = append(list, d.readString())
+		}
+		obj.Type, obj.Value = ListType, list
+
+	case rdbTypeListZiplist:
+		obj.Type, obj.Value = ListType, d.readPacked(parseZiplist)
+
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		var list []string
+		n := d.readCount()
+		for i := 0; i < n && d.err == nil; i++ {
+			if rdbType == rdbTypeListQuicklist {
+				list = append(list, d.readPacked(parseZiplist)...)
+				continue
+			}
+			// Quicklist 2 nodes are either a listpack or a single plain element
+			if container := d.readLength(); container == 1 {
+				list = append(list, d.readString())
+			} else {
+				list = append(list, d.readPacked(parseListpack)...)
+			}
+		}
+		obj.Type, obj.Value = ListType, list
+
+	case rdbTypeSet:
+		n := d.readCount()
+		members := make([]string, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			members = append(members, d.readString())
+		}
+		obj.Type, obj.Value = SetType, setFromMembers(members)
+
+	case rdbTypeSetIntset:
+		obj.Type, obj.Value = SetType, setFromMembers(d.readPacked(parseIntset))
+
+	case rdbTypeSetListpack:
+		obj.Type, obj.Value = SetType, setFromMembers(d.readPacked(parseListpack))
+
+	case rdbTypeZSet, rdbTypeZSet2:
+		zset := newSortedSet()
+		n := d.readCount()
+		for i := 0; i < n && d.err == nil; i++ {
+			member := d.readString()
+			if rdbType == rdbTypeZSet {
+				zset.add(member, d.readStringDouble())
+			} else {
+				zset.add(member, d.readDouble())
+			}
+		}
+		obj.Type, obj.Value = ZSetType, zset
+
+	case rdbTypeZSetZiplist, rdbTypeZSetListpack:
+		parse := parseListpack
+		if rdbType == rdbTypeZSetZiplist {
+			parse = parseZiplist
+		}
+		elements := d.readPacked(parse)
+		zset := newSortedSet()
+		for i := 0; i+1 < len(elements); i += 2 {
+			score, err := strconv.ParseFloat(elements[i+1], 64)
+			if err != nil {
+				d.fail(err)
+			}
+			zset.add(elements[i], score)
+		}
+		obj.Type, obj.Value = ZSetType, zset
+
+	case rdbTypeHash:
+		hash := newHash()
+		n := d.readCount()
+		for i := 0; i < n && d.err == nil; i++ {
+			field := d.readString()
+			hash.set(field, d.readString())
+		}
+		obj.Type, obj.Value = HashType, hash
+
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		parse := parseListpack
+		if rdbType == rdbTypeHashZiplist {
+			parse = parseZiplist
+		}
+		elements := d.readPacked(parse)
+		hash := newHash()
+		for i := 0; i+1 < len(elements); i += 2 {
+			hash.set(elements[i], elements[i+1])
+		}
+		obj.Type, obj.Value = HashType, hash
+
+	case rdbTypeHashMetadata:
+		hash := newHash()
+		minExpire := d.readMillisecondTime()
+		n := d.readCount()
+		for i := 0; i < n && d.err == nil; i++ {
+			ttl := d.readLength()
+			field := d.readString()
+			hash.set(field, d.readString())
+			if ttl != 0 {
+				when := time.UnixMilli(minExpire + int64(ttl) - 1)
+				hash.setFieldExpiry(field, &when)
+			}
+		}
+		obj.Type, obj.Value = HashType, hash
+
+	case rdbTypeHashListpackEx:
+		// Triplets of field, value and absolute expiration time, 0 meaning none
+		d.readMillisecondTime()
+		elements := d.readPacked(parseListpack)
+		hash := newHash()
+		for i := 0; i+2 < len(elements); i += 3 {
+			hash.set(elements[i], elements[i+1])
+			if ms, _ := strconv.ParseInt(elements[i+2], 10, 64); ms != 0 {
+				when := time.UnixMilli(ms)
+				hash.setFieldExpiry(elements[i], &when)
+			}
+		}
+		obj.Type, obj.Value = HashType, hash
+
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		obj.Type, obj.Value = StreamType, d.readStream(rdbType)
+
+	default:
+		d.fail(fmt.Errorf("unsupported value type %d", rdbType))
+	}
+	return obj
+}
+
+// setFromMembers builds a set holding members, in the encoding they call for.
+func setFromMembers(members []string) *redisSet {
+	if len(members) == 0 {
+		return newSet("")
+	}
+	set := newSet(members[0])
+	for _, member := range members {
+		set.add(member)
+	}
+	return set
+}
+
+// readStream reads a stream in any of the three versions of its format, the
+// later ones adding deletion tracking, group read counters and consumer
+// active times.
+func (d *rdbDecoder) readStream(rdbType byte) *redisStream {
+	stream := &redisStream{groups: make(map[string]*streamGroup)}
+
+	nodes := d.readCount()
+	for i := 0; i < nodes && d.err == nil; i++ {
+		key := d.readString()
+		if len(key) != 16 {
+			d.fail(errors.New("stream node key is not a 128 bit ID"))
+			break
+		}
+		master := streamID{binary.BigEndian.Uint64([]byte(key)), binary.BigEndian.Uint64([]byte(key[8:]))}
+		entries, err := decodeStreamNode(master, d.readPacked(parseListpack))
+		if err != nil {
+			d.fail(err)
+		}
+		stream.entries = append(stream.entries, entries...)
+	}
+
+	d.readLength() // Length, implied by the entries
+	stream.lastID = streamID{d.readLength(), d.readLength()}
+	if rdbType == rdbTypeStreamListpacks {
+		stream.entriesAdded = uint64(len(stream.entries))
+	} else {
+		d.readLength() // First ID, implied by the entries
+		d.readLength()
+		stream.maxDeletedID = streamID{d.readLength(), d.readLength()}
+		stream.entriesAdded = d.readLength()
+	}
+
+	groups := d.readCount()
+	for i := 0; i < groups && d.err == nil; i++ {
+		name := d.readString()
+		lastID := streamID{d.readLength(), d.readLength()}
+		entriesRead := int64(-1)
+		if rdbType == rdbTypeStreamListpacks {
+			entriesRead = stream.entriesReadAt(lastID)
+		} else {
+			entriesRead = int64(d.readLength())
+		}
+		group := newStreamGroup(lastID, entriesRead)
+		stream.groups[name] = group
+
+		pending := d.readCount()
+		for j := 0; j < pending && d.err == nil; j++ {
+			id := d.readStreamID()
+			deliveryTime := time.UnixMilli(d.readMillisecondTime())
+			group.pending[id] = &pendingEntry{deliveryTime: deliveryTime, deliveryCount: int(d.readLength())}
+		}
+
+		consumers := d.readCount()
+		for j := 0; j < consumers && d.err == nil; j++ {
+			consumerName := d.readString()
+			consumer := &streamConsumer{seenTime: time.UnixMilli(d.readMillisecondTime())}
+			if rdbType == rdbTypeStreamListpacks3 {
+				if ms := d.readMillisecondTime(); ms != -1 {
+					consumer.activeTime = time.UnixMilli(ms)
+				}
+			}
+			group.consumers[consumerName] = consumer
+
+			owned := d.readCount()
+			for k := 0; k < owned && d.err == nil; k++ {
+				nack, ok := group.pending[d.readStreamID()]
+				if !ok {
+					d.fail(errors.New("consumer pending entry missing from the group"))
+					break
+				}
+				nack.consumer = consumerName
+			}
+		}
+	}
+	return stream
+}
+
+// decodeStreamNode unpacks the entries of a stream node laid out as written by
+// encodeStreamNode, skipping the entries flagged as deleted.
+func decodeStreamNode(master streamID, lp []string) ([]streamEntry, error) {
+	errCorrupt := errors.New("corrupt stream node")
+	pos := 0
+	next := func() int64 {
+		if pos >= len(lp) {
+			pos++
+			return 0
+		}
+		value, _ := strconv.ParseInt(lp[pos], 10, 64)
+		pos++
+		return value
+	}
+
+	count := next() + next() // Valid and deleted entries
+	n := int(next())
+	if n < 0 || pos+n > len(lp) {
+		return nil, errCorrupt
+	}
+	masterFields := lp[pos : pos+n]
+	pos += n
+	next() // Master entry terminator
+
+	var entries []streamEntry
+	for i := int64(0); i < count; i++ {
+		flags := next()
+		id := streamID{master.ms + uint64(next()), master.seq + uint64(next())}
+
+		var fields []string
+		if flags&streamItemFlagSameFields != 0 {
+			if pos+len(masterFields) > len(lp) {
+				return nil, errCorrupt
+			}
+			for _, field := range masterFields {
+				fields = append(fields, field, lp[pos])
+				pos++
+			}
+		} else {
+			n := int(next())
+			if n < 0 || pos+2*n > len(lp) {
+				return nil, errCorrupt
+			}
+			fields = append(fields, lp[pos:pos+2*n]...)
+			pos += 2 * n
+		}
+		next() // Element count of the entry, for walking the node backwards
+		if pos > len(lp) {
+			return nil, errCorrupt
+		}
+
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, streamEntry{ID: id, Fields: fields})
+		}
+	}
+	return entries, nil
+}
@@ -1,6 +1,10 @@
 package main
 
-import "fmt"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+)
 
 // isReplica indicates if this instance is running in replica mode or primary mode
 var isReplica = false
@@ -9,26 +13,82 @@ var isReplica = false
 var replicaHost = ""
 var replicaPort = ""
 
-// Replication ID
-var replID = ""
+// replicaReadOnly makes replicas refuse the write commands of their clients,
+// leaving them to the primary, set with replica-read-only.
+var replicaReadOnly = true
 
-// replOffset tracks the amount of replication stream data processed by this instance.
+// Replication ID, naming the history of the dataset that replicas follow
+var replID = newReplicationID()
+
+// newReplicationID returns a random replication ID of 40 hex characters, as
+// Redis generates them.
+func newReplicationID() string {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// replOffset tracks the amount of replication stream data sent by this instance.
 var replOffset = 0
 
 // replicaClients holds the connections to all downstream replicas.
-var replicaClients []Client
+var replicaClients []*Client
+
+// replicationDB is the database the replication stream last selected, or -1
+// when replicas must be told which database to use before the next command.
+var replicationDB = -1
+
+// Set while a MULTI/EXEC transaction runs. The first write the transaction
+// propagates is preceded by MULTI, so that replicas apply its writes as a unit;
+// multiPropagated then tells that the matching EXEC must follow.
+var propagatingTransaction = false
+var multiPropagated = false
+
+// beginPropagatedTransaction marks the start of a transaction's execution.
+// Must be called with keyspaceMutex held.
+func beginPropagatedTransaction() {
+	propagatingTransaction = true
+}
+
+// endPropagatedTransaction closes the transaction on the replication stream,
+// sending EXEC if any of its writes were propagated. Read-only transactions
+// leave the stream untouched.
+func endPropagatedTransaction() {
+	propagatingTransaction = false
+	if multiPropagated {
+		multiPropagated = false
+		PropagateWriteCommandToReplicas([]string{"EXEC"})
+	}
+}
 
-// PropagateWriteCommandToReplicas sends a write command (like SET, DEL) to all connected replicas.
+// PropagateWriteCommandToReplicas sends a write command (like SET, DEL) to all connected replicas,
+// and appends it to the AOF. A SELECT is sent first whenever the command runs
+// against a different database than the previous one.
 func PropagateWriteCommandToReplicas(commandStringArray []string) {
+	if propagatingTransaction && !multiPropagated {
+		multiPropagated = true
+		PropagateWriteCommandToReplicas([]string{"MULTI"})
+	}
+
+	if selectedDB != replicationDB {
+		replicationDB = selectedDB
+		PropagateWriteCommandToReplicas([]string{"SELECT", strconv.Itoa(selectedDB)})
+	}
+
+	feedAppendOnlyFile(commandStringArray)
+
+	// A replica persists the writes of its primary, but does not forward them
 	if isReplica {
 		return
 	}
 
-	// Iterate over all connected replicas and send the command.
+	// The offset counts the bytes of the replication stream
+	encoded := StringArrayToBulkStringArray(commandStringArray)
+	replOffset += len(encoded)
+
+	// Queue the command for every replica: a replica slow to read falls
+	// behind on its own, up to its output buffer limit
 	for _, replica := range replicaClients {
-		_, err := replica.Connection.Write([]byte(StringArrayToBulkStringArray(commandStringArray)))
-		if err != nil {
-			fmt.Println("Error propagating command to replica:", err)
-		}
+		replica.send(encoded)
 	}
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// scanOptions holds the parsed modifiers of SCAN-family commands.
+type scanOptions struct {
+	Cursor uint64
+	Match  string // Glob pattern, empty to match everything
+	Count  int    // Number of elements to visit per call
+	Type   string // SCAN only: restrict results to keys of this type
+}
+
+// parseScanOptions parses "cursor [MATCH pattern] [COUNT count] [TYPE type]".
+// TYPE is only accepted when allowType is set. On failure the RESP error to reply with is returned.
+func parseScanOptions(args []string, allowType bool) (scanOptions, []byte) {
+	options := scanOptions{Count: 10}
+
+	cursor, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return options, []byte("-ERR invalid cursor\r\n")
+	}
+	options.Cursor = cursor
+
+	for i := 1; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+		if i+1 >= len(args) {
+			return options, []byte("-ERR syntax error\r\n")
+		}
+		i++
+
+		switch {
+		case option == "match":
+			options.Match = args[i]
+		case option == "count":
+			count, err := strconv.Atoi(args[i])
+			if err != nil {
+				return options, []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if count < 1 {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.Count = count
+		case option == "type" && allowType:
+			options.Type = strings.ToLower(args[i])
+		default:
+			return options, []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	return options, nil
+}
+
+// scanHash positions a name in the cursor space.
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// scanBatch returns the next batch of names for a cursor, together with the cursor
+// to continue from (0 once the iteration is complete).
+//
+// Names are visited in order of their hash, and a cursor is simply the hash to resume
+// from. This gives the same guarantee as Redis: every name present for the whole
+// iteration is returned at least once, however the collection changes in between.
+// Names sharing a hash are always returned in the same batch.
+func scanBatch(names []string, cursor uint64, count int) ([]string, uint64) {
+	type hashedName struct {
+		hash uint64
+		name string
+	}
+
+	remaining := make([]hashedName, 0, len(names))
+	for _, name := range names {
+		if h := scanHash(name); h >= cursor {
+			remaining = append(remaining, hashedName{h, name})
+		}
+	}
+	sort.Slice(remaining, func(i, j int) bool {
+		if remaining[i].hash == remaining[j].hash {
+			return remaining[i].name < remaining[j].name
+		}
+		return remaining[i].hash < remaining[j].hash
+	})
+
+	end := min(count, len(remaining))
+	for end > 0 && end < len(remaining) && remaining[end].hash == remaining[end-1].hash {
+		end++
+	}
+
+	batch := make([]string, end)
+	for i := range batch {
+		batch[i] = remaining[i].name
+	}
+
+	if end == len(remaining) || remaining[end-1].hash == math.MaxUint64 {
+		return batch, 0
+	}
+	return batch, remaining[end-1].hash + 1
+}
+
+// encodeScanReply builds the [cursor, [elements...]] reply of the SCAN family.
+func encodeScanReply(cursor uint64, elements []string) []byte {
+	return encodeArray([]interface{}{
+		strconv.FormatUint(cursor, 10),
+		elements,
+	})
+}
+
+// scanKeys implements SCAN over the whole keyspace.
+func scanKeys(options scanOptions) []byte {
+	batch, next := scanBatch(allKeys(), options.Cursor, options.Count)
+
+	result := []string{}
+	for _, key := range batch {
+		if options.Match != "" && !globMatch(options.Match, key) {
+			continue
+		}
+		if options.Type != "" && keyType(key) != options.Type {
+			continue
+		}
+		result = append(result, key)
+	}
+
+	return encodeScanReply(next, result)
+}
+
+// hscan implements HSCAN, returning field/value pairs.
+func hscan(key string, options scanOptions) []byte {
+	hash, wrongType := lookupHash(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	batch, next := scanBatch(hkeys(hash), options.Cursor, options.Count)
+
+	result := []string{}
+	for _, field := range batch {
+		if options.Match == "" || globMatch(options.Match, field) {
+			value, _ := hash.get(field)
+			result = append(result, field, value)
+		}
+	}
+
+	return encodeScanReply(next, result)
+}
+
+// sscan implements SSCAN, returning set members.
+func sscan(key string, options scanOptions) []byte {
+	set, wrongType := lookupSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	batch, next := scanBatch(smembers(set), options.Cursor, options.Count)
+
+	result := []string{}
+	for _, member := range batch {
+		if options.Match == "" || globMatch(options.Match, member) {
+			result = append(result, member)
+		}
+	}
+
+	return encodeScanReply(next, result)
+}
+
+// zscan implements ZSCAN, returning member/score pairs.
+func zscan(key string, options scanOptions) []byte {
+	set, wrongType := lookupZSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	members := make([]string, 0, set.length())
+	for _, m := range set.members() {
+		members = append(members, m.Member)
+	}
+	batch, next := scanBatch(members, options.Cursor, options.Count)
+
+	result := []string{}
+	for _, member := range batch {
+		if options.Match == "" || globMatch(options.Match, member) {
+			score, _ := set.score(member)
+			result = append(result, member, formatScore(score))
+		}
+	}
+
+	return encodeScanReply(next, result)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"maps"
+	"math/rand"
+	"slices"
+	"strconv"
+)
+
+// redisSet is the value of a set key, in one of three encodings:
+// an intset (a sorted slice of integers) while every member is an integer,
+// a listpack (a slice of members) while the set is small, and otherwise a
+// hashtable. Exactly one of the fields is in use.
+type redisSet struct {
+	intset   []int64
+	listpack []string
+	dict     map[string]struct{}
+}
+
+// newSet returns an empty set in the most compact encoding able to hold first.
+func newSet(first string) *redisSet {
+	if _, ok := parseIntsetMember(first); ok {
+		return &redisSet{intset: []int64{}}
+	}
+	if len(first) <= setMaxListpackValue {
+		return &redisSet{listpack: []string{}}
+	}
+	return &redisSet{dict: make(map[string]struct{})}
+}
+
+// encoding returns the name of the set's encoding, as reported by OBJECT ENCODING.
+func (s *redisSet) encoding() string {
+	switch {
+	case s.dict != nil:
+		return "hashtable"
+	case s.listpack != nil:
+		return "listpack"
+	}
+	return "intset"
+}
+
+// size returns the number of members; a nil set is empty.
+func (s *redisSet) size() int {
+	switch {
+	case s == nil:
+		return 0
+	case s.dict != nil:
+		return len(s.dict)
+	case s.listpack != nil:
+		return len(s.listpack)
+	}
+	return len(s.intset)
+}
+
+// contains reports whether member is in the set.
+func (s *redisSet) contains(member string) bool {
+	switch {
+	case s == nil:
+		return false
+	case s.dict != nil:
+		_, ok := s.dict[member]
+		return ok
+	case s.listpack != nil:
+		return slices.Contains(s.listpack, member)
+	}
+	value, ok := parseIntsetMember(member)
+	if !ok {
+		return false
+	}
+	_, found := slices.BinarySearch(s.intset, value)
+	return found
+}
+
+// add inserts member, converting the set to a more general encoding when the
+// member or the new size no longer fits the current one.
+// Returns true if the member was not already present.
+func (s *redisSet) add(member string) bool {
+	if s.contains(member) {
+		return false
+	}
+
+	if s.dict == nil && s.listpack == nil {
+		value, isInt := parseIntsetMember(member)
+		switch {
+		case isInt && len(s.intset) < setMaxIntsetEntries:
+			at, _ := slices.BinarySearch(s.intset, value)
+			s.intset = slices.Insert(s.intset, at, value)
+			return true
+		case len(s.intset) < setMaxListpackEntries && len(member) <= setMaxListpackValue:
+			s.convertToListpack()
+		default:
+			s.convertToHashtable()
+		}
+	}
+
+	if s.listpack != nil {
+		if len(s.listpack) < setMaxListpackEntries && len(member) <= setMaxListpackValue {
+			s.listpack = append(s.listpack, member)
+			return true
+		}
+		s.convertToHashtable()
+	}
+
+	s.dict[member] = struct{}{}
+	return true
+}
+
+// remove deletes member. Returns false if it was not present.
+func (s *redisSet) remove(member string) bool {
+	switch {
+	case s.dict != nil:
+		if _, ok := s.dict[member]; !ok {
+			return false
+		}
+		delete(s.dict, member)
+		return true
+	case s.listpack != nil:
+		i := slices.Index(s.listpack, member)
+		if i < 0 {
+			return false
+		}
+		s.listpack = slices.Delete(s.listpack, i, i+1)
+		return true
+	}
+
+	value, ok := parseIntsetMember(member)
+	if !ok {
+		return false
+	}
+	i, found := slices.BinarySearch(s.intset, value)
+	if !found {
+		return false
+	}
+	s.intset = slices.Delete(s.intset, i, i+1)
+	return true
+}
+
+// members returns every member of the set.
+func (s *redisSet) members() []string {
+	switch {
+	case s == nil:
+		return []string{}
+	case s.dict != nil:
+		result := make([]string, 0, len(s.dict))
+		for member := range s.dict {
+			result = append(result, member)
+		}
+		return result
+	case s.listpack != nil:
+		return slices.Clone(s.listpack)
+	}
+	result := make([]string, len(s.intset))
+	for i, value := range s.intset {
+		result[i] = strconv.FormatInt(value, 10)
+	}
+	return result
+}
+
+// convertToListpack switches an intset to the listpack encoding.
+func (s *redisSet) convertToListpack() {
+	s.listpack = s.members()
+	s.intset = nil
+}
+
+// convertToHashtable switches the set to the hashtable encoding.
+func (s *redisSet) convertToHashtable() {
+	members := s.members()
+	s.dict = make(map[string]struct{}, len(members))
+	for _, member := range members {
+		s.dict[member] = struct{}{}
+	}
+	s.intset, s.listpack = nil, nil
+}
+
+// clone returns an independent copy of the set, in the same encoding.
+func (s *redisSet) clone() *redisSet {
+	return &redisSet{
+		intset:   slices.Clone(s.intset),
+		listpack: slices.Clone(s.listpack),
+		dict:     maps.Clone(s.dict),
+	}
+}
+
+// lookupSet returns the set stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupSet(key string) (set *redisSet, wrongType bool) {
+	obj, wrongType := lookupKeyOfType(key, SetType)
+	if obj == nil {
+		return nil, wrongType
+	}
+	return obj.Value.(*redisSet), false
+}
+
+// lookupSets returns the sets stored at each of keys, with nil for missing keys.
+// wrongType is set if any key holds a value of another data type.
+func lookupSets(keys []string) (sets []*redisSet, wrongType bool) {
+	sets = make([]*redisSet, len(keys))
+	for i, key := range keys {
+		sets[i], wrongType = lookupSet(key)
+		if wrongType {
+			return nil, true
+		}
+	}
+	return sets, false
+}
+
+// sadd adds the given members to the set stored at key, creating it if needed.
+// Returns the number of members that were not already present.
+// The caller must ensure key does not hold another data type.
+func sadd(key string, members []string) int {
+	set, _ := lookupSet(key)
+	if set == nil {
+		set = newSet(members[0])
+		setKey(key, SetType, set)
+	}
+
+	added := 0
+	for _, member := range members {
+		if set.add(member) {
+			added++
+		}
+	}
+
+	return added
+}
+
+// srem removes the given members from the set stored at key.
+// The key is deleted once its last member is removed.
+// Returns the number of members that were removed.
+func srem(key string, members []string) int {
+	set, _ := lookupSet(key)
+	if set == nil {
+		return 0
+	}
+
+	removed := 0
+	for _, member := range members {
+		if set.remove(member) {
+			removed++
+		}
+	}
+
+	if set.size() == 0 {
+		deleteKey(key)
+	}
+
+	return removed
+}
+
+// smembers returns every member of set.
+func smembers(set *redisSet) []string {
+	return set.members()
+}
+
+// sinter returns the members present in every one of sets.
+// A missing set is empty, so it empties the result.
+func sinter(sets []*redisSet) []string {
+	result := []string{}
+	for _, member := range sets[0].members() {
+		inAll := true
+		for _, set := range sets[1:] {
+			if !set.contains(member) {
+				inAll = false
+				break
+			}
+		}
+		if inAll {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// sunion returns the members present in at least one of sets.
+func sunion(sets []*redisSet) []string {
+	seen := make(map[string]struct{})
+	result := []string{}
+	for _, set := range sets {
+		for _, member := range set.members() {
+			if _, ok := seen[member]; !ok {
+				seen[member] = struct{}{}
+				result = append(result, member)
+			}
+		}
+	}
+	return result
+}
+
+// sdiff returns the members of the first set that are not in any of the following ones.
+func sdiff(sets []*redisSet) []string {
+	result := []string{}
+	for _, member := range sets[0].members() {
+		inOther := false
+		for _, set := range sets[1:] {
+			if set.contains(member) {
+				inOther = true
+				break
+			}
+		}
+		if !inOther {
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+// storeSet replaces whatever is stored at destination with a set of the given members.
+// An empty member list just deletes destination. Returns the size of the stored set.
+func storeSet(destination string, members []string) int {
+	deleteKey(destination)
+	if len(members) == 0 {
+		return 0
+	}
+	return sadd(destination, members)
+}
+
+// srandmember returns random members of set.
+// A positive count returns up to count distinct members; a negative count returns
+// exactly -count members, which may repeat.
+func srandmember(set *redisSet, count int) []string {
+	members := smembers(set)
+	if len(members) == 0 {
+		return []string{}
+	}
+
+	if count < 0 {
+		result := make([]string, -count)
+		for i := range result {
+			result[i] = members[rand.Intn(len(members))]
+		}
+		return result
+	}
+
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
+	})
+	if count > len(members) {
+		count = len(members)
+	}
+	return members[:count]
+}
+
+// spop removes and returns up to count random members of the set stored at key.
+func spop(key string, set *redisSet, count int) []string {
+	popped := srandmember(set, count)
+	srem(key, popped)
+	return popped
+}
+
+// smove moves member from the set at source to the set at destination.
+// The caller must ensure neither key holds another data type.
+// Returns true if the member was moved, false if it was not in source.
+func smove(source, destination, member string) bool {
+	set, _ := lookupSet(source)
+	if !set.contains(member) {
+		return false
+	}
+	if source == destination {
+		return true
+	}
+
+	srem(source, []string{member})
+	sadd(destination, []string{member})
+	return true
+}
+
+// scard replies with the number of members of the set stored at key.
+func scard(key string) []byte {
+	set, wrongType := lookupSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	return []byte(":" + strconv.Itoa(set.size()) + "\r\n")
+}
@@ -0,0 +1,69 @@
+package main
+
+import "strconv"
+
+// sharedIntegerCount is the number of shared integers: string values from "0"
+// to "9999" all point to the same few bytes rather than holding their own
+// copy, as with OBJ_SHARED_INTEGERS in Redis. Counters and flags, often
+// stored in millions of keys, take much less memory that way.
+const sharedIntegerCount = 10000
+
+// sharedIntegers holds the shared integers, boxed once so that the values of
+// the keys share the interface allocation as well as the string.
+var sharedIntegers = makeSharedIntegers()
+
+func makeSharedIntegers() []interface{} {
+	shared := make([]interface{}, sharedIntegerCount)
+	for i := range shared {
+		shared[i] = strconv.Itoa(i)
+	}
+	return shared
+}
+
+// stringValue returns the value to store for the string s: the shared integer
+// it spells, if any, or s itself.
+func stringValue(s string) interface{} {
+	if n, ok := sharedInteger(s); ok {
+		return sharedIntegers[n]
+	}
+	return s
+}
+
+// sharedInteger returns the index of the shared integer s spells in canonical
+// form, if any.
+func sharedInteger(s string) (int, bool) {
+	if len(s) == 0 || len(s) > 4 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || n >= sharedIntegerCount || sharedIntegers[n].(string) != s {
+		return 0, false
+	}
+	return n, true
+}
+
+// Interning of the names of hash and stream fields, which tend to repeat from
+// one key to the next. Interned strings share their bytes; the table is
+// guarded by keyspaceMutex and stops growing once full, keeping the strings
+// it holds for the lifetime of the server.
+const (
+	internTableSize = 1 << 16
+	internMaxLength = 64
+)
+
+var internTable = make(map[string]string)
+
+// intern returns the interned copy of s, interning it if there is room.
+// Strings longer than internMaxLength are returned as they are.
+func intern(s string) string {
+	if len(s) > internMaxLength {
+		return s
+	}
+	if interned, ok := internTable[s]; ok {
+		return interned
+	}
+	if len(internTable) < internTableSize {
+		internTable[s] = s
+	}
+	return s
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleShutdownSignals waits for SIGTERM or SIGINT, then shuts the server
+// down gracefully: no new connections are accepted, the dataset is persisted
+// and replica links are closed before the process exits.
+func handleShutdownSignals(listener net.Listener) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-signals
+	serverLog(logWarning, "Received %s, scheduling shutdown...", sig)
+
+	listener.Close()
+
+	// Holding the lock for good keeps clients from writing past the final save
+	keyspaceMutex.Lock()
+	if err := prepareForShutdown(); err != nil {
+		serverLog(logWarning, "Errors trying to shut down the server: %v", err)
+		removePidFile()
+		os.Exit(1)
+	}
+	serverLog(logWarning, "Gedis is now ready to exit, bye bye...")
+	os.Exit(0)
+}
+
+// prepareForShutdown flushes the AOF, saves the RDB file when save points are
+// configured, closes the connections to replicas and removes the pid file.
+// Must be called with keyspaceMutex held.
+func prepareForShutdown() error {
+	if aofFile != nil {
+		serverLog(logNotice, "Calling fsync() on the AOF file.")
+		if err := aofFile.Sync(); err != nil {
+			return err
+		}
+		aofFile.Close()
+		aofFile = nil
+	}
+
+	if len(savePoints) > 0 {
+		serverLog(logNotice, "Saving the final RDB snapshot before exiting.")
+		if err := writeRDBFile(encodeRDB(databases)); err != nil {
+			return err
+		}
+		serverLog(logNotice, "DB saved on disk")
+	}
+
+	// The replicas are sent the stream still queued for them, within
+	// closeTimeout, so that they do not miss the last writes
+	for _, replica := range replicaClients {
+		replica.closeOutput()
+	}
+	for _, replica := range replicaClients {
+		<-replica.output.done
+	}
+
+	if pidfile != "" {
+		serverLog(logNotice, "Removing the pid file.")
+		removePidFile()
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package main
+
+import "math/rand"
+
+// Skiplist parameters, as in Redis: up to 32 levels, each level holding
+// roughly a quarter of the nodes of the level below.
+const (
+	ZSKIPLIST_MAXLEVEL = 32
+	ZSKIPLIST_P        = 0.25
+)
+
+// skiplistLevel is one forward link of a skiplist node.
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int // Number of nodes the link jumps over, used to compute ranks
+}
+
+// skiplistNode holds one member of a sorted set.
+type skiplistNode struct {
+	sortedSetMember
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+// skiplist keeps the members of a sorted set ordered by score, ties broken
+// lexicographically, with O(log n) insertion, deletion, rank and range lookups.
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+// newSkiplist returns an empty skiplist.
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, ZSKIPLIST_MAXLEVEL)},
+		level:  1,
+	}
+}
+
+// randomSkiplistLevel picks the level of a new node, with a power-law
+// distribution so that higher levels are exponentially rarer.
+func randomSkiplistLevel() int {
+	level := 1
+	for level < ZSKIPLIST_MAXLEVEL && rand.Float64() < ZSKIPLIST_P {
+		level++
+	}
+	return level
+}
+
+// before reports whether node orders strictly before the given score and member.
+func (n *skiplistNode) before(score float64, member string) bool {
+	return n.Score < score || (n.Score == score && n.Member < member)
+}
+
+// insert adds a new node. The caller must ensure member is not already present.
+func (zsl *skiplist) insert(score float64, member string) *skiplistNode {
+	var update [ZSKIPLIST_MAXLEVEL]*skiplistNode
+	var rank [ZSKIPLIST_MAXLEVEL]int
+
+	// Find the insertion point on every level, recording the rank reached
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+
+	x = &skiplistNode{
+		sortedSetMember: sortedSetMember{Member: member, Score: score},
+		level:           make([]skiplistLevel, level),
+	}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	// Untouched levels now jump over one more node
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+	return x
+}
+
+// delete removes the node with the given score and member.
+// Returns false if there is no such node.
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [ZSKIPLIST_MAXLEVEL]*skiplistNode
+
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.level[0].forward
+	if x == nil || x.Score != score || x.Member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank returns the 1-based rank of the node with the given score and member,
+// or 0 if there is no such node.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.before(score, member) || (x.level[i].forward.Score == score && x.level[i].forward.Member == member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.Score == score && x.Member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank returns the node at the given 1-based rank, or nil if out of range.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank && x != zsl.header {
+			return x
+		}
+	}
+	return nil
+}
+
+// firstInRange returns the first node within a range, given as predicates
+// telling whether a member is above its lower end and below its upper end.
+// Returns nil if no node is in range.
+func (zsl *skiplist) firstInRange(aboveMin, belowMax func(sortedSetMember) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !aboveMin(x.level[i].forward.sortedSetMember) {
+			x = x.level[i].forward
+		}
+	}
+	x = x.level[0].forward
+	if x == nil || !belowMax(x.sortedSetMember) {
+		return nil
+	}
+	return x
+}
+
+// lastInRange is firstInRange for the last node within the range.
+func (zsl *skiplist) lastInRange(aboveMin, belowMax func(sortedSetMember) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && belowMax(x.level[i].forward.sortedSetMember) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header || !aboveMin(x.sortedSetMember) {
+		return nil
+	}
+	return x
+}
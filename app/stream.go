@@ -0,0 +1,689 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// streamEntry is one entry of a stream.
+type streamEntry struct {
+	ID     streamID
+	Fields []string // Field/value pairs in the order given to XADD, flattened as [field1, value1, ...]
+}
+
+// redisStream is the value of a stream key.
+type redisStream struct {
+	entries      []streamEntry // Sorted by ID, so that entries can be looked up by binary search
+	lastID       streamID      // ID of the last entry ever added, which new IDs must exceed
+	entriesAdded uint64        // Number of entries ever added, deleted ones included
+	maxDeletedID streamID      // Highest ID among the deleted entries
+	groups       map[string]*streamGroup
+}
+
+// lookupStream returns the stream stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupStream(key string) (stream *redisStream, wrongType bool) {
+	obj, wrongType := lookupKeyOfType(key, StreamType)
+	if obj == nil {
+		return nil, wrongType
+	}
+	return obj.Value.(*redisStream), false
+}
+
+// length returns the number of entries; a nil stream is empty.
+func (s *redisStream) length() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.entries)
+}
+
+// clone returns an independent copy of the stream.
+func (s *redisStream) clone() *redisStream {
+	duplicate := *s
+	// The field lists of entries are never modified, so they can be shared
+	duplicate.entries = slices.Clone(s.entries)
+	duplicate.groups = cloneGroups(s.groups)
+	return &duplicate
+}
+
+// hasTombstonesAfter reports whether an entry at or after id was deleted,
+// which makes counting the entries after id from entriesAdded unreliable.
+func (s *redisStream) hasTombstonesAfter(id streamID) bool {
+	return s.length() > 0 && s.maxDeletedID != (streamID{}) && !s.maxDeletedID.less(id)
+}
+
+// entriesReadAt returns how many entries were ever added up to and including
+// id, or -1 if deletions make that impossible to tell.
+func (s *redisStream) entriesReadAt(id streamID) int64 {
+	added := int64(s.entriesAdded)
+	if added == 0 || s.length() == 0 || !id.less(s.lastID) {
+		return added
+	}
+
+	first := s.entries[0].ID
+	if s.maxDeletedID != (streamID{}) && !s.maxDeletedID.less(first) {
+		return -1
+	}
+	switch {
+	case id.less(first):
+		return added - int64(s.length())
+	case id == first:
+		return added - int64(s.length()) + 1
+	}
+	return -1
+}
+
+// search returns the position of the entry with the given ID, or where it would
+// be inserted, and whether it exists.
+func (s *redisStream) search(id streamID) (int, bool) {
+	return slices.BinarySearchFunc(s.entries, id, func(entry streamEntry, id streamID) int {
+		return entry.ID.compare(id)
+	})
+}
+
+// entry returns the entry with the given ID, or nil if there is none.
+func (s *redisStream) entry(id streamID) *streamEntry {
+	i, found := s.search(id)
+	if !found {
+		return nil
+	}
+	return &s.entries[i]
+}
+
+// entriesAfter returns the entries with an ID greater than id, at most count
+// of them if count is non-zero. A nil stream has none.
+func (s *redisStream) entriesAfter(id streamID, count int) []streamEntry {
+	if s == nil {
+		return nil
+	}
+	i, found := s.search(id)
+	if found {
+		i++
+	}
+	entries := s.entries[i:]
+	if count > 0 && len(entries) > count {
+		entries = entries[:count]
+	}
+	return entries
+}
+
+// delete removes the entry with the given ID. Returns false if there is none.
+func (s *redisStream) delete(id streamID) bool {
+	i, found := s.search(id)
+	if !found {
+		return false
+	}
+	s.entries = slices.Delete(s.entries, i, i+1)
+	if s.maxDeletedID.less(id) {
+		s.maxDeletedID = id
+	}
+	return true
+}
+
+// streamID is the ID of a stream entry: a millisecond timestamp and a sequence
+// number distinguishing entries added within the same millisecond.
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+// String formats id as "<ms>-<seq>".
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// less reports whether id orders before other.
+func (id streamID) less(other streamID) bool {
+	return id.ms < other.ms || (id.ms == other.ms && id.seq < other.seq)
+}
+
+// compare returns -1, 0 or 1 as id orders before, equal to or after other.
+func (id streamID) compare(other streamID) int {
+	switch {
+	case id.less(other):
+		return -1
+	case other.less(id):
+		return 1
+	}
+	return 0
+}
+
+// parseStreamID parses an ID argument of the form "<ms>-<seq>", or just "<ms>"
+// in which case the sequence number is 0.
+func parseStreamID(arg string) (streamID, bool) {
+	msPart, seqPart, hasSeq := strings.Cut(arg, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	if !hasSeq {
+		return streamID{ms: ms}, true
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, false
+	}
+	return streamID{ms, seq}, true
+}
+
+// nextStreamID resolves the ID argument of XADD against the last ID of the
+// stream: "*" generates an ID from the current time, "<ms>-*" the next sequence
+// number within ms, and an explicit ID must exceed last.
+// On failure the RESP error to reply with is returned.
+func nextStreamID(arg string, last streamID) (streamID, []byte) {
+	if arg == "*" {
+		ms := uint64(time.Now().UnixMilli())
+		if ms <= last.ms {
+			// The clock went backwards or this millisecond already has entries
+			return streamID{last.ms, last.seq + 1}, nil
+		}
+		return streamID{ms: ms}, nil
+	}
+
+	msPart, seqPart, ok := strings.Cut(arg, "-")
+	if !ok {
+		return streamID{}, []byte("-ERR invalid stream ID format\r\n")
+	}
+
+	var id streamID
+	if seqPart == "*" {
+		ms, err := strconv.ParseUint(msPart, 10, 64)
+		if err != nil {
+			return streamID{}, []byte("-ERR invalid milliseconds part in ID\r\n")
+		}
+		id.ms = ms
+		switch {
+		case ms == last.ms:
+			id.seq = last.seq + 1
+		case ms == 0:
+			// 0-0 is invalid, so 0-* starts at 0-1
+			id.seq = 1
+		}
+	} else {
+		var valid bool
+		id, valid = parseStreamID(arg)
+		if !valid {
+			return streamID{}, []byte("-ERR invalid stream ID values\r\n")
+		}
+		if id == (streamID{}) {
+			return streamID{}, []byte("-ERR The ID specified in XADD must be greater than 0-0\r\n")
+		}
+	}
+
+	if !last.less(id) {
+		return streamID{}, []byte("-ERR The ID specified in XADD is equal or smaller than the target stream top item\r\n")
+	}
+	return id, nil
+}
+
+// xadd appends an entry with the given ID and field/value pairs to the stream
+// stored at key, creating the stream if needed. The caller must ensure the key
+// does not hold another data type and that id exceeds the stream's last ID.
+// Returns the stream.
+func xadd(key string, id streamID, fieldValues []string) *redisStream {
+	stream, _ := lookupStream(key)
+	if stream == nil {
+		stream = &redisStream{}
+		setKey(key, StreamType, stream)
+	}
+
+	fields := slices.Clone(fieldValues)
+	for i := 0; i < len(fields); i += 2 {
+		fields[i] = intern(fields[i])
+	}
+
+	// IDs only grow, so appending keeps the entries sorted
+	stream.entries = append(stream.entries, streamEntry{ID: id, Fields: fields})
+	stream.lastID = id
+	stream.entriesAdded++
+	signalKeyAsReady(key)
+	return stream
+}
+
+// streamNodeMaxEntries is the number of entries Redis packs into one node of a
+// stream. Approximate trimming only ever removes whole nodes.
+const streamNodeMaxEntries = 100
+
+// streamTrimOptions holds a parsed MAXLEN | MINID [= | ~] threshold [LIMIT count] clause.
+type streamTrimOptions struct {
+	MinID       bool // Trim entries below ID rather than beyond MaxLen entries
+	Approximate bool
+	MaxLen      int
+	ID          streamID
+	Limit       int // Maximum number of entries removed by an approximate trim, 0 for no limit
+}
+
+// parseStreamTrim parses a trimming clause starting at args[0], which must be
+// MAXLEN or MINID. Returns the options and the number of arguments consumed.
+// An approximate trim without LIMIT removes at most 100 nodes' worth of entries,
+// as in Redis. On failure the RESP error to reply with is returned.
+func parseStreamTrim(args []string) (streamTrimOptions, int, []byte) {
+	options := streamTrimOptions{MinID: strings.ToLower(args[0]) == "minid"}
+	i := 1
+	if i < len(args) && (args[i] == "=" || args[i] == "~") {
+		options.Approximate = args[i] == "~"
+		i++
+	}
+	if i >= len(args) {
+		return options, 0, []byte("-ERR syntax error\r\n")
+	}
+
+	if options.MinID {
+		id, ok := parseStreamID(args[i])
+		if !ok {
+			return options, 0, []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+		}
+		options.ID = id
+	} else {
+		maxLen, err := strconv.Atoi(args[i])
+		if err != nil {
+			return options, 0, []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		if maxLen < 0 {
+			return options, 0, []byte("-ERR The MAXLEN argument must be >= 0.\r\n")
+		}
+		options.MaxLen = maxLen
+	}
+	i++
+
+	if options.Approximate {
+		options.Limit = 100 * streamNodeMaxEntries
+	}
+	if i+1 < len(args) && strings.ToLower(args[i]) == "limit" {
+		limit, err := strconv.Atoi(args[i+1])
+		if err != nil {
+			return options, 0, []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		if limit < 0 {
+			return options, 0, []byte("-ERR The LIMIT argument must be >= 0.\r\n")
+		}
+		if !options.Approximate {
+			return options, 0, []byte("-ERR syntax error, LIMIT cannot be used without the special ~ option\r\n")
+		}
+		options.Limit = limit
+		i += 2
+	}
+	return options, i, nil
+}
+
+// trim removes entries from the head of the stream, either beyond the newest
+// MaxLen entries or below ID. An approximate trim only removes whole nodes of
+// streamNodeMaxEntries entries, no more than Limit entries in all, so it may
+// leave more than asked for. Returns the number of entries removed.
+func (s *redisStream) trim(options streamTrimOptions) int {
+	excess := 0
+	if options.MinID {
+		excess, _ = s.search(options.ID)
+	} else {
+		excess = max(len(s.entries)-options.MaxLen, 0)
+	}
+	if options.Approximate {
+		if options.Limit > 0 {
+			excess = min(excess, options.Limit)
+		}
+		excess -= excess % streamNodeMaxEntries
+	}
+
+	s.entries = slices.Delete(s.entries, 0, excess)
+	return excess
+}
+
+// xtrim implements XTRIM key MAXLEN | MINID [= | ~] threshold [LIMIT count].
+// Replies with the number of entries removed.
+func xtrim(args []string) []byte {
+	if len(args) < 4 {
+		return []byte("-ERR wrong number of arguments for 'xtrim' command\r\n")
+	}
+	switch strings.ToLower(args[2]) {
+	case "maxlen", "minid":
+	default:
+		return []byte("-ERR syntax error\r\n")
+	}
+	options, consumed, errReply := parseStreamTrim(args[2:])
+	if errReply != nil {
+		return errReply
+	}
+	if 2+consumed != len(args) {
+		return []byte("-ERR syntax error\r\n")
+	}
+
+	stream, wrongType := lookupStream(args[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if stream == nil {
+		return []byte(":0\r\n")
+	}
+	return []byte(":" + strconv.Itoa(stream.trim(options)) + "\r\n")
+}
+
+// xsetid implements XSETID key last-id [ENTRIESADDED entries-added] [MAXDELETEDID max-deleted-id].
+func xsetid(args []string) []byte {
+	if len(args) < 3 {
+		return []byte("-ERR wrong number of arguments for 'xsetid' command\r\n")
+	}
+	lastID, ok := parseStreamID(args[2])
+	if !ok {
+		return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+	}
+
+	entriesAdded, maxDeletedID := int64(-1), streamID{}
+	hasMaxDeleted := false
+	for i := 3; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return []byte("-ERR syntax error\r\n")
+		}
+		switch strings.ToLower(args[i]) {
+		case "entriesadded":
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if n < 0 {
+				return []byte("-ERR entries_added must be positive\r\n")
+			}
+			entriesAdded = n
+		case "maxdeletedid":
+			if maxDeletedID, ok = parseStreamID(args[i+1]); !ok {
+				return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+			}
+			hasMaxDeleted = true
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+	if hasMaxDeleted && lastID.less(maxDeletedID) {
+		return []byte("-ERR The ID specified in XSETID is smaller than the provided max_deleted_entry_id\r\n")
+	}
+
+	stream, wrongType := lookupStream(args[1])
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if stream == nil {
+		return []byte("-ERR no such key\r\n")
+	}
+	if entriesAdded >= 0 && uint64(entriesAdded) < uint64(stream.length()) {
+		return []byte("-ERR The entries_added specified in XSETID is smaller than the target stream length\r\n")
+	}
+	if stream.length() > 0 && lastID.less(stream.entries[stream.length()-1].ID) {
+		return []byte("-ERR The ID specified in XSETID is smaller than the target stream top item\r\n")
+	}
+
+	stream.lastID = lastID
+	if entriesAdded >= 0 {
+		stream.entriesAdded = uint64(entriesAdded)
+	}
+	if hasMaxDeleted {
+		stream.maxDeletedID = maxDeletedID
+	}
+	return []byte("+OK\r\n")
+}
+
+// xdel removes the entries with the given IDs from the stream stored at key.
+// Replies with the number of entries actually deleted.
+func xdel(key string, ids []string) []byte {
+	parsed := make([]streamID, len(ids))
+	for i, arg := range ids {
+		id, ok := parseStreamID(arg)
+		if !ok {
+			return []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+		}
+		parsed[i] = id
+	}
+
+	stream, wrongType := lookupStream(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if stream == nil {
+		return []byte(":0\r\n")
+	}
+
+	deleted := 0
+	for _, id := range parsed {
+		if stream.delete(id) {
+			deleted++
+		}
+	}
+	// Unlike other types, an emptied stream is kept along with its last ID
+	return []byte(":" + strconv.Itoa(deleted) + "\r\n")
+}
+
+// encodeStreamEntries encodes entries as a RESP array of [id, [field, value, ...]] pairs.
+func encodeStreamEntries(entries []streamEntry) []interface{} {
+	result := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		result[i] = []interface{}{entry.ID.String(), entry.Fields}
+	}
+	return result
+}
+
+// xreadOptions holds the parsed arguments of XREAD and XREADGROUP.
+type xreadOptions struct {
+	Count    int // Maximum number of entries per stream, 0 for no limit
+	Block    bool
+	Timeout  time.Duration // How long to block for, 0 meaning forever
+	Group    string        // XREADGROUP only
+	Consumer string        // XREADGROUP only
+	NoAck    bool          // XREADGROUP only: deliver without adding to the pending entries list
+	Keys     []string
+	IDs      []string // Raw IDs, one per key, possibly "$" or ">"
+}
+
+// parseXRead parses the arguments following the command name of
+//
+//	XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+//	XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds] [NOACK] STREAMS key [key ...] id [id ...]
+//
+// The IDs are validated but left unresolved. On failure the RESP error to reply with is returned.
+func parseXRead(commandName string, args []string) (xreadOptions, []byte) {
+	var options xreadOptions
+	group := commandName == "xreadgroup"
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "group":
+			if !group {
+				return options, []byte("-ERR The GROUP option is only supported by XREADGROUP. You called XREAD instead.\r\n")
+			}
+			if i+2 >= len(args) {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.Group, options.Consumer = args[i+1], args[i+2]
+			i += 2
+		case "noack":
+			if !group {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.NoAck = true
+		case "count":
+			if i+1 >= len(args) {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			count, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return options, []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			options.Count = max(count, 0)
+			i++
+		case "block":
+			if i+1 >= len(args) {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			ms, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return options, []byte("-ERR timeout is not an integer or out of range\r\n")
+			}
+			if ms < 0 {
+				return options, []byte("-ERR timeout is negative\r\n")
+			}
+			options.Block = true
+			options.Timeout = time.Duration(ms) * time.Millisecond
+			i++
+		case "streams":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return options, []byte("-ERR Unbalanced '" + commandName + "' list of streams: for each stream key an ID or '$' must be specified.\r\n")
+			}
+			if group && options.Group == "" {
+				return options, []byte("-ERR Missing GROUP option for XREADGROUP\r\n")
+			}
+			options.Keys = rest[:len(rest)/2]
+			options.IDs = rest[len(rest)/2:]
+
+			for _, id := range options.IDs {
+				switch {
+				case id == "$" && group:
+					return options, []byte("-ERR The $ ID is meaningless in the context of XREADGROUP: you want to read the history of this consumer by specifying a proper ID, or use the > ID to get new messages. The $ ID would just return an empty result set.\r\n")
+				case id == ">" && !group:
+					return options, []byte("-ERR The > ID can be specified only when calling XREADGROUP using the GROUP <group> <consumer> option.\r\n")
+				case id == "$" || id == ">":
+					continue
+				}
+				if _, ok := parseStreamID(id); !ok {
+					return options, []byte("-ERR Invalid stream ID specified as stream command argument\r\n")
+				}
+			}
+			return options, nil
+		default:
+			return options, []byte("-ERR syntax error\r\n")
+		}
+	}
+	return options, []byte("-ERR syntax error\r\n")
+}
+
+// xread replies with the entries of every stream in keys added after the
+// matching ID in after, at most count (if non-zero) per stream.
+// Streams without new entries are left out; nil is returned if none has any.
+func xread(keys []string, after []streamID, count int) []byte {
+	var result []interface{}
+	for i, key := range keys {
+		stream, wrongType := lookupStream(key)
+		if wrongType {
+			return []byte(wrongTypeError)
+		}
+
+		if entries := stream.entriesAfter(after[i], count); len(entries) > 0 {
+			result = append(result, []interface{}{key, encodeStreamEntries(entries)})
+		}
+	}
+
+	if result == nil {
+		return nil
+	}
+	return encodeArray(result)
+}
+
+// xinfo implements XINFO STREAM | GROUPS | CONSUMERS | HELP, each replying with
+// a flat list of field/value pairs per object described.
+func xinfo(args []string) []byte {
+	if len(args) < 2 {
+		return []byte("-ERR wrong number of arguments for 'xinfo' command\r\n")
+	}
+	subcommand := strings.ToLower(args[1])
+
+	if subcommand == "help" {
+		return StringArrayToBulkStringArray([]string{
+			"XINFO <subcommand> [<arg> [value] [opt] ...]. Subcommands are:",
+			"CONSUMERS <key> <groupname>",
+			"    Show consumers of <groupname>.",
+			"GROUPS <key>",
+			"    Show the stream consumer groups.",
+			"STREAM <key>",
+			"    Show information about the stream.",
+		})
+	}
+
+	arity := map[string]int{"stream": 3, "groups": 3, "consumers": 4}
+	if expected, known := arity[subcommand]; !known || len(args) != expected {
+		return []byte("-ERR unknown subcommand or wrong number of arguments for '" + sanitizeErrorArgument(args[1]) + "'. Try XINFO HELP.\r\n")
+	}
+
+	key := args[2]
+	stream, wrongType := lookupStream(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if stream == nil {
+		return []byte("-ERR no such key\r\n")
+	}
+
+	switch subcommand {
+	case "stream":
+		var first, last interface{}
+		recordedFirstID := streamID{}
+		if n := stream.length(); n > 0 {
+			first = encodeStreamEntries(stream.entries[:1])[0]
+			last = encodeStreamEntries(stream.entries[n-1:])[0]
+			recordedFirstID = stream.entries[0].ID
+		}
+		// Entries are not kept in a radix tree, so report the nodes they would fill
+		nodes := (stream.length() + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+		return encodeArray([]interface{}{
+			"length", stream.length(),
+			"radix-tree-keys", nodes,
+			"radix-tree-nodes", nodes + 1,
+			"last-generated-id", stream.lastID.String(),
+			"max-deleted-entry-id", stream.maxDeletedID.String(),
+			"entries-added", int(stream.entriesAdded),
+			"recorded-first-entry-id", recordedFirstID.String(),
+			"groups", len(stream.groups),
+			"first-entry", first,
+			"last-entry", last,
+		})
+
+	case "groups":
+		result := []interface{}{}
+		for _, name := range slices.Sorted(maps.Keys(stream.groups)) {
+			group := stream.groups[name]
+			var entriesRead, lag interface{}
+			if group.entriesRead >= 0 {
+				entriesRead = int(group.entriesRead)
+			}
+			if n, ok := group.lag(stream); ok {
+				lag = int(n)
+			}
+			result = append(result, []interface{}{
+				"name", name,
+				"consumers", len(group.consumers),
+				"pending", len(group.pending),
+				"last-delivered-id", group.lastID.String(),
+				"entries-read", entriesRead,
+				"lag", lag,
+			})
+		}
+		return encodeArray(result)
+
+	default:
+		group := stream.group(args[3])
+		if group == nil {
+			return []byte("-NOGROUP No such consumer group '" + sanitizeErrorArgument(args[3]) + "' for key name '" + sanitizeErrorArgument(key) + "'\r\n")
+		}
+
+		pending := make(map[string]int)
+		for _, nack := range group.pending {
+			pending[nack.consumer]++
+		}
+
+		now := time.Now()
+		result := []interface{}{}
+		for _, name := range slices.Sorted(maps.Keys(group.consumers)) {
+			consumer := group.consumers[name]
+			inactive := -1
+			if !consumer.activeTime.IsZero() {
+				inactive = int(now.Sub(consumer.activeTime).Milliseconds())
+			}
+			result = append(result, []interface{}{
+				"name", name,
+				"pending", pending[name],
+				"idle", int(now.Sub(consumer.seenTime).Milliseconds()),
+				"inactive", inactive,
+			})
+		}
+		return encodeArray(result)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxStringLength is the largest string value that can be built by commands like SETRANGE.
+const maxStringLength = 512 * 1024 * 1024
+
+// setOptions holds the parsed modifiers of a SET command.
+type setOptions struct {
+	NX      bool       // Only set if the key does not exist
+	XX      bool       // Only set if the key already exists
+	Get     bool       // Reply with the previous value instead of OK
+	KeepTTL bool       // Retain the key's existing expiry
+	Expiry  *time.Time // Absolute expiry to apply, if any
+}
+
+// parseSetOptions parses the optional arguments that follow SET key value.
+// Options may appear in any order. On failure the RESP error to reply with is returned.
+func parseSetOptions(args []string) (setOptions, []byte) {
+	var options setOptions
+	expirySet := false
+
+	for i := 0; i < len(args); i++ {
+		option := strings.ToLower(args[i])
+
+		switch option {
+		case "nx":
+			if options.XX {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.NX = true
+
+		case "xx":
+			if options.NX {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.XX = true
+
+		case "get":
+			options.Get = true
+
+		case "keepttl":
+			if expirySet {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			options.KeepTTL = true
+
+		case "ex", "px", "exat", "pxat":
+			if expirySet || options.KeepTTL || i+1 >= len(args) {
+				return options, []byte("-ERR syntax error\r\n")
+			}
+			i++
+
+			amount, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil {
+				return options, []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			if amount <= 0 {
+				return options, []byte("-ERR invalid expire time in 'set' command\r\n")
+			}
+
+			unit := time.Second
+			if option == "px" || option == "pxat" {
+				unit = time.Millisecond
+			}
+			absolute := option == "exat" || option == "pxat"
+
+			when, ok := expiryFromArgument(amount, unit, absolute)
+			if !ok {
+				return options, []byte("-ERR invalid expire time in 'set' command\r\n")
+			}
+			options.Expiry = &when
+			expirySet = true
+
+		default:
+			return options, []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	return options, nil
+}
+
+// setGeneric stores value at key according to options, replacing a value of any type.
+// Replies +OK (or the previous value with GET), and a Null Bulk String when
+// an NX / XX condition prevents the write.
+func setGeneric(key, value string, options setOptions) []byte {
+	exists := keyExists(key)
+
+	var previous []byte
+	if options.Get {
+		previous = []byte("$-1\r\n")
+		if exists {
+			old, wrongType := lookupKeyOfType(key, StringType)
+			if wrongType {
+				return []byte(wrongTypeError)
+			}
+			previous = StringToBulkString(old.Value.(string))
+		}
+	}
+
+	if (options.NX && exists) || (options.XX && !exists) {
+		if options.Get {
+			return previous
+		}
+		return []byte("$-1\r\n")
+	}
+
+	expiry := options.Expiry
+	if options.KeepTTL {
+		expiry = getExpiry(key)
+	}
+
+	// Overwrite whatever type was previously stored under the key
+	setKey(key, StringType, value).Expiry = expiry
+
+	if options.Get {
+		return previous
+	}
+	return []byte("+OK\r\n")
+}
+
+// mget returns the values of the given keys as a RESP array, with a
+// Null Bulk String for every key that is missing, expired or not a string.
+func mget(keys []string) []byte {
+	values := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if value, wrongType := lookupKeyOfType(key, StringType); value != nil && !wrongType {
+			values[i] = value.Value.(string)
+		}
+	}
+	return encodeArray(values)
+}
+
+// mset stores every key/value pair, replacing existing values and their TTLs.
+func mset(keyValues []string) {
+	for i := 0; i+1 < len(keyValues); i += 2 {
+		setGeneric(keyValues[i], keyValues[i+1], setOptions{})
+	}
+}
+
+// msetnx stores every key/value pair only if none of the keys exist.
+// Returns true if the values were set.
+func msetnx(keyValues []string) bool {
+	for i := 0; i < len(keyValues); i += 2 {
+		if keyExists(keyValues[i]) {
+			return false
+		}
+	}
+
+	mset(keyValues)
+	return true
+}
+
+// lookupString returns the live string value stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupString(key string) (value *redisObject, wrongType bool) {
+	return lookupKeyOfType(key, StringType)
+}
+
+// appendString appends suffix to the string at key, creating it if needed.
+// Returns the new length of the string.
+func appendString(key, suffix string) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	if value == nil {
+		setKey(key, StringType, suffix)
+		return []byte(":" + strconv.Itoa(len(suffix)) + "\r\n")
+	}
+
+	current := value.Value.(string)
+	if len(current)+len(suffix) > maxStringLength {
+		return []byte("-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n")
+	}
+	value.Value = stringValue(current + suffix)
+	return []byte(":" + strconv.Itoa(len(current)+len(suffix)) + "\r\n")
+}
+
+// strlen returns the length of the string at key, or 0 if it is missing.
+func strlen(key string) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if value == nil {
+		return []byte(":0\r\n")
+	}
+	return []byte(":" + strconv.Itoa(len(value.Value.(string))) + "\r\n")
+}
+
+// getrange returns the substring between the inclusive start and end offsets.
+// Negative offsets count from the end of the string.
+func getrange(key string, start, end int) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+	if value == nil {
+		return StringToBulkString("")
+	}
+
+	str := value.Value.(string)
+	length := len(str)
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+
+	if length == 0 || start > end {
+		return StringToBulkString("")
+	}
+	return StringToBulkString(str[start : end+1])
+}
+
+// setrange overwrites the string at key starting at offset, zero-padding it
+// if offset lies beyond its current end. Returns the new length of the string.
+func setrange(key string, offset int, part string) []byte {
+	if offset < 0 {
+		return []byte("-ERR offset is out of range\r\n")
+	}
+
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	// An empty write never creates or grows the key
+	if len(part) == 0 {
+		if value == nil {
+			return []byte(":0\r\n")
+		}
+		return []byte(":" + strconv.Itoa(len(value.Value.(string))) + "\r\n")
+	}
+
+	if offset+len(part) > maxStringLength {
+		return []byte("-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n")
+	}
+
+	if value == nil {
+		value = setKey(key, StringType, "")
+	}
+
+	buf := []byte(value.Value.(string))
+	if offset+len(part) > len(buf) {
+		buf = append(buf, make([]byte, offset+len(part)-len(buf))...)
+	}
+	copy(buf[offset:], part)
+	value.Value = string(buf)
+
+	return []byte(":" + strconv.Itoa(len(buf)) + "\r\n")
+}
+
+// incrBy adds delta to the integer stored at key, treating a missing key as 0.
+// The key's TTL is left untouched. Shared by INCR, INCRBY, DECR and DECRBY.
+func incrBy(key string, delta int64) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	current := int64(0)
+	if value != nil {
+		parsed, err := strconv.ParseInt(value.Value.(string), 10, 64)
+		if err != nil {
+			return []byte("-ERR value is not an integer or out of range\r\n")
+		}
+		current = parsed
+	}
+
+	if (delta > 0 && current > math.MaxInt64-delta) ||
+		(delta < 0 && current < math.MinInt64-delta) {
+		return []byte("-ERR increment or decrement would overflow\r\n")
+	}
+	current += delta
+
+	if value == nil {
+		value = setKey(key, StringType, "")
+	}
+	value.Value = stringValue(strconv.FormatInt(current, 10))
+
+	return []byte(":" + value.Value.(string) + "\r\n")
+}
+
+// incrByFloat adds delta to the number stored at key, treating a missing key as 0.
+// Replies with the new value as a Bulk String.
+func incrByFloat(key string, delta float64) []byte {
+	value, wrongType := lookupString(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	current := 0.0
+	if value != nil {
+		parsed, err := strconv.ParseFloat(value.Value.(string), 64)
+		if err != nil {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+		current = parsed
+	}
+
+	current += delta
+	if math.IsNaN(current) || math.IsInf(current, 0) {
+		return []byte("-ERR increment would produce NaN or Infinity\r\n")
+	}
+
+	if value == nil {
+		value = setKey(key, StringType, "")
+	}
+	value.Value = stringValue(strconv.FormatFloat(current, 'f', -1, 64))
+
+	return StringToBulkString(value.Value.(string))
+}
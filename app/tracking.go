@@ -0,0 +1,172 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// trackingOptions holds the client-side caching settings of a client, set
+// with CLIENT TRACKING ON.
+type trackingOptions struct {
+	bcast    bool     // Invalidate every key matching prefixes, not only the keys read
+	prefixes []string // In BCAST mode, the prefixes of the keys to invalidate, all keys if empty
+	redirect int64    // ID of the client receiving the invalidations, 0 for the client itself
+	noloop   bool     // Do not invalidate the keys the client modifies itself
+}
+
+// trackingTable maps the keys read by clients tracking them, in the default
+// mode, to those clients. A key is dropped once it has been invalidated: the
+// clients track it again when they next read it.
+var trackingTable = make(map[string]map[*Client]struct{})
+
+// bcastClients holds the clients tracking keys in BCAST mode.
+var bcastClients = make(map[*Client]struct{})
+
+// clientTracking implements CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST] [NOLOOP].
+func clientTracking(client *Client, args []string) []byte {
+	if len(args) < 1 {
+		return []byte("-ERR wrong number of arguments for 'client|tracking' command\r\n")
+	}
+
+	options := &trackingOptions{}
+	for i := 1; i < len(args); i++ {
+		switch option := strings.ToLower(args[i]); {
+		case option == "bcast":
+			options.bcast = true
+		case option == "noloop":
+			options.noloop = true
+		case option == "prefix" && i+1 < len(args):
+			options.prefixes = append(options.prefixes, args[i+1])
+			i++
+		case option == "redirect" && i+1 < len(args):
+			id, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || clients[id] == nil {
+				return []byte("-ERR The client ID you want redirect to does not exist\r\n")
+			}
+			options.redirect = id
+			i++
+		default:
+			return []byte("-ERR syntax error\r\n")
+		}
+	}
+
+	switch strings.ToLower(args[0]) {
+	case "on":
+		if len(options.prefixes) > 0 && !options.bcast {
+			return []byte("-ERR PREFIX option requires BCAST mode to be enabled\r\n")
+		}
+		if client.Protocol != 3 && options.redirect == 0 {
+			return []byte("-ERR Client tracking requires RESP3 (see HELLO 3) or a REDIRECT to a client subscribed to __redis__:invalidate\r\n")
+		}
+		client.Tracking = options
+		if options.bcast {
+			bcastClients[client] = struct{}{}
+		} else {
+			delete(bcastClients, client)
+		}
+	case "off":
+		disableTracking(client)
+	default:
+		return []byte("-ERR syntax error\r\n")
+	}
+	return []byte("+OK\r\n")
+}
+
+// disableTracking stops the client-side caching of a client. Its entries in
+// trackingTable are dropped lazily, when the keys are invalidated.
+func disableTracking(client *Client) {
+	client.Tracking = nil
+	delete(bcastClients, client)
+}
+
+// trackCommandKeys records the keys read by a client tracking them, and sends
+// invalidations for the keys a write command is about to modify.
+// Must be called with keyspaceMutex held.
+func trackCommandKeys(client *Client, commandName string, args []string) {
+	info := commandTable[commandName]
+	if info == nil {
+		return
+	}
+
+	switch {
+	case isWriteCommand(commandName):
+		for _, key := range info.commandKeys(args) {
+			invalidateKey(key, client)
+		}
+
+	case client.Tracking != nil && !client.Tracking.bcast:
+		for _, key := range info.commandKeys(args) {
+			if trackingTable[key] == nil {
+				trackingTable[key] = make(map[*Client]struct{})
+			}
+			trackingTable[key][client] = struct{}{}
+		}
+	}
+}
+
+// invalidateKey tells the clients caching key that it is being modified by
+// the client writer.
+// Must be called with keyspaceMutex held.
+func invalidateKey(key string, writer *Client) {
+	for c := range trackingTable[key] {
+		if c.Tracking != nil && !c.Tracking.bcast {
+			sendInvalidation(c, []interface{}{key}, writer)
+		}
+	}
+	delete(trackingTable, key)
+
+	for c := range bcastClients {
+		for _, prefix := range c.Tracking.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				sendInvalidation(c, []interface{}{key}, writer)
+				break
+			}
+		}
+		if len(c.Tracking.prefixes) == 0 {
+			sendInvalidation(c, []interface{}{key}, writer)
+		}
+	}
+}
+
+// invalidateAll tells every tracking client that all the keys they cache are
+// gone, as FLUSHDB and FLUSHALL do: the invalidation carries no key.
+// Must be called with keyspaceMutex held.
+func invalidateAll(writer *Client) {
+	notified := make(map[*Client]bool)
+	for _, tracking := range trackingTable {
+		for c := range tracking {
+			if c.Tracking != nil && !notified[c] {
+				sendInvalidation(c, nil, writer)
+				notified[c] = true
+			}
+		}
+	}
+	clear(trackingTable)
+
+	for c := range bcastClients {
+		sendInvalidation(c, nil, writer)
+	}
+}
+
+// sendInvalidation sends the invalidation of keys, nil for all of them, to a
+// tracking client: as an invalidate push frame, or as a message on the
+// __redis__:invalidate channel to the client it redirects to. Like every push,
+// it is queued for the client's writer rather than written under the lock.
+func sendInvalidation(c *Client, keys []interface{}, writer *Client) {
+	if c == writer && c.Tracking.noloop {
+		return
+	}
+
+	var invalidated interface{}
+	if keys != nil {
+		invalidated = keys
+	}
+
+	if c.Tracking.redirect == 0 {
+		c.send(encodeRESP(respPush{"invalidate", invalidated}, 3))
+		return
+	}
+	if target := clients[c.Tracking.redirect]; target != nil {
+		target.send(encodeRESP(respPush{"message", "__redis__:invalidate", invalidated}, target.Protocol))
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"fmt"
-	"sort"
+	"math"
+	"math/rand"
+	"slices"
 	"strconv"
+	"strings"
 )
 
 // sortedSetMember represents a single element in a Sorted Set (ZSET).
@@ -13,160 +16,946 @@ type sortedSetMember struct {
 	Score  float64
 }
 
-// sortedSets is the global storage for all ZSETs.
-var sortedSets = make(map[string]map[string]sortedSetMember)
+// sortedSet is the value of a zset key. Small sets are kept as a listpack: a
+// slice of members in order. Past zset-max-listpack-entries members, or once a
+// member is longer than zset-max-listpack-value, the set converts to a skiplist
+// for ordered access plus a dict from member to score for O(1) score lookups.
+type sortedSet struct {
+	listpack []sortedSetMember
+	dict     map[string]float64
+	zsl      *skiplist // nil while the set is a listpack
+}
+
+// newSortedSet returns an empty sorted set, encoded as a listpack.
+func newSortedSet() *sortedSet {
+	return &sortedSet{listpack: []sortedSetMember{}}
+}
+
+// encoding returns the name of the set's encoding, as reported by OBJECT ENCODING.
+func (z *sortedSet) encoding() string {
+	if z.zsl == nil {
+		return "listpack"
+	}
+	return "skiplist"
+}
+
+// convertToSkiplist switches the set to the skiplist encoding.
+func (z *sortedSet) convertToSkiplist() {
+	z.dict = make(map[string]float64, len(z.listpack))
+	z.zsl = newSkiplist()
+	for _, m := range z.listpack {
+		z.dict[m.Member] = m.Score
+		z.zsl.insert(m.Score, m.Member)
+	}
+	z.listpack = nil
+}
+
+// listpackIndex returns the position of member in the listpack, or -1.
+func (z *sortedSet) listpackIndex(member string) int {
+	return slices.IndexFunc(z.listpack, func(m sortedSetMember) bool {
+		return m.Member == member
+	})
+}
+
+// length returns the number of members; a nil set is empty.
+func (z *sortedSet) length() int {
+	switch {
+	case z == nil:
+		return 0
+	case z.zsl == nil:
+		return len(z.listpack)
+	}
+	return len(z.dict)
+}
+
+// score returns the score of member, if present.
+func (z *sortedSet) score(member string) (float64, bool) {
+	switch {
+	case z == nil:
+		return 0, false
+	case z.zsl == nil:
+		if i := z.listpackIndex(member); i >= 0 {
+			return z.listpack[i].Score, true
+		}
+		return 0, false
+	}
+	score, ok := z.dict[member]
+	return score, ok
+}
+
+// add sets the score of member, adding it if needed.
+// Returns true if the member is new.
+func (z *sortedSet) add(member string, score float64) bool {
+	if z.zsl == nil {
+		i := z.listpackIndex(member)
+		exists := i >= 0
+		if exists {
+			z.listpack = slices.Delete(z.listpack, i, i+1)
+		}
+
+		if len(z.listpack)+1 <= zsetMaxListpackEntries && len(member) <= zsetMaxListpackValue {
+			m := sortedSetMember{Member: member, Score: score}
+			at, _ := slices.BinarySearchFunc(z.listpack, m, compareSortedSetMembers)
+			z.listpack = slices.Insert(z.listpack, at, m)
+			return !exists
+		}
+		z.convertToSkiplist()
+		z.zsl.insert(score, member)
+		z.dict[member] = score
+		return !exists
+	}
+
+	current, exists := z.dict[member]
+	if exists {
+		if current == score {
+			return false
+		}
+		z.zsl.delete(current, member)
+	}
+	z.zsl.insert(score, member)
+	z.dict[member] = score
+	return !exists
+}
+
+// remove deletes member. Returns false if it was not present.
+func (z *sortedSet) remove(member string) bool {
+	if z.zsl == nil {
+		i := z.listpackIndex(member)
+		if i < 0 {
+			return false
+		}
+		z.listpack = slices.Delete(z.listpack, i, i+1)
+		return true
+	}
+
+	score, exists := z.dict[member]
+	if !exists {
+		return false
+	}
+	z.zsl.delete(score, member)
+	delete(z.dict, member)
+	return true
+}
+
+// rank returns the 0-based rank of member in score order, if present.
+func (z *sortedSet) rank(member string) (int, bool) {
+	score, exists := z.score(member)
+	if !exists {
+		return 0, false
+	}
+	if z.zsl == nil {
+		return z.listpackIndex(member), true
+	}
+	return z.zsl.rank(score, member) - 1, true
+}
+
+// rangeByRank returns the members with 0-based ranks start to stop inclusive,
+// which must be within the set. With rev set, ranks count from the highest
+// score and members are returned in that order.
+func (z *sortedSet) rangeByRank(start, stop int, rev bool) []sortedSetMember {
+	result := make([]sortedSetMember, 0, stop-start+1)
+	length := z.length()
+
+	if z.zsl == nil {
+		for i := start; i <= stop; i++ {
+			if rev {
+				result = append(result, z.listpack[length-1-i])
+			} else {
+				result = append(result, z.listpack[i])
+			}
+		}
+		return result
+	}
+
+	if rev {
+		for node := z.zsl.byRank(length - start); len(result) < cap(result); node = node.backward {
+			result = append(result, node.sortedSetMember)
+		}
+	} else {
+		for node := z.zsl.byRank(start + 1); len(result) < cap(result); node = node.level[0].forward {
+			result = append(result, node.sortedSetMember)
+		}
+	}
+	return result
+}
+
+// rangeBounds returns the 0-based ranks of the first and last members within a
+// range, given as predicates telling whether a member is above its lower end and
+// below its upper end. ok is false when no member is in range.
+func (z *sortedSet) rangeBounds(aboveMin, belowMax func(sortedSetMember) bool) (first, last int, ok bool) {
+	if z.length() == 0 {
+		return 0, 0, false
+	}
+
+	if z.zsl == nil {
+		first = slices.IndexFunc(z.listpack, aboveMin)
+		if first < 0 || !belowMax(z.listpack[first]) {
+			return 0, 0, false
+		}
+		last = first
+		for last+1 < len(z.listpack) && belowMax(z.listpack[last+1]) {
+			last++
+		}
+		return first, last, true
+	}
+
+	firstNode := z.zsl.firstInRange(aboveMin, belowMax)
+	if firstNode == nil {
+		return 0, 0, false
+	}
+	lastNode := z.zsl.lastInRange(aboveMin, belowMax)
+	first = z.zsl.rank(firstNode.Score, firstNode.Member) - 1
+	last = z.zsl.rank(lastNode.Score, lastNode.Member) - 1
+	return first, last, true
+}
+
+// members returns every member in score order.
+func (z *sortedSet) members() []sortedSetMember {
+	length := z.length()
+	if length == 0 {
+		return nil
+	}
+	return z.rangeByRank(0, length-1, false)
+}
+
+// clone returns an independent copy of the set, in the same encoding.
+func (z *sortedSet) clone() *sortedSet {
+	if z.zsl == nil {
+		return &sortedSet{listpack: slices.Clone(z.listpack)}
+	}
+
+	duplicate := newSortedSet()
+	duplicate.convertToSkiplist()
+	for _, m := range z.members() {
+		duplicate.add(m.Member, m.Score)
+	}
+	return duplicate
+}
+
+// compareSortedSetMembers orders members by score, ties broken lexicographically.
+func compareSortedSetMembers(a, b sortedSetMember) int {
+	switch {
+	case a.Score < b.Score:
+		return -1
+	case a.Score > b.Score:
+		return 1
+	}
+	return strings.Compare(a.Member, b.Member)
+}
+
+// lookupZSet returns the sorted set stored at key, or nil if there is none.
+// wrongType is set when key holds a value of another data type.
+func lookupZSet(key string) (zset *sortedSet, wrongType bool) {
+	obj, wrongType := lookupKeyOfType(key, ZSetType)
+	if obj == nil {
+		return nil, wrongType
+	}
+	return obj.Value.(*sortedSet), false
+}
+
+// formatScore renders a score the way it is returned to clients.
+func formatScore(score float64) string {
+	return fmt.Sprintf("%g", score)
+}
 
 // zadd adds a member with a specific score to the sorted set stored at key.
 // If the member already exists, its score is updated.
 // Returns 1 if the element is new, 0 if it was updated.
+// The caller must ensure key does not hold another data type.
 func zadd(key string, score float64, member string) int {
-	if sortedSets[key] == nil {
-		sortedSets[key] = make(map[string]sortedSetMember)
+	set, _ := lookupZSet(key)
+	if set == nil {
+		set = newSortedSet()
+		setKey(key, ZSetType, set)
 	}
+	signalKeyAsReady(key)
 
-	_, exists := sortedSets[key][member]
+	if set.add(member, score) {
+		return 1
+	} else {
+		return 0
+	}
+}
 
-	sortedSets[key][member] = sortedSetMember{
-		Member: member,
-		Score:  score,
+// zaddOptions holds the flags accepted by ZADD.
+type zaddOptions struct {
+	NX, XX bool // Only add new members / only update existing ones
+	GT, LT bool // Only update when the new score is greater / less than the current one
+	CH     bool // Reply with the number of changed members rather than added ones
+	Incr   bool // Increment the score of a single member, like ZINCRBY
+}
+
+// parseZAddOptions parses the flags at the start of the ZADD arguments that
+// follow the key, returning them with the remaining score/member arguments.
+// On failure the RESP error to reply with is returned.
+func parseZAddOptions(args []string) (zaddOptions, []string, []byte) {
+	var options zaddOptions
+	i := 0
+loop:
+	for ; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			options.NX = true
+		case "xx":
+			options.XX = true
+		case "gt":
+			options.GT = true
+		case "lt":
+			options.LT = true
+		case "ch":
+			options.CH = true
+		case "incr":
+			options.Incr = true
+		default:
+			break loop
+		}
 	}
+	pairs := args[i:]
 
-	if exists {
-		return 0
-	} else {
-		return 1
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return options, nil, []byte("-ERR syntax error\r\n")
+	}
+	if options.NX && options.XX {
+		return options, nil, []byte("-ERR XX and NX options at the same time are not compatible\r\n")
+	}
+	if (options.GT && options.LT) || (options.NX && (options.GT || options.LT)) {
+		return options, nil, []byte("-ERR GT, LT, and/or NX options at the same time are not compatible\r\n")
+	}
+	if options.Incr && len(pairs) != 2 {
+		return options, nil, []byte("-ERR INCR option supports a single increment-element pair\r\n")
+	}
+	return options, pairs, nil
+}
+
+// zaddGeneric implements ZADD once its options are parsed, applying every
+// score/member pair subject to the conditional flags.
+func zaddGeneric(key string, options zaddOptions, pairs []string) []byte {
+	set, wrongType := lookupZSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	// Validate every score before touching the set
+	scores := make([]float64, len(pairs)/2)
+	for i := range scores {
+		score, err := strconv.ParseFloat(pairs[i*2], 64)
+		if err != nil || math.IsNaN(score) {
+			return []byte("-ERR value is not a valid float\r\n")
+		}
+		scores[i] = score
+	}
+
+	added, changed := 0, 0
+	for i, score := range scores {
+		member := pairs[i*2+1]
+		current, exists := set.score(member)
+
+		if (options.NX && exists) || (options.XX && !exists) {
+			continue
+		}
+		if options.Incr && exists {
+			score += current
+			if math.IsNaN(score) {
+				return []byte("-ERR resulting score is not a number (NaN)\r\n")
+			}
+		}
+		if exists && ((options.GT && score <= current) || (options.LT && score >= current)) {
+			continue
+		}
+
+		if !exists {
+			added++
+		} else if score != current {
+			changed++
+		}
+		zadd(key, score, member)
+		set, _ = lookupZSet(key)
+
+		if options.Incr {
+			return StringToBulkString(formatScore(score))
+		}
 	}
+
+	// An INCR that was not applied replies with a null
+	if options.Incr {
+		return []byte("$-1\r\n")
+	}
+	if options.CH {
+		return []byte(":" + strconv.Itoa(added+changed) + "\r\n")
+	}
+	return []byte(":" + strconv.Itoa(added) + "\r\n")
 }
 
 // zrank returns the 0-based index (rank) of the member in the sorted set.
 // The rank is determined by ordering members by Score (low to high).
 // Returns nil if the member or key does not exist.
 func zrank(key string, member string) *int {
-	set, ok := sortedSets[key]
+	set, _ := lookupZSet(key)
+	rank, ok := set.rank(member)
 	if !ok {
 		return nil
 	}
+	return &rank
+}
 
-	// Flatten map to slice
-	members := make([]sortedSetMember, 0, len(set))
-	for _, m := range set {
-		members = append(members, m)
+// zrandmember returns random members of set, with the same count semantics as
+// SRANDMEMBER: a positive count returns up to count distinct members, a negative
+// count returns exactly -count members, which may repeat.
+func zrandmember(set *sortedSet, count int) []sortedSetMember {
+	length := set.length()
+	if length == 0 {
+		return []sortedSetMember{}
 	}
 
-	// Sort slice by Score then Member
-	sort.Slice(members, func(i, j int) bool {
-		if members[i].Score == members[j].Score {
-			return members[i].Member < members[j].Member
+	// Repeats are allowed, so each pick is an independent lookup by rank
+	if count < 0 {
+		result := make([]sortedSetMember, -count)
+		for i := range result {
+			rank := rand.Intn(length)
+			result[i] = set.rangeByRank(rank, rank, false)[0]
 		}
-		return members[i].Score < members[j].Score
+		return result
+	}
+
+	members := set.members()
+	rand.Shuffle(len(members), func(i, j int) {
+		members[i], members[j] = members[j], members[i]
 	})
+	return members[:min(count, len(members))]
+}
 
-	// Iterate to find the requested member's index
-	for idx, m := range members {
-		if m.Member == member {
-			return &idx
+// zcard returns the number of elements (cardinality) in the sorted set.
+func zcard(key string) int {
+	set, _ := lookupZSet(key)
+	return set.length()
+}
+
+// zscore returns the score of a member in the sorted set as a Bulk String.
+func zscore(key, member string, protocol int) []byte {
+	set, wrongType := lookupZSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	score, ok := set.score(member)
+	if !ok {
+		return encodeRESP(nil, protocol)
+	}
+
+	return encodeRESP(score, protocol)
+}
+
+// zrem removes a member from the sorted set.
+// Returns 1 if removed, 0 if not found.
+func zrem(key, member string) []byte {
+	set, wrongType := lookupZSet(key)
+	if wrongType {
+		return []byte(wrongTypeError)
+	}
+
+	if set == nil || !set.remove(member) {
+		return []byte(":0\r\n")
+	}
+
+	// If the set is empty, remove the key entirely
+	if set.length() == 0 {
+		deleteKey(key)
+	}
+
+	return []byte(":1\r\n")
+}
+
+// zpop removes and returns up to count members with the lowest or highest scores
+// from set, which is stored at key. The key is removed once the set is empty.
+func zpop(key string, set *sortedSet, lowest bool, count int) []sortedSetMember {
+	count = min(count, set.length())
+	if count == 0 {
+		return []sortedSetMember{}
+	}
+
+	popped := set.rangeByRank(0, count-1, !lowest)
+	for _, m := range popped {
+		set.remove(m.Member)
+	}
+	if set.length() == 0 {
+		deleteKey(key)
+	}
+	return popped
+}
+
+// zmpop pops up to count members with the lowest or highest scores from the
+// first non-empty sorted set among keys, returning that key and the popped members.
+// popped is nil when every sorted set is empty.
+func zmpop(keys []string, lowest bool, count int) (key string, popped []sortedSetMember, errReply []byte) {
+	for _, key := range keys {
+		set, wrongType := lookupZSet(key)
+		if wrongType {
+			return "", nil, []byte(wrongTypeError)
 		}
+		if set.length() == 0 {
+			continue
+		}
+		return key, zpop(key, set, lowest, count), nil
+	}
+	return "", nil, nil
+}
+
+// servedZSetPop is zmpop for the blocking pops. Replicas are sent
+// the equivalent non-blocking pop against the key that was served.
+func servedZSetPop(keys []string, lowest bool, count int) (key string, popped []sortedSetMember, errReply []byte) {
+	key, popped, errReply = zmpop(keys, lowest, count)
+	if popped != nil {
+		end := "MAX"
+		if lowest {
+			end = "MIN"
+		}
+		PropagateWriteCommandToReplicas([]string{"ZMPOP", "1", key, end, "COUNT", strconv.Itoa(len(popped))})
+	}
+	return key, popped, errReply
+}
+
+// zsetPairs returns members as [member, score] pairs, the shape ZMPOP replies with.
+func zsetPairs(members []sortedSetMember) []interface{} {
+	pairs := make([]interface{}, len(members))
+	for i, m := range members {
+		pairs[i] = []interface{}{m.Member, formatScore(m.Score)}
+	}
+	return pairs
+}
+
+// scoreRange is a score interval as given to ZRANGEBYSCORE and ZCOUNT,
+// where either end may be exclusive.
+type scoreRange struct {
+	Min, Max     float64
+	MinExclusive bool
+	MaxExclusive bool
+}
+
+// parseScoreBound parses one end of a score range: a float, "-inf"/"+inf",
+// or either of those prefixed with "(" to make the bound exclusive.
+func parseScoreBound(arg string) (value float64, exclusive bool, ok bool) {
+	if strings.HasPrefix(arg, "(") {
+		exclusive = true
+		arg = arg[1:]
+	}
+	value, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, false, false
+	}
+	return value, exclusive, true
+}
+
+// parseScoreRange parses the min and max arguments of a score range query.
+// On failure the RESP error to reply with is returned.
+func parseScoreRange(minArg, maxArg string) (scoreRange, []byte) {
+	var r scoreRange
+	var minOK, maxOK bool
+	r.Min, r.MinExclusive, minOK = parseScoreBound(minArg)
+	r.Max, r.MaxExclusive, maxOK = parseScoreBound(maxArg)
+	if !minOK || !maxOK {
+		return r, []byte("-ERR min or max is not a float\r\n")
 	}
+	return r, nil
+}
+
+// aboveMin reports whether m is past the lower end of the range.
+func (r scoreRange) aboveMin(m sortedSetMember) bool {
+	return m.Score > r.Min || (!r.MinExclusive && m.Score == r.Min)
+}
+
+// belowMax reports whether m is before the upper end of the range.
+func (r scoreRange) belowMax(m sortedSetMember) bool {
+	return m.Score < r.Max || (!r.MaxExclusive && m.Score == r.Max)
+}
 
-	return nil
+// zcount returns the number of members of set whose score falls within r.
+func zcount(set *sortedSet, r scoreRange) int {
+	return countInRange(set, r.aboveMin, r.belowMax)
 }
 
-// zrange returns a range of members from the sorted set, given start and stop indices.
-func zrange(key string, start, stop int) []string {
-	set, ok := sortedSets[key]
+// countInRange returns the number of members of set within a range, computed
+// from the ranks of its first and last members.
+func countInRange(set *sortedSet, aboveMin, belowMax func(sortedSetMember) bool) int {
+	first, last, ok := set.rangeBounds(aboveMin, belowMax)
 	if !ok {
-		return []string{}
+		return 0
 	}
+	return last - first + 1
+}
+
+// lexBound is one end of a lex range: a member, or "-"/"+" which sort below
+// and above every member respectively.
+type lexBound struct {
+	Member    string
+	Exclusive bool
+	Infinity  int // -1 for "-", 1 for "+", 0 for a member
+}
+
+// lexRange is a member interval as given to ZRANGEBYLEX and ZLEXCOUNT.
+type lexRange struct {
+	Min, Max lexBound
+}
+
+// parseLexBound parses one end of a lex range: "-", "+", or a member prefixed
+// with "[" (inclusive) or "(" (exclusive).
+func parseLexBound(arg string) (lexBound, bool) {
+	switch {
+	case arg == "-":
+		return lexBound{Infinity: -1}, true
+	case arg == "+":
+		return lexBound{Infinity: 1}, true
+	case strings.HasPrefix(arg, "["):
+		return lexBound{Member: arg[1:]}, true
+	case strings.HasPrefix(arg, "("):
+		return lexBound{Member: arg[1:], Exclusive: true}, true
+	}
+	return lexBound{}, false
+}
 
-	// Flatten map to slice
-	members := make([]sortedSetMember, 0, len(set))
-	for _, m := range set {
-		members = append(members, m)
+// parseLexRange parses the min and max arguments of a lex range query.
+// On failure the RESP error to reply with is returned.
+func parseLexRange(minArg, maxArg string) (lexRange, []byte) {
+	var r lexRange
+	var minOK, maxOK bool
+	r.Min, minOK = parseLexBound(minArg)
+	r.Max, maxOK = parseLexBound(maxArg)
+	if !minOK || !maxOK {
+		return r, []byte("-ERR min or max not valid string range item\r\n")
 	}
+	return r, nil
+}
+
+// aboveMin reports whether m is past the lower end of the range.
+func (r lexRange) aboveMin(m sortedSetMember) bool {
+	if r.Min.Infinity != 0 {
+		return r.Min.Infinity < 0
+	}
+	return m.Member > r.Min.Member || (!r.Min.Exclusive && m.Member == r.Min.Member)
+}
+
+// belowMax reports whether m is before the upper end of the range.
+func (r lexRange) belowMax(m sortedSetMember) bool {
+	if r.Max.Infinity != 0 {
+		return r.Max.Infinity > 0
+	}
+	return m.Member < r.Max.Member || (!r.Max.Exclusive && m.Member == r.Max.Member)
+}
 
-	// Sort slice by Score then Member
-	sort.Slice(members, func(i, j int) bool {
-		if members[i].Score == members[j].Score {
-			return members[i].Member < members[j].Member
+// zlexcount returns the number of members of set falling within r.
+func zlexcount(set *sortedSet, r lexRange) int {
+	return countInRange(set, r.aboveMin, r.belowMax)
+}
+
+// encodeZSetMembers encodes members as an array of names, each followed by
+// its score when withScores is set.
+func encodeZSetMembers(members []sortedSetMember, withScores bool) []byte {
+	reply := make([]string, 0, len(members)*2)
+	for _, m := range members {
+		reply = append(reply, m.Member)
+		if withScores {
+			reply = append(reply, formatScore(m.Score))
 		}
-		return members[i].Score < members[j].Score
-	})
+	}
+	return StringArrayToBulkStringArray(reply)
+}
+
+// zsetOpOptions holds the options of ZUNION, ZINTER and ZDIFF and their STORE variants.
+type zsetOpOptions struct {
+	Weights    []float64 // One per input key; nil means every weight is 1
+	Aggregate  string    // "sum", "min" or "max"
+	WithScores bool
+}
 
-	length := len(members)
+// parseZSetOp parses "numkeys key [key ...]" followed by the options of a
+// ZUNION/ZINTER/ZDIFF style command. WEIGHTS and AGGREGATE are only accepted
+// when allowWeights is set, and WITHSCORES when allowScores is set.
+// On failure the RESP error to reply with is returned.
+func parseZSetOp(commandName string, args []string, allowWeights, allowScores bool) ([]string, zsetOpOptions, []byte) {
+	options := zsetOpOptions{Aggregate: "sum"}
 
-	// Handle negative indices
-	if start < 0 {
-		start += length
+	numKeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, options, []byte("-ERR value is not an integer or out of range\r\n")
+	}
+	if numKeys <= 0 {
+		return nil, options, []byte("-ERR at least 1 input key is needed for '" + commandName + "' command\r\n")
 	}
-	if stop < 0 {
-		stop += length
+	if numKeys > len(args)-1 {
+		return nil, options, []byte("-ERR syntax error\r\n")
 	}
+	keys := args[1 : numKeys+1]
 
-	if start < 0 {
-		start = 0
+	rest := args[numKeys+1:]
+	for i := 0; i < len(rest); i++ {
+		switch option := strings.ToLower(rest[i]); {
+		case option == "weights" && allowWeights:
+			if i+numKeys >= len(rest) {
+				return nil, options, []byte("-ERR syntax error\r\n")
+			}
+			options.Weights = make([]float64, numKeys)
+			for j := range options.Weights {
+				weight, err := strconv.ParseFloat(rest[i+1+j], 64)
+				if err != nil || math.IsNaN(weight) {
+					return nil, options, []byte("-ERR weight value is not a float\r\n")
+				}
+				options.Weights[j] = weight
+			}
+			i += numKeys
+		case option == "aggregate" && allowWeights:
+			if i+1 >= len(rest) {
+				return nil, options, []byte("-ERR syntax error\r\n")
+			}
+			i++
+			options.Aggregate = strings.ToLower(rest[i])
+			if options.Aggregate != "sum" && options.Aggregate != "min" && options.Aggregate != "max" {
+				return nil, options, []byte("-ERR syntax error\r\n")
+			}
+		case option == "withscores" && allowScores:
+			options.WithScores = true
+		default:
+			return nil, options, []byte("-ERR syntax error\r\n")
+		}
 	}
-	if stop >= length {
-		stop = length - 1
+	return keys, options, nil
+}
+
+// lookupZSetInputs returns the member scores of each key for a ZUNION/ZINTER/ZDIFF,
+// with nil for missing keys. Plain sets are accepted, every member scoring 1.
+func lookupZSetInputs(keys []string) ([]map[string]float64, []byte) {
+	inputs := make([]map[string]float64, len(keys))
+	for i, key := range keys {
+		obj := lookupKey(key)
+		if obj == nil {
+			continue
+		}
+
+		scores := make(map[string]float64)
+		switch value := obj.Value.(type) {
+		case *sortedSet:
+			for _, m := range value.members() {
+				scores[m.Member] = m.Score
+			}
+		case *redisSet:
+			for _, member := range value.members() {
+				scores[member] = 1
+			}
+		default:
+			return nil, []byte(wrongTypeError)
+		}
+		inputs[i] = scores
 	}
+	return inputs, nil
+}
 
-	if start > stop || start >= length {
-		return []string{}
+// aggregateScores combines two scores of the same member as ZUNION/ZINTER do.
+func aggregateScores(aggregate string, a, b float64) float64 {
+	switch aggregate {
+	case "min":
+		return math.Min(a, b)
+	case "max":
+		return math.Max(a, b)
 	}
+	sum := a + b
+	// inf + -inf is defined as 0, as in Redis
+	if math.IsNaN(sum) {
+		return 0
+	}
+	return sum
+}
 
-	// Return the range
-	result := make([]string, stop-start+1)
-	for i := start; i <= stop; i++ {
-		result[i-start] = members[i].Member
+// zsetOperation computes the union, intersection or difference ("union",
+// "inter" or "diff") of inputs, applying weights and the aggregate function.
+func zsetOperation(op string, inputs []map[string]float64, options zsetOpOptions) *sortedSet {
+	weighted := func(i int, score float64) float64 {
+		if options.Weights == nil {
+			return score
+		}
+		score *= options.Weights[i]
+		if math.IsNaN(score) {
+			return 0
+		}
+		return score
 	}
 
-	return result
+	result := make(map[string]float64)
+	switch op {
+	case "union":
+		for i, input := range inputs {
+			for member, score := range input {
+				score = weighted(i, score)
+				if existing, ok := result[member]; ok {
+					score = aggregateScores(options.Aggregate, existing, score)
+				}
+				result[member] = score
+			}
+		}
+
+	case "inter":
+	members:
+		for member, score := range inputs[0] {
+			score = weighted(0, score)
+			for i, input := range inputs[1:] {
+				other, ok := input[member]
+				if !ok {
+					continue members
+				}
+				score = aggregateScores(options.Aggregate, score, weighted(i+1, other))
+			}
+			result[member] = score
+		}
+
+	case "diff":
+		for member, score := range inputs[0] {
+			found := false
+			for _, input := range inputs[1:] {
+				if _, ok := input[member]; ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				result[member] = score
+			}
+		}
+	}
+
+	set := newSortedSet()
+	for member, score := range result {
+		set.add(member, score)
+	}
+	return set
 }
 
-// zcard returns the number of elements (cardinality) in the sorted set.
-func zcard(key string) int {
-	set, ok := sortedSets[key]
-	if !ok {
-		return 0
+// storeZSet replaces the value at destination with set, removing it when set is empty.
+// Returns the number of members stored.
+func storeZSet(destination string, set *sortedSet) int {
+	deleteKey(destination)
+	if set.length() > 0 {
+		setKey(destination, ZSetType, set)
+		signalKeyAsReady(destination)
 	}
-	return len(set)
+	return set.length()
 }
 
-// zscore returns the score of a member in the sorted set as a Bulk String.
-func zscore(key, member string) []byte {
-	set, ok := sortedSets[key]
-	if !ok {
-		return []byte("$-1\r\n")
+// zrangeSpec is a range query in the unified ZRANGE grammar:
+// start stop [BYSCORE|BYLEX] [REV] [LIMIT offset count] [WITHSCORES].
+type zrangeSpec struct {
+	By            string // "rank", "score" or "lex"
+	Rev           bool   // Order from the highest score; score and lex bounds are then given max first
+	Start, Stop   int    // Ranks, for a rank range
+	Scores        scoreRange
+	Lex           lexRange
+	Offset, Count int // LIMIT; a negative Count means no limit
+	WithScores    bool
+}
+
+// parseZRangeSpec parses the arguments of ZRANGE following the key.
+// WITHSCORES is only accepted when allowScores is set (not for ZRANGESTORE).
+// On failure the RESP error to reply with is returned.
+func parseZRangeSpec(args []string, allowScores bool) (zrangeSpec, []byte) {
+	spec := zrangeSpec{By: "rank", Count: -1}
+	limit := false
+
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "byscore":
+			spec.By = "score"
+		case "bylex":
+			spec.By = "lex"
+		case "rev":
+			spec.Rev = true
+		case "withscores":
+			if !allowScores {
+				return spec, []byte("-ERR syntax error\r\n")
+			}
+			spec.WithScores = true
+		case "limit":
+			if i+2 >= len(args) {
+				return spec, []byte("-ERR syntax error\r\n")
+			}
+			var err1, err2 error
+			spec.Offset, err1 = strconv.Atoi(args[i+1])
+			spec.Count, err2 = strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return spec, []byte("-ERR value is not an integer or out of range\r\n")
+			}
+			limit = true
+			i += 2
+		default:
+			return spec, []byte("-ERR syntax error\r\n")
+		}
 	}
 
-	m, ok := set[member]
-	if !ok {
-		return []byte("$-1\r\n")
+	if limit && spec.By == "rank" {
+		return spec, []byte("-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n")
+	}
+	if spec.WithScores && spec.By == "lex" {
+		return spec, []byte("-ERR syntax error, WITHSCORES not supported in combination with BYLEX\r\n")
 	}
 
-	scoreStr := fmt.Sprintf("%g", m.Score)
-	return []byte("$" + strconv.Itoa(len(scoreStr)) + "\r\n" + scoreStr + "\r\n")
+	minArg, maxArg := args[0], args[1]
+	if spec.Rev {
+		minArg, maxArg = maxArg, minArg
+	}
+
+	var errReply []byte
+	switch spec.By {
+	case "score":
+		spec.Scores, errReply = parseScoreRange(minArg, maxArg)
+	case "lex":
+		spec.Lex, errReply = parseLexRange(minArg, maxArg)
+	default:
+		var err1, err2 error
+		spec.Start, err1 = strconv.Atoi(args[0])
+		spec.Stop, err2 = strconv.Atoi(args[1])
+		if err1 != nil || err2 != nil {
+			errReply = []byte("-ERR value is not an integer or out of range\r\n")
+		}
+	}
+	return spec, errReply
 }
 
-// zrem removes a member from the sorted set.
-// Returns 1 if removed, 0 if not found.
-func zrem(key, member string) []byte {
-	set, ok := sortedSets[key]
-	if !ok {
-		return []byte(":0\r\n")
+// zrangeGeneric returns the members of set selected by spec, in the order they
+// are to be replied with. Only the selected members are visited.
+func zrangeGeneric(set *sortedSet, spec zrangeSpec) []sortedSetMember {
+	length := set.length()
+	if length == 0 {
+		return []sortedSetMember{}
 	}
 
-	_, memberExists := set[member]
-	if !memberExists {
-		return []byte(":0\r\n")
+	if spec.By == "rank" {
+		start, stop, ok := normalizeListRange(spec.Start, spec.Stop, length)
+		if !ok {
+			return []sortedSetMember{}
+		}
+		return set.rangeByRank(start, stop, spec.Rev)
 	}
 
-	// Remove from inner map
-	delete(set, member)
+	// A negative offset selects nothing, as in Redis
+	if spec.Offset < 0 {
+		return []sortedSetMember{}
+	}
 
-	// If the set is empty, remove the key entirely
-	if len(set) == 0 {
-		delete(sortedSets, key)
+	aboveMin, belowMax := spec.Scores.aboveMin, spec.Scores.belowMax
+	if spec.By == "lex" {
+		aboveMin, belowMax = spec.Lex.aboveMin, spec.Lex.belowMax
+	}
+	first, last, ok := set.rangeBounds(aboveMin, belowMax)
+	if !ok {
+		return []sortedSetMember{}
 	}
 
-	return []byte(":1\r\n")
+	// Work in ranks counted in the direction of the reply
+	if spec.Rev {
+		first, last = length-1-last, length-1-first
+	}
+	start := first + spec.Offset
+	stop := last
+	if spec.Count >= 0 {
+		stop = min(stop, start+spec.Count-1)
+	}
+	if start > stop {
+		return []sortedSetMember{}
+	}
+	return set.rangeByRank(start, stop, spec.Rev)
 }